@@ -32,22 +32,32 @@
 package main
 
 import (
+    "bytes"
+    "crypto/sha1"
     "encoding/json"
+    "errors"
     "flag"
+    "fmt"
     "io/ioutil"
     "net/http"
     "os"
     "path"
     "strconv"
     "strings"
+    "sync"
     "syscall"
+    "time"
 
+    "auth"
     "dash"
+    "drm"
     "hls"
+    "keystore"
     "logger"
     "mp4"
     "ts"
     "util"
+    "vtt"
 )
 
 const (
@@ -55,46 +65,1107 @@ const (
     contentTypeFile = "application/octet-stream"
 )
 
+// Secret of the tokens authenticating the key requests
+var keySecret string
+
 func handleFileRequest(w http.ResponseWriter, path string, contentType string) {
     data, err := ioutil.ReadFile(path)
     if err != nil {
-        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+        logger.Error("%s", err.Error())
+        return
+    }
+
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+
+    _, err = w.Write(data)
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+        logger.Error("%s", err.Error())
+    }
+}
+
+// Read a package file and the sidecar files it references
+func readJsonConfig(filename string) (jConfig mp4.JsonConfig, err error) {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return
+    }
+
+    err = json.Unmarshal(data, &jConfig)
+    if err != nil {
+        return
+    }
+
+    if jConfig.Events != "" {
+        jConfig.EventStreams, err = mp4.ReadEventStreams("/" + jConfig.Events)
+        if err != nil {
+            return
+        }
+    }
+
+    if jConfig.Encryption != nil {
+        err = drm.LoadKey(jConfig.Encryption)
+        if err != nil {
+            return
+        }
+    }
+
+    if jConfig.HlsByteRanges && jConfig.Watermarked() {
+        err = errors.New("Package " + filename + " is watermarked and cannot use byte ranges")
+        return
+    }
+
+    if jConfig.Preview != nil {
+        if len(jConfig.Playlist) != 0 || jConfig.HlsByteRanges {
+            err = errors.New("Preview of " + filename + " needs a package of tracks without byte ranges")
+            return
+        }
+        if jConfig.Preview.Duration == 0 || jConfig.Preview.Claim == "" {
+            err = errors.New("Preview of " + filename + " needs a duration and the claim of the entitlements")
+            return
+        }
+    }
+
+    if jConfig.Cenc != nil {
+        _, err = drm.NewKeyProvider(jConfig.Cenc)
+        if err != nil {
+            return
+        }
+        if jConfig.HlsByteRanges {
+            err = errors.New("Package " + filename + " protected with common encryption cannot use byte ranges")
+            return
+        }
+    }
+
+    if len(jConfig.DateRanges) != 0 && jConfig.ProgramDateTime == nil {
+        err = errors.New("Date ranges of " + filename + " need a program date time")
+        return
+    }
+    for _, dateRange := range jConfig.DateRanges {
+        if dateRange.Id == "" {
+            err = errors.New("Date ranges of " + filename + " need an Id")
+            return
+        }
+        // Values are written in quoted strings of the playlists, which cannot hold double quotes nor line breaks
+        if strings.ContainsAny(dateRange.Id, "\"\r\n") || strings.ContainsAny(dateRange.Class, "\"\r\n") {
+            err = errors.New("Invalid Id or Class of a date range in " + filename)
+            return
+        }
+        for name, value := range dateRange.Attributes {
+            // Attribute names are X- followed by upper case letters, digits and dashes
+            if len(name) <= 2 || strings.HasPrefix(name, "X-") == false || strings.Trim(name[2:], "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") != "" || name == "X-SKIP" {
+                err = errors.New("Invalid attribute name of date range " + dateRange.Id + " in " + filename)
+                return
+            }
+            if strings.ContainsAny(value, "\"\r\n") {
+                err = errors.New("Invalid value of attribute " + name + " of date range " + dateRange.Id + " in " + filename)
+                return
+            }
+        }
+    }
+
+    for i, item := range jConfig.Playlist {
+        var itemConfig mp4.JsonConfig
+        itemConfig, err = readJsonConfig("/" + item.Package)
+        if err != nil {
+            return
+        }
+        if len(itemConfig.Playlist) != 0 {
+            err = errors.New("Playlist package " + item.Package + " cannot be an item of another playlist")
+            return
+        }
+        jConfig.Playlist[i].Config = &itemConfig
+        if jConfig.Live != nil && itemConfig.SegmentDuration != jConfig.SegmentDuration {
+            err = errors.New("Items of live channel " + filename + " must have the segment duration of the channel")
+            return
+        }
+    }
+
+    if jConfig.Live != nil {
+        if len(jConfig.Playlist) == 0 || jConfig.SegmentDuration == 0 {
+            err = errors.New("Live channel " + filename + " needs a segment duration and a playlist")
+            return
+        }
+        if jConfig.Live.TimeShiftBufferDepth == 0 {
+            jConfig.Live.TimeShiftBufferDepth = 10 * jConfig.SegmentDuration
+        }
+        if jConfig.Live.MinimumUpdatePeriod == 0 {
+            jConfig.Live.MinimumUpdatePeriod = jConfig.SegmentDuration
+        }
+        if jConfig.Live.PartDuration >= jConfig.SegmentDuration * 1000 {
+            err = errors.New("Parts of live channel " + filename + " must be shorter than its segments")
+            return
+        }
+        // The single Period of the channel is described by the tracks of the first item
+        reference := *jConfig.Playlist[0].Config
+        for _, item := range jConfig.Playlist[1:] {
+            for _, trackType := range []string{ "audio", "video" } {
+                for _, r := range reference.Tracks[trackType] {
+                    t, e := util.MatchTrack(reference, *item.Config, trackType, r.Lang, r.Bandwidth)
+                    if e != nil || util.CompatibleTracks(r, t) == false {
+                        err = errors.New("Items of live channel " + filename + " must have the " + trackType + " timescale and codec configuration of its first item, " + item.Package + " does not")
+                        return
+                    }
+                }
+            }
+        }
+    }
+
+    return
+}
+
+// Key of the HLS segments of a package, nil if they are not encrypted. CMAF segments are only encrypted with the
+// cbcs common encryption, with the key of their type of tracks.
+func segmentKey(jConfig mp4.JsonConfig, dir string, videoId string, keyType string) *hls.SegmentKey {
+    if jConfig.Cenc != nil && jConfig.Cenc.Scheme == "cbcs" {
+        return &hls.SegmentKey{ Method: "SAMPLE-AES", URI: path.Join("/key", dir, videoId), Type: keyType, RotationPeriod: jConfig.Cenc.RotationPeriod }
+    }
+    if jConfig.Encryption == nil || jConfig.HlsFormat == "fmp4" {
+        return nil
+    }
+    return &hls.SegmentKey{ Method: jConfig.Encryption.Method, URI: path.Join("/key", dir, videoId), RotationPeriod: jConfig.Encryption.RotationPeriod }
+}
+
+// Packages protected with common encryption are played by HLS with the CMAF segments of the cbcs scheme, their TS
+// segments would be clear
+func servedWithHls(jConfig mp4.JsonConfig, trackType string, extension string) bool {
+    if protectedUpstream(jConfig) {
+        return false
+    }
+    if jConfig.Cenc == nil {
+        return true
+    }
+    return jConfig.Cenc.Scheme == "cbcs" && hls.PackageMediaOptions(jConfig).Fmp4 && extension != ".ts" && trackType != "muxed" && trackType != "iframes"
+}
+
+// Sources protected upstream are passed through to the DASH fragments only, without their keys their samples
+// cannot be written in TS segments nor signalled to the HLS clients
+func protectedUpstream(jConfig mp4.JsonConfig) bool {
+    for _, tracks := range jConfig.Tracks {
+        for _, t := range tracks {
+            if t.Config != nil && t.Config.PassthroughEncryption() {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Encrypt a TS segment of a package with AES-128, with the key of its period. The IV is its media sequence number.
+func encryptSegment(jConfig mp4.JsonConfig, segmentNumber uint32, b []byte) ([]byte, error) {
+    if jConfig.Encryption == nil || jConfig.Encryption.Method != "AES-128" {
+        return b, nil
+    }
+
+    key, err := drm.PeriodKey(*jConfig.Encryption, drm.KeyPeriod(*jConfig.Encryption, segmentNumber))
+    if err != nil {
+        return nil, err
+    }
+    return drm.EncryptSegment(key, drm.SequenceIV(uint64(segmentNumber - 1)), b)
+}
+
+// SAMPLE-AES encryption of the samples of a TS segment, nil if they are clear
+func sampleEncryption(jConfig mp4.JsonConfig, segmentNumber uint32) (*ts.SampleEncryption, error) {
+    if jConfig.Encryption == nil || jConfig.Encryption.Method != "SAMPLE-AES" {
+        return nil, nil
+    }
+
+    key, err := drm.PeriodKey(*jConfig.Encryption, drm.KeyPeriod(*jConfig.Encryption, segmentNumber))
+    if err != nil {
+        return nil, err
+    }
+    return &ts.SampleEncryption{ Key: key, IV: drm.SequenceIV(uint64(segmentNumber - 1)) }, nil
+}
+
+// Size of a TS segment once encrypted, AES-128 pads the segments to a multiple of the block size
+func encryptedSegmentSize(jConfig mp4.JsonConfig, size int64) int64 {
+    if jConfig.Encryption == nil || jConfig.Encryption.Method != "AES-128" {
+        return size
+    }
+    return (size / 16 + 1) * 16
+}
+
+// Options of the fragments of a track. Inband events are carried by the video fragments, or by the audio ones
+// for audio only content.
+func fragmentOptions(jConfig mp4.JsonConfig, trackType string, iFramesOnly bool) (options mp4.FragmentOptions) {
+    options.IFramesOnly = iFramesOnly
+    if (trackType == "video" && iFramesOnly == false) || jConfig.Tracks["video"] == nil {
+        options.Events = jConfig.EventStreams
+    }
+    return
+}
+
+// DASH init of a track, declaring the common encryption of its fragments
+func createDashInit(jConfig mp4.JsonConfig, t mp4.TrackEntry, trackType string) ([]byte, error) {
+    content := mp4.CreateDashInitWithConf(*t.Config)
+    protection, err := drm.TrackProtection(jConfig.Cenc, drm.TrackKeyType(trackType, t.Config), 0)
+    if err != nil {
+        return nil, err
+    }
+    if protection != nil {
+        mp4.ProtectDashInit(content, *protection)
+    }
+    return mp4.MapToBytes(content)
+}
+
+// TS segment of a track
+func createTSSegment(jConfig mp4.JsonConfig, t mp4.TrackEntry, segmentNumber uint32) ([]byte, error) {
+    encryption, err := sampleEncryption(jConfig, segmentNumber)
+    if err != nil {
+        return nil, err
+    }
+    return encryptSegment(jConfig, segmentNumber, ts.CreateHLSFragmentWithConf(*t.Config, t.File, segmentNumber, jConfig.SegmentDuration, encryption))
+}
+
+// TS segment of a video track muxed with an audio track
+func createMuxedTSSegment(jConfig mp4.JsonConfig, video mp4.TrackEntry, audio mp4.TrackEntry, segmentNumber uint32) ([]byte, error) {
+    encryption, err := sampleEncryption(jConfig, segmentNumber)
+    if err != nil {
+        return nil, err
+    }
+    return encryptSegment(jConfig, segmentNumber, ts.CreateMuxedHLSFragmentWithConf(*video.Config, video.File, *audio.Config, audio.File, segmentNumber, jConfig.SegmentDuration, encryption))
+}
+
+// Sizes of the segments of the renditions served as single resources, by rendition and package content
+var segmentSizesCache = struct {
+    sync.Mutex
+    sizes map[string][]int64
+}{ sizes: make(map[string][]int64) }
+
+// Sizes of the segments of a rendition of a package. They are computed without building the segments, once
+// per rendition: the key identifies the rendition and the package content the sizes depend on.
+func segmentSizes(jConfig mp4.JsonConfig, rendition string, numberOfSegments uint32, size func(uint32) (int64, error)) ([]int64, error) {
+    data, err := json.Marshal(struct {
+        Package      mp4.JsonConfig
+        EventStreams []mp4.EventStream
+    }{ Package: jConfig, EventStreams: jConfig.EventStreams })
+    if err != nil {
+        return nil, err
+    }
+    if jConfig.Encryption != nil {
+        data = append(data, jConfig.Encryption.ContentKey...)
+    }
+    key := fmt.Sprintf("%s %x", rendition, sha1.Sum(data))
+
+    segmentSizesCache.Lock()
+    sizes, ok := segmentSizesCache.sizes[key]
+    segmentSizesCache.Unlock()
+    if ok {
+        return sizes, nil
+    }
+
+    sizes = make([]int64, numberOfSegments)
+    for i := uint32(1); i <= numberOfSegments; i++ {
+        sizes[i - 1], err = size(i)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    segmentSizesCache.Lock()
+    segmentSizesCache.sizes[key] = sizes
+    segmentSizesCache.Unlock()
+    return sizes, nil
+}
+
+// Sizes of the TS or CMAF segments of a track
+func trackSegmentSizes(jConfig mp4.JsonConfig, t mp4.TrackEntry, trackType string, extension string) ([]int64, error) {
+    return segmentSizes(jConfig, t.File + extension, util.NumberOfSegments(t, jConfig), func(segmentNumber uint32) (int64, error) {
+        if extension == ".m4s" {
+            return mp4.MapSize(mp4.CreateDashFragmentWithConf(*t.Config, t.File, segmentNumber, jConfig.SegmentDuration, fragmentOptions(jConfig, trackType, false))), nil
+        }
+        encryption, err := sampleEncryption(jConfig, segmentNumber)
+        if err != nil {
+            return 0, err
+        }
+        return encryptedSegmentSize(jConfig, ts.GetHLSFragmentSize(*t.Config, t.File, segmentNumber, jConfig.SegmentDuration, encryption)), nil
+    })
+}
+
+// Sizes of the TS segments of a video track muxed with an audio track
+func muxedSegmentSizes(jConfig mp4.JsonConfig, video mp4.TrackEntry, audio mp4.TrackEntry) ([]int64, error) {
+    return segmentSizes(jConfig, video.File + "+" + audio.File + ".ts", util.NumberOfSegments(video, jConfig), func(segmentNumber uint32) (int64, error) {
+        encryption, err := sampleEncryption(jConfig, segmentNumber)
+        if err != nil {
+            return 0, err
+        }
+        return encryptedSegmentSize(jConfig, ts.GetMuxedHLSFragmentSize(*video.Config, video.File, *audio.Config, audio.File, segmentNumber, jConfig.SegmentDuration, encryption)), nil
+    })
+}
+
+// Serve the segments of a rendition as a single resource. Only the segments overlapping the requested byte
+// range are built, a range may span several segments. The segments are built and written one at a time, the
+// response holds a single segment in memory whatever the size of the range.
+func handleSegmentRanges(w http.ResponseWriter, r *http.Request, sizes []int64, contentType string, segment func(uint32) ([]byte, error)) {
+    var total int64
+    for _, size := range sizes {
+        total += size
+    }
+
+    start, end, ok, err := util.ParseByteRange(r.Header.Get("Range"), total)
+    if err != nil {
+        w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusRequestedRangeNotSatisfiable)
+        logger.Error("%s", err.Error())
+        return
+    }
+    if ok == false {
+        start, end = 0, total - 1
+    }
+
+    // The headers are sent with the first segment, a segment failing after it can only cut the response short
+    headerSent := false
+    sendHeader := func() {
+        w.Header().Set("Content-Type", contentType)
+        w.Header().Set("Accept-Ranges", "bytes")
+        w.Header().Set("Content-Length", strconv.FormatInt(end + 1 - start, 10))
+        if ok {
+            w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+            w.WriteHeader(http.StatusPartialContent)
+        }
+        headerSent = true
+    }
+
+    var offset int64
+    for i, size := range sizes {
+        if offset + size > start && offset <= end {
+            data, err := segment(uint32(i + 1))
+            if err == nil && int64(len(data)) != size {
+                err = fmt.Errorf("Segment %d is %d bytes instead of %d", i + 1, len(data), size)
+            }
+            if err != nil {
+                if headerSent == false {
+                    http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                }
+                logger.Error("%s", err.Error())
+                return
+            }
+            from := int64(0)
+            if start > offset {
+                from = start - offset
+            }
+            to := size
+            if end + 1 < offset + size {
+                to = end + 1 - offset
+            }
+            if headerSent == false {
+                sendHeader()
+            }
+            _, err = w.Write(data[from:to])
+            if err != nil {
+                logger.Error("%s", err.Error())
+                return
+            }
+        }
+        offset += size
+    }
+    if headerSent == false {
+        sendHeader()
+    }
+}
+
+// Token of a package, passed in the token parameter or as a bearer token
+func requestToken(r *http.Request) (token string) {
+    token = r.URL.Query().Get("token")
+    if token == "" {
+        token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    }
+    return
+}
+
+// Session ID of the token of a request, the media of watermarked packages are only served to the session of
+// a token of the package
+func requestSession(r *http.Request, dir string, videoId string) (string, error) {
+    claims, err := auth.TokenClaims(keySecret, path.Join(dir, videoId), requestToken(r), time.Now())
+    if err != nil {
+        return "", err
+    }
+    if claims["sid"] == "" {
+        return "", errors.New("Token has no session ID")
+    }
+    return claims["sid"], nil
+}
+
+// Watermark variant of a segment of a track for a session: the track itself (variant A) or its variant B, given by
+// the watermark bit of the session for the number of the segment. DASH and HLS address the same segment numbers,
+// numbered on the channel for the live channels, so a session gets the same variant of a segment from both and on
+// retries. The file of the track is already rooted.
+func watermarkVariant(t mp4.TrackEntry, session string, segmentNumber uint32) mp4.TrackEntry {
+    if t.Watermark == nil || session == "" || auth.WatermarkBit(keySecret, session, segmentNumber) == 0 {
+        return t
+    }
+    variant := *t.Watermark
+    variant.File = "/" + variant.File
+    return variant
+}
+
+// Preview of a package for the user of a request, nil when the token of the request gives an entitlement to the
+// whole package. Users without a valid token play the preview.
+func requestPreview(r *http.Request, jConfig mp4.JsonConfig, dir string, videoId string) *mp4.PreviewConfig {
+    if jConfig.Preview == nil {
+        return nil
+    }
+    claims, err := auth.TokenClaims(keySecret, path.Join(dir, videoId), requestToken(r), time.Now())
+    if err != nil {
+        return jConfig.Preview
+    }
+    for _, entitlement := range jConfig.Preview.Entitlements {
+        if claims[jConfig.Preview.Claim] == entitlement {
+            return nil
+        }
+    }
+    return jConfig.Preview
+}
+
+// Number of segments of a track listed in the media playlists, up to the end of the preview if the package has
+// one for the user of the request
+func playlistSegments(jConfig mp4.JsonConfig, t mp4.TrackEntry) uint32 {
+    n := util.NumberOfSegments(t, jConfig)
+    if preview := util.PreviewSegments(jConfig); preview != 0 && preview < n {
+        return preview
+    }
+    return n
+}
+
+// Keys of the encrypted segments of a package (eg: /key/video/video-0.key for the first key period of
+// /video/video/video.json). They are only served with a token of the package, passed in the token
+// parameter or as a bearer token.
+func handleKeyRequest(w http.ResponseWriter, r *http.Request, dir string, basename string, extension string) {
+    i := strings.LastIndex(basename, "-")
+    if extension != ".key" || i == -1 {
+        http.Error(w, `{ "status": "ERROR", "reason": "Invalid key request" }`, http.StatusNotFound)
+        logger.Error("Invalid key request")
+        return
+    }
+    videoId := basename[:i]
+    // Keys of the common encryption are the keys of a type of tracks, given in the type parameter (eg:
+    // video-0.key?type=hd), package names can hold any character
+    keyType := r.URL.Query().Get("type")
+
+    err := auth.CheckToken(keySecret, path.Join(dir, videoId), requestToken(r), time.Now())
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusForbidden)
+        logger.Error("Key of %s denied: %s", path.Join(dir, videoId), err.Error())
+        return
+    }
+
+    period, err := strconv.ParseUint(basename[i+1:], 10, 32)
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusNotFound)
+        logger.Error("%s", err.Error())
+        return
+    }
+
+    jConfig, err := readJsonConfig(path.Join(dir, videoId + ".json"))
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+        logger.Error("%s", err.Error())
+        return
+    }
+    if (keyType == "" && jConfig.Encryption == nil) || (keyType != "" && jConfig.Cenc == nil) {
+        http.Error(w, `{ "status": "ERROR", "reason": "Package is not encrypted" }`, http.StatusNotFound)
+        logger.Error("Package %s is not encrypted", path.Join(dir, videoId))
+        return
+    }
+
+    var key []byte
+    if keyType != "" {
+        var provider drm.KeyProvider
+        provider, err = drm.NewKeyProvider(jConfig.Cenc)
+        if err == nil {
+            var contentKey drm.ContentKey
+            contentKey, err = provider.ContentKey(keyType, uint32(period))
+            key = contentKey.Key
+        }
+    } else {
+        key, err = drm.PeriodKey(*jConfig.Encryption, uint32(period))
+    }
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+        logger.Error("%s", err.Error())
+        return
+    }
+
+    w.Header().Set("Content-Type", contentTypeFile)
+    w.Header().Set("Content-Length", strconv.Itoa(len(key)))
+    w.Header().Set("Cache-Control", "no-store")
+    _, err = w.Write(key)
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+        logger.Error("%s", err.Error())
+    }
+}
+
+// ClearKey licenses of a package protected with common encryption (eg: /license/clearkey/video/video for
+// /video/video/video.json), authorized by the token of the package
+func handleClearKeyLicenseRequest(w http.ResponseWriter, r *http.Request, dir string, videoId string) {
+    if r.Method == "OPTIONS" {
+        return
+    }
+    if r.Method != "POST" {
+        http.Error(w, `{ "status": "ERROR", "reason": "License requests are posted" }`, http.StatusMethodNotAllowed)
+        logger.Error("License request of %s is not posted", path.Join(dir, videoId))
+        return
+    }
+
+    err := auth.CheckToken(keySecret, path.Join(dir, videoId), requestToken(r), time.Now())
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusForbidden)
+        logger.Error("License of %s denied: %s", path.Join(dir, videoId), err.Error())
+        return
+    }
+
+    jConfig, err := readJsonConfig(path.Join(dir, videoId + ".json"))
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+        logger.Error("%s", err.Error())
+        return
+    }
+    if jConfig.Cenc == nil || jConfig.Cenc.ClearKey == false {
+        http.Error(w, `{ "status": "ERROR", "reason": "Package is not protected with ClearKey" }`, http.StatusNotFound)
+        logger.Error("Package %s is not protected with ClearKey", path.Join(dir, videoId))
+        return
+    }
+
+    provider, err := drm.NewKeyProvider(jConfig.Cenc)
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+        logger.Error("%s", err.Error())
+        return
+    }
+    request, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 65536))
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusBadRequest)
+        logger.Error("%s", err.Error())
+        return
+    }
+    license, err := drm.ClearKeyLicense(provider, request)
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusBadRequest)
+        logger.Error("%s", err.Error())
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Content-Length", strconv.Itoa(len(license)))
+    w.Header().Set("Cache-Control", "no-store")
+    _, err = w.Write(license)
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+        logger.Error("%s", err.Error())
+    }
+}
+
+// Track of a live channel playing one of its segments, with the number of the segment in the package of the
+// playlist item and the options shifting the item timeline to the channel timeline
+func liveSegmentTrack(jConfig mp4.JsonConfig, trackType string, trackLang string, trackBandwidth uint64, number uint32, iFramesOnly bool, session string) (t mp4.TrackEntry, segmentNumber uint32, options mp4.FragmentOptions, err error) {
+    itemIndex, segmentNumber, ok := util.LiveSegment(jConfig, number)
+    if ok == false {
+        err = fmt.Errorf("Segment %d is after the end of the channel", number)
+        return
+    }
+
+    item := jConfig.Playlist[itemIndex]
+    t, err = util.MatchTrack(*jConfig.Playlist[0].Config, *item.Config, trackType, trackLang, trackBandwidth)
+    if err != nil {
+        return
+    }
+    t.File = "/" + t.File
+    if segmentNumber > util.NumberOfSegments(t, *item.Config) {
+        err = fmt.Errorf("Segment %d of %s is out of the track", segmentNumber, t.File)
+        return
+    }
+    t = watermarkVariant(t, session, number)
+
+    options.Live = true
+    options.IFramesOnly = iFramesOnly
+    options.Protection, err = drm.TrackProtection(jConfig.Cenc, drm.TrackKeyType(trackType, t.Config), drm.CencKeyPeriod(jConfig.Cenc, number))
+    options.DecodeTimeOffset = util.LiveDecodeTimeOffset(jConfig, number, t.Config.Timescale)
+    return
+}
+
+// CMAF chunks of a segment of a live channel, they are the parts of the segment for LL-HLS
+func liveSegmentChunks(jConfig mp4.JsonConfig, trackType string, trackLang string, trackBandwidth uint64, number uint32, session string) (chunks []map[string][]interface{}, timescale uint32, err error) {
+    t, segmentNumber, options, err := liveSegmentTrack(jConfig, trackType, trackLang, trackBandwidth, number, false, session)
+    if err != nil {
+        return
+    }
+    chunks = mp4.CreateDashChunksWithConf(*t.Config, t.File, segmentNumber, jConfig.SegmentDuration, jConfig.Live.PartDuration, options)
+    if chunks == nil {
+        err = fmt.Errorf("Cannot create segment %d of %s", segmentNumber, t.File)
+    }
+    return chunks, t.Config.Timescale, err
+}
+
+// Wait until a live resource is available, at most maxWait. ok is false if it is available later.
+func waitLiveAvailability(availabilityTime time.Time, maxWait time.Duration) (ok bool) {
+    wait := availabilityTime.Sub(time.Now())
+    if wait > maxWait {
+        return false
+    }
+    if wait > 0 {
+        time.Sleep(wait)
+    }
+    return true
+}
+
+// Low-Latency HLS media playlist of a live channel. The reload of the playlist is blocked until the segment
+// _HLS_msn, or its part _HLS_part, is available, and _HLS_skip requests a delta update.
+func handleLivePlaylistRequest(w http.ResponseWriter, r *http.Request, jConfig mp4.JsonConfig, dir string, trackName string, trackType string, trackLang string, trackBandwidth uint64) {
+    if trackType != "audio" && trackType != "video" {
+        http.Error(w, `{ "status": "ERROR", "reason": "Live channels only serve audio and video media playlists" }`, http.StatusNotFound)
+        logger.Error("Live channels only serve audio and video media playlists")
+        return
+    }
+
+    query := r.URL.Query()
+    if query.Get("_HLS_msn") != "" {
+        number, err := strconv.ParseUint(query.Get("_HLS_msn"), 10, 32)
+        var part uint64
+        if err == nil && query.Get("_HLS_part") != "" {
+            part, err = strconv.ParseUint(query.Get("_HLS_part"), 10, 32)
+            part++
+        }
+        if err == nil && uint32(number) > util.LiveEdge(jConfig, time.Now()) + 2 {
+            err = fmt.Errorf("Segment %d is too far from the live edge", number)
+        }
+        if err != nil {
+            http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusBadRequest)
+            logger.Error("%s", err.Error())
+            return
+        }
+        // The playlist is not served without the requested segment or part once the reload was blocked for
+        // three target durations
+        if n := util.LiveSegments(jConfig); n == 0 || uint32(number) <= n {
+            if waitLiveAvailability(util.LiveAvailabilityTime(jConfig, uint32(number), uint32(part)), 3 * time.Duration(jConfig.SegmentDuration) * time.Second) == false {
+                http.Error(w, `{ "status": "ERROR", "reason": "Segment is not available yet" }`, http.StatusServiceUnavailable)
+                logger.Error("Part %d of segment %d is not available within three target durations", part, number)
+                return
+            }
+        }
+    } else if query.Get("_HLS_part") != "" {
+        http.Error(w, `{ "status": "ERROR", "reason": "_HLS_part needs _HLS_msn" }`, http.StatusBadRequest)
+        logger.Error("_HLS_part needs _HLS_msn")
+        return
+    }
+
+    now := time.Now()
+    edge := util.LiveEdge(jConfig, now)
+    first, last := util.LiveWindow(jConfig, edge)
+    var options hls.LiveOptions
+    options.StartTime = jConfig.Live.AvailabilityStartTime
+    options.PartTarget = float64(jConfig.Live.PartDuration) / 1000
+    options.Skip = query.Get("_HLS_skip") == "YES" || query.Get("_HLS_skip") == "v2"
+    reference := *jConfig.Playlist[0].Config
+    t, err := util.MatchTrack(reference, reference, trackType, trackLang, trackBandwidth)
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusNotFound)
         logger.Error("%s", err.Error())
         return
     }
+    options.Key = segmentKey(jConfig, dir, trackName, drm.TrackKeyType(trackType, t.Config))
+    if n := util.LiveSegments(jConfig); n != 0 && edge >= n {
+        options.Ended = true
+    }
 
-    w.Header().Set("Content-Type", contentType)
-    w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+    var segments []hls.LiveSegment
+    for number := first; number <= last; number++ {
+        segments = append(segments, hls.LiveSegment{ Number: number })
+    }
+    if jConfig.Live.PartDuration != 0 && options.Ended == false {
+        segments = append(segments, hls.LiveSegment{ Number: edge + 1, InProgress: true })
+    }
+    if len(segments) == 0 {
+        http.Error(w, `{ "status": "ERROR", "reason": "Channel is not available yet" }`, http.StatusNotFound)
+        logger.Error("Channel %s is not available yet", trackName)
+        return
+    }
 
-    _, err = w.Write(data)
+    // Parts of the last two complete segments and of the segment in progress
+    for i := range segments {
+        if jConfig.Live.PartDuration == 0 || segments[i].Number + 2 <= edge {
+            continue
+        }
+        // The parts of both watermark variants have the same durations
+        chunks, timescale, err := liveSegmentChunks(jConfig, trackType, trackLang, trackBandwidth, segments[i].Number, "")
+        if err != nil {
+            http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+            logger.Error("%s", err.Error())
+            return
+        }
+        available := len(chunks)
+        if segments[i].InProgress == true && int(util.LiveParts(jConfig, now)) < available {
+            available = int(util.LiveParts(jConfig, now))
+        }
+        for _, chunk := range chunks[:available] {
+            segments[i].Parts = append(segments[i].Parts, hls.LivePart{ Duration: float64(mp4.ChunkDuration(chunk)) / float64(timescale), Independent: mp4.IndependentChunk(chunk) })
+        }
+        segments[i].PartCount = len(chunks)
+    }
+
+    b := []byte(hls.CreateLiveMediaDescriptor(jConfig.SegmentDuration, segments, trackName, trackType, trackLang, trackBandwidth, options))
+    w.Header().Set("Content-Type", "application/x-mpegURL")
+    w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+    _, err = w.Write(b)
     if err != nil {
         http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
         logger.Error("%s", err.Error())
     }
 }
 
-func handleManifestRequest(w http.ResponseWriter, dir string, basename string, extension string) {
-    data, err := ioutil.ReadFile(path.Join(dir, basename + ".json"))
+// Init segments and fragments of a live channel, fragments are numbered on the wall clock from the availability
+// start time and their decode times continue across the items of the playlist. Low latency channels serve the
+// parts of the segments (eg: video_video_eng_400000-12-3.m4s for the third part of segment 12), and stream the
+// segment in progress at the live edge chunk by chunk.
+func handleLiveMediaRequest(w http.ResponseWriter, r *http.Request, jConfig mp4.JsonConfig, dir string, trackName string, trackType string, trackLang string, trackBandwidth uint64, trackIds []string, extension string, iFramesOnly bool, session string) {
+    lowLatency := jConfig.Live.PartDuration != 0 && iFramesOnly == false
+    segmentDuration := time.Duration(jConfig.SegmentDuration) * time.Second
+
+    var b []byte
+    switch extension {
+        case ".hls":
+            handleLivePlaylistRequest(w, r, jConfig, dir, trackName, trackType, trackLang, trackBandwidth)
+            return
+        case ".dash":
+            t, err := util.MatchTrack(*jConfig.Playlist[0].Config, *jConfig.Playlist[0].Config, trackType, trackLang, trackBandwidth)
+            if err != nil {
+                http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                logger.Error("%s", err.Error())
+                return
+            }
+            b, err = createDashInit(jConfig, t, trackType)
+            if err != nil {
+                http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                logger.Error("%s", err.Error())
+                return
+            }
+        case ".m4s":
+            if len(trackIds) != 2 && (len(trackIds) != 3 || lowLatency == false) {
+                http.Error(w, `{ "status": "ERROR", "reason": "Invalid track Id" }`, http.StatusInternalServerError)
+                logger.Error("Invalid track Id")
+                return
+            }
+            number, err := strconv.ParseUint(trackIds[1], 10, 32)
+            var part uint64
+            if err == nil && len(trackIds) == 3 {
+                part, err = strconv.ParseUint(trackIds[2], 10, 32)
+                if err == nil && part == 0 {
+                    err = errors.New("Parts are numbered from 1")
+                }
+            }
+            if err != nil {
+                http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                logger.Error("%s", err.Error())
+                return
+            }
+            edge := util.LiveEdge(jConfig, time.Now())
+            // The segment in progress at the live edge is available by parts or chunks, the parts are
+            // requested before they are available
+            if (lowLatency == false && uint32(number) > edge) || (part == 0 && uint32(number) > edge + 1) || uint32(number) > edge + 2 {
+                http.Error(w, `{ "status": "ERROR", "reason": "Segment is not available yet" }`, http.StatusNotFound)
+                logger.Error("Segment %d is not available yet, live edge is %d", number, edge)
+                return
+            }
+            if uint32(number) + jConfig.Live.TimeShiftBufferDepth / jConfig.SegmentDuration + 1 < edge {
+                http.Error(w, `{ "status": "ERROR", "reason": "Segment is out of the time shift buffer" }`, http.StatusNotFound)
+                logger.Error("Segment %d is out of the time shift buffer, live edge is %d", number, edge)
+                return
+            }
+
+            if lowLatency == false {
+                var t mp4.TrackEntry
+                var segmentNumber uint32
+                var options mp4.FragmentOptions
+                t, segmentNumber, options, err = liveSegmentTrack(jConfig, trackType, trackLang, trackBandwidth, uint32(number), iFramesOnly, session)
+                if err != nil {
+                    http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusNotFound)
+                    logger.Error("%s", err.Error())
+                    return
+                }
+                b, err = mp4.MapToBytes(mp4.CreateDashFragmentWithConf(*t.Config, t.File, segmentNumber, jConfig.SegmentDuration, options))
+                if err != nil {
+                    http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                    logger.Error("%s", err.Error())
+                    return
+                }
+                break
+            }
+
+            var chunks []map[string][]interface{}
+            chunks, _, err = liveSegmentChunks(jConfig, trackType, trackLang, trackBandwidth, uint32(number), session)
+            if err == nil && int(part) > len(chunks) {
+                err = fmt.Errorf("Segment %d has %d parts", number, len(chunks))
+            }
+            if err != nil {
+                http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusNotFound)
+                logger.Error("%s", err.Error())
+                return
+            }
+
+            if part != 0 {
+                if waitLiveAvailability(util.LiveAvailabilityTime(jConfig, uint32(number), uint32(part)), segmentDuration) == false {
+                    http.Error(w, `{ "status": "ERROR", "reason": "Part is not available yet" }`, http.StatusNotFound)
+                    logger.Error("Part %d of segment %d is not available yet", part, number)
+                    return
+                }
+                b, err = mp4.MapToBytes(chunks[part - 1])
+                if err != nil {
+                    http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                    logger.Error("%s", err.Error())
+                    return
+                }
+                break
+            }
+
+            // Chunked transfer of the segment, each chunk is sent when it is available
+            w.Header().Set("Content-Type", "video/mp4")
+            flusher, _ := w.(http.Flusher)
+            for k, chunk := range chunks {
+                if waitLiveAvailability(util.LiveAvailabilityTime(jConfig, uint32(number), uint32(k + 1)), segmentDuration) == false {
+                    // The chunks already sent can only be cut short
+                    if k == 0 {
+                        http.Error(w, `{ "status": "ERROR", "reason": "Segment is not available yet" }`, http.StatusServiceUnavailable)
+                    }
+                    logger.Error("Chunk %d of segment %d is not available yet", k + 1, number)
+                    return
+                }
+                var data []byte
+                data, err = mp4.MapToBytes(chunk)
+                if err != nil {
+                    if k == 0 {
+                        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                    }
+                    logger.Error("%s", err.Error())
+                    return
+                }
+                _, err = w.Write(data)
+                if err != nil {
+                    logger.Error("%s", err.Error())
+                    return
+                }
+                if flusher != nil {
+                    flusher.Flush()
+                }
+            }
+            return
+        default:
+            http.Error(w, `{ "status": "ERROR", "reason": "Live channels only serve DASH and HLS with CMAF segments" }`, http.StatusNotFound)
+            logger.Error("Live channels only serve DASH and HLS with CMAF segments")
+            return
+    }
+
+    w.Header().Set("Content-Type", "video/mp4")
+    w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+    _, err := w.Write(b)
     if err != nil {
         http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
         logger.Error("%s", err.Error())
+    }
+}
+
+// Media playlist and segments muxing a video track with the audio track of a language,
+// tracks are addressed by the language of the audio track and the bandwidth of the video track
+func handleMuxedMediaRequest(w http.ResponseWriter, r *http.Request, jConfig mp4.JsonConfig, dir string, trackName string, trackLang string, trackBandwidth uint64, trackIds []string, extension string, session string) {
+    audio, ok := util.MuxedAudioTrack(jConfig.Tracks["audio"], trackLang)
+    if ok == false {
+        http.Error(w, `{ "status": "ERROR", "reason": "No audio track to mux" }`, http.StatusNotFound)
+        logger.Error("No audio track to mux")
         return
     }
+    audio.File = "/" + audio.File
 
-    var jConfig mp4.JsonConfig
-    err = json.Unmarshal(data, &jConfig)
+    for _, video := range jConfig.Tracks["video"] {
+        if video.Bandwidth != trackBandwidth {
+            continue
+        }
+        video.File = "/" + video.File
+
+        var b []byte
+        switch extension {
+            case ".hls":
+                segmentNumber := playlistSegments(jConfig, video)
+                options := hls.PackageMediaOptions(jConfig)
+                options.Key = segmentKey(jConfig, dir, trackName, "muxed")
+                if jConfig.HlsByteRanges {
+                    var err error
+                    options.SegmentSizes, err = muxedSegmentSizes(jConfig, video, audio)
+                    if err != nil {
+                        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                        logger.Error("%s", err.Error())
+                        return
+                    }
+                }
+                b = []byte(hls.CreateMediaDescriptor(jConfig.SegmentDuration, segmentNumber, trackName, "muxed", audio.Lang, trackBandwidth, options))
+                w.Header().Set("Content-Type", "application/x-mpegURL")
+            case ".ts":
+                if len(trackIds) == 1 && jConfig.HlsByteRanges {
+                    sizes, err := muxedSegmentSizes(jConfig, video, audio)
+                    if err != nil {
+                        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                        logger.Error("%s", err.Error())
+                        return
+                    }
+                    handleSegmentRanges(w, r, sizes, "video/MP2T", func(segmentNumber uint32) ([]byte, error) {
+                        return createMuxedTSSegment(jConfig, video, audio, segmentNumber)
+                    })
+                    return
+                }
+                if len(trackIds) != 2 {
+                    http.Error(w, `{ "status": "ERROR", "reason": "Invalid track Id" }`, http.StatusInternalServerError)
+                    logger.Error("Invalid track Id")
+                    return
+                }
+                num, err := strconv.ParseUint(trackIds[1], 10, 32)
+                if err != nil {
+                    http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                    logger.Error("%s", err.Error())
+                    return
+                }
+                b, err = createMuxedTSSegment(jConfig, watermarkVariant(video, session, uint32(num)), audio, uint32(num))
+                if err != nil {
+                    http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                    logger.Error("%s", err.Error())
+                    return
+                }
+                w.Header().Set("Content-Type", "video/MP2T")
+            default:
+                http.Error(w, `{ "status": "ERROR", "reason": "Muxed tracks are only served as HLS" }`, http.StatusNotFound)
+                logger.Error("Muxed tracks are only served as HLS")
+                return
+        }
+
+        w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+        _, err := w.Write(b)
+        if err != nil {
+            http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+            logger.Error("%s", err.Error())
+        }
+        return
+    }
+
+    http.Error(w, `{ "status": "ERROR", "reason": "Video track not found" }`, http.StatusNotFound)
+    logger.Error("Video track %d not found", trackBandwidth)
+}
+
+// I-Frame only media playlist of a video track, pointing into its TS segments, or into the watermark variants of
+// the segments of the session
+func handleIFramesMediaRequest(w http.ResponseWriter, jConfig mp4.JsonConfig, trackName string, trackLang string, trackBandwidth uint64, extension string, session string) {
+    if extension != ".hls" || jConfig.HlsFormat == "fmp4" || jConfig.Encryption != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "I-Frame playlists are only served for clear TS segments" }`, http.StatusNotFound)
+        logger.Error("I-Frame playlists are only served for clear TS segments")
+        return
+    }
+
+    for _, t := range jConfig.Tracks["video"] {
+        if t.Lang != trackLang || t.Bandwidth != trackBandwidth {
+            continue
+        }
+        t.File = "/" + t.File
+
+        var iFrames []hls.IFrameSegment
+        segmentNumber := playlistSegments(jConfig, t)
+        for i := uint32(1); i <= segmentNumber; i++ {
+            variant := watermarkVariant(t, session, i)
+            for _, iFrame := range ts.GetIFrameRanges(*variant.Config, variant.File, i, jConfig.SegmentDuration) {
+                iFrames = append(iFrames, hls.IFrameSegment{ Segment: i, Offset: iFrame.Offset, Size: iFrame.Size, Duration: iFrame.Duration })
+            }
+        }
+
+        b := []byte(hls.CreateIFramesMediaDescriptor(jConfig.SegmentDuration, iFrames, trackName, trackLang, trackBandwidth))
+        w.Header().Set("Content-Type", "application/x-mpegURL")
+        w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+        _, err := w.Write(b)
+        if err != nil {
+            http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+            logger.Error("%s", err.Error())
+        }
+        return
+    }
+
+    http.Error(w, `{ "status": "ERROR", "reason": "Video track not found" }`, http.StatusNotFound)
+    logger.Error("Video track %d not found", trackBandwidth)
+}
+
+// Media playlist of a playlist package, segments are addressed on the package of each item
+func handlePlaylistMediaRequest(w http.ResponseWriter, jConfig mp4.JsonConfig, trackType string, trackLang string, trackBandwidth uint64, extension string) {
+    if extension != ".hls" || trackType == "subtitle" {
+        http.Error(w, `{ "status": "ERROR", "reason": "Playlist packages only serve audio and video media playlists" }`, http.StatusNotFound)
+        logger.Error("Playlist packages only serve audio and video media playlists")
+        return
+    }
+
+    reference := *jConfig.Playlist[0].Config
+    matchType := trackType
+    matchLang := trackLang
+    if trackType == "muxed" {
+        // Muxed segments are addressed on the bandwidth of the video track
+        matchType = "video"
+        for _, t := range reference.Tracks["video"] {
+            if t.Bandwidth == trackBandwidth {
+                matchLang = t.Lang
+            }
+        }
+    }
+
+    options := hls.PackageMediaOptions(jConfig)
+    var items []hls.ItemSegments
+    for _, item := range jConfig.Playlist {
+        t, err := util.MatchTrack(reference, *item.Config, matchType, matchLang, trackBandwidth)
+        if err != nil {
+            http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+            logger.Error("%s", err.Error())
+            return
+        }
+
+        var segments hls.ItemSegments
+        dir, filename := path.Split(item.Package)
+        itemId, _ := util.SplitFilename(filename)
+        lang := t.Lang
+        if trackType == "muxed" {
+            lang = trackLang
+        }
+        segments.Prefix = fmt.Sprintf("%s/%s_%s_%s_%d", path.Join("/video", dir), itemId, trackType, lang, t.Bandwidth)
+        segments.First, segments.Last = util.PlaylistItemSegments(item, t)
+        segments.SegmentDuration = item.Config.SegmentDuration
+        segments.Key = segmentKey(*item.Config, dir, itemId, drm.TrackKeyType(matchType, t.Config))
+        items = append(items, segments)
+    }
+
+    b := []byte(hls.CreatePlaylistMediaDescriptor(items, options))
+    w.Header().Set("Content-Type", "application/x-mpegURL")
+    w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+    _, err := w.Write(b)
+    if err != nil {
+        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+        logger.Error("%s", err.Error())
+    }
+}
+
+func handleManifestRequest(w http.ResponseWriter, r *http.Request, dir string, basename string, extension string) {
+    jConfig, err := readJsonConfig(path.Join(dir, basename + ".json"))
     if err != nil {
         http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
         logger.Error("%s", err.Error())
         return
     }
+    jConfig.Preview = requestPreview(r, jConfig, dir, basename)
 
     var manifest string
     switch extension {
         case ".mpd":
+            if jConfig.Cenc != nil && jConfig.Cenc.ClearKey && jConfig.Cenc.ClearKeyUrl == "" {
+                jConfig.Cenc.ClearKeyUrl = "/license/clearkey" + path.Join(dir, basename)
+            }
             manifest = dash.CreateDashManifest(jConfig, basename)
             w.Header().Set("Content-Type", "application/dash+xml")
         case ".m3u8":
+            if servedWithHls(jConfig, "", extension) == false {
+                http.Error(w, `{ "status": "ERROR", "reason": "Media is not served with this common encryption scheme" }`, http.StatusNotFound)
+                logger.Error("Media %s is not served with HLS in its protection scheme", basename)
+                return
+            }
             manifest = hls.CreateMainDescriptor(jConfig, basename)
             w.Header().Set("Content-Type", "application/x-mpegURL")
     }
@@ -107,7 +1178,7 @@ func handleManifestRequest(w http.ResponseWriter, dir string, basename string, e
     }
 }
 
-func handleMediaRequest(w http.ResponseWriter, dir string, basename string, extension string) {
+func handleMediaRequest(w http.ResponseWriter, r *http.Request, dir string, basename string, extension string) {
     trackName, trackType, trackLang, trackId, err := util.ParseBasename(basename)
     if err != nil {
         http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
@@ -124,18 +1195,65 @@ func handleMediaRequest(w http.ResponseWriter, dir string, basename string, exte
         return
     }
 
-    data, err := ioutil.ReadFile(path.Join(dir, trackName + ".json"))
+    jConfig, err := readJsonConfig(path.Join(dir, trackName + ".json"))
     if err != nil {
         http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
         logger.Error("%s", err.Error())
         return
     }
 
-    var jConfig mp4.JsonConfig
-    err = json.Unmarshal(data, &jConfig)
-    if err != nil {
-        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
-        logger.Error("%s", err.Error())
+    // Media of watermarked packages are only served to the session of a token, it gives the variants of the segments
+    session := ""
+    if jConfig.Watermarked() {
+        session, err = requestSession(r, dir, trackName)
+        if err != nil {
+            http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusForbidden)
+            logger.Error("Media of %s denied: %s", path.Join(dir, trackName), err.Error())
+            return
+        }
+    }
+
+    // Segments after the preview are refused to the users without entitlement, whatever their URL
+    jConfig.Preview = requestPreview(r, jConfig, dir, trackName)
+    if jConfig.Preview != nil && len(trackIds) == 2 {
+        number, err := strconv.ParseUint(trackIds[1], 10, 32)
+        if err == nil && uint32(number) > util.PreviewSegments(jConfig) {
+            http.Error(w, `{ "status": "ERROR", "reason": "Segment is after the preview" }`, http.StatusForbidden)
+            logger.Error("Segment %d of %s is after the preview", number, path.Join(dir, trackName))
+            return
+        }
+    }
+
+    // Trick mode Representations are built from the I-Frames of the video tracks
+    iFramesOnly := false
+    if trackType == "trick" && (extension == ".dash" || extension == ".m4s") {
+        trackType = "video"
+        iFramesOnly = true
+    }
+
+    if (extension == ".hls" || extension == ".ts") && servedWithHls(jConfig, trackType, extension) == false {
+        http.Error(w, `{ "status": "ERROR", "reason": "Media is not served with this common encryption scheme" }`, http.StatusNotFound)
+        logger.Error("Media %s is not served with HLS in its protection scheme", trackName)
+        return
+    }
+
+    if jConfig.Live != nil {
+        handleLiveMediaRequest(w, r, jConfig, dir, trackName, trackType, trackLang, trackBandwidth, trackIds, extension, iFramesOnly, session)
+        return
+    }
+
+    if trackType == "iframes" && len(jConfig.Playlist) == 0 {
+        handleIFramesMediaRequest(w, jConfig, trackName, trackLang, trackBandwidth, extension, session)
+        return
+    }
+
+    if trackType == "muxed" && len(jConfig.Playlist) == 0 {
+        handleMuxedMediaRequest(w, r, jConfig, dir, trackName, trackLang, trackBandwidth, trackIds, extension, session)
+        return
+    }
+
+    if len(jConfig.Playlist) != 0 {
+        handlePlaylistMediaRequest(w, jConfig, trackType, trackLang, trackBandwidth, extension)
         return
     }
 
@@ -151,10 +1269,27 @@ func handleMediaRequest(w http.ResponseWriter, dir string, basename string, exte
 
             switch extension {
                 case ".dash":
-                    content := mp4.CreateDashInitWithConf(*t.Config) // InitData
-                    b = mp4.MapToBytes(content)
+                    b, err = createDashInit(jConfig, t, trackType) // InitData
+                    if err != nil {
+                        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                        logger.Error("%s", err.Error())
+                        return
+                    }
                     w.Header().Set("Content-Type", "video/mp4")
                 case ".m4s":
+                    if len(trackIds) == 1 && jConfig.HlsByteRanges && iFramesOnly == false {
+                        var sizes []int64
+                        sizes, err = trackSegmentSizes(jConfig, t, trackType, extension)
+                        if err != nil {
+                            http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                            logger.Error("%s", err.Error())
+                            return
+                        }
+                        handleSegmentRanges(w, r, sizes, "video/mp4", func(segmentNumber uint32) ([]byte, error) {
+                            return mp4.MapToBytes(mp4.CreateDashFragmentWithConf(*t.Config, t.File, segmentNumber, jConfig.SegmentDuration, fragmentOptions(jConfig, trackType, false)))
+                        })
+                        return
+                    }
                     if len(trackIds) !=2 {
                         http.Error(w, `{ "status": "ERROR", "reason": "Invalid track Id" }`, http.StatusInternalServerError)
                         logger.Error("Invalid track Id")
@@ -169,19 +1304,79 @@ func handleMediaRequest(w http.ResponseWriter, dir string, basename string, exte
                     }
                     var segmentNumber uint32
                     segmentNumber = uint32(num)
-                    content := mp4.CreateDashFragmentWithConf(*t.Config, t.File, segmentNumber, jConfig.SegmentDuration) // Fragment
-                    b = mp4.MapToBytes(content)
+                    options := fragmentOptions(jConfig, trackType, iFramesOnly)
+                    options.Protection, err = drm.TrackProtection(jConfig.Cenc, drm.TrackKeyType(trackType, t.Config), drm.CencKeyPeriod(jConfig.Cenc, segmentNumber))
+                    if err != nil {
+                        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                        logger.Error("%s", err.Error())
+                        return
+                    }
+                    variant := watermarkVariant(t, session, segmentNumber)
+                    content := mp4.CreateDashFragmentWithConf(*variant.Config, variant.File, segmentNumber, jConfig.SegmentDuration, options) // Fragment
+                    b, err = mp4.MapToBytes(content)
+                    if err != nil {
+                        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                        logger.Error("%s", err.Error())
+                        return
+                    }
                     w.Header().Set("Content-Type", "video/mp4")
 
                 case ".hls":
                     if trackType == "subtitle" {
-                        b = []byte(hls.CreateSubtitlesDescriptor(trackName, trackLang, trackBandwidth))
+                        // Subtitles only content ends with its last cue
+                        duration := util.PackageDuration(jConfig)
+                        if duration == 0 {
+                            var f vtt.File
+                            f, err = vtt.ParseFile(t.File)
+                            if err != nil {
+                                http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                                logger.Error("%s", err.Error())
+                                return
+                            }
+                            duration = f.Duration()
+                        }
+                        if jConfig.Preview != nil && jConfig.Preview.Duration < duration {
+                            duration = jConfig.Preview.Duration
+                        }
+                        b = []byte(hls.CreateSubtitlesDescriptor(jConfig.SegmentDuration, duration, trackName, trackLang, trackBandwidth))
                     } else {
-                        segmentNumber := util.NumberOfSegments(t, jConfig)
-                        b = []byte(hls.CreateMediaDescriptor(jConfig.SegmentDuration, segmentNumber, trackName, trackType, trackLang, trackBandwidth))
+                        segmentNumber := playlistSegments(jConfig, t)
+                        options := hls.PackageMediaOptions(jConfig)
+                        options.Key = segmentKey(jConfig, dir, trackName, drm.TrackKeyType(trackType, t.Config))
+                        if jConfig.HlsByteRanges {
+                            segmentExtension := ".ts"
+                            if options.Fmp4 {
+                                segmentExtension = ".m4s"
+                            }
+                            options.SegmentSizes, err = trackSegmentSizes(jConfig, t, trackType, segmentExtension)
+                            if err != nil {
+                                http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                                logger.Error("%s", err.Error())
+                                return
+                            }
+                        }
+                        b = []byte(hls.CreateMediaDescriptor(jConfig.SegmentDuration, segmentNumber, trackName, trackType, trackLang, trackBandwidth, options))
                     }
                     w.Header().Set("Content-Type", "application/x-mpegURL")
                 case ".ts":
+                    if len(trackIds) == 1 && jConfig.HlsByteRanges {
+                        var sizes []int64
+                        sizes, err = trackSegmentSizes(jConfig, t, trackType, extension)
+                        if err != nil {
+                            http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                            logger.Error("%s", err.Error())
+                            return
+                        }
+                        handleSegmentRanges(w, r, sizes, "video/MP2T", func(segmentNumber uint32) ([]byte, error) {
+                            return createTSSegment(jConfig, t, segmentNumber)
+                        })
+                        return
+                    }
+                    if len(trackIds) != 2 {
+                        http.Error(w, `{ "status": "ERROR", "reason": "Invalid track Id" }`, http.StatusInternalServerError)
+                        logger.Error("Invalid track Id")
+                        return
+                    }
                     var num uint64
                     num, err = strconv.ParseUint(trackIds[1], 10, 32)
                     if err != nil {
@@ -189,23 +1384,46 @@ func handleMediaRequest(w http.ResponseWriter, dir string, basename string, exte
                         logger.Error("%s", err.Error())
                         return
                     }
-                    var segmentNumber uint32
-                    segmentNumber = uint32(num)
-                    b = ts.CreateHLSFragmentWithConf(*t.Config, t.File, segmentNumber, jConfig.SegmentDuration)
+                    b, err = createTSSegment(jConfig, watermarkVariant(t, session, uint32(num)), uint32(num))
+                    if err != nil {
+                        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                        logger.Error("%s", err.Error())
+                        return
+                    }
                     w.Header().Set("Content-Type", "video/MP2T")
 
                 case ".vtt":
-                    handleFileRequest(w, t.File, contentTypeFile)
-                    return
+                    // The whole file for DASH, segments aligned on the media segments for HLS
+                    if len(trackIds) != 2 {
+                        handleFileRequest(w, t.File, contentTypeFile)
+                        return
+                    }
+                    var num uint64
+                    num, err = strconv.ParseUint(trackIds[1], 10, 32)
+                    if err != nil || num == 0 {
+                        http.Error(w, `{ "status": "ERROR", "reason": "Invalid track Id" }`, http.StatusInternalServerError)
+                        logger.Error("Invalid track Id")
+                        return
+                    }
+                    var f vtt.File
+                    f, err = vtt.ParseFile(t.File)
+                    if err != nil {
+                        http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
+                        logger.Error("%s", err.Error())
+                        return
+                    }
+                    // CMAF segments have no composition offset
+                    var mpegts uint64
+                    if jConfig.HlsFormat != "fmp4" {
+                        mpegts = util.TimestampOrigin(jConfig)
+                    }
+                    segmentDuration := uint64(jConfig.SegmentDuration) * 1000
+                    b = []byte(f.Segment((num - 1) * segmentDuration, num * segmentDuration, mpegts))
+                    w.Header().Set("Content-Type", "text/vtt")
             }
 
-            w.Header().Set("Content-Length", strconv.Itoa(len(b)))
-            _, err := w.Write(b)
-            if err != nil {
-                http.Error(w, `{ "status": "ERROR", "reason": "` + err.Error() + `" }`, http.StatusInternalServerError)
-                logger.Error("%s", err.Error())
-                return
-            }
+            // Byte ranges of the TS segments are requested by the I-Frame playlists
+            http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
             return
         }
     }
@@ -214,24 +1432,24 @@ func handleMediaRequest(w http.ResponseWriter, dir string, basename string, exte
     logger.Error("Media not found : %s", path.Join(dir, basename + extension))
 }
 
-func handleContentRequest(w http.ResponseWriter, dir string, basename string, extension string) {
+func handleContentRequest(w http.ResponseWriter, r *http.Request, dir string, basename string, extension string) {
     switch extension {
         case ".mpd":
-            handleManifestRequest(w, dir, basename, extension)
+            handleManifestRequest(w, r, dir, basename, extension)
         case ".dash":
-            handleMediaRequest(w, dir, basename, extension)
+            handleMediaRequest(w, r, dir, basename, extension)
         case ".m4s":
-            handleMediaRequest(w, dir, basename, extension)
+            handleMediaRequest(w, r, dir, basename, extension)
 
         case ".m3u8":
-            handleManifestRequest(w, dir, basename, extension)
+            handleManifestRequest(w, r, dir, basename, extension)
         case ".hls":
-            handleMediaRequest(w, dir, basename, extension)
+            handleMediaRequest(w, r, dir, basename, extension)
         case ".ts":
-            handleMediaRequest(w, dir, basename, extension)
+            handleMediaRequest(w, r, dir, basename, extension)
 
         case ".vtt":
-            handleMediaRequest(w, dir, basename, extension)
+            handleMediaRequest(w, r, dir, basename, extension)
 
         default:
             http.Error(w, `{ "status": "ERROR", "reason": "Format is not supported" }`, http.StatusInternalServerError)
@@ -244,8 +1462,8 @@ func handleHttpRequest(w http.ResponseWriter, r *http.Request) {
 
     w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Access-Control-Allow-Credentials", "true")
-    w.Header().Set("Access-Control-Allow-Methods", "GET,OPTIONS")
-    w.Header().Set("Access-Control-Allow-Headers", "DNT,X-CustomHeader,Keep-Alive,Range,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type")
+    w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+    w.Header().Set("Access-Control-Allow-Headers", "DNT,X-CustomHeader,Keep-Alive,Range,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type,Authorization")
     w.Header().Set("Connection", "close")
 
     dir, filename := path.Split(path.Clean(r.URL.Path))
@@ -257,9 +1475,26 @@ func handleHttpRequest(w http.ResponseWriter, r *http.Request) {
 
     switch paths[0] {
         case "video":
-            handleContentRequest(w, dir[6:], basename, extension) // Remove relative path /video/ -> /
+            handleContentRequest(w, r, dir[6:], basename, extension) // Remove relative path /video/ -> /
+        case "key":
+            handleKeyRequest(w, r, dir[4:], basename, extension) // Remove relative path /key/ -> /
+        case "license":
+            if len(paths) < 3 || paths[1] != "clearkey" || extension != "" {
+                http.Error(w, `{ "status": "ERROR", "reason": "Invalid license request" }`, http.StatusNotFound)
+                logger.Error("Invalid license request")
+                return
+            }
+            handleClearKeyLicenseRequest(w, r, dir[17:], basename) // Remove relative path /license/clearkey/ -> /
         default:
-            switch extension {
+            switch strings.ToLower(extension) {
+                // Packages, key files and CPIX documents hold the content keys
+                case ".json", ".key", ".xml":
+                    http.Error(w, `{ "status": "ERROR", "reason": "Forbidden" }`, http.StatusForbidden)
+                    logger.Error("Forbidden file %s", r.URL.Path)
+                // Source files of the packages are only served through the segments, within the preview of the token
+                case ".mp4", ".m4a", ".m4v", ".mov":
+                    http.Error(w, `{ "status": "ERROR", "reason": "Forbidden" }`, http.StatusForbidden)
+                    logger.Error("Forbidden file %s", r.URL.Path)
                 case ".html":
                     handleFileRequest(w, r.URL.Path, contentTypeHtml)
                 default:
@@ -270,7 +1505,7 @@ func handleHttpRequest(w http.ResponseWriter, r *http.Request) {
 
 func help() {
     logger.Message("Afrostream Media Server version 0.1     Sebastien Petit <spebsd@gmail.com>")
-    logger.Message("Usage: ams -d [directory] < -p [port] -log [filename] >")
+    logger.Message("Usage: ams -d [directory] < -p [port] -log [filename] -k [secret] -keystore [location] -keystorekey [secret] >")
     logger.Message("  < ... > are optional\n")
     flag.PrintDefaults()
     logger.Message("\nExample: amspackager -d public_html -p 80")
@@ -291,6 +1526,14 @@ func main() {
     var port string
     flag.StringVar(&port, "p", "80", "Listening `port` of AMS web server")
 
+    flag.StringVar(&keySecret, "k", "", "`secret` of the tokens authenticating the key requests, keys are not served without it")
+
+    var keyStore string
+    flag.StringVar(&keyStore, "keystore", "", "Key store `location` of the assets of the packages: URL of an HTTP KMS, or key store filename relative to the root directory")
+
+    var keyStoreSecret string
+    flag.StringVar(&keyStoreSecret, "keystorekey", "", "`secret` of the key store: bearer token of the KMS, or AES-256 key of the key store file in 64 hexadecimal digits")
+
     flag.Parse()
 
     if flag_help {
@@ -322,6 +1565,17 @@ func main() {
         }
     }
 
+    if keyStore != "" {
+        if strings.Contains(keyStore, "://") == false {
+            keyStore = path.Join("/", keyStore)
+        }
+        drm.KeyStore, err = keystore.Open(keyStore, keyStoreSecret)
+        if err != nil {
+            logger.Message("Cannot open key store %s : %v", keyStore, err)
+            return
+        }
+    }
+
     logger.Message("[*] Running Afrostream Media Server on port %s, press CTRL+C to exit", port)
 
     http.HandleFunc("/", handleHttpRequest)
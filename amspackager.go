@@ -32,28 +32,44 @@
 package main
 
 import (
+    "bytes"
     "encoding/json"
     "errors"
     "flag"
     "fmt"
+    "io/ioutil"
     "os"
     "path"
+    "strconv"
+    "strings"
+    "time"
 
+    "drm"
+    "keystore"
     "logger"
     "mp4"
+    "util"
 )
 
 type fileSlice []string
 type languageSlice []string
+type keySlice [][]byte
+type watermarkSlice []string
+type playlistSlice []mp4.PlaylistItem
 
 type inputFile struct {
     Filename string
     Language string
+    Key       []byte // Content key of a file protected upstream, its samples are decrypted when they are served
+    Watermark string // Variant B of the forensic watermark of a video file, the file being variant A
 }
 
 // Global vars for Flags
 var inputFilenames fileSlice
 var languageCodes languageSlice
+var inputKeys keySlice
+var watermarkFilenames watermarkSlice
+var playlistItems playlistSlice
 
 func (s *fileSlice) String() string {
     return fmt.Sprintf("%+v", *s)
@@ -84,6 +100,81 @@ func (s *languageSlice) Set(value string) error {
     return nil
 }
 
+func (s *keySlice) String() string {
+    return fmt.Sprintf("%x", *s)
+}
+
+func (s *keySlice) Set(value string) error {
+    if inputFilenames == nil {
+        return errors.New("No input filenames specified before -ikey option")
+    }
+    key, err := drm.ParseKey(value)
+    if err != nil {
+        return errors.New("Content key of an input file is 32 hexadecimal digits")
+    }
+    for len(*s) < len(inputFilenames) - 1 {
+        *s = append(*s, nil)
+    }
+    *s = append(*s, key)
+
+    return nil
+}
+
+func (s *watermarkSlice) String() string {
+    return fmt.Sprintf("%+v", *s)
+}
+
+func (s *watermarkSlice) Set(value string) error {
+    if inputFilenames == nil {
+        return errors.New("No input filenames specified before -wm option")
+    }
+    for len(*s) < len(inputFilenames) - 1 {
+        *s = append(*s, "")
+    }
+    *s = append(*s, value)
+
+    return nil
+}
+
+func (s *playlistSlice) String() string {
+    return fmt.Sprintf("%+v", *s)
+}
+
+// Parse a playlist item with the format package.json[:in-out], in and out points are in milliseconds
+func (s *playlistSlice) Set(value string) error {
+    var item mp4.PlaylistItem
+    item.Package = value
+    if i := strings.LastIndex(value, ":"); i != -1 {
+        item.Package = value[:i]
+        points := strings.Split(value[i+1:], "-")
+        if len(points) != 2 {
+            return errors.New("Playlist item in and out points must be formatted as in-out (eg: intro.json:0-30000)")
+        }
+        var err error
+        if points[0] != "" {
+            item.In, err = strconv.ParseUint(points[0], 10, 64)
+            if err != nil {
+                return err
+            }
+        }
+        if points[1] != "" {
+            item.Out, err = strconv.ParseUint(points[1], 10, 64)
+            if err != nil {
+                return err
+            }
+        }
+        if item.Out != 0 && item.Out <= item.In {
+            return errors.New("Playlist item out point must be after its in point")
+        }
+    }
+    if path.Ext(item.Package) != ".json" {
+        return errors.New("Playlist items must be .json packages")
+    }
+    *s = append(*s, item)
+
+    return nil
+}
+
 func parseMp4Files(files []inputFile) (mp4Files map[string][]mp4.Mp4) {
     mp4Files = make(map[string][]mp4.Mp4)
     for _, in := range files {
@@ -100,9 +191,352 @@ func parseMp4Files(files []inputFile) (mp4Files map[string][]mp4.Mp4) {
     return
 }
 
+// Write a playlist package chaining already packaged files, played as a live channel when live is set
+func createPlaylistPackage(jsonFilename string, live *mp4.LiveConfig, hlsFormat string, cenc *mp4.CencConfig, cpixOutFilename string) {
+    var jConf mp4.JsonConfig
+    jConf.Live = live
+    jConf.Cenc = cenc
+    jConf.HlsFormat = hlsFormat
+    for _, item := range playlistItems {
+        logger.Message("-- Adding package='%s' in=%dms out=%dms", item.Package, item.In, item.Out)
+        data, err := ioutil.ReadFile(item.Package)
+        if err != nil {
+            logger.Message("Cannot read package '%s' : %v", item.Package, err)
+            return
+        }
+        var itemConf mp4.JsonConfig
+        err = json.Unmarshal(data, &itemConf)
+        if err != nil {
+            logger.Message("Cannot decode package '%s' : %v", item.Package, err)
+            return
+        }
+        if len(itemConf.Playlist) != 0 {
+            logger.Message("Package '%s' is a playlist package and cannot be chained", item.Package)
+            return
+        }
+        if itemConf.Preview != nil {
+            logger.Message("Package '%s' has a preview, its segments are served to entitled users only and cannot be chained", item.Package)
+            return
+        }
+        if live == nil && itemConf.Watermarked() {
+            logger.Message("Package '%s' is watermarked, its segments are served with its own token and cannot be chained", item.Package)
+            return
+        }
+        if live != nil && jConf.SegmentDuration != 0 && jConf.SegmentDuration != itemConf.SegmentDuration {
+            logger.Message("Package '%s' has a segment duration of %ds, items of a live channel must have the same segment duration", item.Package, itemConf.SegmentDuration)
+            return
+        }
+        if jConf.SegmentDuration < itemConf.SegmentDuration {
+            jConf.SegmentDuration = itemConf.SegmentDuration
+        }
+        jConf.Playlist = append(jConf.Playlist, item)
+    }
+
+    // The items of a live channel have various definitions, all their tracks share the key of the channel. The
+    // key periods of a live channel have no end, its rotated keys are derived from the key of the channel.
+    if cenc != nil && cenc.RotationPeriod != 0 && (cenc.AssetId != "" || cpixOutFilename != "") {
+        logger.Message("Keys of live channels are rotated with a key (-key) or a key file, without key store nor CPIX document")
+        return
+    }
+    if cenc != nil && protectPackage(jsonFilename, cenc, []string{ "" }, 1, cpixOutFilename) == false {
+        return
+    }
+
+    jsonStr, err := json.Marshal(jConf)
+    if err != nil {
+        panic(err)
+    }
+
+    logger.Message("\n-- Creating playlist package file '%s'\n", jsonFilename)
+    err = ioutil.WriteFile(jsonFilename, jsonStr, 0644)
+    if err != nil {
+        logger.Message("Cannot write file '%s' : %v", jsonFilename, err)
+        return
+    }
+
+    logger.Message("Playlist has been packaged successfully")
+}
+
+// Samples of a file protected upstream are passed through with their protection, they cannot be encrypted again.
+// With the key of the file they are decrypted when they are served instead, and handled like clear samples.
+func sourceProtection(mp4File mp4.Mp4, sConf *mp4.StreamConfig, key []byte, cenc *mp4.CencConfig, encryption *mp4.EncryptionConfig) bool {
+    var err error
+    sConf.Encryption, err = mp4File.StreamEncryption()
+    if err != nil {
+        logger.Message("Cannot read the protection of file '%s' : %v", mp4File.Filename, err)
+        return false
+    }
+    if sConf.Encryption == nil {
+        if key != nil {
+            logger.Message("File '%s' is not protected, its key is ignored", mp4File.Filename)
+        }
+        return true
+    }
+    if key != nil {
+        if sConf.Encryption.Scheme != "cenc" && sConf.Encryption.Scheme != "cbcs" {
+            logger.Message("File '%s' is protected with %s, it cannot be decrypted", mp4File.Filename, sConf.Encryption.Scheme)
+            return false
+        }
+        sConf.Encryption.Key = key
+        logger.Message("   protected with %s, key ID %s (decrypted when served)", sConf.Encryption.Scheme, drm.FormatKeyId(sConf.Encryption.Tenc.DefaultKID[:]))
+        return true
+    }
+    if cenc != nil || encryption != nil {
+        logger.Message("File '%s' is already protected with %s, it cannot be encrypted again", mp4File.Filename, sConf.Encryption.Scheme)
+        return false
+    }
+    logger.Message("   protected with %s, key ID %s (served with DASH only)", sConf.Encryption.Scheme, drm.FormatKeyId(sConf.Encryption.Tenc.DefaultKID[:]))
+    return true
+}
+
+// Asset ID of a package in the key store: the name of its JSON file
+func packageAssetId(jsonFilename string) string {
+    name := path.Base(jsonFilename)
+    return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// Key types of the audio and video tracks of a package
+func packageKeyTypes(tracks map[string][]mp4.TrackEntry) (keyTypes []string) {
+    found := make(map[string]bool)
+    for _, trackType := range []string{ "audio", "video", "trick" } {
+        for _, t := range tracks[trackType] {
+            keyType := drm.TrackKeyType(trackType, t.Config)
+            if found[keyType] == false {
+                found[keyType] = true
+                keyTypes = append(keyTypes, keyType)
+            }
+        }
+    }
+    return
+}
+
+// Number of key periods of a package, its key changes every RotationPeriod segments of its longest track
+func packageKeyPeriods(jConf mp4.JsonConfig) (periods uint32) {
+    periods = 1
+    if jConf.Cenc == nil || jConf.Cenc.RotationPeriod == 0 {
+        return
+    }
+    for _, trackType := range []string{ "audio", "video" } {
+        for _, t := range jConf.Tracks[trackType] {
+            n := (util.NumberOfSegments(t, jConf) + jConf.Cenc.RotationPeriod - 1) / jConf.Cenc.RotationPeriod
+            if n > periods {
+                periods = n
+            }
+        }
+    }
+    return
+}
+
+// Keys of a package protected with the keys of an asset of the key store: keys are generated for the key types
+// of its tracks and its key periods the first time the asset is packaged, they are exported in a CPIX document
+// with -cpixout
+func protectPackage(jsonFilename string, cenc *mp4.CencConfig, keyTypes []string, periods uint32, cpixOutFilename string) bool {
+    if cenc.AssetId != "" {
+        _, err := drm.LoadAssetKeys(cenc.AssetId)
+        if err == keystore.ErrAssetNotFound {
+            logger.Message("-- Generating keys of asset '%s'", cenc.AssetId)
+            var keys []drm.ContentKey
+            for _, keyType := range keyTypes {
+                for period := uint32(0); period < periods; period++ {
+                    key, err := drm.GenerateKey(keyType, period)
+                    if err != nil {
+                        logger.Message("Cannot generate key : %v", err)
+                        return false
+                    }
+                    if periods > 1 {
+                        logger.Message("   %s key ID %s for key period %d", keyType, drm.FormatKeyId(key.KeyId), period)
+                    } else {
+                        logger.Message("   %s key ID %s", keyType, drm.FormatKeyId(key.KeyId))
+                    }
+                    keys = append(keys, key)
+                }
+            }
+            err = drm.StoreAssetKeys(cenc.AssetId, keys)
+        }
+        if err != nil {
+            logger.Message("Cannot get the keys of asset '%s' : %v", cenc.AssetId, err)
+            return false
+        }
+    }
+
+    if cpixOutFilename == "" {
+        return true
+    }
+    if cenc.AssetId == "" && cenc.Key == "" {
+        logger.Message("Exporting a CPIX document needs the key (-key) or a key store")
+        return false
+    }
+    provider, err := drm.NewKeyProvider(cenc)
+    if err != nil {
+        logger.Message("Cannot get the keys of the package : %v", err)
+        return false
+    }
+    contentId := cenc.AssetId
+    if contentId == "" {
+        contentId = packageAssetId(jsonFilename)
+    }
+    keys := provider.Keys()
+    if cenc.AssetId == "" && cenc.RotationPeriod != 0 {
+        // Keys of all the key periods, derived from the key of the package
+        keys = nil
+        for period := uint32(0); period < periods; period++ {
+            key, err := provider.ContentKey("", period)
+            if err != nil {
+                logger.Message("Cannot get the keys of the package : %v", err)
+                return false
+            }
+            keys = append(keys, key)
+        }
+    }
+    data, err := drm.ExportCpix(contentId, cenc, keys)
+    if err == nil {
+        logger.Message("-- Exporting CPIX document '%s'", cpixOutFilename)
+        err = ioutil.WriteFile(cpixOutFilename, data, 0600)
+    }
+    if err != nil {
+        logger.Message("Cannot export CPIX document '%s' : %v", cpixOutFilename, err)
+        return false
+    }
+    return true
+}
+
+// Video track of a file, segments being cut every segmentDuration seconds
+func videoTrack(mp4File mp4.Mp4, segmentDuration uint) (t mp4.TrackEntry) {
+    mdat := mp4File.Boxes["mdat"][0].(mp4.MdatBox)
+    mdhd := mp4File.Boxes["moov.trak.mdia.mdhd"][0].(mp4.MdhdBox)
+    hdlr := mp4File.Boxes["moov.trak.mdia.hdlr"][0].(mp4.HdlrBox)
+    stts := mp4File.Boxes["moov.trak.mdia.minf.stbl.stts"][0].(mp4.SttsBox)
+    var ctts mp4.CttsBox
+    cttsBoxPresent := false
+    if mp4File.Boxes["moov.trak.mdia.minf.stbl.ctts"] != nil {
+        ctts = mp4File.Boxes["moov.trak.mdia.minf.stbl.ctts"][0].(mp4.CttsBox)
+        cttsBoxPresent = true
+    }
+    stsz := mp4File.Boxes["moov.trak.mdia.minf.stbl.stsz"][0].(mp4.StszBox)
+    stss := mp4File.Boxes["moov.trak.mdia.minf.stbl.stss"][0].(mp4.StssBox)
+    entryPath := mp4File.SampleEntryPath()
+    avc1 := mp4File.Boxes[entryPath][0].(mp4.Avc1Box)
+    avcC := mp4File.Boxes[entryPath + ".avcC"][0].(mp4.AvcCBox)
+    elst := mp4File.Boxes["moov.trak.edts.elst"][0].(mp4.ElstBox)
+    t.Bandwidth = uint64(float64(mdat.Size) / (float64(mdhd.Duration) / float64(mdhd.Timescale)) * 8)
+    t.PeakBandwidth = peakBandwidth(stsz, stts.Entries[0].SampleDelta, mdhd.Timescale, segmentDuration)
+    t.File = mp4File.Filename
+    t.Lang = mp4File.Language
+    t.Config = new(mp4.StreamConfig)
+    t.Config.StszBoxOffset = stsz.Offset
+    t.Config.StszBoxSize = stsz.Size
+    t.Config.SttsBoxOffset = stts.Offset
+    t.Config.SttsBoxSize = stts.Size
+    t.Config.MdatBoxOffset = mdat.Offset
+    t.Config.MdatBoxSize = mdat.Size
+    t.Config.Type = "video"
+    t.Config.Rate = 0x00010000
+    t.Config.Volume = 0x0100
+    t.Config.Duration = mdhd.Duration
+    t.Config.Timescale = mdhd.Timescale
+    t.Config.Language[0] = byte((0x7c00 & mdhd.Language) >> 10) + 0x60
+    t.Config.Language[1] = byte((0x03e0 & mdhd.Language) >> 5) + 0x60
+    t.Config.Language[2] = byte(0x1f & mdhd.Language) + 0x60
+    t.Config.HandlerType = hdlr.HandlerType
+    t.Config.SampleDelta = stts.Entries[0].SampleDelta
+    t.Config.MediaTime = elst.MediaTime
+    t.Config.Video = new(mp4.StreamVideoEntry)
+    t.Config.Video.Width = avc1.Width
+    t.Config.Video.Height = avc1.Height
+    t.Config.Video.HorizontalResolution = avc1.HorizontalResolution
+    t.Config.Video.VerticalResolution = avc1.VerticalResolution
+    t.Config.Video.EntryDataSize = avc1.EntryDataSize
+    t.Config.Video.FramesPerSample = avc1.FramesPerSample
+    t.Config.Video.BitDepth = avc1.BitDepth
+    t.Config.Video.ColorTableIndex = avc1.ColorTableIndex
+    t.Config.Video.CodecInfo = [3]byte{ avcC.AVCProfileIndication, avcC.ProfileCompatibility, avcC.AVCLevelIndication }
+    t.Config.Video.NalUnitSize = avcC.NalUnitSize & 0x03
+    t.Config.Video.SPSEntryCount = avcC.SPSEntryCount
+    t.Config.Video.SPSSize = avcC.SPSSize
+    t.Config.Video.SPSData = avcC.SPSData
+    t.Config.Video.PPSEntryCount = avcC.PPSEntryCount
+    t.Config.Video.PPSSize = avcC.PPSSize
+    t.Config.Video.PPSData = avcC.PPSData
+    t.Config.Video.StssBoxOffset = stss.Offset
+    t.Config.Video.StssBoxSize = stss.Size
+    t.Config.Video.IFrameCount = stss.EntryCount
+    var iFramesSize uint64
+    for _, sampleNumber := range stss.SampleNumber {
+        if stsz.SampleSize != 0 {
+            iFramesSize += uint64(stsz.SampleSize)
+        } else if sampleNumber >= 1 && sampleNumber <= stsz.SampleCount {
+            iFramesSize += uint64(stsz.EntrySize[sampleNumber - 1])
+        }
+    }
+    t.Config.Video.IFrameBandwidth = uint64(float64(iFramesSize) / (float64(mdhd.Duration) / float64(mdhd.Timescale)) * 8)
+    if cttsBoxPresent == true {
+        t.Config.Video.CttsBoxOffset = ctts.Offset
+        t.Config.Video.CttsBoxSize = ctts.Size
+    }
+
+    return
+}
+
+// Variant B of the forensic watermark of a video track. Both variants are served with the init segment of the
+// track, they need the same decoder configuration, samples durations and I-Frames.
+func watermarkTrack(t mp4.TrackEntry, in inputFile, segmentDuration uint, cenc *mp4.CencConfig, encryption *mp4.EncryptionConfig) *mp4.TrackEntry {
+    mp4Files := parseMp4Files([]inputFile{ in })
+    if len(mp4Files["video"]) != 1 {
+        logger.Message("Watermark file '%s' has no video track", in.Filename)
+        return nil
+    }
+    mp4File := mp4Files["video"][0]
+    variant := videoTrack(mp4File, segmentDuration)
+    a, b := t.Config, variant.Config
+    if a.Timescale != b.Timescale || a.Duration != b.Duration || a.SampleDelta != b.SampleDelta || a.MediaTime != b.MediaTime || a.Video.IFrameCount != b.Video.IFrameCount || bytes.Equal(a.Video.SPSData, b.Video.SPSData) == false || bytes.Equal(a.Video.PPSData, b.Video.PPSData) == false {
+        logger.Message("Watermark file '%s' is not encoded like '%s', their segments cannot be exchanged", in.Filename, t.File)
+        return nil
+    }
+    if sourceProtection(mp4File, variant.Config, in.Key, cenc, encryption) == false {
+        return nil
+    }
+    if (a.Encryption == nil) != (b.Encryption == nil) {
+        logger.Message("Watermark file '%s' is not protected like '%s'", in.Filename, t.File)
+        return nil
+    }
+    logger.Message("   watermark variant B '%s'", in.Filename)
+    variant.Lang = t.Lang
+    return &variant
+}
+
+// Highest bandwidth of the segments of a track, segments being cut every segmentDuration seconds
+func peakBandwidth(stsz mp4.StszBox, sampleDelta uint32, timescale uint32, segmentDuration uint) (peak uint64) {
+    if sampleDelta == 0 || segmentDuration == 0 {
+        return
+    }
+    samplesPerSegment := uint32(uint64(segmentDuration) * uint64(timescale) / uint64(sampleDelta))
+    if samplesPerSegment == 0 {
+        samplesPerSegment = 1
+    }
+
+    var size uint64
+    var i uint32
+    for i = 0; i < stsz.SampleCount; i++ {
+        if stsz.SampleSize != 0 {
+            size += uint64(stsz.SampleSize)
+        } else {
+            size += uint64(stsz.EntrySize[i])
+        }
+        if (i + 1) % samplesPerSegment == 0 || i + 1 == stsz.SampleCount {
+            if bandwidth := size * 8 / uint64(segmentDuration); bandwidth > peak {
+                peak = bandwidth
+            }
+            size = 0
+        }
+    }
+
+    return
+}
+
 func help() {
     fmt.Printf("Afrostream Media Server version 0.1     Sebastien Petit <spebsd@gmail.com>\n")
-    fmt.Printf("Usage: amspackager -o [filename] < -d [duration] > { -i [filename] < -l [language] > ... }\n")
+    fmt.Printf("Usage: amspackager -o [filename] < -d [duration] -e [filename] -hls [format] -byterange -date [time] -key [key] -keyfile [filename] -encryption [method] -rotate [number] -cenc [scheme] -kid [key ID] -drm [systems] -keystore [location] -keystorekey [key] -cpix [filename] -cpixout [filename] -preview [duration] -entitlement [claim=values] > { -i [filename] < -l [language] -ikey [key] -wm [filename] > ... }\n")
+    fmt.Printf("       amspackager -o [filename] < -live [time] -loop -t [duration] -hls [format] -cenc [scheme] -kid [key ID] -drm [systems] -key [key] -rotate [number] -keystore [location] -keystorekey [key] -cpixout [filename] > { -p [filename] ... }\n")
     fmt.Printf("  < ... > are optional\n\n")
     flag.PrintDefaults()
     fmt.Printf("\nExample: amspackager -d video -o video.json -d 8 -i video-384k.mp4 -i video-1500k.mp4 -i video-2950k.mp4 -i audio-128k.mp4 -i sub_fr.vtt -l fra -i sub_en.vtt -l eng\n")
@@ -120,10 +554,79 @@ func main() {
     var segmentDuration uint
     flag.UintVar(&segmentDuration, "d", 10, "Segments `duration` in seconds")
 
-    flag.Var(&inputFilenames, "i", "MP4 or VTT input `filename`\n\t\tMP4 -> avc1 video or mp4a audio (only one stream per mp4 file is supported)\n\t\tVTT -> vtt subtitles")
+    flag.Var(&inputFilenames, "i", "MP4 or VTT input `filename`\n\t\tMP4 -> avc1 video or mp4a audio, or encv and enca samples protected upstream (only one stream per mp4 file is supported)\n\t\tVTT -> vtt subtitles")
 
     flag.Var(&languageCodes, "l", "ISO-639-2 `language` code for the input file preceeding this argument")
 
+    flag.Var(&inputKeys, "ikey", "Content `key` in 32 hexadecimal digits of the input file preceeding this argument, protected upstream with cenc or cbcs: its samples are decrypted when they are served, clear or encrypted again")
+
+    flag.Var(&watermarkFilenames, "wm", "MP4 `filename` of the variant B of the forensic watermark of the video input file preceeding this argument, encoded like it: ams serves variant A or B per segment and session")
+
+    flag.Var(&playlistItems, "p", "Package `filename` to chain in a playlist package instead of packaging input files, with optional in and out points in milliseconds (eg: -p intro.json -p episode.json:0-1200000)")
+
+    var eventsFilename string
+    flag.StringVar(&eventsFilename, "e", "", "Timed events sidecar JSON `filename` (DASH EventStream and EMSG)")
+
+    var hlsFormat string
+    flag.StringVar(&hlsFormat, "hls", "ts", "HLS segments `format`: ts or fmp4 (CMAF segments shared with DASH)")
+
+    var byteRanges bool
+    flag.BoolVar(&byteRanges, "byterange", false, "Address the HLS segments as byte ranges of a single file per rendition")
+
+    var programDateTime string
+    flag.StringVar(&programDateTime, "date", "", "Wall clock `time` of the start of the program, dating the HLS segments (RFC 3339, eg: 2016-01-01T20:00:00Z)")
+
+    var key string
+    flag.StringVar(&key, "key", "", "AES-128 `key` of the HLS segments in 32 hexadecimal digits, stored in the package")
+
+    var keyFilename string
+    flag.StringVar(&keyFilename, "keyfile", "", "Key store `filename` holding the AES-128 key of the HLS segments, relative to the root directory of AMS")
+
+    var encryptionMethod string
+    flag.StringVar(&encryptionMethod, "encryption", "AES-128", "Encryption `method` of the HLS segments with a key: AES-128 (whole segments) or SAMPLE-AES (audio and video samples)")
+
+    var keyRotation uint
+    flag.UintVar(&keyRotation, "rotate", 0, "Rotate the key of the HLS segments, or the common encryption keys, every `number` segments")
+
+    var liveStartTime string
+    flag.StringVar(&liveStartTime, "live", "", "Availability start `time` of a live channel playing the playlist (RFC 3339, eg: 2016-01-01T00:00:00Z)")
+
+    var liveLoop bool
+    flag.BoolVar(&liveLoop, "loop", false, "Restart the playlist of the live channel at its end")
+
+    var timeShiftBufferDepth uint
+    flag.UintVar(&timeShiftBufferDepth, "t", 0, "Time shift buffer `duration` of the live channel in seconds (default 10 segments)")
+
+    var partDuration uint
+    flag.UintVar(&partDuration, "part", 0, "Low latency live channel: `duration` in milliseconds of the LL-HLS parts and of the chunks of the CMAF segments")
+
+    var cencScheme string
+    flag.StringVar(&cencScheme, "cenc", "", "Common encryption `scheme` of the CMAF fragments, with the key given by -key or -keyfile, or the keys of the package in the key store: cenc (AES-CTR, DASH only) or cbcs (AES-CBC pattern encryption, DASH and HLS with -hls fmp4)")
+
+    var keyId string
+    flag.StringVar(&keyId, "kid", "", "Key `ID` of the common encryption in 32 hexadecimal digits")
+
+    var drmSystems string
+    flag.StringVar(&drmSystems, "drm", "", "DRM `systems` of the common encryption, separated by commas: widevine, playready, clearkey (system data is set in the package)")
+
+    var keyStoreLocation string
+    flag.StringVar(&keyStoreLocation, "keystore", "", "Key store `location` of the common encryption keys: URL of a key management service, or key store filename")
+
+    var keyStoreSecret string
+    flag.StringVar(&keyStoreSecret, "keystorekey", "", "Bearer token of the key management service, or AES-256 `key` of the key store file in 64 hexadecimal digits")
+
+    var cpixFilename string
+    flag.StringVar(&cpixFilename, "cpix", "", "CPIX document `filename` to import the common encryption keys and DRM systems of the package from, into the key store")
+
+    var cpixOutFilename string
+    flag.StringVar(&cpixOutFilename, "cpixout", "", "CPIX document `filename` to export the common encryption keys and DRM systems of the package to")
+
+    var previewDuration uint
+    flag.UintVar(&previewDuration, "preview", 0, "Preview `duration` in seconds of the users without entitlement, who only play the start of the package")
+
+    var entitlement string
+    flag.StringVar(&entitlement, "entitlement", "", "Token claim and values of the `entitlement` to play the whole package of a preview, separated by commas (eg: ent=subscriber,premium)")
+
     flag.Parse()
 
     if flag_help {
@@ -135,6 +638,180 @@ func main() {
 
     logger.Message("AMSPackager -- spebsd@gmail.com / Afrostream\n")
 
+    switch hlsFormat {
+        case "ts":
+            hlsFormat = ""
+        case "fmp4":
+        default:
+            logger.Message("Unknown HLS segments format '%s', use ts or fmp4", hlsFormat)
+            return
+    }
+
+    if keyStoreLocation != "" {
+        var err error
+        drm.KeyStore, err = keystore.Open(keyStoreLocation, keyStoreSecret)
+        if err != nil {
+            logger.Message("Cannot open key store '%s' : %v", keyStoreLocation, err)
+            return
+        }
+    }
+
+    var cenc *mp4.CencConfig
+    if cpixFilename != "" {
+        if drm.KeyStore == nil {
+            logger.Message("Importing a CPIX document needs a key store (-keystore)")
+            return
+        }
+        if keyId != "" || key != "" || keyFilename != "" {
+            logger.Message("Keys are imported from the CPIX document, -kid, -key and -keyfile cannot be used")
+            return
+        }
+        logger.Message("-- Importing CPIX document '%s'", cpixFilename)
+        data, err := ioutil.ReadFile(cpixFilename)
+        if err != nil {
+            logger.Message("Cannot read CPIX document '%s' : %v", cpixFilename, err)
+            return
+        }
+        cenc = &mp4.CencConfig{ Scheme: cencScheme }
+        contentId, keys, err := drm.ImportCpix(data, cenc)
+        if err != nil {
+            logger.Message("Cannot import CPIX document '%s' : %v", cpixFilename, err)
+            return
+        }
+        if contentId == "" {
+            contentId = packageAssetId(jsonFilename)
+        }
+        err = drm.StoreAssetKeys(contentId, keys)
+        if err != nil {
+            logger.Message("Cannot store the keys of asset '%s' : %v", contentId, err)
+            return
+        }
+        cenc.AssetId = contentId
+    } else if cencScheme != "" {
+        if key == "" && keyFilename == "" {
+            // Keys of the asset of the package in the key store
+            if drm.KeyStore == nil {
+                logger.Message("Common encryption needs a key, a key file or a key store")
+                return
+            }
+            cenc = &mp4.CencConfig{ Scheme: cencScheme, AssetId: packageAssetId(jsonFilename) }
+        } else {
+            if _, err := drm.ParseKeyId(keyId); err != nil {
+                logger.Message("Invalid key ID '%s' : %v", keyId, err)
+                return
+            }
+            if _, err := drm.ParseKey(key); key != "" && err != nil {
+                logger.Message("Invalid key '%s' : %v", key, err)
+                return
+            }
+            cenc = &mp4.CencConfig{ Scheme: cencScheme, KeyId: keyId, Key: key, KeyFile: keyFilename }
+        }
+    }
+
+    if cenc != nil {
+        if cenc.Scheme != "cenc" && cenc.Scheme != "cbcs" {
+            logger.Message("Unknown common encryption scheme '%s', use cenc or cbcs", cenc.Scheme)
+            return
+        }
+        cenc.RotationPeriod = uint32(keyRotation)
+        if byteRanges {
+            logger.Message("Packages protected with common encryption cannot use byte ranges")
+            return
+        }
+        for _, system := range strings.Split(drmSystems, ",") {
+            switch system {
+                case "":
+                case "widevine":
+                    if cenc.Widevine == nil {
+                        cenc.Widevine = &mp4.WidevineConfig{}
+                    }
+                case "playready":
+                    if cenc.PlayReady == nil {
+                        cenc.PlayReady = &mp4.PlayReadyConfig{}
+                    }
+                case "clearkey":
+                    cenc.ClearKey = true
+                default:
+                    logger.Message("Unknown DRM system '%s', use widevine, playready or clearkey", system)
+                    return
+            }
+        }
+    } else if drmSystems != "" || cpixOutFilename != "" {
+        logger.Message("DRM systems and CPIX documents need common encryption (-cenc)")
+        return
+    }
+
+    var encryption *mp4.EncryptionConfig
+    if cenc == nil && (key != "" || keyFilename != "") {
+        if _, err := drm.ParseKey(key); key != "" && err != nil {
+            logger.Message("Invalid key '%s' : %v", key, err)
+            return
+        }
+        if encryptionMethod != "AES-128" && encryptionMethod != "SAMPLE-AES" {
+            logger.Message("Unknown encryption method '%s', use AES-128 or SAMPLE-AES", encryptionMethod)
+            return
+        }
+        encryption = new(mp4.EncryptionConfig)
+        encryption.Method = encryptionMethod
+        encryption.Key = key
+        encryption.KeyFile = keyFilename
+        encryption.RotationPeriod = uint32(keyRotation)
+    }
+
+    var preview *mp4.PreviewConfig
+    if previewDuration != 0 {
+        claim := strings.SplitN(entitlement, "=", 2)
+        if len(claim) != 2 || claim[0] == "" || claim[1] == "" {
+            logger.Message("Preview needs the token claim and values of the entitlement (eg: -entitlement ent=subscriber)")
+            return
+        }
+        if playlistItems != nil {
+            logger.Message("Playlist packages have no preview, set it in the packages of their items")
+            return
+        }
+        if byteRanges {
+            logger.Message("Packages with a preview cannot use byte ranges, the segments after the preview are refused")
+            return
+        }
+        preview = new(mp4.PreviewConfig)
+        preview.Duration = uint64(previewDuration) * 1000
+        preview.Claim = claim[0]
+        preview.Entitlements = strings.Split(claim[1], ",")
+    } else if entitlement != "" {
+        logger.Message("Entitlements need a preview (-preview)")
+        return
+    }
+
+    if playlistItems != nil {
+        if encryption != nil {
+            logger.Message("Playlist packages are not encrypted, encrypt the packages of their items")
+            return
+        }
+        if byteRanges {
+            logger.Message("Playlist packages address the segments of their items, they cannot use byte ranges")
+            return
+        }
+        if cenc != nil && liveStartTime == "" {
+            logger.Message("Only live channels are protected, protect the packages of the playlist items")
+            return
+        }
+        var live *mp4.LiveConfig
+        if liveStartTime != "" {
+            startTime, err := time.Parse(time.RFC3339, liveStartTime)
+            if err != nil {
+                logger.Message("Invalid live start time '%s' : %v", liveStartTime, err)
+                return
+            }
+            live = new(mp4.LiveConfig)
+            live.AvailabilityStartTime = startTime
+            live.Loop = liveLoop
+            live.TimeShiftBufferDepth = uint32(timeShiftBufferDepth)
+            live.PartDuration = uint32(partDuration)
+        }
+        createPlaylistPackage(jsonFilename, live, hlsFormat, cenc, cpixOutFilename)
+        return
+    }
+
     var mp4FileSlice []inputFile
     var vttFileSlice []inputFile
     for i, inputFilename := range inputFilenames {
@@ -147,6 +824,12 @@ func main() {
                 } else {
                     in.Language = "eng"
                 }
+                if i < len(inputKeys) {
+                    in.Key = inputKeys[i]
+                }
+                if i < len(watermarkFilenames) {
+                    in.Watermark = watermarkFilenames[i]
+                }
                 mp4FileSlice = append(mp4FileSlice, in)
             case ".vtt":
                 var in inputFile
@@ -163,69 +846,46 @@ func main() {
     }
 
     mp4Files := parseMp4Files(mp4FileSlice)
+    sourceKeys := make(map[string][]byte)
+    watermarks := make(map[string]inputFile)
+    for _, in := range mp4FileSlice {
+        sourceKeys[in.Filename] = in.Key
+        if in.Watermark != "" {
+            watermarks[in.Filename] = inputFile{ Filename: in.Watermark, Language: in.Language, Key: in.Key }
+        }
+    }
+    if len(watermarks) != 0 && byteRanges {
+        logger.Message("Watermarked segments cannot be addressed as byte ranges, their sizes depend on the session")
+        return
+    }
 
     var jConf mp4.JsonConfig
     jConf.Tracks = make(map[string][]mp4.TrackEntry)
     jConf.SegmentDuration = uint32(segmentDuration)
+    jConf.HlsFormat = hlsFormat
+    jConf.Encryption = encryption
+    jConf.Cenc = cenc
+    jConf.HlsByteRanges = byteRanges
+    jConf.Preview = preview
+    if programDateTime != "" {
+        startTime, err := time.Parse(time.RFC3339, programDateTime)
+        if err != nil {
+            logger.Message("Invalid program date time '%s' : %v", programDateTime, err)
+            return
+        }
+        jConf.ProgramDateTime = &startTime
+    }
 
     for _, mp4File := range mp4Files["video"] {
-        mdat := mp4File.Boxes["mdat"][0].(mp4.MdatBox)
-        mdhd := mp4File.Boxes["moov.trak.mdia.mdhd"][0].(mp4.MdhdBox)
-        hdlr := mp4File.Boxes["moov.trak.mdia.hdlr"][0].(mp4.HdlrBox)
-        stts := mp4File.Boxes["moov.trak.mdia.minf.stbl.stts"][0].(mp4.SttsBox)
-        var ctts mp4.CttsBox
-        cttsBoxPresent := false
-        if mp4File.Boxes["moov.trak.mdia.minf.stbl.ctts"] != nil {
-            ctts = mp4File.Boxes["moov.trak.mdia.minf.stbl.ctts"][0].(mp4.CttsBox)
-            cttsBoxPresent = true
+        t := videoTrack(mp4File, segmentDuration)
+        if sourceProtection(mp4File, t.Config, sourceKeys[mp4File.Filename], cenc, encryption) == false {
+            return
         }
-        stsz := mp4File.Boxes["moov.trak.mdia.minf.stbl.stsz"][0].(mp4.StszBox)
-        stss := mp4File.Boxes["moov.trak.mdia.minf.stbl.stss"][0].(mp4.StssBox)
-        avc1 := mp4File.Boxes["moov.trak.mdia.minf.stbl.stsd.avc1"][0].(mp4.Avc1Box)
-        avcC := mp4File.Boxes["moov.trak.mdia.minf.stbl.stsd.avc1.avcC"][0].(mp4.AvcCBox)
-        elst := mp4File.Boxes["moov.trak.edts.elst"][0].(mp4.ElstBox)
-        var t mp4.TrackEntry
-        t.Bandwidth = uint64(float64(mdat.Size) / (float64(mdhd.Duration) / float64(mdhd.Timescale)) * 8)
-        t.File = mp4File.Filename
-        t.Lang = mp4File.Language
-        t.Config = new(mp4.StreamConfig)
-        t.Config.StszBoxOffset = stsz.Offset
-        t.Config.StszBoxSize = stsz.Size
-        t.Config.MdatBoxOffset = mdat.Offset
-        t.Config.MdatBoxSize = mdat.Size
-        t.Config.Type = "video"
-        t.Config.Rate = 0x00010000
-        t.Config.Volume = 0x0100
-        t.Config.Duration = mdhd.Duration
-        t.Config.Timescale = mdhd.Timescale
-        t.Config.Language[0] = byte((0x7c00 & mdhd.Language) >> 10) + 0x60
-        t.Config.Language[1] = byte((0x03e0 & mdhd.Language) >> 5) + 0x60
-        t.Config.Language[2] = byte(0x1f & mdhd.Language) + 0x60
-        t.Config.HandlerType = hdlr.HandlerType
-        t.Config.SampleDelta = stts.Entries[0].SampleDelta
-        t.Config.MediaTime = elst.MediaTime
-        t.Config.Video = new(mp4.StreamVideoEntry)
-        t.Config.Video.Width = avc1.Width
-        t.Config.Video.Height = avc1.Height
-        t.Config.Video.HorizontalResolution = avc1.HorizontalResolution
-        t.Config.Video.VerticalResolution = avc1.VerticalResolution
-        t.Config.Video.EntryDataSize = avc1.EntryDataSize
-        t.Config.Video.FramesPerSample = avc1.FramesPerSample
-        t.Config.Video.BitDepth = avc1.BitDepth
-        t.Config.Video.ColorTableIndex = avc1.ColorTableIndex
-        t.Config.Video.CodecInfo = [3]byte{ avcC.AVCProfileIndication, avcC.ProfileCompatibility, avcC.AVCLevelIndication }
-        t.Config.Video.NalUnitSize = avcC.NalUnitSize & 0x03
-        t.Config.Video.SPSEntryCount = avcC.SPSEntryCount
-        t.Config.Video.SPSSize = avcC.SPSSize
-        t.Config.Video.SPSData = avcC.SPSData
-        t.Config.Video.PPSEntryCount = avcC.PPSEntryCount
-        t.Config.Video.PPSSize = avcC.PPSSize
-        t.Config.Video.PPSData = avcC.PPSData
-        t.Config.Video.StssBoxOffset = stss.Offset
-        t.Config.Video.StssBoxSize = stss.Size
-        if cttsBoxPresent == true {
-            t.Config.Video.CttsBoxOffset = ctts.Offset
-            t.Config.Video.CttsBoxSize = ctts.Size
+        if in, ok := watermarks[mp4File.Filename]; ok {
+            t.Watermark = watermarkTrack(t, in, segmentDuration, cenc, encryption)
+            if t.Watermark == nil {
+                return
+            }
         }
         jConf.Tracks["video"] = append(jConf.Tracks["video"], t)
     }
@@ -236,15 +896,19 @@ func main() {
         hdlr := mp4File.Boxes["moov.trak.mdia.hdlr"][0].(mp4.HdlrBox)
         stts := mp4File.Boxes["moov.trak.mdia.minf.stbl.stts"][0].(mp4.SttsBox)
         stsz := mp4File.Boxes["moov.trak.mdia.minf.stbl.stsz"][0].(mp4.StszBox)
-        mp4a := mp4File.Boxes["moov.trak.mdia.minf.stbl.stsd.mp4a"][0].(mp4.Mp4aBox)
+        entryPath := mp4File.SampleEntryPath()
+        mp4a := mp4File.Boxes[entryPath][0].(mp4.Mp4aBox)
         elst := mp4File.Boxes["moov.trak.edts.elst"][0].(mp4.ElstBox)
         var t mp4.TrackEntry
         t.Bandwidth = uint64(float64(mdat.Size) / (float64(mdhd.Duration) / float64(mdhd.Timescale)) * 8)
+        t.PeakBandwidth = peakBandwidth(stsz, stts.Entries[0].SampleDelta, mdhd.Timescale, segmentDuration)
         t.File = mp4File.Filename
         t.Lang = mp4File.Language
         t.Config = new(mp4.StreamConfig)
         t.Config.StszBoxOffset = stsz.Offset
         t.Config.StszBoxSize = stsz.Size
+        t.Config.SttsBoxOffset = stts.Offset
+        t.Config.SttsBoxSize = stts.Size
         t.Config.MdatBoxOffset = mdat.Offset
         t.Config.MdatBoxSize = mdat.Size
         t.Config.Type = "audio"
@@ -263,6 +927,22 @@ func main() {
         t.Config.Audio.SampleSize = mp4a.SampleSize
         t.Config.Audio.CompressionId = mp4a.CompressionId
         t.Config.Audio.SampleRate = mp4a.SampleRate
+        if mp4File.Boxes[entryPath + ".esds"] != nil {
+            esds := mp4File.Boxes[entryPath + ".esds"][0].(mp4.EsdsBox)
+            dsi := esds.DecoderSpecificInfo()
+            asc, err := mp4.ParseAudioSpecificConfig(dsi)
+            if err == nil {
+                t.Config.Audio.ObjectType = asc.SignalledObjectType()
+                t.Config.Audio.SamplingFrequency = asc.OutputSamplingFrequency()
+                t.Config.Audio.ChannelConfiguration = asc.OutputChannelConfiguration()
+                t.Config.Audio.DecoderSpecificInfo = dsi
+            } else {
+                logger.Message("Cannot decode AudioSpecificConfig of file '%s' : %v", mp4File.Filename, err)
+            }
+        }
+        if sourceProtection(mp4File, t.Config, sourceKeys[mp4File.Filename], cenc, encryption) == false {
+            return
+        }
         jConf.Tracks["audio"] = append(jConf.Tracks["audio"], t)
     }
 
@@ -277,6 +957,20 @@ func main() {
         jConf.Tracks["subtitle"] = append(jConf.Tracks["subtitle"], t)
     }
 
+    if eventsFilename != "" {
+        logger.Message("-- Adding events='%s'", eventsFilename)
+        _, err := mp4.ReadEventStreams(eventsFilename)
+        if err != nil {
+            logger.Message("Cannot read events file '%s' : %v", eventsFilename, err)
+            return
+        }
+        jConf.Events = eventsFilename
+    }
+
+    if cenc != nil && protectPackage(jsonFilename, cenc, packageKeyTypes(jConf.Tracks), packageKeyPeriods(jConf), cpixOutFilename) == false {
+        return
+    }
+
     //jsonStr, err := json.Marshaldent(jConf, "", "  ")
     jsonStr, err := json.Marshal(jConf)
     if err != nil {
@@ -0,0 +1,115 @@
+package auth
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Claims of a token on the user session it is created for (eg: "sid" for the session ID). Their names and values
+// are signed with the asset, they cannot contain commas nor equal signs.
+type Claims map[string]string
+
+func (claims Claims) String() string {
+    names := make([]string, 0, len(claims))
+    for name := range claims {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for i, name := range names {
+        names[i] = name + "=" + claims[name]
+    }
+    return strings.Join(names, ",")
+}
+
+func parseClaims(s string) (claims Claims, err error) {
+    claims = make(Claims)
+    if s == "" {
+        return
+    }
+    for _, claim := range strings.Split(s, ",") {
+        fields := strings.SplitN(claim, "=", 2)
+        if len(fields) != 2 || fields[0] == "" {
+            return nil, errors.New("Invalid token")
+        }
+        claims[fields[0]] = fields[1]
+    }
+    return
+}
+
+// Signature of an asset path and the claims of a token until an expiry time
+func sign(secret string, asset string, claims string, expires int64) []byte {
+    mac := hmac.New(sha256.New, []byte(secret))
+    if claims == "" {
+        mac.Write([]byte(strconv.FormatInt(expires, 10) + ":" + asset))
+    } else {
+        mac.Write([]byte(strconv.FormatInt(expires, 10) + ":" + claims + ":" + asset))
+    }
+    return mac.Sum(nil)
+}
+
+// Create a token granting access to the keys of an asset (eg: "/video/video") until it expires.
+// The token is "<expiry unix time>-<hexadecimal HMAC-SHA256 of "<expiry>:<asset>">".
+func CreateToken(secret string, asset string, expires time.Time) string {
+    return CreateTokenWithClaims(secret, asset, expires, nil)
+}
+
+// Create a token with claims on the user session, the token is "<expiry unix time>-<claims>-<hexadecimal
+// HMAC-SHA256 of "<expiry>:<claims>:<asset>">", the claims being "name=value" pairs sorted by name and
+// separated by commas (eg: "1451606400-sid=4f2a9c-6d0b...")
+func CreateTokenWithClaims(secret string, asset string, expires time.Time, claims Claims) string {
+    token := strconv.FormatInt(expires.Unix(), 10) + "-"
+    if len(claims) != 0 {
+        token += claims.String() + "-"
+    }
+    return token + hex.EncodeToString(sign(secret, asset, claims.String(), expires.Unix()))
+}
+
+// Check a token created by CreateToken or CreateTokenWithClaims
+func CheckToken(secret string, asset string, token string, now time.Time) error {
+    _, err := TokenClaims(secret, asset, token, now)
+    return err
+}
+
+// Check a token and return its claims, empty for a token created by CreateToken
+func TokenClaims(secret string, asset string, token string, now time.Time) (claims Claims, err error) {
+    if secret == "" {
+        return nil, errors.New("No secret to check the token")
+    }
+
+    i, j := strings.Index(token, "-"), strings.LastIndex(token, "-")
+    if i == -1 {
+        return nil, errors.New("Invalid token")
+    }
+    expires, err := strconv.ParseInt(token[:i], 10, 64)
+    if err != nil {
+        return nil, errors.New("Invalid token")
+    }
+    encodedClaims := ""
+    if j > i {
+        encodedClaims = token[i+1:j]
+    }
+    signature, err := hex.DecodeString(token[j+1:])
+    if err != nil || hmac.Equal(signature, sign(secret, asset, encodedClaims, expires)) == false {
+        return nil, errors.New("Invalid token")
+    }
+    if now.Unix() > expires {
+        return nil, errors.New("Token expired")
+    }
+
+    return parseClaims(encodedClaims)
+}
+
+// Bit of the forensic watermark of a segment played by a session: the first bit of the HMAC-SHA256 of
+// "<session ID>:<segment number>". The segments of a capture give the bits of its session, the backend finds
+// the session ID whose bits match.
+func WatermarkBit(secret string, session string, segmentNumber uint32) byte {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(session + ":" + strconv.FormatUint(uint64(segmentNumber), 10)))
+    return mac.Sum(nil)[0] >> 7
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestCreateToken(t *testing.T) {
+    // HMAC-SHA256 of "1900000000:/video/a" with the secret "s3cret"
+    expected := "1900000000-01cad1b197a6e44ea49cc3227669ed511d6b2d70b4a2585be0e4d739c1290ca4"
+    if token := CreateToken("s3cret", "/video/a", time.Unix(1900000000, 0)); token != expected {
+        t.Errorf("token %s, expected %s", token, expected)
+    }
+}
+
+func TestCheckToken(t *testing.T) {
+    now := time.Unix(1800000000, 0)
+    token := CreateToken("s3cret", "/video/a", now.Add(time.Hour))
+
+    if err := CheckToken("s3cret", "/video/a", token, now); err != nil {
+        t.Errorf("valid token refused: %v", err)
+    }
+    if err := CheckToken("s3cret", "/video/a", token, now.Add(time.Hour)); err != nil {
+        t.Errorf("token refused at its expiry time: %v", err)
+    }
+
+    invalid := map[string]string{
+        "expired":         CreateToken("s3cret", "/video/a", now.Add(-time.Second)),
+        "other asset":     CreateToken("s3cret", "/video/b", now.Add(time.Hour)),
+        "other secret":    CreateToken("other", "/video/a", now.Add(time.Hour)),
+        "extended expiry": "1900000000" + token[10:],
+        "truncated":       token[:len(token)-2],
+        "not hexadecimal": token[:len(token)-1] + "g",
+        "no signature":    "1900000000",
+        "no expiry":       token[10:],
+        "empty":           "",
+    }
+    for name, token := range invalid {
+        if err := CheckToken("s3cret", "/video/a", token, now); err == nil {
+            t.Errorf("%s token %q accepted", name, token)
+        }
+    }
+
+    if err := CheckToken("", "/video/a", CreateToken("", "/video/a", now.Add(time.Hour)), now); err == nil {
+        t.Error("token accepted without a secret")
+    }
+}
+
+func TestTokenClaims(t *testing.T) {
+    // HMAC-SHA256 of "1900000000:sid=4f2a9c,user=42:/video/a" with the secret "s3cret"
+    claims := Claims{ "user": "42", "sid": "4f2a9c" }
+    expected := "1900000000-sid=4f2a9c,user=42-2f7e0cf808550eb9ae812f3b28818fb404fe033a37c606feaa98aac4c9bc5459"
+    token := CreateTokenWithClaims("s3cret", "/video/a", time.Unix(1900000000, 0), claims)
+    if token != expected {
+        t.Errorf("token %s, expected %s", token, expected)
+    }
+
+    now := time.Unix(1800000000, 0)
+    parsed, err := TokenClaims("s3cret", "/video/a", token, now)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if parsed.String() != claims.String() {
+        t.Errorf("claims %s, expected %s", parsed, claims)
+    }
+
+    // Claims whose values hold dashes
+    token = CreateTokenWithClaims("s3cret", "/video/a", now.Add(time.Hour), Claims{ "sid": "4f-2a-9c" })
+    if parsed, err := TokenClaims("s3cret", "/video/a", token, now); err != nil || parsed["sid"] != "4f-2a-9c" {
+        t.Errorf("claims %s, %v", parsed, err)
+    }
+
+    // Tokens without claims have empty claims
+    parsed, err = TokenClaims("s3cret", "/video/a", CreateToken("s3cret", "/video/a", now.Add(time.Hour)), now)
+    if err != nil || parsed == nil || len(parsed) != 0 {
+        t.Errorf("claims %s, %v", parsed, err)
+    }
+
+    invalid := map[string]string{
+        "changed claim":  strings.Replace(expected, "sid=4f2a9c", "sid=4f2a9d", 1),
+        "added claim":    strings.Replace(expected, "user=42", "user=42,admin=1", 1),
+        "removed claims": strings.Replace(expected, "sid=4f2a9c,user=42-", "", 1),
+        "invalid claims": CreateTokenWithClaims("s3cret", "/video/a", now.Add(time.Hour), Claims{ "": "42" }),
+    }
+    for name, token := range invalid {
+        if claims, err := TokenClaims("s3cret", "/video/a", token, now); err == nil {
+            t.Errorf("%s token %q accepted with the claims %s", name, token, claims)
+        }
+    }
+}
+
+func TestWatermarkBit(t *testing.T) {
+    // First bits of the HMAC-SHA256 of "4f2a9c:1" to "4f2a9c:8" with the secret "s3cret"
+    expected := []byte{ 0, 0, 0, 0, 0, 1, 1, 0 }
+    for i, bit := range expected {
+        if b := WatermarkBit("s3cret", "4f2a9c", uint32(i + 1)); b != bit {
+            t.Errorf("bit %d of segment %d, expected %d", b, i + 1, bit)
+        }
+    }
+}
@@ -32,14 +32,18 @@
 package dash
 
 import (
+    "bytes"
+    "encoding/base64"
+    "encoding/xml"
     "errors"
     "fmt"
+    "html"
+    "path"
+    "time"
 
+    "drm"
     "mp4"
-)
-
-const (
-    drm_system_id_widevine = "edef8ba979d64acea3c827dcd51d21ed"
+    "util"
 )
 
 func createExternalSubtitlesAdaptationSet(tracks []mp4.TrackEntry, videoId string) (s string, err error) {
@@ -55,7 +59,7 @@ func createExternalSubtitlesAdaptationSet(tracks []mp4.TrackEntry, videoId strin
     return
 }
 
-func createAudioAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDuration uint32) (s string, err error) {
+func createAudioAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDuration uint32, startNumber uint32, presentationTimeOffset uint64, contentProtection string, inbandEvents string, segmentAvailability string) (s string, err error) {
     var minBandwidth uint64
     var maxBandwidth uint64
 
@@ -80,24 +84,30 @@ func createAudioAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDu
     s += fmt.Sprintf(`      minBandwidth="%d"`, minBandwidth) + "\n"
     s += fmt.Sprintf(`      maxBandwidth="%d"`, maxBandwidth) + "\n"
     s += `      segmentAlignment="true"` + "\n"
-    s += fmt.Sprintf(`      audioSamplingRate="%d"`, tracks[0].Config.Timescale) + "\n"
-    s += `      mimeType="audio/mp4"` + "\n"
-    s += `      codecs="mp4a.40.2">` + "\n"
-    s += `      <AudioChannelConfiguration` + "\n"
-    s += `        schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011"` + "\n"
-    s += fmt.Sprintf(`        value="%d">`, tracks[0].Config.Audio.NumberOfChannels) + "\n"
-    s += `      </AudioChannelConfiguration>` + "\n"
+    s += `      mimeType="audio/mp4">` + "\n"
+    s += contentProtection
+    s += inbandEvents
     s += `      <SegmentTemplate` + "\n"
     s += fmt.Sprintf(`        timescale="%d"`, tracks[0].Config.Timescale) + "\n"
     s += fmt.Sprintf(`        initialization="%s_$RepresentationID$.dash"`, videoId) + "\n"
     s += fmt.Sprintf(`        media="%s_$RepresentationID$-$Number$.m4s"`, videoId) + "\n"
-    s += `        startNumber="1"` + "\n"
+    s += fmt.Sprintf(`        startNumber="%d"`, startNumber) + "\n"
+    s += segmentAvailability
+    if presentationTimeOffset != 0 {
+        s += fmt.Sprintf(`        presentationTimeOffset="%d"`, presentationTimeOffset * uint64(tracks[0].Config.Timescale) / 1000) + "\n"
+    }
     s += fmt.Sprintf(`        duration="%d">`, segmentDuration * tracks[0].Config.Timescale) + "\n"
     s += `      </SegmentTemplate>` + "\n"
     for _, t := range tracks {
         s += `      <Representation` + "\n"
         s += fmt.Sprintf(`        id="audio_%s_%d"`, t.Lang, t.Bandwidth) + "\n"
-        s += fmt.Sprintf(`        bandwidth="%d">`, t.Bandwidth) + "\n"
+        s += fmt.Sprintf(`        bandwidth="%d"`, t.Bandwidth) + "\n"
+        s += fmt.Sprintf(`        audioSamplingRate="%d"`, t.Config.AudioSamplingRate()) + "\n"
+        s += fmt.Sprintf(`        codecs="%s">`, t.Config.Audio.Codecs()) + "\n"
+        s += `        <AudioChannelConfiguration` + "\n"
+        s += `          schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011"` + "\n"
+        s += fmt.Sprintf(`          value="%d">`, t.Config.Audio.Channels()) + "\n"
+        s += `        </AudioChannelConfiguration>` + "\n"
         s += `      </Representation>` + "\n"
     }
     s += `    </AdaptationSet>` + "\n"
@@ -105,7 +115,7 @@ func createAudioAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDu
     return
 }
 
-func createVideoAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDuration uint32) (s string, err error) {
+func createVideoAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDuration uint32, startNumber uint32, presentationTimeOffset uint64, contentProtection string, representationProtection []string, inbandEvents string, segmentAvailability string) (s string, err error) {
     var minBandwidth uint64
     var maxBandwidth uint64
     var minWidth uint16
@@ -144,6 +154,7 @@ func createVideoAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDu
         return
     }
     s = `    <AdaptationSet` + "\n"
+    s += fmt.Sprintf(`      id="%d"`, 2) + "\n"
     s += fmt.Sprintf(`      group="%d"`, 2) + "\n"
     s += `      contentType="video"` + "\n"
     s += `      lang="en"` + "\n"
@@ -156,15 +167,21 @@ func createVideoAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDu
     s += `      segmentAlignment="true"` + "\n"
     s += `      mimeType="video/mp4"` + "\n"
     s += `      startWithSAP="1">` + "\n"
+    s += contentProtection
+    s += inbandEvents
     s += `      <SegmentTemplate` + "\n"
     s += fmt.Sprintf(`        timescale="%d"`, tracks[0].Config.Timescale) + "\n"
     s += fmt.Sprintf(`        initialization="%s_$RepresentationID$.dash"`, videoId) + "\n"
     s += fmt.Sprintf(`        media="%s_$RepresentationID$-$Number$.m4s"`, videoId) + "\n"
-    s += `        startNumber="1"` + "\n"
+    s += fmt.Sprintf(`        startNumber="%d"`, startNumber) + "\n"
+    s += segmentAvailability
+    if presentationTimeOffset != 0 {
+        s += fmt.Sprintf(`        presentationTimeOffset="%d"`, presentationTimeOffset * uint64(tracks[0].Config.Timescale) / 1000) + "\n"
+    }
     s += fmt.Sprintf(`        duration="%d">`, segmentDuration * tracks[0].Config.Timescale) + "\n"
     s += `      </SegmentTemplate>` + "\n"
 
-    for _, t := range tracks {
+    for i, t := range tracks {
         s += `      <Representation` + "\n"
         s += fmt.Sprintf(`        id="video_%s_%d"`, t.Lang, t.Bandwidth) + "\n"
         s += fmt.Sprintf(`        bandwidth="%d"`, t.Bandwidth) + "\n"
@@ -172,6 +189,9 @@ func createVideoAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDu
         s += fmt.Sprintf(`        height="%d"`, t.Config.Video.Height) + "\n"
         s += fmt.Sprintf(`        codecs="avc1.%.2X%.2X%.2X"`, t.Config.Video.CodecInfo[0], t.Config.Video.CodecInfo[1], t.Config.Video.CodecInfo[2]) + "\n"
         s += `        scanType="progressive">` + "\n"
+        if representationProtection != nil {
+            s += representationProtection[i]
+        }
         s += `      </Representation>` + "\n"
     }
     s += `    </AdaptationSet>` + "\n"
@@ -179,54 +199,393 @@ func createVideoAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDu
     return
 }
 
-func createContentProtection(jConf mp4.JsonConfig, videoId string) (s string) {
+// Create the trick mode AdaptationSet of the video AdaptationSet, its segments only carry the I-Frames.
+// Tracks packaged without I-Frames information have no trick mode Representation.
+func createTrickModeAdaptationSet(tracks []mp4.TrackEntry, videoId string, segmentDuration uint32, startNumber uint32, presentationTimeOffset uint64, contentProtection string, representationProtection []string) (s string) {
+    var trickTracks []mp4.TrackEntry
+    var trickProtection []string
+    for i, t := range tracks {
+        if t.Config.Video.IFrameCount != 0 && t.Config.SampleDelta != 0 {
+            trickTracks = append(trickTracks, t)
+            if representationProtection != nil {
+                trickProtection = append(trickProtection, representationProtection[i])
+            }
+        }
+    }
+    if trickTracks == nil {
+        return
+    }
+
+    s = `    <AdaptationSet` + "\n"
+    s += fmt.Sprintf(`      id="%d"`, 3) + "\n"
+    s += fmt.Sprintf(`      group="%d"`, 2) + "\n"
+    s += `      contentType="video"` + "\n"
+    s += `      lang="en"` + "\n"
+    s += `      segmentAlignment="true"` + "\n"
+    s += `      mimeType="video/mp4"` + "\n"
+    s += `      startWithSAP="1">` + "\n"
+    s += contentProtection
+    s += `      <EssentialProperty` + "\n"
+    s += `        schemeIdUri="http://dashif.org/guidelines/trickmode"` + "\n"
+    s += fmt.Sprintf(`        value="%d"/>`, 2) + "\n"
+    s += `      <SegmentTemplate` + "\n"
+    s += fmt.Sprintf(`        timescale="%d"`, trickTracks[0].Config.Timescale) + "\n"
+    s += fmt.Sprintf(`        initialization="%s_$RepresentationID$.dash"`, videoId) + "\n"
+    s += fmt.Sprintf(`        media="%s_$RepresentationID$-$Number$.m4s"`, videoId) + "\n"
+    s += fmt.Sprintf(`        startNumber="%d"`, startNumber) + "\n"
+    if presentationTimeOffset != 0 {
+        s += fmt.Sprintf(`        presentationTimeOffset="%d"`, presentationTimeOffset * uint64(trickTracks[0].Config.Timescale) / 1000) + "\n"
+    }
+    s += fmt.Sprintf(`        duration="%d">`, segmentDuration * trickTracks[0].Config.Timescale) + "\n"
+    s += `      </SegmentTemplate>` + "\n"
+
+    for i, t := range trickTracks {
+        // Average number of frames between two I-Frames
+        maxPlayoutRate := t.Config.Duration / uint64(t.Config.SampleDelta) / uint64(t.Config.Video.IFrameCount)
+        if maxPlayoutRate == 0 {
+            maxPlayoutRate = 1
+        }
+        s += `      <Representation` + "\n"
+        s += fmt.Sprintf(`        id="trick_%s_%d"`, t.Lang, t.Bandwidth) + "\n"
+        s += fmt.Sprintf(`        bandwidth="%d"`, t.Config.Video.IFrameBandwidth) + "\n"
+        s += fmt.Sprintf(`        width="%d"`, t.Config.Video.Width) + "\n"
+        s += fmt.Sprintf(`        height="%d"`, t.Config.Video.Height) + "\n"
+        s += fmt.Sprintf(`        codecs="avc1.%.2X%.2X%.2X"`, t.Config.Video.CodecInfo[0], t.Config.Video.CodecInfo[1], t.Config.Video.CodecInfo[2]) + "\n"
+        s += fmt.Sprintf(`        maxPlayoutRate="%d"`, maxPlayoutRate) + "\n"
+        s += `        codingDependency="false"` + "\n"
+        s += `        scanType="progressive">` + "\n"
+        if trickProtection != nil {
+            s += trickProtection[i]
+        }
+        s += `      </Representation>` + "\n"
+    }
+    s += `    </AdaptationSet>` + "\n"
+
+    return
+}
+
+func escapeXml(str string) string {
+    var b bytes.Buffer
+    xml.EscapeText(&b, []byte(str))
+    return b.String()
+}
+
+func createEventStreams(streams []mp4.EventStream, presentationTimeOffset uint64) (s string) {
     s = ""
-    s += `<ContentProtection>`
-    s += `</ContentProtection>`
+    for _, stream := range streams {
+        s += `    <EventStream` + "\n"
+        s += fmt.Sprintf(`      schemeIdUri="%s"`, escapeXml(stream.SchemeIdUri)) + "\n"
+        if stream.Value != "" {
+            s += fmt.Sprintf(`      value="%s"`, escapeXml(stream.Value)) + "\n"
+        }
+        if presentationTimeOffset != 0 {
+            s += fmt.Sprintf(`      presentationTimeOffset="%d"`, presentationTimeOffset * uint64(stream.Timescale) / 1000) + "\n"
+        }
+        s += fmt.Sprintf(`      timescale="%d">`, stream.Timescale) + "\n"
+        for _, e := range stream.Events {
+            s += fmt.Sprintf(`      <Event presentationTime="%d"`, e.PresentationTime)
+            if e.Duration != 0 {
+                s += fmt.Sprintf(` duration="%d"`, e.Duration)
+            }
+            s += fmt.Sprintf(` id="%d">%s</Event>`, e.Id, escapeXml(e.MessageData)) + "\n"
+        }
+        s += `    </EventStream>` + "\n"
+    }
 
     return
 }
 
-func CreateDashManifest(jConf mp4.JsonConfig, videoId string) (dashManifest string) {
-    dashManifest = ""
-    dashManifest += `<?xml version="1.0" encoding="utf-8"?>` + "\n"
-    dashManifest += `<!-- Created with Afrostream Media Server -->` + "\n"
-    dashManifest += `<MPD` + "\n"
-    dashManifest += `xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"` + "\n"
-    dashManifest += `xmlns="urn:mpeg:dash:schema:mpd:2011"` + "\n"
-    dashManifest += `xsi:schemaLocation="urn:mpeg:dash:schema:mpd:2011 http://standards.iso.org/ittf/PubliclyAvailableStandards/MPEG-DASH_schema_files/DASH-MPD.xsd"` + "\n"
-    dashManifest += `type="static"` + "\n"
-    var duration uint64
-    if jConf.Tracks["video"] != nil {
-        duration = uint64(jConf.Tracks["video"][0].Config.Duration) / uint64(jConf.Tracks["video"][0].Config.Timescale)
-    } else {
-        duration = uint64(jConf.Tracks["audio"][0].Config.Duration) / uint64(jConf.Tracks["audio"][0].Config.Timescale)
+func createInbandEventStreams(streams []mp4.EventStream) (s string) {
+    s = ""
+    for _, stream := range streams {
+        if stream.Inband == false {
+            continue
+        }
+        s += fmt.Sprintf(`      <InbandEventStream schemeIdUri="%s" value="%s"/>`, escapeXml(stream.SchemeIdUri), escapeXml(stream.Value)) + "\n"
     }
-    dashManifest += fmt.Sprintf(`mediaPresentationDuration="PT%dH%dM%d.%dS"`, duration / 3600, (duration / 60) % 60, duration % 60, (duration * 1000) % 1000) + "\n"
-    dashManifest += fmt.Sprintf(`maxSegmentDuration="PT%dS"`, jConf.SegmentDuration) + "\n"
-    dashManifest += fmt.Sprintf(`minBufferTime="PT%dS"`, jConf.SegmentDuration + 1) + "\n"
-    dashManifest += `profiles="urn:mpeg:dash:profile:isoff-live:2011">` + "\n"
-    dashManifest += `  <Period>` + "\n"
-    dashManifest += `    <BaseURL>./</BaseURL>` + "\n"
 
-    a, err := createAudioAdaptationSet(jConf.Tracks["audio"], videoId, jConf.SegmentDuration)
+    return
+}
+
+// ContentProtection descriptor of the common encryption of the tracks of a key type, with their default key ID.
+// The descriptor is indented for an AdaptationSet, or for a Representation. When the key rotates, the default key
+// ID is the key ID of the first key period and the fragments carry the pssh boxes of their period.
+func createContentProtection(jConf mp4.JsonConfig, keyType string, indent string) (s string, err error) {
+    protection, err := drm.TrackProtection(jConf.Cenc, keyType, 0)
+    if err != nil || protection == nil {
+        return
+    }
+    systems, err := drm.Systems(jConf.Cenc, drm.ContentKey{ KeyId: protection.KeyId, Key: protection.Key })
     if err != nil {
         return
     }
-    dashManifest += a
-    a, err = createVideoAdaptationSet(jConf.Tracks["video"], videoId, jConf.SegmentDuration)
+    return createContentProtectionDescriptors(protection.Scheme, protection.KeyId, systems, protection.KeyRotation, indent), nil
+}
+
+// ContentProtection descriptor of a track protected upstream, with the default key ID and the DRM systems of its
+// source. Empty for clear tracks.
+func createSourceContentProtection(t mp4.TrackEntry, indent string) (s string) {
+    if t.Config == nil || t.Config.PassthroughEncryption() == false {
+        return
+    }
+    encryption := t.Config.Encryption
+    return createContentProtectionDescriptors(encryption.Scheme, encryption.Tenc.DefaultKID[:], drm.SourceSystems(encryption), false, indent)
+}
+
+func createContentProtectionDescriptors(scheme string, keyId []byte, systems []drm.System, keyRotation bool, indent string) (s string) {
+    s = indent + `<ContentProtection` + "\n"
+    s += indent + `  schemeIdUri="urn:mpeg:dash:mp4protection:2011"` + "\n"
+    s += indent + fmt.Sprintf(`  value="%s"`, scheme) + "\n"
+    s += indent + fmt.Sprintf(`  cenc:default_KID="%s"/>`, drm.FormatKeyId(keyId)) + "\n"
+
+    // A descriptor per DRM system, with its pssh box for the players which do not read the init. Rotating keys are
+    // requested with the pssh boxes of the fragments of each key period instead.
+    for _, system := range systems {
+        s += indent + `<ContentProtection` + "\n"
+        if system.Value != "" {
+            s += indent + fmt.Sprintf(`  schemeIdUri="%s"`, system.SchemeIdUri) + "\n"
+            s += indent + fmt.Sprintf(`  value="%s">`, system.Value) + "\n"
+        } else {
+            s += indent + fmt.Sprintf(`  schemeIdUri="%s">`, system.SchemeIdUri) + "\n"
+        }
+        if keyRotation == false {
+            s += indent + fmt.Sprintf(`  <cenc:pssh>%s</cenc:pssh>`, system.PsshBase64()) + "\n"
+        }
+        if system.Pro != nil && keyRotation == false {
+            s += indent + fmt.Sprintf(`  <mspr:pro>%s</mspr:pro>`, base64.StdEncoding.EncodeToString(system.Pro)) + "\n"
+        }
+        if system.LaUrl != "" {
+            s += indent + fmt.Sprintf(`  <dashif:laurl>%s</dashif:laurl>`, html.EscapeString(system.LaUrl)) + "\n"
+        }
+        s += indent + `</ContentProtection>` + "\n"
+    }
+
+    return
+}
+
+// ContentProtection descriptor of a video track, protected upstream or with the key of its definition
+func createVideoTrackContentProtection(jConf mp4.JsonConfig, t mp4.TrackEntry, indent string) (string, error) {
+    if t.Config != nil && t.Config.PassthroughEncryption() {
+        return createSourceContentProtection(t, indent), nil
+    }
+    return createContentProtection(jConf, drm.TrackKeyType("video", t.Config), indent)
+}
+
+// ContentProtection descriptors of the video tracks: shared by the AdaptationSet when the tracks have the same
+// key, or one per Representation when the definitions or the sources have their own keys (eg: SD and HD)
+func createVideoContentProtection(jConf mp4.JsonConfig, tracks []mp4.TrackEntry) (shared string, representations []string, err error) {
+    keyIds := make(map[string]bool)
+    for _, t := range tracks {
+        if t.Config != nil && t.Config.PassthroughEncryption() {
+            keyIds[string(t.Config.Encryption.Tenc.DefaultKID[:])] = true
+            continue
+        }
+        var protection *mp4.Protection
+        protection, err = drm.TrackProtection(jConf.Cenc, drm.TrackKeyType("video", t.Config), 0)
+        if err != nil || protection == nil {
+            return
+        }
+        keyIds[string(protection.KeyId)] = true
+    }
+    if len(keyIds) <= 1 {
+        if len(tracks) != 0 {
+            shared, err = createVideoTrackContentProtection(jConf, tracks[0], "      ")
+        }
+        return
+    }
+
+    for _, t := range tracks {
+        var p string
+        p, err = createVideoTrackContentProtection(jConf, t, "        ")
+        if err != nil {
+            return
+        }
+        representations = append(representations, p)
+    }
+    return
+}
+
+// SegmentTemplate attributes of a low latency live channel: segments are requested as soon as their first chunk
+// is available, and transferred chunk by chunk
+func createSegmentAvailability(jConf mp4.JsonConfig) (s string) {
+    if jConf.Live == nil || jConf.Live.PartDuration == 0 {
+        return
+    }
+    s += fmt.Sprintf(`        availabilityTimeOffset="%.3f"`, float64(jConf.SegmentDuration * 1000 - jConf.Live.PartDuration) / 1000) + "\n"
+    s += `        availabilityTimeComplete="false"` + "\n"
+
+    return
+}
+
+func formatDuration(duration uint64) string {
+    return fmt.Sprintf("PT%dH%dM%d.%03dS", duration / 3600000, (duration / 60000) % 60, (duration / 1000) % 60, duration % 1000)
+}
+
+// Create the Period content of a package, presentationTimeOffset is in milliseconds
+func createPeriodContent(jConf mp4.JsonConfig, videoId string, startNumber uint32, presentationTimeOffset uint64) (s string, err error) {
+    s = createEventStreams(jConf.EventStreams, presentationTimeOffset)
+
+    // Inband events are carried by the video fragments, or by the audio ones for audio only content
+    audioInbandEvents := ""
+    videoInbandEvents := createInbandEventStreams(jConf.EventStreams)
+    if jConf.Tracks["video"] == nil {
+        audioInbandEvents = videoInbandEvents
+    }
+
+    audioProtection, err := createContentProtection(jConf, "audio", "      ")
+    if err != nil {
+        return
+    }
+    if tracks := jConf.Tracks["audio"]; len(tracks) != 0 && tracks[0].Config != nil && tracks[0].Config.PassthroughEncryption() {
+        audioProtection = createSourceContentProtection(tracks[0], "      ")
+    }
+    videoProtection, representationProtection, err := createVideoContentProtection(jConf, jConf.Tracks["video"])
+    if err != nil {
+        return
+    }
+
+    a, err := createAudioAdaptationSet(jConf.Tracks["audio"], videoId, jConf.SegmentDuration, startNumber, presentationTimeOffset, audioProtection, audioInbandEvents, createSegmentAvailability(jConf))
+    if err != nil {
+        return
+    }
+    s += a
+    a, err = createVideoAdaptationSet(jConf.Tracks["video"], videoId, jConf.SegmentDuration, startNumber, presentationTimeOffset, videoProtection, representationProtection, videoInbandEvents, createSegmentAvailability(jConf))
     if err != nil {
         return
     }
-    dashManifest += a
+    s += a
+    s += createTrickModeAdaptationSet(jConf.Tracks["video"], videoId, jConf.SegmentDuration, startNumber, presentationTimeOffset, videoProtection, representationProtection)
     a, err = createExternalSubtitlesAdaptationSet(jConf.Tracks["subtitle"], videoId)
     if err != nil {
         return
     }
-    dashManifest += a
-    dashManifest += `  </Period>` + "\n"
-    dashManifest += `</MPD>` + "\n"
+    s += a
 
     return
 }
 
+// Create one Period per playlist item, each Period addresses the segments of its own package
+func createPlaylistPeriods(jConf mp4.JsonConfig) (s string, duration uint64, maxSegmentDuration uint32, err error) {
+    for i, item := range jConf.Playlist {
+        in, out := util.PlaylistItemRange(item)
+        startNumber := uint32(in / (uint64(item.Config.SegmentDuration) * 1000)) + 1
+        dir, filename := path.Split(item.Package)
+        videoId, _ := util.SplitFilename(filename)
+
+        s += fmt.Sprintf(`  <Period id="%d" start="%s" duration="%s">`, i + 1, formatDuration(duration), formatDuration(out - in)) + "\n"
+        s += fmt.Sprintf(`    <BaseURL>%s</BaseURL>`, path.Join("/video", dir) + "/") + "\n"
+        var p string
+        p, err = createPeriodContent(*item.Config, videoId, startNumber, in)
+        if err != nil {
+            return
+        }
+        s += p
+        s += `  </Period>` + "\n"
+
+        duration += out - in
+        if item.Config.SegmentDuration > maxSegmentDuration {
+            maxSegmentDuration = item.Config.SegmentDuration
+        }
+    }
+
+    return
+}
+
+// Create the single Period of a live channel. Segments are addressed on the channel and numbered from its
+// availability start time, the tracks of the first playlist item describe every item, which must have their
+// timescale and codec configuration.
+func createLivePeriod(jConf mp4.JsonConfig, videoId string) (s string, err error) {
+    reference := *jConf.Playlist[0].Config
+    reference.SegmentDuration = jConf.SegmentDuration
+    reference.EventStreams = nil
+    reference.Live = jConf.Live
+    reference.Cenc = jConf.Cenc
+    reference.Tracks = map[string][]mp4.TrackEntry{ "audio": reference.Tracks["audio"], "video": reference.Tracks["video"] }
+
+    p, err := createPeriodContent(reference, videoId, 1, 0)
+    if err != nil {
+        return
+    }
+    s = `  <Period id="1" start="PT0S">` + "\n"
+    s += `    <BaseURL>./</BaseURL>` + "\n"
+    s += p
+    s += `  </Period>` + "\n"
+
+    return
+}
+
+// Attributes of a dynamic MPD, its segments become available on the wall clock from the availability start time
+func createLiveAttributes(jConf mp4.JsonConfig, now time.Time) (s string) {
+    s += `type="dynamic"` + "\n"
+    s += fmt.Sprintf(`availabilityStartTime="%s"`, jConf.Live.AvailabilityStartTime.UTC().Format(time.RFC3339)) + "\n"
+    s += fmt.Sprintf(`publishTime="%s"`, now.UTC().Format(time.RFC3339)) + "\n"
+    s += fmt.Sprintf(`minimumUpdatePeriod="PT%dS"`, jConf.Live.MinimumUpdatePeriod) + "\n"
+    s += fmt.Sprintf(`timeShiftBufferDepth="PT%dS"`, jConf.Live.TimeShiftBufferDepth) + "\n"
+    if n := util.LiveSegments(jConf); n != 0 {
+        s += fmt.Sprintf(`mediaPresentationDuration="%s"`, formatDuration(uint64(n) * uint64(jConf.SegmentDuration) * 1000)) + "\n"
+    }
+
+    return
+}
+
+func CreateDashManifest(jConf mp4.JsonConfig, videoId string) (dashManifest string) {
+    var periods string
+    var attributes string
+    var utcTiming string
+    var duration uint64
+    var err error
+    segmentDuration := jConf.SegmentDuration
+    if jConf.Live != nil {
+        now := time.Now()
+        periods, err = createLivePeriod(jConf, videoId)
+        if err != nil {
+            return
+        }
+        attributes = createLiveAttributes(jConf, now)
+        utcTiming = fmt.Sprintf(`  <UTCTiming schemeIdUri="urn:mpeg:dash:utc:direct:2014" value="%s"/>`, now.UTC().Format("2006-01-02T15:04:05.000Z")) + "\n"
+    } else if len(jConf.Playlist) != 0 {
+        periods, duration, segmentDuration, err = createPlaylistPeriods(jConf)
+        if err != nil {
+            return
+        }
+    } else {
+        var p string
+        p, err = createPeriodContent(jConf, videoId, 1, 0)
+        if err != nil {
+            return
+        }
+        periods = `  <Period>` + "\n"
+        periods += `    <BaseURL>./</BaseURL>` + "\n"
+        periods += p
+        periods += `  </Period>` + "\n"
+        duration = util.PackageDuration(jConf)
+        // The last segment of a preview is cut at the end of the preview
+        if jConf.Preview != nil && jConf.Preview.Duration < duration {
+            duration = jConf.Preview.Duration
+        }
+    }
+    if jConf.Live == nil {
+        attributes = `type="static"` + "\n"
+        attributes += fmt.Sprintf(`mediaPresentationDuration="%s"`, formatDuration(duration)) + "\n"
+    }
+
+    dashManifest = ""
+    dashManifest += `<?xml version="1.0" encoding="utf-8"?>` + "\n"
+    dashManifest += `<!-- Created with Afrostream Media Server -->` + "\n"
+    dashManifest += `<MPD` + "\n"
+    dashManifest += `xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"` + "\n"
+    dashManifest += `xmlns="urn:mpeg:dash:schema:mpd:2011"` + "\n"
+    dashManifest += `xmlns:cenc="urn:mpeg:cenc:2013"` + "\n"
+    dashManifest += `xmlns:mspr="urn:microsoft:playready"` + "\n"
+    dashManifest += `xmlns:dashif="https://dashif.org/"` + "\n"
+    dashManifest += `xsi:schemaLocation="urn:mpeg:dash:schema:mpd:2011 http://standards.iso.org/ittf/PubliclyAvailableStandards/MPEG-DASH_schema_files/DASH-MPD.xsd"` + "\n"
+    dashManifest += attributes
+    dashManifest += fmt.Sprintf(`maxSegmentDuration="PT%dS"`, segmentDuration) + "\n"
+    dashManifest += fmt.Sprintf(`minBufferTime="PT%dS"`, segmentDuration + 1) + "\n"
+    dashManifest += `profiles="urn:mpeg:dash:profile:isoff-live:2011">` + "\n"
+    dashManifest += periods
+    dashManifest += utcTiming
+    dashManifest += `</MPD>` + "\n"
+
+    return
+}
@@ -0,0 +1,41 @@
+package dash
+
+import (
+    "strings"
+    "testing"
+
+    "mp4"
+)
+
+func testVideoTrack(bandwidth uint64, iFrameCount uint32) mp4.TrackEntry {
+    video := &mp4.StreamVideoEntry{Width: 1280, Height: 720, CodecInfo: [3]byte{0x64, 0x00, 0x1F}, IFrameCount: iFrameCount, IFrameBandwidth: bandwidth / 10}
+    return mp4.TrackEntry{Bandwidth: bandwidth, Lang: "eng", File: "video.mp4", Config: &mp4.StreamConfig{Type: "video", Timescale: 25000, SampleDelta: 1000, Duration: 25000 * 120, Video: video}}
+}
+
+func TestTrickModeAdaptationSet(t *testing.T) {
+    tracks := []mp4.TrackEntry{testVideoTrack(3000000, 60), testVideoTrack(1500000, 0)}
+    s := createTrickModeAdaptationSet(tracks, "v", 4, 1, 0, "", nil)
+
+    for _, expected := range []string{
+        `<EssentialProperty` + "\n" + `        schemeIdUri="http://dashif.org/guidelines/trickmode"` + "\n" + `        value="2"/>`,
+        `initialization="v_$RepresentationID$.dash"`,
+        `duration="100000">`,
+        `id="trick_eng_3000000"`,
+        `bandwidth="300000"`,
+        `codecs="avc1.64001F"`,
+        `maxPlayoutRate="50"`,
+        `codingDependency="false"`,
+    } {
+        if !strings.Contains(s, expected) {
+            t.Errorf("%s\nexpected to contain %s", s, expected)
+        }
+    }
+    // The track packaged without I-Frames information has no trick mode Representation
+    if strings.Count(s, "<Representation") != 1 {
+        t.Errorf("%s\nexpected a single Representation", s)
+    }
+
+    if s := createTrickModeAdaptationSet([]mp4.TrackEntry{testVideoTrack(1500000, 0)}, "v", 4, 1, 0, "", nil); s != "" {
+        t.Errorf("trick mode AdaptationSet %s without I-Frames information", s)
+    }
+}
@@ -0,0 +1,56 @@
+package drm
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "strings"
+)
+
+// W3C ClearKey license request of a player (https://www.w3.org/TR/encrypted-media/#clear-key-request-format)
+type clearKeyRequest struct {
+    Kids []string `json:"kids"` // Key IDs in base64url
+    Type string   `json:"type"`
+}
+
+// JSON Web Key of a content key
+type clearKeyJwk struct {
+    Kty string `json:"kty"` // Always "oct"
+    Kid string `json:"kid"` // Key ID in base64url
+    K   string `json:"k"`   // Content key in base64url
+}
+
+// W3C ClearKey license, the JSON Web Key Set of the requested keys
+type clearKeyLicense struct {
+    Keys []clearKeyJwk `json:"keys"`
+    Type string        `json:"type,omitempty"`
+}
+
+// License answering a ClearKey license request with the keys of a package, the key IDs which are not keys of the
+// package are ignored
+func ClearKeyLicense(provider KeyProvider, request []byte) (license []byte, err error) {
+    var req clearKeyRequest
+    err = json.Unmarshal(request, &req)
+    if err != nil {
+        return nil, errors.New("Invalid ClearKey license request: " + err.Error())
+    }
+
+    res := clearKeyLicense{ Keys: []clearKeyJwk{}, Type: req.Type }
+    for _, kid := range req.Kids {
+        // Some players pad the key IDs
+        keyId, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(kid, "="))
+        if err != nil {
+            continue
+        }
+        key, ok := provider.KeyById(keyId)
+        if ok == false {
+            continue
+        }
+        res.Keys = append(res.Keys, clearKeyJwk{
+            Kty: "oct",
+            Kid: base64.RawURLEncoding.EncodeToString(key.KeyId),
+            K: base64.RawURLEncoding.EncodeToString(key.Key),
+        })
+    }
+    return json.Marshal(res)
+}
@@ -0,0 +1,34 @@
+package drm
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+func TestClearKeyLicense(t *testing.T) {
+    provider := packageKeyProvider{ key: ContentKey{ KeyId: testKeyId, Key: testKey } }
+
+    // Key ID of the package, padded, unknown and invalid key IDs
+    request := `{ "kids": [ "EAAAABAAEAAQABAAAAAAAQ==", "EAAAABAAEAAQABAAAAAAAg", "!" ], "type": "temporary" }`
+    license, err := ClearKeyLicense(provider, []byte(request))
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := `{"keys":[{"kty":"oct","kid":"EAAAABAAEAAQABAAAAAAAQ","k":"AAECAwQFBgcICQoLDA0ODw"}],"type":"temporary"}`
+    if string(license) != expected {
+        t.Errorf("license %s, expected %s", license, expected)
+    }
+
+    license, err = ClearKeyLicense(provider, []byte(`{ "kids": [ "EAAAABAAEAAQABAAAAAAAg" ] }`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var res clearKeyLicense
+    if err := json.Unmarshal(license, &res); err != nil || res.Keys == nil || len(res.Keys) != 0 {
+        t.Errorf("license %s, expected an empty key set", license)
+    }
+
+    if _, err := ClearKeyLicense(provider, []byte(`{ "kids": "EAAAABAAEAAQABAAAAAAAQ" }`)); err == nil {
+        t.Error("invalid license request accepted")
+    }
+}
@@ -0,0 +1,312 @@
+package drm
+
+import (
+    "encoding/base64"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "html"
+    "strings"
+
+    "mp4"
+)
+
+// DASH-IF Content Protection Information Exchange document (CPIX 2.3), only its clear content keys are read.
+// Elements are matched by their local names whatever their namespace prefix.
+type cpixDocument struct {
+    ContentId   string             `xml:"contentId,attr"`
+    ContentKeys []cpixContentKey   `xml:"ContentKeyList>ContentKey"`
+    DrmSystems  []cpixDrmSystem    `xml:"DRMSystemList>DRMSystem"`
+    Periods     []cpixKeyPeriod    `xml:"ContentKeyPeriodList>ContentKeyPeriod"`
+    UsageRules  []cpixKeyUsageRule `xml:"ContentKeyUsageRuleList>ContentKeyUsageRule"`
+}
+
+type cpixContentKey struct {
+    Kid            string `xml:"kid,attr"`
+    Scheme         string `xml:"commonEncryptionScheme,attr"`
+    PlainValue     string `xml:"Data>Secret>PlainValue"`
+    EncryptedValue string `xml:"Data>Secret>EncryptedValue>CipherData>CipherValue"`
+}
+
+type cpixDrmSystem struct {
+    Kid      string `xml:"kid,attr"`
+    SystemId string `xml:"systemId,attr"`
+    Pssh     string `xml:"PSSH"`
+}
+
+type cpixKeyPeriod struct {
+    Id    string `xml:"id,attr"`
+    Index uint32 `xml:"index,attr"`
+}
+
+type cpixKeyUsageRule struct {
+    Kid               string `xml:"kid,attr"`
+    IntendedTrackType string `xml:"intendedTrackType,attr"`
+    KeyPeriodFilters  []struct {
+        PeriodId string `xml:"periodId,attr"`
+    } `xml:"KeyPeriodFilter"`
+    AudioFilter *struct{} `xml:"AudioFilter"`
+    VideoFilter *struct {
+        MinPixels uint32 `xml:"minPixels,attr"`
+        MaxPixels uint32 `xml:"maxPixels,attr"`
+    } `xml:"VideoFilter"`
+}
+
+// Pixels of the largest SD and HD pictures in the video filters of the CPIX usage rules
+const (
+    cpixMaxSdPixels = 768 * 576
+    cpixMaxHdPixels = 1920 * 1080
+)
+
+// Import a CPIX document: the keys of its usage rules, and the pssh boxes of its DRM systems which are set in
+// the common encryption of the package. The content ID of the document is returned.
+func ImportCpix(data []byte, conf *mp4.CencConfig) (contentId string, keys []ContentKey, err error) {
+    var doc cpixDocument
+    err = xml.Unmarshal(data, &doc)
+    if err != nil {
+        return "", nil, errors.New("Invalid CPIX document: " + err.Error())
+    }
+
+    contentKeys := make(map[string]ContentKey)
+    for _, k := range doc.ContentKeys {
+        if k.EncryptedValue != "" {
+            return "", nil, errors.New("Encrypted content keys of CPIX documents are not supported, key ID " + k.Kid)
+        }
+        var key ContentKey
+        key.KeyId, err = ParseKeyId(k.Kid)
+        if err != nil {
+            return
+        }
+        key.Key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(k.PlainValue))
+        if err != nil || len(key.Key) != KeySize {
+            return "", nil, errors.New("Invalid content key of key ID " + k.Kid)
+        }
+        contentKeys[FormatKeyId(key.KeyId)] = key
+        if conf.Scheme == "" {
+            conf.Scheme = k.Scheme
+        }
+    }
+    if conf.Scheme == "" {
+        conf.Scheme = "cenc"
+    }
+
+    periods := make(map[string]uint32)
+    for _, period := range doc.Periods {
+        periods[period.Id] = period.Index
+    }
+
+    if doc.UsageRules == nil {
+        // A single key encrypts all the tracks
+        if len(contentKeys) != 1 {
+            return "", nil, errors.New("CPIX document without usage rules must have a single content key")
+        }
+        for _, key := range contentKeys {
+            keys = append(keys, key)
+        }
+    }
+    for _, rule := range doc.UsageRules {
+        key, err := cpixRuleKey(rule, contentKeys)
+        if err != nil {
+            return "", nil, err
+        }
+        if rule.KeyPeriodFilters == nil {
+            keys = append(keys, key)
+        }
+        for _, filter := range rule.KeyPeriodFilters {
+            index, ok := periods[filter.PeriodId]
+            if ok == false {
+                return "", nil, errors.New("Unknown CPIX key period " + filter.PeriodId)
+            }
+            key.Period = index
+            keys = append(keys, key)
+        }
+    }
+
+    for _, system := range doc.DrmSystems {
+        err = importCpixDrmSystem(system, conf)
+        if err != nil {
+            return
+        }
+    }
+
+    return doc.ContentId, keys, nil
+}
+
+// Key of a usage rule, with the key type of the tracks of the rule
+func cpixRuleKey(rule cpixKeyUsageRule, contentKeys map[string]ContentKey) (key ContentKey, err error) {
+    keyId, err := ParseKeyId(rule.Kid)
+    if err != nil {
+        return
+    }
+    key, ok := contentKeys[FormatKeyId(keyId)]
+    if ok == false {
+        return key, errors.New("Unknown CPIX content key " + rule.Kid)
+    }
+
+    switch strings.ToUpper(rule.IntendedTrackType) {
+        case "ALL":
+            key.KeyType = ""
+        case "AUDIO":
+            key.KeyType = "audio"
+        case "VIDEO":
+            key.KeyType = "video"
+        case "SD":
+            key.KeyType = "sd"
+        case "HD":
+            key.KeyType = "hd"
+        case "UHD", "UHD1", "UHD2":
+            key.KeyType = "uhd"
+        case "":
+            switch {
+                case rule.AudioFilter != nil:
+                    key.KeyType = "audio"
+                case rule.VideoFilter == nil:
+                    key.KeyType = ""
+                case rule.VideoFilter.MaxPixels != 0 && rule.VideoFilter.MaxPixels <= cpixMaxSdPixels:
+                    key.KeyType = "sd"
+                case rule.VideoFilter.MinPixels > cpixMaxHdPixels:
+                    key.KeyType = "uhd"
+                case rule.VideoFilter.MaxPixels != 0 && rule.VideoFilter.MaxPixels <= cpixMaxHdPixels:
+                    key.KeyType = "hd"
+                default:
+                    key.KeyType = "video"
+            }
+        default:
+            err = errors.New("Unsupported CPIX intended track type " + rule.IntendedTrackType)
+    }
+    return
+}
+
+func importCpixDrmSystem(system cpixDrmSystem, conf *mp4.CencConfig) (err error) {
+    keyId, err := ParseKeyId(system.Kid)
+    if err != nil {
+        return
+    }
+    pssh := strings.TrimSpace(system.Pssh)
+    if pssh != "" {
+        data, err := base64.StdEncoding.DecodeString(pssh)
+        if err == nil {
+            _, err = mp4.ParsePsshBox(data)
+        }
+        if err != nil {
+            return errors.New("Invalid CPIX pssh box of key ID " + system.Kid)
+        }
+    }
+
+    switch strings.ToLower(strings.Replace(system.SystemId, "-", "", -1)) {
+        case SystemIdWidevine:
+            if conf.Widevine == nil {
+                conf.Widevine = &mp4.WidevineConfig{}
+            }
+            if pssh != "" {
+                if conf.Widevine.Pssh == nil {
+                    conf.Widevine.Pssh = make(map[string]string)
+                }
+                conf.Widevine.Pssh[FormatKeyId(keyId)] = pssh
+            }
+        case SystemIdPlayReady:
+            if conf.PlayReady == nil {
+                conf.PlayReady = &mp4.PlayReadyConfig{}
+            }
+            if pssh != "" {
+                if conf.PlayReady.Pssh == nil {
+                    conf.PlayReady.Pssh = make(map[string]string)
+                }
+                conf.PlayReady.Pssh[FormatKeyId(keyId)] = pssh
+            }
+        case SystemIdClearKey, clearKeySystemIdDashIf:
+            conf.ClearKey = true
+    }
+    return
+}
+
+// Export the keys of a package and the pssh boxes of its DRM systems in a CPIX document, the content keys are
+// written in clear
+func ExportCpix(contentId string, conf *mp4.CencConfig, keys []ContentKey) (data []byte, err error) {
+    s := `<?xml version="1.0" encoding="UTF-8"?>` + "\n"
+    s += `<!-- Created with Afrostream Media Server -->` + "\n"
+    s += fmt.Sprintf(`<cpix:CPIX contentId="%s" version="2.3" xmlns:cpix="urn:dashif:org:cpix" xmlns:pskc="urn:ietf:params:xml:ns:keyprov:pskc">`, html.EscapeString(contentId)) + "\n"
+
+    // Each key once, the same key may encrypt several periods or types of tracks
+    s += `  <cpix:ContentKeyList>` + "\n"
+    exported := make(map[string]bool)
+    for _, key := range keys {
+        kid := FormatKeyId(key.KeyId)
+        if exported[kid] {
+            continue
+        }
+        exported[kid] = true
+        s += fmt.Sprintf(`    <cpix:ContentKey kid="%s" commonEncryptionScheme="%s">`, kid, conf.Scheme) + "\n"
+        s += fmt.Sprintf(`      <cpix:Data><pskc:Secret><pskc:PlainValue>%s</pskc:PlainValue></pskc:Secret></cpix:Data>`, base64.StdEncoding.EncodeToString(key.Key)) + "\n"
+        s += `    </cpix:ContentKey>` + "\n"
+    }
+    s += `  </cpix:ContentKeyList>` + "\n"
+
+    s += `  <cpix:DRMSystemList>` + "\n"
+    exported = make(map[string]bool)
+    for _, key := range keys {
+        kid := FormatKeyId(key.KeyId)
+        if exported[kid] {
+            continue
+        }
+        exported[kid] = true
+        systems, err := Systems(conf, key)
+        if err != nil {
+            return nil, err
+        }
+        for _, system := range systems {
+            s += fmt.Sprintf(`    <cpix:DRMSystem kid="%s" systemId="%s">`, kid, FormatKeyId(system.Pssh.SystemId[:])) + "\n"
+            s += fmt.Sprintf(`      <cpix:PSSH>%s</cpix:PSSH>`, system.PsshBase64()) + "\n"
+            s += `    </cpix:DRMSystem>` + "\n"
+        }
+    }
+    s += `  </cpix:DRMSystemList>` + "\n"
+
+    // Key periods are only listed for rotated keys
+    var lastPeriod uint32
+    for _, key := range keys {
+        if key.Period > lastPeriod {
+            lastPeriod = key.Period
+        }
+    }
+    if lastPeriod != 0 {
+        s += `  <cpix:ContentKeyPeriodList>` + "\n"
+        for period := uint32(0); period <= lastPeriod; period++ {
+            s += fmt.Sprintf(`    <cpix:ContentKeyPeriod id="keyPeriod_%d" index="%d"/>`, period, period) + "\n"
+        }
+        s += `  </cpix:ContentKeyPeriodList>` + "\n"
+    }
+
+    s += `  <cpix:ContentKeyUsageRuleList>` + "\n"
+    for _, key := range keys {
+        s += fmt.Sprintf(`    <cpix:ContentKeyUsageRule kid="%s" intendedTrackType="%s">`, FormatKeyId(key.KeyId), cpixTrackType(key.KeyType)) + "\n"
+        if lastPeriod != 0 {
+            s += fmt.Sprintf(`      <cpix:KeyPeriodFilter periodId="keyPeriod_%d"/>`, key.Period) + "\n"
+        }
+        switch key.KeyType {
+            case "audio":
+                s += `      <cpix:AudioFilter/>` + "\n"
+            case "video":
+                s += `      <cpix:VideoFilter/>` + "\n"
+            case "sd":
+                s += fmt.Sprintf(`      <cpix:VideoFilter maxPixels="%d"/>`, cpixMaxSdPixels) + "\n"
+            case "hd":
+                s += fmt.Sprintf(`      <cpix:VideoFilter minPixels="%d" maxPixels="%d"/>`, cpixMaxSdPixels + 1, cpixMaxHdPixels) + "\n"
+            case "uhd":
+                s += fmt.Sprintf(`      <cpix:VideoFilter minPixels="%d"/>`, cpixMaxHdPixels + 1) + "\n"
+        }
+        s += `    </cpix:ContentKeyUsageRule>` + "\n"
+    }
+    s += `  </cpix:ContentKeyUsageRuleList>` + "\n"
+    s += `</cpix:CPIX>` + "\n"
+
+    return []byte(s), nil
+}
+
+// Intended track type of the CPIX usage rule of a key type
+func cpixTrackType(keyType string) string {
+    if keyType == "" {
+        return "ALL"
+    }
+    return strings.ToUpper(keyType)
+}
@@ -0,0 +1,158 @@
+package drm
+
+import (
+    "bytes"
+    "encoding/hex"
+    "reflect"
+    "strings"
+    "testing"
+
+    "mp4"
+)
+
+func testContentKey(keyType string, period uint32, kid string) ContentKey {
+    keyId, _ := hex.DecodeString(kid)
+    key := make([]byte, KeySize)
+    copy(key, keyId)
+    key[15] ^= 0xff
+    return ContentKey{ KeyId: keyId, Key: key, KeyType: keyType, Period: period }
+}
+
+func TestCpixRoundTrip(t *testing.T) {
+    keys := []ContentKey{
+        testContentKey("audio", 0, "10000000100010001000100000000001"),
+        testContentKey("sd", 0, "10000000100010001000100000000002"),
+        testContentKey("hd", 0, "10000000100010001000100000000003"),
+        testContentKey("uhd", 0, "10000000100010001000100000000004"),
+        testContentKey("audio", 1, "10000000100010001000100000000005"),
+        testContentKey("sd", 1, "10000000100010001000100000000002"), // The same key in two periods
+    }
+    conf := &mp4.CencConfig{ Scheme: "cbcs", Widevine: &mp4.WidevineConfig{}, PlayReady: &mp4.PlayReadyConfig{}, ClearKey: true }
+    data, err := ExportCpix(`movie "1"`, conf, keys)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    imported := &mp4.CencConfig{}
+    contentId, importedKeys, err := ImportCpix(data, imported)
+    if err != nil {
+        t.Fatalf("%v\n%s", err, data)
+    }
+    if contentId != `movie "1"` {
+        t.Errorf("content ID %q", contentId)
+    }
+    if !reflect.DeepEqual(importedKeys, keys) {
+        t.Errorf("keys %+v, expected %+v", importedKeys, keys)
+    }
+    if imported.Scheme != "cbcs" || !imported.ClearKey || imported.Widevine == nil || imported.PlayReady == nil {
+        t.Fatalf("common encryption %+v", imported)
+    }
+    // Each key has its pssh boxes once, given to the packaging as the pssh boxes of the vendor
+    if len(imported.Widevine.Pssh) != 5 || len(imported.PlayReady.Pssh) != 5 {
+        t.Errorf("%d Widevine and %d PlayReady pssh boxes, expected 5", len(imported.Widevine.Pssh), len(imported.PlayReady.Pssh))
+    }
+    systems, err := Systems(imported, keys[2])
+    if err != nil {
+        t.Fatal(err)
+    }
+    exported, _ := Systems(conf, keys[2])
+    if len(systems) != 3 || !bytes.Equal(systems[1].Pssh.Bytes(), exported[1].Pssh.Bytes()) {
+        t.Error("the PlayReady pssh box of the document is not the one exported")
+    }
+}
+
+const testCpixKeys = `<cpix:ContentKeyList>
+    <cpix:ContentKey kid="10000000-1000-1000-1000-100000000001" commonEncryptionScheme="cenc">
+      <cpix:Data><pskc:Secret><pskc:PlainValue>AAECAwQFBgcICQoLDA0ODw==</pskc:PlainValue></pskc:Secret></cpix:Data>
+    </cpix:ContentKey>
+    <cpix:ContentKey kid="10000000-1000-1000-1000-100000000002">
+      <cpix:Data><pskc:Secret><pskc:PlainValue>
+        EBESExQVFhcYGRobHB0eHw==
+      </pskc:PlainValue></pskc:Secret></cpix:Data>
+    </cpix:ContentKey>
+  </cpix:ContentKeyList>`
+
+func testCpix(body string) []byte {
+    return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<cpix:CPIX contentId="movie" xmlns:cpix="urn:dashif:org:cpix" xmlns:pskc="urn:ietf:params:xml:ns:keyprov:pskc">
+  ` + body + `
+</cpix:CPIX>`)
+}
+
+func TestImportCpixFilters(t *testing.T) {
+    rules := `<cpix:ContentKeyUsageRuleList>
+    <cpix:ContentKeyUsageRule kid="10000000-1000-1000-1000-100000000001"><cpix:AudioFilter/></cpix:ContentKeyUsageRule>
+    <cpix:ContentKeyUsageRule kid="10000000-1000-1000-1000-100000000002"><cpix:VideoFilter maxPixels="442368"/></cpix:ContentKeyUsageRule>
+    <cpix:ContentKeyUsageRule kid="10000000-1000-1000-1000-100000000002"><cpix:VideoFilter minPixels="442369" maxPixels="2073600"/></cpix:ContentKeyUsageRule>
+    <cpix:ContentKeyUsageRule kid="10000000-1000-1000-1000-100000000002"><cpix:VideoFilter minPixels="2073601"/></cpix:ContentKeyUsageRule>
+    <cpix:ContentKeyUsageRule kid="10000000-1000-1000-1000-100000000002"><cpix:VideoFilter/></cpix:ContentKeyUsageRule>
+    <cpix:ContentKeyUsageRule kid="10000000-1000-1000-1000-100000000001"/>
+  </cpix:ContentKeyUsageRuleList>`
+    conf := &mp4.CencConfig{}
+    _, keys, err := ImportCpix(testCpix(testCpixKeys + rules), conf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if conf.Scheme != "cenc" {
+        t.Errorf("scheme %q", conf.Scheme)
+    }
+    var keyTypes []string
+    for _, key := range keys {
+        keyTypes = append(keyTypes, key.KeyType)
+    }
+    if strings.Join(keyTypes, ",") != "audio,sd,hd,uhd,video," {
+        t.Errorf("key types %q", keyTypes)
+    }
+    if hex.EncodeToString(keys[1].Key) != "101112131415161718191a1b1c1d1e1f" {
+        t.Errorf("key %x", keys[1].Key)
+    }
+}
+
+func TestImportCpixSingleKey(t *testing.T) {
+    body := `<cpix:ContentKeyList>
+    <cpix:ContentKey kid="10000000100010001000100000000001">
+      <cpix:Data><pskc:Secret><pskc:PlainValue>AAECAwQFBgcICQoLDA0ODw==</pskc:PlainValue></pskc:Secret></cpix:Data>
+    </cpix:ContentKey>
+  </cpix:ContentKeyList>`
+    conf := &mp4.CencConfig{}
+    _, keys, err := ImportCpix(testCpix(body), conf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(keys) != 1 || keys[0].KeyType != "" || !bytes.Equal(keys[0].KeyId, testKeyId) || !bytes.Equal(keys[0].Key, testKey) {
+        t.Errorf("keys %+v", keys)
+    }
+    if conf.Scheme != "cenc" {
+        t.Errorf("default scheme %q", conf.Scheme)
+    }
+}
+
+func TestImportCpixErrors(t *testing.T) {
+    documents := map[string]string{
+        "several keys without rules": testCpixKeys,
+        "encrypted key": `<cpix:ContentKeyList><cpix:ContentKey kid="10000000-1000-1000-1000-100000000001"><cpix:Data><pskc:Secret>` +
+            `<pskc:EncryptedValue><enc:CipherData xmlns:enc="http://www.w3.org/2001/04/xmlenc#"><enc:CipherValue>AAAA</enc:CipherValue>` +
+            `</enc:CipherData></pskc:EncryptedValue></pskc:Secret></cpix:Data></cpix:ContentKey></cpix:ContentKeyList>`,
+        "short key": `<cpix:ContentKeyList><cpix:ContentKey kid="10000000-1000-1000-1000-100000000001"><cpix:Data><pskc:Secret>` +
+            `<pskc:PlainValue>AAECAwQFBgcICQoLDA0O</pskc:PlainValue></pskc:Secret></cpix:Data></cpix:ContentKey></cpix:ContentKeyList>`,
+        "invalid key ID": `<cpix:ContentKeyList><cpix:ContentKey kid="1000"><cpix:Data><pskc:Secret>` +
+            `<pskc:PlainValue>AAECAwQFBgcICQoLDA0ODw==</pskc:PlainValue></pskc:Secret></cpix:Data></cpix:ContentKey></cpix:ContentKeyList>`,
+        "unknown rule key": testCpixKeys + `<cpix:ContentKeyUsageRuleList>` +
+            `<cpix:ContentKeyUsageRule kid="10000000-1000-1000-1000-100000000003"/></cpix:ContentKeyUsageRuleList>`,
+        "unknown period": testCpixKeys + `<cpix:ContentKeyUsageRuleList><cpix:ContentKeyUsageRule kid="10000000-1000-1000-1000-100000000001">` +
+            `<cpix:KeyPeriodFilter periodId="keyPeriod_1"/></cpix:ContentKeyUsageRule></cpix:ContentKeyUsageRuleList>`,
+        "unknown track type": testCpixKeys + `<cpix:ContentKeyUsageRuleList>` +
+            `<cpix:ContentKeyUsageRule kid="10000000-1000-1000-1000-100000000001" intendedTrackType="TEXT"/></cpix:ContentKeyUsageRuleList>`,
+        "invalid pssh box": testCpixKeys + `<cpix:ContentKeyUsageRuleList><cpix:ContentKeyUsageRule kid="10000000-1000-1000-1000-100000000001"/>` +
+            `</cpix:ContentKeyUsageRuleList><cpix:DRMSystemList><cpix:DRMSystem kid="10000000-1000-1000-1000-100000000001" ` +
+            `systemId="edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"><cpix:PSSH>AAAAIHBzc2g=</cpix:PSSH></cpix:DRMSystem></cpix:DRMSystemList>`,
+    }
+    for name, body := range documents {
+        if _, keys, err := ImportCpix(testCpix(body), &mp4.CencConfig{}); err == nil {
+            t.Errorf("%s: imported %+v", name, keys)
+        }
+    }
+    if _, keys, err := ImportCpix([]byte("<cpix:CPIX"), &mp4.CencConfig{}); err == nil {
+        t.Errorf("truncated document imported %+v", keys)
+    }
+}
@@ -1,55 +1,116 @@
-package main
+package drm
 
 import (
-    "io"
-    "fmt"
-    "crypto/rand"
-    "crypto/cipher"
+    "bytes"
     "crypto/aes"
+    "crypto/cipher"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "io/ioutil"
+
+    "mp4"
 )
 
-func keygen(size uint) (b []byte, err error) {
-    b = make([]byte, size)
-    _, err = rand.Read(b)
+const KeySize = 16
+
+// Parse a key written in hexadecimal (eg: "000102030405060708090a0b0c0d0e0f")
+func ParseKey(s string) (key []byte, err error) {
+    key, err = hex.DecodeString(s)
+    if err == nil && len(key) != KeySize {
+        err = errors.New("Key must be 16 bytes long")
+    }
     return
 }
 
-func encrypt(key []byte, iv [byte]data []byte) (crypted []byte, err error) {
-    block, err := aes.NewCipher(key)
+// Read a key store file, holding the key in binary or in hexadecimal
+func ReadKeyFile(filename string) (key []byte, err error) {
+    data, err := ioutil.ReadFile(filename)
     if err != nil {
-        return nil, err
+        return
     }
-    iv := []byte("AESkey0123456789")
-    stream := cipher.NewCTR(block, iv)
-    crypted = make([]byte, len(data))
-    stream.XORKeyStream(crypted, data)
-    return
+
+    if len(data) == KeySize {
+        key = data
+        return
+    }
+    return ParseKey(string(bytes.TrimSpace(data)))
 }
 
+// Load the content key of a package from the key store: the per-asset key of the package, or its key file
+func LoadKey(conf *mp4.EncryptionConfig) (err error) {
+    switch conf.Method {
+        case "AES-128", "SAMPLE-AES":
+        default:
+            return errors.New("Unsupported encryption method " + conf.Method)
+    }
 
-func main() {
-    data := []byte("")
+    if conf.Key != "" {
+        conf.ContentKey, err = ParseKey(conf.Key)
+    } else if conf.KeyFile != "" {
+        conf.ContentKey, err = ReadKeyFile("/" + conf.KeyFile)
+    } else {
+        err = errors.New("Encryption needs a key or a key file")
+    }
+    return
+}
 
-    key, err := keygen(16)
-    if err != nil {
-        panic(err.Error())
+// Key period of a segment numbered from 1
+func KeyPeriod(conf mp4.EncryptionConfig, segmentNumber uint32) uint32 {
+    if conf.RotationPeriod == 0 || segmentNumber == 0 {
+        return 0
     }
+    return (segmentNumber - 1) / conf.RotationPeriod
+}
 
-    crypted, err := encrypt(key, data)
-    if err != nil {
-        panic(err.Error())
+// Key of a key period. Rotated keys are derived from the content key by encrypting the period number,
+// so only the content key needs to be stored.
+func PeriodKey(conf mp4.EncryptionConfig, period uint32) (key []byte, err error) {
+    if conf.RotationPeriod == 0 {
+        return conf.ContentKey, nil
     }
+    return derivePeriodKey(conf.ContentKey, period)
+}
 
-    decrypted, err := encrypt(key, crypted)
+func derivePeriodKey(contentKey []byte, period uint32) (key []byte, err error) {
+    block, err := aes.NewCipher(contentKey)
     if err != nil {
-        panic(err.Error())
+        return
     }
+    key = make([]byte, KeySize)
+    binary.BigEndian.PutUint32(key[KeySize-4:], period)
+    block.Encrypt(key, key)
+    return
+}
 
-    fmt.Printf("%x\n", key)
-    fmt.Printf("%d : ''%s''\n", len(data), data)
-    fmt.Printf("%d : ''%x''\n", len(crypted), crypted)
-    fmt.Printf("%d : ''%s''\n", len(decrypted), decrypted)
+// Key period of a CMAF segment numbered from 1, protected with common encryption
+func CencKeyPeriod(conf *mp4.CencConfig, segmentNumber uint32) uint32 {
+    if conf == nil || conf.RotationPeriod == 0 || segmentNumber == 0 {
+        return 0
+    }
+    return (segmentNumber - 1) / conf.RotationPeriod
+}
 
+// Initialization vector of a segment: its media sequence number as a 128 bits big endian integer
+func SequenceIV(sequenceNumber uint64) (iv []byte) {
+    iv = make([]byte, aes.BlockSize)
+    binary.BigEndian.PutUint64(iv[8:], sequenceNumber)
     return
 }
 
+// Encrypt a whole segment with AES-128-CBC and PKCS7 padding
+func EncryptSegment(key []byte, iv []byte, data []byte) (encrypted []byte, err error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return
+    }
+
+    padding := aes.BlockSize - len(data) % aes.BlockSize
+    encrypted = make([]byte, len(data) + padding)
+    copy(encrypted, data)
+    for i := len(data); i < len(encrypted); i++ {
+        encrypted[i] = byte(padding)
+    }
+    cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+    return
+}
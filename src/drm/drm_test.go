@@ -0,0 +1,79 @@
+package drm
+
+import (
+    "bytes"
+    "encoding/hex"
+    "testing"
+
+    "mp4"
+)
+
+var testKey, _ = hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+
+func TestParseKey(t *testing.T) {
+    key, err := ParseKey("000102030405060708090a0b0c0d0e0f")
+    if err != nil || !bytes.Equal(key, testKey) {
+        t.Errorf("key %x, %v", key, err)
+    }
+    for _, s := range []string{"", "000102030405060708090a0b0c0d0e", "000102030405060708090a0b0c0d0e0f10", "000102030405060708090a0b0c0d0e0g"} {
+        if _, err := ParseKey(s); err == nil {
+            t.Errorf("key %q parsed", s)
+        }
+    }
+}
+
+func TestKeyPeriod(t *testing.T) {
+    conf := mp4.EncryptionConfig{RotationPeriod: 3}
+    for segmentNumber, expected := range map[uint32]uint32{0: 0, 1: 0, 3: 0, 4: 1, 6: 1, 7: 2} {
+        if period := KeyPeriod(conf, segmentNumber); period != expected {
+            t.Errorf("segment %d in key period %d, expected %d", segmentNumber, period, expected)
+        }
+    }
+    if period := KeyPeriod(mp4.EncryptionConfig{}, 100); period != 0 {
+        t.Errorf("segment 100 in key period %d without rotation", period)
+    }
+}
+
+func TestPeriodKey(t *testing.T) {
+    key, err := PeriodKey(mp4.EncryptionConfig{ContentKey: testKey}, 5)
+    if err != nil || !bytes.Equal(key, testKey) {
+        t.Errorf("key %x without rotation, expected the content key", key)
+    }
+
+    // AES-128-ECB of the big endian period number with the content key
+    conf := mp4.EncryptionConfig{ContentKey: testKey, RotationPeriod: 10}
+    for period, expected := range map[uint32]string{0: "c6a13b37878f5b826f4f8162a1c8d879", 1: "7346139595c0b41e497bbde365f42d0a"} {
+        key, err := PeriodKey(conf, period)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if hex.EncodeToString(key) != expected {
+            t.Errorf("key %x of period %d, expected %s", key, period, expected)
+        }
+    }
+
+    if _, err := PeriodKey(mp4.EncryptionConfig{ContentKey: testKey[:8], RotationPeriod: 10}, 1); err == nil {
+        t.Error("key derived from a short content key")
+    }
+}
+
+func TestEncryptSegment(t *testing.T) {
+    iv := SequenceIV(5)
+    if hex.EncodeToString(iv) != "00000000000000000000000000000005" {
+        t.Errorf("IV %x of sequence number 5", iv)
+    }
+
+    encrypted, err := EncryptSegment(testKey, iv, []byte("segment"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if hex.EncodeToString(encrypted) != "ffd3f47e2200a8bab26ff402c70fa1d8" {
+        t.Errorf("encrypted segment %x", encrypted)
+    }
+
+    // A whole block of PKCS7 padding follows the aligned segments
+    encrypted, err = EncryptSegment(testKey, iv, make([]byte, 32))
+    if err != nil || len(encrypted) != 48 {
+        t.Errorf("encrypted segment of %d bytes, expected 48", len(encrypted))
+    }
+}
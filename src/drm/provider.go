@@ -0,0 +1,283 @@
+package drm
+
+import (
+    "bytes"
+    "crypto/aes"
+    "crypto/rand"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "strings"
+
+    "keystore"
+    "mp4"
+)
+
+// Content key of the common encryption and its key ID
+type ContentKey struct {
+    KeyId   []byte
+    Key     []byte
+    KeyType string // Tracks encrypted with the key (eg: "hd"), "" for all the tracks
+    Period  uint32 // Key period of the key
+}
+
+// Provider of the content keys of a package, the tracks of a package may be encrypted with different keys
+// (eg: "audio", "sd" and "hd") and the keys may change with the key periods
+type KeyProvider interface {
+    ContentKey(keyType string, period uint32) (ContentKey, error)
+    KeyById(keyId []byte) (ContentKey, bool)
+    Keys() []ContentKey
+}
+
+// Key store of the assets, the keys of the packages giving an asset ID are loaded from it
+var KeyStore keystore.Backend
+
+// Single key of all the tracks, given in the package or in a key file. When the key rotates, the keys of the key
+// periods are derived from it like the rotated HLS keys, and their key IDs are the key ID of the package plus the
+// period: the key of the package itself is never used.
+type packageKeyProvider struct {
+    key      ContentKey
+    rotation bool
+}
+
+func (provider packageKeyProvider) ContentKey(keyType string, period uint32) (key ContentKey, err error) {
+    if provider.rotation == false {
+        if period != 0 {
+            return ContentKey{}, fmt.Errorf("No key for key period %d", period)
+        }
+        return provider.key, nil
+    }
+
+    key.Period = period
+    key.KeyId = make([]byte, len(provider.key.KeyId))
+    copy(key.KeyId, provider.key.KeyId)
+    binary.BigEndian.PutUint32(key.KeyId[12:16], binary.BigEndian.Uint32(key.KeyId[12:16]) + period)
+    key.Key, err = derivePeriodKey(provider.key.Key, period)
+    return
+}
+
+func (provider packageKeyProvider) KeyById(keyId []byte) (ContentKey, bool) {
+    if len(keyId) != len(provider.key.KeyId) || bytes.Equal(keyId[:12], provider.key.KeyId[:12]) == false {
+        return ContentKey{}, false
+    }
+    period := binary.BigEndian.Uint32(keyId[12:16]) - binary.BigEndian.Uint32(provider.key.KeyId[12:16])
+    key, err := provider.ContentKey("", period)
+    return key, err == nil
+}
+
+// Keys of the package, only the key of the first key period when the key rotates
+func (provider packageKeyProvider) Keys() []ContentKey {
+    key, _ := provider.ContentKey("", 0)
+    return []ContentKey{ key }
+}
+
+// Keys of an asset of the key store
+type storeKeyProvider struct {
+    assetId string
+    keys    []ContentKey
+}
+
+// Key of a type of tracks, or of the more general types: the video keys are the keys of their definition, or
+// the "video" key, or the key of all the tracks
+func (provider storeKeyProvider) ContentKey(keyType string, period uint32) (ContentKey, error) {
+    keyTypes := []string{ keyType, "" }
+    switch keyType {
+        case "sd", "hd", "uhd":
+            keyTypes = []string{ keyType, "video", "" }
+        case "":
+            keyTypes = []string{ "" }
+    }
+    for _, t := range keyTypes {
+        for _, key := range provider.keys {
+            if key.KeyType == t && key.Period == period {
+                return key, nil
+            }
+        }
+    }
+    return ContentKey{}, fmt.Errorf("No key of the %s tracks for key period %d in asset %s", keyType, period, provider.assetId)
+}
+
+func (provider storeKeyProvider) KeyById(keyId []byte) (ContentKey, bool) {
+    for _, key := range provider.keys {
+        if bytes.Equal(key.KeyId, keyId) {
+            return key, true
+        }
+    }
+    return ContentKey{}, false
+}
+
+func (provider storeKeyProvider) Keys() []ContentKey {
+    return provider.keys
+}
+
+// Key type of a track: "audio", or the definition of the video: "sd" up to 576 lines, "hd" up to 1080 lines
+// and "uhd" above. The I-Frames of the trick mode are encrypted with the key of their video.
+func TrackKeyType(trackType string, sConf *mp4.StreamConfig) string {
+    if (trackType != "video" && trackType != "trick") || sConf == nil || sConf.Video == nil {
+        return trackType
+    }
+    switch {
+        case sConf.Video.Height <= 576:
+            return "sd"
+        case sConf.Video.Height <= 1080:
+            return "hd"
+    }
+    return "uhd"
+}
+
+// Parse a key ID written in hexadecimal, with or without the dashes of a UUID
+// (eg: "10000000-1000-1000-1000-100000000001")
+func ParseKeyId(s string) (keyId []byte, err error) {
+    keyId, err = ParseKey(strings.Replace(s, "-", "", -1))
+    if err != nil {
+        err = errors.New("Invalid key ID " + s)
+    }
+    return
+}
+
+// Key provider of a package protected with common encryption
+func NewKeyProvider(conf *mp4.CencConfig) (provider KeyProvider, err error) {
+    if conf.Scheme != "cenc" && conf.Scheme != "cbcs" {
+        return nil, errors.New("Unsupported protection scheme " + conf.Scheme)
+    }
+    if conf.AssetId != "" {
+        return LoadAssetKeys(conf.AssetId)
+    }
+
+    var key ContentKey
+    key.KeyId, err = ParseKeyId(conf.KeyId)
+    if err != nil {
+        return
+    }
+    if conf.Key != "" {
+        key.Key, err = ParseKey(conf.Key)
+    } else if conf.KeyFile != "" {
+        key.Key, err = ReadKeyFile("/" + conf.KeyFile)
+    } else {
+        err = errors.New("Common encryption needs a key, a key file or an asset of the key store")
+    }
+    if err != nil {
+        return
+    }
+    return packageKeyProvider{ key: key, rotation: conf.RotationPeriod != 0 }, nil
+}
+
+// Key provider of an asset of the key store
+func LoadAssetKeys(assetId string) (provider KeyProvider, err error) {
+    if KeyStore == nil {
+        return nil, errors.New("No key store to load the keys of asset " + assetId)
+    }
+    asset, err := KeyStore.Load(assetId)
+    if err != nil {
+        return
+    }
+
+    keys := make([]ContentKey, len(asset.Keys))
+    for i, k := range asset.Keys {
+        keys[i].KeyType = k.KeyType
+        keys[i].Period = k.Period
+        keys[i].KeyId, err = ParseKeyId(k.KeyId)
+        if err != nil {
+            return
+        }
+        keys[i].Key, err = ParseKey(k.Key)
+        if err != nil {
+            return
+        }
+    }
+    return storeKeyProvider{ assetId: assetId, keys: keys }, nil
+}
+
+// Store keys as the keys of an asset
+func StoreAssetKeys(assetId string, keys []ContentKey) error {
+    if KeyStore == nil {
+        return errors.New("No key store to store the keys of asset " + assetId)
+    }
+    var asset keystore.Asset
+    for _, key := range keys {
+        asset.Keys = append(asset.Keys, keystore.Key{
+            KeyType: key.KeyType,
+            Period: key.Period,
+            KeyId: FormatKeyId(key.KeyId),
+            Key: hex.EncodeToString(key.Key),
+        })
+    }
+    return KeyStore.Store(assetId, asset)
+}
+
+// Random key of a type of tracks, with a random key ID
+func GenerateKey(keyType string, period uint32) (key ContentKey, err error) {
+    key.KeyType = keyType
+    key.Period = period
+    key.KeyId = make([]byte, 16)
+    key.Key = make([]byte, KeySize)
+    _, err = rand.Read(key.KeyId)
+    if err != nil {
+        return
+    }
+    // Version 4 UUID
+    key.KeyId[6] = key.KeyId[6] & 0x0f | 0x40
+    key.KeyId[8] = key.KeyId[8] & 0x3f | 0x80
+    _, err = rand.Read(key.Key)
+    return
+}
+
+// Protection of the fragments of the tracks of a key type, in a key period. The fragments of a rotating key give
+// the key of their period.
+func TrackProtection(conf *mp4.CencConfig, keyType string, period uint32) (protection *mp4.Protection, err error) {
+    if conf == nil {
+        return
+    }
+
+    provider, err := NewKeyProvider(conf)
+    if err != nil {
+        return
+    }
+    key, err := provider.ContentKey(keyType, period)
+    if err != nil {
+        return
+    }
+    protection = &mp4.Protection{ Scheme: conf.Scheme, KeyId: key.KeyId, Key: key.Key, KeyRotation: conf.RotationPeriod != 0 }
+    if conf.Scheme == "cbcs" {
+        // HLS clients take the IV from the init, it is the IV of the first key period for all the periods
+        ivKey := key
+        if period != 0 {
+            ivKey, err = provider.ContentKey(keyType, 0)
+            if err != nil {
+                return
+            }
+        }
+        protection.ConstantIV, err = ConstantIV(ivKey)
+        if err != nil {
+            return
+        }
+    }
+
+    systems, err := Systems(conf, key)
+    for _, system := range systems {
+        protection.Pssh = append(protection.Pssh, system.Pssh)
+    }
+    return
+}
+
+// Constant IV of the cbcs samples encrypted with a key: the encryption of its key ID, so the IV does not change
+// when the fragments are built again
+func ConstantIV(key ContentKey) (iv []byte, err error) {
+    block, err := aes.NewCipher(key.Key)
+    if err != nil {
+        return
+    }
+    iv = make([]byte, aes.BlockSize)
+    block.Encrypt(iv, key.KeyId)
+    return
+}
+
+// Key ID written as a UUID (eg: "10000000-1000-1000-1000-100000000001")
+func FormatKeyId(keyId []byte) string {
+    s := hex.EncodeToString(keyId)
+    if len(s) != 32 {
+        return s
+    }
+    return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
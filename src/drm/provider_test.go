@@ -0,0 +1,148 @@
+package drm
+
+import (
+    "bytes"
+    "testing"
+
+    "mp4"
+)
+
+func TestCencKeyPeriod(t *testing.T) {
+    conf := &mp4.CencConfig{ RotationPeriod: 5 }
+    for segmentNumber, expected := range map[uint32]uint32{ 0: 0, 1: 0, 5: 0, 6: 1, 11: 2 } {
+        if period := CencKeyPeriod(conf, segmentNumber); period != expected {
+            t.Errorf("segment %d in key period %d, expected %d", segmentNumber, period, expected)
+        }
+    }
+    if period := CencKeyPeriod(&mp4.CencConfig{}, 11); period != 0 {
+        t.Errorf("segment 11 in key period %d without rotation", period)
+    }
+    if period := CencKeyPeriod(nil, 11); period != 0 {
+        t.Errorf("segment 11 in key period %d without protection", period)
+    }
+}
+
+func TestPackageKeyProvider(t *testing.T) {
+    provider, err := NewKeyProvider(&mp4.CencConfig{ Scheme: "cenc", KeyId: "10000000-1000-1000-1000-1000ffffffff", Key: "000102030405060708090a0b0c0d0e0f" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    key, err := provider.ContentKey("hd", 0)
+    if err != nil || !bytes.Equal(key.Key, testKey) {
+        t.Errorf("key %x, expected the key of the package", key.Key)
+    }
+    if _, err := provider.ContentKey("", 1); err == nil {
+        t.Error("key of period 1 without rotation")
+    }
+
+    // The keys of the periods are derived like the rotated HLS keys, their key IDs count the periods
+    provider, err = NewKeyProvider(&mp4.CencConfig{ Scheme: "cenc", KeyId: "10000000-1000-1000-1000-1000ffffffff", Key: "000102030405060708090a0b0c0d0e0f", RotationPeriod: 10 })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, period := range []uint32{ 0, 1, 7 } {
+        key, err := provider.ContentKey("audio", period)
+        if err != nil {
+            t.Fatal(err)
+        }
+        derived, _ := PeriodKey(mp4.EncryptionConfig{ ContentKey: testKey, RotationPeriod: 10 }, period)
+        if !bytes.Equal(key.Key, derived) || key.Period != period {
+            t.Errorf("key %x of period %d, expected %x", key.Key, period, derived)
+        }
+        if expected := []byte{ 0xff, 0xff, 0xff, 0xff }; period == 0 && !bytes.Equal(key.KeyId[12:], expected) {
+            t.Errorf("key ID %x of period 0", key.KeyId)
+        }
+        byId, ok := provider.KeyById(key.KeyId)
+        if !ok || !bytes.Equal(byId.Key, key.Key) || byId.Period != period {
+            t.Errorf("key %+v of key ID %x, expected %+v", byId, key.KeyId, key)
+        }
+    }
+    key, _ = provider.ContentKey("", 1)
+    if FormatKeyId(key.KeyId) != "10000000-1000-1000-1000-100000000000" {
+        t.Errorf("key ID %s of period 1", FormatKeyId(key.KeyId))
+    }
+    if _, ok := provider.KeyById(testKeyId[:8]); ok {
+        t.Error("key of a short key ID")
+    }
+    if keys := provider.Keys(); len(keys) != 1 || keys[0].Period != 0 {
+        t.Errorf("keys %+v, expected the key of the first period", keys)
+    }
+}
+
+func TestStoreKeyProvider(t *testing.T) {
+    provider := storeKeyProvider{ assetId: "movie", keys: []ContentKey{
+        testContentKey("", 0, "10000000100010001000100000000001"),
+        testContentKey("video", 0, "10000000100010001000100000000002"),
+        testContentKey("hd", 0, "10000000100010001000100000000003"),
+        testContentKey("hd", 1, "10000000100010001000100000000004"),
+    } }
+
+    // A key type falls back on the video key then on the key of all the tracks
+    tests := []struct {
+        keyType string
+        period  uint32
+        kid     byte
+    }{
+        { "hd", 0, 3 },
+        { "hd", 1, 4 },
+        { "sd", 0, 2 },
+        { "audio", 0, 1 },
+        { "", 0, 1 },
+    }
+    for _, test := range tests {
+        key, err := provider.ContentKey(test.keyType, test.period)
+        if err != nil {
+            t.Errorf("%s key of period %d: %v", test.keyType, test.period, err)
+        } else if key.KeyId[15] != test.kid {
+            t.Errorf("%s key of period %d has the key ID %x", test.keyType, test.period, key.KeyId)
+        }
+    }
+    for _, keyType := range []string{ "sd", "audio", "" } {
+        if _, err := provider.ContentKey(keyType, 1); err == nil {
+            t.Errorf("%s key of period 1", keyType)
+        }
+    }
+}
+
+func TestTrackKeyType(t *testing.T) {
+    video := func(height uint16) *mp4.StreamConfig {
+        return &mp4.StreamConfig{ Video: &mp4.StreamVideoEntry{ Height: height } }
+    }
+    tests := []struct {
+        trackType string
+        sConf     *mp4.StreamConfig
+        expected  string
+    }{
+        { "audio", nil, "audio" },
+        { "video", video(576), "sd" },
+        { "video", video(720), "hd" },
+        { "trick", video(1080), "hd" },
+        { "video", video(2160), "uhd" },
+        { "video", nil, "video" },
+    }
+    for _, test := range tests {
+        if keyType := TrackKeyType(test.trackType, test.sConf); keyType != test.expected {
+            t.Errorf("key type %s, expected %s", keyType, test.expected)
+        }
+    }
+}
+
+func TestTrackProtectionConstantIV(t *testing.T) {
+    conf := &mp4.CencConfig{ Scheme: "cbcs", KeyId: "10000000-1000-1000-1000-100000000001", Key: "000102030405060708090a0b0c0d0e0f", RotationPeriod: 10 }
+
+    // The IV of the init is the IV of the first key period, the IV of all the key periods
+    first, err := TrackProtection(conf, "video", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, err := TrackProtection(conf, "video", 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !second.KeyRotation || bytes.Equal(first.Key, second.Key) || bytes.Equal(first.KeyId, second.KeyId) {
+        t.Errorf("protections %+v and %+v of the key periods", first, second)
+    }
+    if len(first.ConstantIV) != 16 || !bytes.Equal(first.ConstantIV, second.ConstantIV) {
+        t.Errorf("constant IVs %x and %x of the key periods", first.ConstantIV, second.ConstantIV)
+    }
+}
@@ -0,0 +1,215 @@
+package drm
+
+import (
+    "crypto/aes"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "html"
+    "unicode/utf16"
+
+    "mp4"
+)
+
+// System IDs of the pssh boxes
+const (
+    SystemIdWidevine  = "edef8ba979d64acea3c827dcd51d21ed"
+    SystemIdPlayReady = "9a04f07998404286ab92e65be0885f95"
+    SystemIdClearKey  = "1077efecc0b24d02ace33c1e52e2fb4b" // W3C common pssh box of ClearKey
+)
+
+// ClearKey is signalled in the MPD by the DASH-IF scheme, its pssh box uses the W3C system ID
+const (
+    clearKeySystemIdDashIf = "e2719d58a985b3c9781ab030af78d30e"
+    clearKeySchemeIdUri    = "urn:uuid:e2719d58-a985-b3c9-781a-b030af78d30e"
+)
+
+// DRM system of a protected package, its pssh box is written in the init segments and its descriptor in the MPD
+type System struct {
+    SchemeIdUri string      // ContentProtection scheme of the MPD
+    Value       string      // ContentProtection value of the MPD (eg: "Widevine")
+    Pssh        mp4.PsshBox
+    Pro         []byte      // PlayReady Object, PlayReady only
+    LaUrl       string      // License URL given in the MPD, ClearKey only
+}
+
+// DRM systems of a package protected with a content key
+func Systems(conf *mp4.CencConfig, key ContentKey) (systems []System, err error) {
+    if conf.Widevine != nil {
+        systemId, _ := hex.DecodeString(SystemIdWidevine)
+        system := System{ SchemeIdUri: "urn:uuid:" + FormatKeyId(systemId), Value: "Widevine" }
+        pssh, err := vendorPssh(conf.Widevine.Pssh, key.KeyId)
+        if err != nil {
+            return nil, err
+        }
+        if pssh != nil {
+            system.Pssh = *pssh
+        } else {
+            system.Pssh = mp4.NewPsshBox(conf.PsshVersion, systemId, [][]byte{ key.KeyId }, widevinePsshData(conf, key.KeyId))
+        }
+        systems = append(systems, system)
+    }
+    if conf.PlayReady != nil {
+        systemId, _ := hex.DecodeString(SystemIdPlayReady)
+        system := System{ SchemeIdUri: "urn:uuid:" + FormatKeyId(systemId), Value: "MSPR 2.0" }
+        pssh, err := vendorPssh(conf.PlayReady.Pssh, key.KeyId)
+        if err != nil {
+            return nil, err
+        }
+        if pssh != nil {
+            system.Pssh = *pssh
+        } else {
+            header := conf.PlayReady.Header
+            if header == "" {
+                header, err = playReadyHeader(conf, key)
+                if err != nil {
+                    return nil, err
+                }
+            }
+            system.Pssh = mp4.NewPsshBox(conf.PsshVersion, systemId, [][]byte{ key.KeyId }, playReadyObject(header))
+        }
+        // The data of the PlayReady pssh box is the PlayReady Object
+        system.Pro = system.Pssh.Data
+        systems = append(systems, system)
+    }
+    if conf.ClearKey {
+        systemId, _ := hex.DecodeString(SystemIdClearKey)
+        systems = append(systems, System{
+            SchemeIdUri: clearKeySchemeIdUri,
+            Value: "ClearKey1.0",
+            Pssh: mp4.NewPsshBox(1, systemId, [][]byte{ key.KeyId }, nil),
+            LaUrl: conf.ClearKeyUrl,
+        })
+    }
+    return
+}
+
+// DRM systems of a source protected upstream, signalled by the pssh boxes of its file. Systems other than
+// Widevine, PlayReady and ClearKey are signalled by their system ID only.
+func SourceSystems(encryption *mp4.StreamEncryption) (systems []System) {
+    for _, pssh := range encryption.Pssh {
+        system := System{ SchemeIdUri: "urn:uuid:" + FormatKeyId(pssh.SystemId[:]), Pssh: pssh }
+        switch hex.EncodeToString(pssh.SystemId[:]) {
+            case SystemIdWidevine:
+                system.Value = "Widevine"
+            case SystemIdPlayReady:
+                system.Value = "MSPR 2.0"
+                system.Pro = pssh.Data
+            case SystemIdClearKey:
+                system.SchemeIdUri = clearKeySchemeIdUri
+                system.Value = "ClearKey1.0"
+        }
+        systems = append(systems, system)
+    }
+    return
+}
+
+// Pssh box given by the DRM vendor for a key, nil if there is none
+func vendorPssh(boxes map[string]string, keyId []byte) (pssh *mp4.PsshBox, err error) {
+    s, ok := boxes[FormatKeyId(keyId)]
+    if ok == false {
+        return
+    }
+    data, err := base64.StdEncoding.DecodeString(s)
+    if err != nil {
+        return nil, errors.New("Invalid pssh box of key ID " + FormatKeyId(keyId))
+    }
+    box, err := mp4.ParsePsshBox(data)
+    if err != nil {
+        return nil, errors.New("Invalid pssh box of key ID " + FormatKeyId(keyId))
+    }
+    return &box, nil
+}
+
+// Pssh box of a system in base 64, the content of the cenc:pssh element of the MPD
+func (system System) PsshBase64() string {
+    return base64.StdEncoding.EncodeToString(system.Pssh.Bytes())
+}
+
+// WidevinePsshData protocol buffer: key ID (2), provider (3), content ID (4) and protection scheme (9)
+func widevinePsshData(conf *mp4.CencConfig, keyId []byte) (data []byte) {
+    data = appendProtobufBytes(data, 2, keyId)
+    if conf.Widevine.Provider != "" {
+        data = appendProtobufBytes(data, 3, []byte(conf.Widevine.Provider))
+    }
+    if conf.Widevine.ContentId != "" {
+        data = appendProtobufBytes(data, 4, []byte(conf.Widevine.ContentId))
+    }
+    data = appendProtobufVarint(data, 9, uint64(binary.BigEndian.Uint32([]byte(conf.Scheme))))
+    return
+}
+
+// Protocol buffer field with a varint value (wire type 0)
+func appendProtobufVarint(data []byte, field uint64, value uint64) []byte {
+    b := make([]byte, 2 * binary.MaxVarintLen64)
+    n := binary.PutUvarint(b, field << 3)
+    n += binary.PutUvarint(b[n:], value)
+    return append(data, b[:n]...)
+}
+
+// Protocol buffer field with a length delimited value (wire type 2)
+func appendProtobufBytes(data []byte, field uint64, value []byte) []byte {
+    b := make([]byte, 2 * binary.MaxVarintLen64)
+    n := binary.PutUvarint(b, field << 3 | 2)
+    n += binary.PutUvarint(b[n:], uint64(len(value)))
+    data = append(data, b[:n]...)
+    return append(data, value...)
+}
+
+// PlayReady header of the key: version 4.0 with its checksum for cenc, version 4.3 for the AESCBC keys of cbcs
+func playReadyHeader(conf *mp4.CencConfig, key ContentKey) (header string, err error) {
+    kid := playReadyKeyId(key.KeyId)
+    header = `<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader"`
+    if conf.Scheme == "cbcs" {
+        header += ` version="4.3.0.0"><DATA><PROTECTINFO><KIDS>`
+        header += `<KID ALGID="AESCBC" VALUE="` + base64.StdEncoding.EncodeToString(kid) + `"></KID>`
+        header += `</KIDS></PROTECTINFO>`
+    } else {
+        block, err := aes.NewCipher(key.Key)
+        if err != nil {
+            return "", err
+        }
+        checksum := make([]byte, aes.BlockSize)
+        block.Encrypt(checksum, kid)
+
+        header += ` version="4.0.0.0"><DATA><PROTECTINFO><KEYLEN>16</KEYLEN><ALGID>AESCTR</ALGID></PROTECTINFO>`
+        header += `<KID>` + base64.StdEncoding.EncodeToString(kid) + `</KID>`
+        header += `<CHECKSUM>` + base64.StdEncoding.EncodeToString(checksum[0:8]) + `</CHECKSUM>`
+    }
+    if conf.PlayReady.LaUrl != "" {
+        header += `<LA_URL>` + html.EscapeString(conf.PlayReady.LaUrl) + `</LA_URL>`
+    }
+    if conf.PlayReady.LuiUrl != "" {
+        header += `<LUI_URL>` + html.EscapeString(conf.PlayReady.LuiUrl) + `</LUI_URL>`
+    }
+    if conf.PlayReady.CustomAttributes != "" {
+        header += `<CUSTOMATTRIBUTES>` + conf.PlayReady.CustomAttributes + `</CUSTOMATTRIBUTES>`
+    }
+    header += `</DATA></WRMHEADER>`
+    return
+}
+
+// PlayReady Object holding a single rights management header record, in UTF-16 little endian
+func playReadyObject(header string) (pro []byte) {
+    record := utf16.Encode([]rune(header))
+    pro = make([]byte, 10 + 2 * len(record))
+    binary.LittleEndian.PutUint32(pro[0:4], uint32(len(pro)))
+    binary.LittleEndian.PutUint16(pro[4:6], 1) // Record count
+    binary.LittleEndian.PutUint16(pro[6:8], 1) // Rights management header
+    binary.LittleEndian.PutUint16(pro[8:10], uint16(2 * len(record)))
+    for i, c := range record {
+        binary.LittleEndian.PutUint16(pro[10+i*2:12+i*2], c)
+    }
+    return
+}
+
+// PlayReady key IDs are GUIDs: the first three fields are little endian
+func playReadyKeyId(keyId []byte) (kid []byte) {
+    kid = make([]byte, 16)
+    copy(kid, keyId)
+    kid[0], kid[1], kid[2], kid[3] = keyId[3], keyId[2], keyId[1], keyId[0]
+    kid[4], kid[5] = keyId[5], keyId[4]
+    kid[6], kid[7] = keyId[7], keyId[6]
+    return
+}
@@ -0,0 +1,97 @@
+package drm
+
+import (
+    "bytes"
+    "encoding/binary"
+    "encoding/hex"
+    "strings"
+    "testing"
+    "unicode/utf16"
+
+    "mp4"
+)
+
+var testKeyId, _ = hex.DecodeString("10000000100010001000100000000001")
+
+func TestPlayReadyKeyId(t *testing.T) {
+    if kid := hex.EncodeToString(playReadyKeyId(testKeyId)); kid != "00000010001000101000100000000001" {
+        t.Errorf("PlayReady key ID %s", kid)
+    }
+}
+
+func TestPlayReadyHeader(t *testing.T) {
+    conf := &mp4.CencConfig{ Scheme: "cenc", PlayReady: &mp4.PlayReadyConfig{ LaUrl: "https://license.example.com/rightsmanager.asmx?a=1&b=2" } }
+    header, err := playReadyHeader(conf, ContentKey{ KeyId: testKeyId, Key: testKey })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // The checksum is the first 8 bytes of the AES-128-ECB of the PlayReady key ID with the content key
+    expected := `<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.0.0.0"><DATA>` +
+        `<PROTECTINFO><KEYLEN>16</KEYLEN><ALGID>AESCTR</ALGID></PROTECTINFO><KID>AAAAEAAQABAQABAAAAAAAQ==</KID>` +
+        `<CHECKSUM>zb7Nwv651g8=</CHECKSUM><LA_URL>https://license.example.com/rightsmanager.asmx?a=1&amp;b=2</LA_URL>` +
+        `</DATA></WRMHEADER>`
+    if header != expected {
+        t.Errorf("header %s, expected %s", header, expected)
+    }
+
+    conf.Scheme = "cbcs"
+    conf.PlayReady.LaUrl = ""
+    header, err = playReadyHeader(conf, ContentKey{ KeyId: testKeyId, Key: testKey })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(header, `version="4.3.0.0"`) || !strings.Contains(header, `<KID ALGID="AESCBC" VALUE="AAAAEAAQABAQABAAAAAAAQ=="></KID>`) {
+        t.Errorf("cbcs header %s", header)
+    }
+}
+
+func TestPlayReadyObject(t *testing.T) {
+    header := "<WRMHEADER/>"
+    pro := playReadyObject(header)
+    if int(binary.LittleEndian.Uint32(pro[0:4])) != len(pro) || binary.LittleEndian.Uint16(pro[4:6]) != 1 || binary.LittleEndian.Uint16(pro[6:8]) != 1 {
+        t.Fatalf("PlayReady Object %x", pro)
+    }
+    record := make([]uint16, binary.LittleEndian.Uint16(pro[8:10]) / 2)
+    for i := range record {
+        record[i] = binary.LittleEndian.Uint16(pro[10+2*i:])
+    }
+    if string(utf16.Decode(record)) != header {
+        t.Errorf("record %q, expected %q", string(utf16.Decode(record)), header)
+    }
+}
+
+func TestWidevinePsshData(t *testing.T) {
+    conf := &mp4.CencConfig{ Scheme: "cenc", Widevine: &mp4.WidevineConfig{ Provider: "widevine_test", ContentId: "abc" } }
+    expected := "1210100000001000100010001000000000011a0d7769646576696e655f74657374220361626348e3dc959b06"
+    if data := hex.EncodeToString(widevinePsshData(conf, testKeyId)); data != expected {
+        t.Errorf("WidevinePsshData %s, expected %s", data, expected)
+    }
+}
+
+func TestSystems(t *testing.T) {
+    conf := &mp4.CencConfig{ Scheme: "cenc", PsshVersion: 1, Widevine: &mp4.WidevineConfig{}, PlayReady: &mp4.PlayReadyConfig{}, ClearKey: true, ClearKeyUrl: "https://example.com/license" }
+    systems, err := Systems(conf, ContentKey{ KeyId: testKeyId, Key: testKey })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(systems) != 3 {
+        t.Fatalf("%d systems, expected 3", len(systems))
+    }
+
+    systemIds := []string{ SystemIdWidevine, SystemIdPlayReady, SystemIdClearKey }
+    for i, system := range systems {
+        pssh, err := mp4.ParsePsshBox(system.Pssh.Bytes())
+        if err != nil {
+            t.Fatalf("%s: %v", system.Value, err)
+        }
+        if hex.EncodeToString(pssh.SystemId[:]) != systemIds[i] || pssh.Version != 1 || len(pssh.KIDs) != 1 || !bytes.Equal(pssh.KIDs[0][:], testKeyId) || !bytes.Equal(pssh.Data, system.Pssh.Data) {
+            t.Errorf("%s pssh box %+v", system.Value, pssh)
+        }
+    }
+    if !bytes.Equal(systems[1].Pro, systems[1].Pssh.Data) {
+        t.Error("the PlayReady Object is not the data of the pssh box")
+    }
+    if systems[2].SchemeIdUri != clearKeySchemeIdUri || systems[2].LaUrl != conf.ClearKeyUrl || len(systems[2].Pssh.Data) != 0 {
+        t.Errorf("ClearKey system %+v", systems[2])
+    }
+}
@@ -3,84 +3,569 @@ package hls
 import (
 	"mp4"
 	"fmt"
+	"sort"
+	"time"
+	"util"
 )
 
-// Create subtitles variant list
+// Create subtitles rendition group
 func createMainSubtitlesDescriptor(subtitles []mp4.TrackEntry, videoId string) (s string) {
 	for _, sub := range subtitles {
-		s += fmt.Sprintf(`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",DEFAULT=NO,FORCED=NO,NAME="subtitle_%s",LANGUAGE="%s",URI="%s_subtitle_%s_%d.hls"`, sub.Lang, sub.Lang, videoId, sub.Lang, sub.Bandwidth) + "\n"
+		s += fmt.Sprintf(`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="%s",LANGUAGE="%s",DEFAULT=NO,AUTOSELECT=YES,FORCED=NO,URI="%s_subtitle_%s_%d.hls"`, util.LanguageName(sub.Lang), util.LanguageTag(sub.Lang), videoId, sub.Lang, sub.Bandwidth) + "\n"
 	}
 	return
 }
 
-// Create audio variant list
-func createMainAudioDescriptor(audios []mp4.TrackEntry, videoId string) (s string) {
+// Audio tracks sharing a codec, rendered as an audio rendition group
+type audioGroup struct {
+	Id               string
+	Codecs           string
+	Renditions       []mp4.TrackEntry // Highest bandwidth track of each language, the default language first
+	Bandwidth        uint64           // Highest peak bandwidth of the renditions
+	AverageBandwidth uint64           // Highest average bandwidth of the renditions
+}
+
+// Language of the default audio renditions: the one of the audio track flagged as default by the package, or of
+// the first audio track in the order of the package if none is flagged
+func defaultAudioLang(audios []mp4.TrackEntry) string {
+	for _, audio := range audios {
+		if audio.Default == true {
+			return audio.Lang
+		}
+	}
+	if len(audios) != 0 {
+		return audios[0].Lang
+	}
+	return ""
+}
+
+// Group the audio tracks by codec. The first rendition of each group is its default one: the rendition of the
+// default language, or the first track of the group in the order of the package if it has no such rendition.
+func createAudioGroups(audios []mp4.TrackEntry) (groups []audioGroup) {
+	defaultLang := defaultAudioLang(audios)
 	for _, audio := range audios {
-		s += fmt.Sprintf(`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",LANGUAGE="%s",NAME="audio_%s",AUTOSELECT=YES,DEFAULT=YES,URI="%s_audio_%s_%d.hls"`, audio.Lang, audio.Lang, videoId, audio.Lang, audio.Bandwidth) + "\n"
+		codecs := audio.Config.Audio.Codecs()
+		g := -1
+		for i := range groups {
+			if groups[i].Codecs == codecs {
+				g = i
+			}
+		}
+		if g == -1 {
+			groups = append(groups, audioGroup{Id: "audio-" + codecs, Codecs: codecs})
+			g = len(groups) - 1
+		}
+
+		group := &groups[g]
+		found := false
+		for i, rendition := range group.Renditions {
+			if rendition.Lang == audio.Lang {
+				if audio.Bandwidth > rendition.Bandwidth {
+					group.Renditions[i] = audio
+				}
+				found = true
+			}
+		}
+		if found == false {
+			group.Renditions = append(group.Renditions, audio)
+		}
+	}
+
+	for i := range groups {
+		renditions := groups[i].Renditions
+		for j := range renditions {
+			if renditions[j].Lang == defaultLang {
+				renditions[0], renditions[j] = renditions[j], renditions[0]
+				break
+			}
+		}
+		for _, rendition := range renditions {
+			if rendition.MaxBandwidth() > groups[i].Bandwidth {
+				groups[i].Bandwidth = rendition.MaxBandwidth()
+			}
+			if rendition.Bandwidth > groups[i].AverageBandwidth {
+				groups[i].AverageBandwidth = rendition.Bandwidth
+			}
+		}
 	}
+
 	return
 }
 
-// Create video quality variant list with stream
-// Variant list with different video can be added
-func createMainVideoDescriptor(videos []mp4.TrackEntry, videoId string) (s string) {
-	for i, video := range videos {
-		s += fmt.Sprintf("#EXT-X-STREAM-INF:PROGRAM-ID=1," +
-			"BANDWIDTH=%d,RESOLUTION=%dx%d," +
-			"CODECS=\"avc1.%.2x%.2x%.2x,mp4a.40.2\"",
-			video.Bandwidth,
+// Create audio rendition groups
+func createMainAudioDescriptor(groups []audioGroup, videoId string) (s string) {
+	for _, group := range groups {
+		for i, audio := range group.Renditions {
+			isDefault := "NO"
+			if i == 0 {
+				isDefault = "YES"
+			}
+			s += fmt.Sprintf(`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="%s",NAME="%s",LANGUAGE="%s",DEFAULT=%s,AUTOSELECT=YES,CHANNELS="%d",URI="%s_audio_%s_%d.hls"`, group.Id, util.LanguageName(audio.Lang), util.LanguageTag(audio.Lang), isDefault, audio.Config.Audio.Channels(), videoId, audio.Lang, audio.Bandwidth) + "\n"
+		}
+	}
+	return
+}
+
+// Create video variant list, each video is offered with every audio rendition group.
+// Audio only content has one variant per audio rendition group.
+func createMainVideoDescriptor(videos []mp4.TrackEntry, groups []audioGroup, subtitles bool, videoId string) (s string) {
+	renditions := ""
+	if subtitles == true {
+		renditions = `,SUBTITLES="subs"`
+	}
+
+	if len(videos) == 0 {
+		for _, group := range groups {
+			audio := group.Renditions[0]
+			s += fmt.Sprintf(`#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,CODECS="%s",AUDIO="%s"%s`, group.Bandwidth, group.AverageBandwidth, group.Codecs, group.Id, renditions) + "\n"
+			s += fmt.Sprintf("%s_audio_%s_%d.hls\n", videoId, audio.Lang, audio.Bandwidth)
+		}
+		return
+	}
+
+	if len(groups) == 0 {
+		groups = append(groups, audioGroup{})
+	}
+	for _, group := range groups {
+		for _, video := range videos {
+			codecs := fmt.Sprintf("avc1.%.2x%.2x%.2x", video.Config.Video.CodecInfo[0], video.Config.Video.CodecInfo[1], video.Config.Video.CodecInfo[2])
+			audio := ""
+			if group.Id != "" {
+				codecs += "," + group.Codecs
+				audio = fmt.Sprintf(`,AUDIO="%s"`, group.Id)
+			}
+			s += fmt.Sprintf(`#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%dx%d,FRAME-RATE=%.3f,CODECS="%s"%s%s`,
+				video.MaxBandwidth() + group.Bandwidth,
+				video.Bandwidth + group.AverageBandwidth,
+				video.Config.Video.Width,
+				video.Config.Video.Height,
+				float64(video.Config.Timescale) / float64(video.Config.SampleDelta),
+				codecs,
+				audio,
+				renditions) + "\n"
+			s += fmt.Sprintf("%s_video_%s_%d.hls\n", videoId, video.Lang, video.Bandwidth)
+		}
+	}
+
+	return
+}
+
+// Create muxed variant list, each video muxed with the audio track of the default language for the clients
+// which can't play audio renditions
+func createMainMuxedDescriptor(videos []mp4.TrackEntry, audios []mp4.TrackEntry, subtitles bool, videoId string) (s string) {
+	if len(audios) == 0 {
+		return
+	}
+	audio, _ := util.MuxedAudioTrack(audios, defaultAudioLang(audios))
+
+	renditions := ""
+	if subtitles == true {
+		renditions = `,SUBTITLES="subs"`
+	}
+	for _, video := range videos {
+		s += fmt.Sprintf(`#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,RESOLUTION=%dx%d,FRAME-RATE=%.3f,CODECS="avc1.%.2x%.2x%.2x,%s"%s`,
+			video.MaxBandwidth() + audio.MaxBandwidth(),
+			video.Bandwidth + audio.Bandwidth,
 			video.Config.Video.Width,
 			video.Config.Video.Height,
+			float64(video.Config.Timescale) / float64(video.Config.SampleDelta),
 			video.Config.Video.CodecInfo[0],
 			video.Config.Video.CodecInfo[1],
-			video.Config.Video.CodecInfo[2])
+			video.Config.Video.CodecInfo[2],
+			audio.Config.Audio.Codecs(),
+			renditions) + "\n"
+		s += fmt.Sprintf("%s_muxed_%s_%d.hls\n", videoId, audio.Lang, video.Bandwidth)
+	}
 
-		//s += ",AUDIO=\"audio\",SUBTITLES=\"subs\""
-		if i == 0 {
-			s += ",AUTOSELECT=YES,DEFAULT=YES"
-		} else {
-			s += ",AUTOSELECT=YES,DEFAULT=NO"
+	return
+}
+
+// Create I-Frame only variant list, for the fast forward and the thumbnails of the clients
+func createMainIFramesDescriptor(videos []mp4.TrackEntry, videoId string) (s string) {
+	for _, video := range videos {
+		if video.Config.Video.IFrameCount == 0 {
+			continue
 		}
-		s += "\n"
-		s += fmt.Sprintf("%s_video_%s_%d.hls\n", videoId, video.Lang, video.Bandwidth)
+		s += fmt.Sprintf(`#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d,CODECS="avc1.%.2x%.2x%.2x",URI="%s_iframes_%s_%d.hls"`,
+			video.Config.Video.IFrameBandwidth,
+			video.Config.Video.Width,
+			video.Config.Video.Height,
+			video.Config.Video.CodecInfo[0],
+			video.Config.Video.CodecInfo[1],
+			video.Config.Video.CodecInfo[2],
+			videoId,
+			video.Lang,
+			video.Bandwidth) + "\n"
 	}
 
 	return
 }
 
-func CreateMediaDescriptor(fragmentDuration uint32, numberOfSegment uint32, videoId string, trackType string, trackLang string, trackBandwidth uint64) (s string) {
+// Key of encrypted segments
+type SegmentKey struct {
+	Method         string // "AES-128" or "SAMPLE-AES" (the cbcs common encryption for CMAF segments)
+	URI            string // URI of the keys without period and extension (eg: "/key/video/video")
+	Type           string // Type of tracks of a common encryption key, passed in the type parameter (eg: "hd")
+	RotationPeriod uint32 // Number of segments encrypted with the same key, 0 for a single key
+}
+
+// Key tag of a key period, the IV is the media sequence number of the segment if not set
+func (key SegmentKey) tag(period uint32, iv string) (s string) {
+	uri := fmt.Sprintf("%s-%d.key", key.URI, period)
+	if key.Type != "" {
+		uri += "?type=" + key.Type
+	}
+	s = fmt.Sprintf(`#EXT-X-KEY:METHOD=%s,URI="%s"`, key.Method, uri)
+	if iv != "" {
+		s += ",IV=" + iv
+	}
+	return s + "\n"
+}
+
+func (key SegmentKey) period(segmentNumber uint32) uint32 {
+	if key.RotationPeriod == 0 {
+		return 0
+	}
+	return (segmentNumber - 1) / key.RotationPeriod
+}
+
+// Options of the media playlists
+type MediaOptions struct {
+	Fmp4            bool        // CMAF segments and init segment shared with DASH instead of TS segments
+	Key             *SegmentKey // Key of the segments if they are encrypted
+	SegmentSizes    []int64     // Sizes of the segments addressed as byte ranges of a single resource, nil for one resource per segment
+	ProgramDateTime *time.Time  // Wall clock time of the first segment, nil if the segments are not dated
+	DateRanges      []mp4.DateRange // Tagged ranges listed before the segment they start in, when the segments are dated
+}
+
+// Options of the media playlists of a package
+func PackageMediaOptions(jConf mp4.JsonConfig) (options MediaOptions) {
+	// Live channels are played with the CMAF segments of DASH
+	options.Fmp4 = jConf.HlsFormat == "fmp4" || jConf.Live != nil
+	options.ProgramDateTime = jConf.ProgramDateTime
+	options.DateRanges = jConf.DateRanges
+	return
+}
+
+func formatDate(t time.Time) string {
+	return t.Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+// EXT-X-DATERANGE tag of a range dated from the program date time, the client attributes are sorted by name
+func dateRangeTag(programDateTime time.Time, dateRange mp4.DateRange) (s string) {
+	s = fmt.Sprintf("#EXT-X-DATERANGE:ID=\"%s\"", dateRange.Id)
+	if dateRange.Class != "" {
+		s += fmt.Sprintf(",CLASS=\"%s\"", dateRange.Class)
+	}
+	s += fmt.Sprintf(",START-DATE=\"%s\"", formatDate(programDateTime.Add(time.Duration(dateRange.Start) * time.Millisecond)))
+	if dateRange.Duration != 0 {
+		s += fmt.Sprintf(",DURATION=%.3f", float64(dateRange.Duration) / 1000)
+	}
+	if dateRange.Skip == true {
+		s += ",X-SKIP=\"YES\""
+	}
+
+	var names []string
+	for name := range dateRange.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s += fmt.Sprintf(",%s=\"%s\"", name, dateRange.Attributes[name])
+	}
+	return s + "\n"
+}
+
+func (options MediaOptions) version() int {
+	if options.Fmp4 == true {
+		return 7
+	}
+	if options.Key != nil && options.Key.Method == "SAMPLE-AES" {
+		return 5
+	}
+	if options.SegmentSizes != nil {
+		return 4
+	}
+	return 3
+}
+
+func (options MediaOptions) segmentExtension() string {
+	if options.Fmp4 == true {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+func CreateMediaDescriptor(fragmentDuration uint32, numberOfSegment uint32, videoId string, trackType string, trackLang string, trackBandwidth uint64, options MediaOptions) (s string) {
 	s = "#EXTM3U\n"
 	s += fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", fragmentDuration)
-	s += "#EXT-X-VERSION:3\n"
+	s += fmt.Sprintf("#EXT-X-VERSION:%d\n", options.version())
 	s += "#EXT-X-MEDIA-SEQUENCE:0\n"
+	if options.Fmp4 == true {
+		s += fmt.Sprintf("#EXT-X-MAP:URI=\"%s_%s_%s_%d.dash\"\n", videoId, trackType, trackLang, trackBandwidth)
+	}
 
     var i uint32
+	var offset int64
 	for i = 1; i <= numberOfSegment; i++ {
+		if options.ProgramDateTime != nil {
+			// Ranges are listed before the segment they start in
+			start := uint64(i - 1) * uint64(fragmentDuration) * 1000
+			end := start + uint64(fragmentDuration) * 1000
+			for _, dateRange := range options.DateRanges {
+				if dateRange.Start >= start && dateRange.Start < end {
+					s += dateRangeTag(*options.ProgramDateTime, dateRange)
+				}
+			}
+			s += "#EXT-X-PROGRAM-DATE-TIME:" + formatDate(options.ProgramDateTime.Add(time.Duration(start) * time.Millisecond)) + "\n"
+		}
+		if options.Key != nil && (i == 1 || options.Key.period(i) != options.Key.period(i - 1)) {
+			s += options.Key.tag(options.Key.period(i), "")
+		}
 		s += fmt.Sprintf("#EXTINF:%d,\n", fragmentDuration)
-		s += fmt.Sprintf("%s_%s_%s_%d-%d.ts\n", videoId, trackType, trackLang, trackBandwidth, i)
+		if options.SegmentSizes != nil {
+			s += fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n", options.SegmentSizes[i - 1], offset)
+			s += fmt.Sprintf("%s_%s_%s_%d%s\n", videoId, trackType, trackLang, trackBandwidth, options.segmentExtension())
+			offset += options.SegmentSizes[i - 1]
+			continue
+		}
+		s += fmt.Sprintf("%s_%s_%s_%d-%d%s\n", videoId, trackType, trackLang, trackBandwidth, i, options.segmentExtension())
 	}
 	s += "#EXT-X-ENDLIST"
 
 	return
 }
 
-func CreateSubtitlesDescriptor(videoId string, trackLang string, trackBandwidth uint64) (s string) {
+// I-Frame of a TS segment, located by its byte range
+type IFrameSegment struct {
+	Segment  uint32  // Number of the segment
+	Offset   int64
+	Size     int64
+	Duration float64 // Duration in seconds until the next I-Frame
+}
+
+// Create an I-Frame only media playlist pointing into the TS segments of a video track.
+// The PAT and the PMT at the start of the first segment are the media initialization of every I-Frame.
+func CreateIFramesMediaDescriptor(fragmentDuration uint32, iFrames []IFrameSegment, videoId string, trackLang string, trackBandwidth uint64) (s string) {
 	s = "#EXTM3U\n"
-	s += fmt.Sprintf("#EXT-X-TARGETDURATION:1\n")
+	s += fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", fragmentDuration)
+	s += "#EXT-X-VERSION:5\n"
+	s += "#EXT-X-MEDIA-SEQUENCE:0\n"
+	s += "#EXT-X-I-FRAMES-ONLY\n"
+	s += fmt.Sprintf("#EXT-X-MAP:URI=\"%s_video_%s_%d-1.ts\",BYTERANGE=\"376@0\"\n", videoId, trackLang, trackBandwidth)
+
+	for _, iFrame := range iFrames {
+		s += fmt.Sprintf("#EXTINF:%.3f,\n", iFrame.Duration)
+		s += fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n", iFrame.Size, iFrame.Offset)
+		s += fmt.Sprintf("%s_video_%s_%d-%d.ts\n", videoId, trackLang, trackBandwidth, iFrame.Segment)
+	}
+	s += "#EXT-X-ENDLIST"
+
+	return
+}
+
+// Segments of a playlist item listed in a media playlist
+type ItemSegments struct {
+	Prefix          string      // URI of the segments without number and extension (eg: "/video/intro/intro_video_eng_400000")
+	First           uint32      // Number of the first segment
+	Last            uint32      // Number of the last segment
+	SegmentDuration uint32
+	Key             *SegmentKey // Key of the segments if the item is encrypted
+}
+
+// Create a media playlist chaining the segments of several packages, separated by discontinuities
+func CreatePlaylistMediaDescriptor(items []ItemSegments, options MediaOptions) (s string) {
+	var targetDuration uint32
+	for _, item := range items {
+		if item.SegmentDuration > targetDuration {
+			targetDuration = item.SegmentDuration
+		}
+	}
+
+	s = "#EXTM3U\n"
+	s += fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	s += fmt.Sprintf("#EXT-X-VERSION:%d\n", options.version())
+	s += "#EXT-X-MEDIA-SEQUENCE:0\n"
+	s += "#EXT-X-DISCONTINUITY-SEQUENCE:0\n"
+
+	for n, item := range items {
+		if n != 0 {
+			s += "#EXT-X-DISCONTINUITY\n"
+		}
+		if options.Fmp4 == true {
+			s += fmt.Sprintf("#EXT-X-MAP:URI=\"%s.dash\"\n", item.Prefix)
+		}
+		// The media sequence numbers of the playlist are not the ones of the item segments, IVs are explicit.
+		// CMAF segments take their IV from the init segment.
+		for i := item.First; i <= item.Last; i++ {
+			if item.Key != nil && options.Fmp4 == true {
+				if i == item.First || item.Key.period(i) != item.Key.period(i - 1) {
+					s += item.Key.tag(item.Key.period(i), "")
+				}
+			} else if item.Key != nil {
+				s += item.Key.tag(item.Key.period(i), fmt.Sprintf("0x%032x", i - 1))
+			} else if n != 0 && i == item.First && items[n - 1].Key != nil {
+				s += "#EXT-X-KEY:METHOD=NONE\n"
+			}
+			s += fmt.Sprintf("#EXTINF:%d,\n", item.SegmentDuration)
+			s += fmt.Sprintf("%s-%d%s\n", item.Prefix, i, options.segmentExtension())
+		}
+	}
+	s += "#EXT-X-ENDLIST"
+
+	return
+}
+
+// Create the media playlist of WebVTT segments aligned on the media segments, the last segment ends with the
+// presentation (duration in milliseconds)
+func CreateSubtitlesDescriptor(fragmentDuration uint32, duration uint64, videoId string, trackLang string, trackBandwidth uint64) (s string) {
+	s = "#EXTM3U\n"
+	s += fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", fragmentDuration)
 	s += "#EXT-X-VERSION:3\n"
 	s += "#EXT-X-MEDIA-SEQUENCE:0\n"
-	s += fmt.Sprintf("#EXTINF:1,\n")
-	s += fmt.Sprintf("%s_subtitle_%s_%d.vtt\n", videoId, trackLang, trackBandwidth)
+
+	segmentDuration := uint64(fragmentDuration) * 1000
+	for i := uint64(1); (i - 1) * segmentDuration < duration; i++ {
+		d := segmentDuration
+		if i * segmentDuration > duration {
+			d = duration - (i - 1) * segmentDuration
+		}
+		s += fmt.Sprintf("#EXTINF:%.3f,\n", float64(d) / 1000)
+		s += fmt.Sprintf("%s_subtitle_%s_%d-%d.vtt\n", videoId, trackLang, trackBandwidth, i)
+	}
 	s += "#EXT-X-ENDLIST"
 
 	return
 }
 
+// Partial segment of a live media playlist
+type LivePart struct {
+	Duration    float64 // Duration in seconds
+	Independent bool    // Starts with an I-Frame
+}
+
+// Segment of a live media playlist. The parts of the segments close to the live edge are listed, the segment in
+// progress at the live edge only lists its available parts.
+type LiveSegment struct {
+	Number     uint32
+	InProgress bool
+	Parts      []LivePart
+	PartCount  int        // Number of parts of the segment once complete
+}
+
+// Options of the live media playlists
+type LiveOptions struct {
+	StartTime  time.Time   // Wall clock time of the first segment of the channel
+	PartTarget float64     // Maximum duration of the parts in seconds, 0 without parts
+	Skip       bool        // Delta update: the segments before the skip boundary are not listed
+	Ended      bool        // The channel does not loop and has reached its end
+	Key        *SegmentKey // Key of the segments if the channel is protected
+}
+
+// Segments closer to the end of the playlist than the skip boundary are always listed, in target durations
+const liveSkipBoundary = 6
+
+// Create a Low-Latency HLS media playlist of a live channel, its CMAF segments and parts are numbered on the
+// channel. Clients may block the reload of the playlist until a segment or a part is available, and request
+// delta updates skipping the older segments.
+func CreateLiveMediaDescriptor(fragmentDuration uint32, segments []LiveSegment, videoId string, trackType string, trackLang string, trackBandwidth uint64, options LiveOptions) (s string) {
+	prefix := fmt.Sprintf("%s_%s_%s_%d", videoId, trackType, trackLang, trackBandwidth)
+	s = "#EXTM3U\n"
+	s += fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", fragmentDuration)
+	s += "#EXT-X-VERSION:9\n"
+	s += fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,CAN-SKIP-UNTIL=%.1f", float64(liveSkipBoundary * fragmentDuration))
+	if options.PartTarget != 0 {
+		s += fmt.Sprintf(",PART-HOLD-BACK=%.3f\n", 3 * options.PartTarget)
+		s += fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f\n", options.PartTarget)
+	} else {
+		s += "\n"
+	}
+	if len(segments) == 0 {
+		return
+	}
+	s += fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].Number)
+	s += fmt.Sprintf("#EXT-X-MAP:URI=\"%s.dash\"\n", prefix)
+
+	// Complete segments older than the skip boundary from the last one
+	skipped := 0
+	if options.Skip == true {
+		var last uint32
+		for _, segment := range segments {
+			if segment.InProgress == false {
+				last = segment.Number
+			}
+		}
+		for skipped < len(segments) && segments[skipped].InProgress == false && segments[skipped].Number + liveSkipBoundary <= last {
+			skipped++
+		}
+		if skipped != 0 {
+			s += fmt.Sprintf("#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", skipped)
+		}
+	}
+
+	for i, segment := range segments[skipped:] {
+		if options.Key != nil && (i == 0 || options.Key.period(segment.Number) != options.Key.period(segment.Number - 1)) {
+			s += options.Key.tag(options.Key.period(segment.Number), "")
+		}
+		if i == 0 {
+			s += "#EXT-X-PROGRAM-DATE-TIME:" + formatDate(options.StartTime.Add(time.Duration(segment.Number - 1) * time.Duration(fragmentDuration) * time.Second)) + "\n"
+		}
+		for k, part := range segment.Parts {
+			s += fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"%s-%d-%d.m4s\"", part.Duration, prefix, segment.Number, k + 1)
+			if part.Independent == true {
+				s += ",INDEPENDENT=YES"
+			}
+			s += "\n"
+		}
+		if segment.InProgress == false {
+			s += fmt.Sprintf("#EXTINF:%d,\n", fragmentDuration)
+			s += fmt.Sprintf("%s-%d.m4s\n", prefix, segment.Number)
+		}
+	}
+
+	if options.Ended == true {
+		s += "#EXT-X-ENDLIST"
+		return
+	}
+	// Next part, requested by the clients before it is available
+	if options.PartTarget != 0 {
+		last := segments[len(segments) - 1]
+		number, part := last.Number + 1, 1
+		if last.InProgress == true && len(last.Parts) < last.PartCount {
+			number, part = last.Number, len(last.Parts) + 1
+		}
+		s += fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s-%d-%d.m4s\"\n", prefix, number, part)
+	}
+
+	return
+}
+
 func CreateMainDescriptor(jConf mp4.JsonConfig, videoId string) (s string) {
+	// Variants of a playlist package are the ones of its first item, subtitles can't be chained
+	tracks := jConf.Tracks
+	if len(jConf.Playlist) != 0 {
+		tracks = map[string][]mp4.TrackEntry{ "audio": jConf.Playlist[0].Config.Tracks["audio"], "video": jConf.Playlist[0].Config.Tracks["video"] }
+	}
+
+	groups := createAudioGroups(tracks["audio"])
 	s = "#EXTM3U\n"
-	s += createMainVideoDescriptor(jConf.Tracks["video"], videoId)
-	s += createMainAudioDescriptor(jConf.Tracks["audio"], videoId)
-	s += createMainSubtitlesDescriptor(jConf.Tracks["subtitle"], videoId)
+	options := PackageMediaOptions(jConf)
+	if options.Fmp4 == true {
+		s += fmt.Sprintf("#EXT-X-VERSION:%d\n", options.version())
+		s += "#EXT-X-INDEPENDENT-SEGMENTS\n"
+	}
+	s += createMainAudioDescriptor(groups, videoId)
+	s += createMainSubtitlesDescriptor(tracks["subtitle"], videoId)
+	// Muxed variants first, clients ignoring the audio renditions start with the first variant.
+	// CMAF segments are never muxed.
+	if options.Fmp4 == false {
+		s += createMainMuxedDescriptor(tracks["video"], tracks["audio"], len(tracks["subtitle"]) != 0, videoId)
+	}
+	s += createMainVideoDescriptor(tracks["video"], groups, len(tracks["subtitle"]) != 0, videoId)
+	// I-Frames are located in the TS segments of a single package, byte ranges can't be cut in encrypted segments
+	if options.Fmp4 == false && len(jConf.Playlist) == 0 && jConf.Encryption == nil {
+		s += createMainIFramesDescriptor(tracks["video"], videoId)
+	}
 	return
 }
 
@@ -0,0 +1,149 @@
+package hls
+
+import (
+	"mp4"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAudioTrack(lang string, bandwidth uint64, objectType uint8) mp4.TrackEntry {
+	audio := &mp4.StreamAudioEntry{ObjectType: objectType, ChannelConfiguration: 2}
+	return mp4.TrackEntry{Lang: lang, Bandwidth: bandwidth, Config: &mp4.StreamConfig{Type: "audio", Timescale: 48000, SampleDelta: 1024, Audio: audio}}
+}
+
+func testVideoTrack(bandwidth uint64) mp4.TrackEntry {
+	video := &mp4.StreamVideoEntry{Width: 1280, Height: 720, CodecInfo: [3]byte{0x64, 0x00, 0x1f}}
+	return mp4.TrackEntry{Lang: "und", Bandwidth: bandwidth, Config: &mp4.StreamConfig{Type: "video", Timescale: 25000, SampleDelta: 1000, Duration: 25000 * 20, Video: video}}
+}
+
+// Lines of a playlist starting with a tag
+func playlistTags(s string, tag string) (lines []string) {
+	for _, line := range strings.Split(s, "\n") {
+		if strings.HasPrefix(line, tag) {
+			lines = append(lines, line)
+		}
+	}
+	return
+}
+
+func TestDateRangeTag(t *testing.T) {
+	programDateTime := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	dateRange := mp4.DateRange{Id: "intro", Start: 1500}
+	expected := "#EXT-X-DATERANGE:ID=\"intro\",START-DATE=\"2026-01-02T10:00:01.500Z\"\n"
+	if s := dateRangeTag(programDateTime, dateRange); s != expected {
+		t.Errorf("%s\nexpected\n%s", s, expected)
+	}
+
+	dateRange = mp4.DateRange{Id: "intro", Class: "com.afrostream.intro", Start: 1500, Duration: 30250, Skip: true, Attributes: map[string]string{"X-TITLE": "Intro", "X-COM-AFROSTREAM-ID": "42"}}
+	expected = "#EXT-X-DATERANGE:ID=\"intro\",CLASS=\"com.afrostream.intro\",START-DATE=\"2026-01-02T10:00:01.500Z\",DURATION=30.250,X-SKIP=\"YES\",X-COM-AFROSTREAM-ID=\"42\",X-TITLE=\"Intro\"\n"
+	if s := dateRangeTag(programDateTime, dateRange); s != expected {
+		t.Errorf("%s\nexpected\n%s", s, expected)
+	}
+}
+
+func TestCreateMainDescriptorRenditionGroups(t *testing.T) {
+	french := testAudioTrack("fra", 128000, 2)
+	french.Default = true
+	jConf := mp4.JsonConfig{
+		SegmentDuration: 4,
+		Tracks: map[string][]mp4.TrackEntry{
+			"audio":    {testAudioTrack("eng", 64000, 2), french, testAudioTrack("eng", 96000, 2), testAudioTrack("deu", 48000, 5)},
+			"video":    {testVideoTrack(1000000), testVideoTrack(3000000)},
+			"subtitle": {{Lang: "fra", Bandwidth: 256}},
+		},
+	}
+	s := CreateMainDescriptor(jConf, "v")
+
+	expected := []string{
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio-mp4a.40.2",NAME="Français",LANGUAGE="fr",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="v_audio_fra_128000.hls"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio-mp4a.40.2",NAME="English",LANGUAGE="en",DEFAULT=NO,AUTOSELECT=YES,CHANNELS="2",URI="v_audio_eng_96000.hls"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio-mp4a.40.5",NAME="Deutsch",LANGUAGE="de",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="v_audio_deu_48000.hls"`,
+	}
+	if media := playlistTags(s, "#EXT-X-MEDIA:TYPE=AUDIO"); strings.Join(media, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("audio renditions\n%s\nexpected\n%s", strings.Join(media, "\n"), strings.Join(expected, "\n"))
+	}
+	subtitles := playlistTags(s, "#EXT-X-MEDIA:TYPE=SUBTITLES")
+	if len(subtitles) != 1 || !strings.Contains(subtitles[0], `GROUP-ID="subs",NAME="Français",LANGUAGE="fr",DEFAULT=NO,AUTOSELECT=YES`) {
+		t.Errorf("subtitles renditions %q", subtitles)
+	}
+
+	// Each video variant is offered with each audio group and the subtitles
+	variants := playlistTags(s, "#EXT-X-STREAM-INF:")
+	var grouped int
+	for _, variant := range variants {
+		if strings.Contains(variant, `AUDIO="audio-mp4a.40.`) {
+			grouped++
+			if !strings.HasSuffix(variant, `,SUBTITLES="subs"`) {
+				t.Errorf("variant %s without the subtitles group", variant)
+			}
+		}
+	}
+	if grouped != 4 {
+		t.Errorf("%d variants with an audio group, expected 4 in\n%s", grouped, s)
+	}
+	// The muxed variants carry the default language
+	if muxed := strings.Count(s, "v_muxed_fra_"); muxed != 2 {
+		t.Errorf("%d muxed variants with the default language, expected 2 in\n%s", muxed, s)
+	}
+}
+
+func TestCreateAudioGroupsDefault(t *testing.T) {
+	// Without a default flag, the first audio track of the package gives the default language
+	groups := createAudioGroups([]mp4.TrackEntry{testAudioTrack("deu", 48000, 5), testAudioTrack("eng", 64000, 2), testAudioTrack("fra", 64000, 2), testAudioTrack("eng", 48000, 5)})
+	if len(groups) != 2 || groups[0].Renditions[0].Lang != "deu" || groups[1].Renditions[0].Lang != "eng" || groups[1].Renditions[1].Lang != "fra" {
+		t.Errorf("groups %+v", groups)
+	}
+	for _, group := range groups {
+		if defaults := strings.Count(createMainAudioDescriptor([]audioGroup{group}, "v"), "DEFAULT=YES"); defaults != 1 {
+			t.Errorf("%d default renditions in the group %s", defaults, group.Id)
+		}
+	}
+}
+
+func TestCreateMediaDescriptorFmp4(t *testing.T) {
+	s := CreateMediaDescriptor(4, 3, "v", "video", "und", 1000000, MediaOptions{Fmp4: true})
+	expected := "#EXTM3U\n" +
+		"#EXT-X-TARGETDURATION:4\n" +
+		"#EXT-X-VERSION:7\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-MAP:URI=\"v_video_und_1000000.dash\"\n" +
+		"#EXTINF:4,\n" +
+		"v_video_und_1000000-1.m4s\n" +
+		"#EXTINF:4,\n" +
+		"v_video_und_1000000-2.m4s\n" +
+		"#EXTINF:4,\n" +
+		"v_video_und_1000000-3.m4s\n" +
+		"#EXT-X-ENDLIST"
+	if s != expected {
+		t.Errorf("%s\nexpected\n%s", s, expected)
+	}
+
+	// TS segments have no media initialization
+	if s := CreateMediaDescriptor(4, 3, "v", "video", "und", 1000000, MediaOptions{}); strings.Contains(s, "#EXT-X-MAP") || strings.Contains(s, ".m4s") || !strings.Contains(s, "v_video_und_1000000-3.ts\n") {
+		t.Errorf("TS media playlist\n%s", s)
+	}
+}
+
+func TestCreatePlaylistMediaDescriptorFmp4(t *testing.T) {
+	items := []ItemSegments{{Prefix: "/video/a/a_video_und_1000000", First: 1, Last: 2, SegmentDuration: 4}, {Prefix: "/video/b/b_video_und_1000000", First: 3, Last: 3, SegmentDuration: 6}}
+	s := CreatePlaylistMediaDescriptor(items, MediaOptions{Fmp4: true})
+	expected := "#EXT-X-TARGETDURATION:6\n" +
+		"#EXT-X-VERSION:7\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-DISCONTINUITY-SEQUENCE:0\n" +
+		"#EXT-X-MAP:URI=\"/video/a/a_video_und_1000000.dash\"\n" +
+		"#EXTINF:4,\n" +
+		"/video/a/a_video_und_1000000-1.m4s\n" +
+		"#EXTINF:4,\n" +
+		"/video/a/a_video_und_1000000-2.m4s\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXT-X-MAP:URI=\"/video/b/b_video_und_1000000.dash\"\n" +
+		"#EXTINF:6,\n" +
+		"/video/b/b_video_und_1000000-3.m4s\n" +
+		"#EXT-X-ENDLIST"
+	if !strings.HasSuffix(s, expected) {
+		t.Errorf("%s\nexpected to end with\n%s", s, expected)
+	}
+}
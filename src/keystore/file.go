@@ -0,0 +1,104 @@
+package keystore
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "os"
+    "sync"
+)
+
+// Key store file: the JSON map of the assets by asset ID, sealed with AES-256-GCM. The file is the nonce followed
+// by the sealed map.
+type fileBackend struct {
+    filename string
+    aead     cipher.AEAD
+    lock     sync.Mutex
+}
+
+func newFileBackend(filename string, secret string) (backend *fileBackend, err error) {
+    key, err := hex.DecodeString(secret)
+    if err != nil || len(key) != 32 {
+        return nil, errors.New("The key of a key store file must be 32 bytes long in hexadecimal")
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return
+    }
+    aead, err := cipher.NewGCM(block)
+    if err != nil {
+        return
+    }
+    return &fileBackend{ filename: filename, aead: aead }, nil
+}
+
+func (backend *fileBackend) read() (assets map[string]Asset, err error) {
+    assets = make(map[string]Asset)
+    data, err := ioutil.ReadFile(backend.filename)
+    if os.IsNotExist(err) {
+        return assets, nil
+    }
+    if err != nil {
+        return
+    }
+
+    nonceSize := backend.aead.NonceSize()
+    if len(data) < nonceSize {
+        return nil, errors.New("Invalid key store file " + backend.filename)
+    }
+    plain, err := backend.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+    if err != nil {
+        return nil, errors.New("Cannot open key store file " + backend.filename + ": wrong key or corrupted file")
+    }
+    err = json.Unmarshal(plain, &assets)
+    return
+}
+
+func (backend *fileBackend) Load(assetId string) (asset Asset, err error) {
+    backend.lock.Lock()
+    defer backend.lock.Unlock()
+
+    assets, err := backend.read()
+    if err != nil {
+        return
+    }
+    asset, ok := assets[assetId]
+    if ok == false {
+        err = ErrAssetNotFound
+    }
+    return
+}
+
+// Store the keys of an asset, the file is replaced atomically
+func (backend *fileBackend) Store(assetId string, asset Asset) (err error) {
+    backend.lock.Lock()
+    defer backend.lock.Unlock()
+
+    assets, err := backend.read()
+    if err != nil {
+        return
+    }
+    assets[assetId] = asset
+    plain, err := json.Marshal(assets)
+    if err != nil {
+        return
+    }
+
+    nonce := make([]byte, backend.aead.NonceSize())
+    _, err = rand.Read(nonce)
+    if err != nil {
+        return
+    }
+    data := backend.aead.Seal(nonce, nonce, plain, nil)
+
+    tmpFilename := backend.filename + ".tmp"
+    err = ioutil.WriteFile(tmpFilename, data, 0600)
+    if err != nil {
+        return
+    }
+    return os.Rename(tmpFilename, backend.filename)
+}
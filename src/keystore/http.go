@@ -0,0 +1,69 @@
+package keystore
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+// Key management service answering GET and PUT requests on <url>/assets/<asset ID> with the JSON keys of the
+// asset, authorized by a bearer token
+type httpBackend struct {
+    url   string
+    token string
+}
+
+var httpClient = &http.Client{ Timeout: 10 * time.Second }
+
+func (backend *httpBackend) request(method string, assetId string, body []byte) (res *http.Response, err error) {
+    req, err := http.NewRequest(method, backend.url + "/assets/" + url.PathEscape(assetId), bytes.NewReader(body))
+    if err != nil {
+        return
+    }
+    if backend.token != "" {
+        req.Header.Set("Authorization", "Bearer " + backend.token)
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    return httpClient.Do(req)
+}
+
+func (backend *httpBackend) Load(assetId string) (asset Asset, err error) {
+    res, err := backend.request("GET", assetId, nil)
+    if err != nil {
+        return
+    }
+    defer res.Body.Close()
+
+    switch res.StatusCode {
+        case http.StatusOK:
+            err = json.NewDecoder(res.Body).Decode(&asset)
+        case http.StatusNotFound:
+            err = ErrAssetNotFound
+        default:
+            err = errors.New("Key store answered " + strconv.Itoa(res.StatusCode) + " for asset " + assetId)
+    }
+    return
+}
+
+func (backend *httpBackend) Store(assetId string, asset Asset) (err error) {
+    body, err := json.Marshal(asset)
+    if err != nil {
+        return
+    }
+    res, err := backend.request("PUT", assetId, body)
+    if err != nil {
+        return
+    }
+    res.Body.Close()
+
+    if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusNoContent {
+        err = errors.New("Key store answered " + strconv.Itoa(res.StatusCode) + " storing asset " + assetId)
+    }
+    return
+}
@@ -0,0 +1,36 @@
+package keystore
+
+import (
+    "errors"
+    "strings"
+)
+
+// Content key of an asset in the key store
+type Key struct {
+    KeyType string // Tracks encrypted with the key: "audio", "video", "sd", "hd", "uhd", or "" for all the tracks
+    Period  uint32 `json:",omitempty"` // Key period, the first key period is 0
+    KeyId   string // Key ID in 32 hexadecimal digits
+    Key     string // Content key in 32 hexadecimal digits
+}
+
+// Keys of an asset
+type Asset struct {
+    Keys []Key
+}
+
+// Storage of the keys of the assets
+type Backend interface {
+    Load(assetId string) (Asset, error)
+    Store(assetId string, asset Asset) error
+}
+
+var ErrAssetNotFound = errors.New("Asset not found in the key store")
+
+// Open the key store at a location: the URL of an HTTP KMS, or the filename of an encrypted key store file.
+// The secret is the bearer token of the KMS, or the AES-256 key of the file in 64 hexadecimal digits.
+func Open(location string, secret string) (backend Backend, err error) {
+    if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+        return &httpBackend{ url: strings.TrimSuffix(location, "/"), token: secret }, nil
+    }
+    return newFileBackend(location, secret)
+}
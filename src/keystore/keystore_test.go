@@ -0,0 +1,140 @@
+package keystore
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+)
+
+const testSecret = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+var testAsset = Asset{ Keys: []Key{
+    { KeyType: "audio", KeyId: "10000000-1000-1000-1000-100000000001", Key: "000102030405060708090a0b0c0d0e0f" },
+    { KeyType: "hd", Period: 1, KeyId: "10000000-1000-1000-1000-100000000002", Key: "101112131415161718191a1b1c1d1e1f" },
+} }
+
+func TestFileBackend(t *testing.T) {
+    filename := filepath.Join(t.TempDir(), "keys.db")
+    backend, err := Open(filename, testSecret)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := backend.Load("movie"); err != ErrAssetNotFound {
+        t.Errorf("load from a missing file: %v", err)
+    }
+    if err := backend.Store("movie", testAsset); err != nil {
+        t.Fatal(err)
+    }
+    if err := backend.Store("trailer", Asset{ Keys: testAsset.Keys[:1] }); err != nil {
+        t.Fatal(err)
+    }
+
+    asset, err := backend.Load("movie")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(asset, testAsset) {
+        t.Errorf("asset %+v, expected %+v", asset, testAsset)
+    }
+    if _, err := backend.Load("other"); err != ErrAssetNotFound {
+        t.Errorf("load of an unknown asset: %v", err)
+    }
+
+    // The keys are sealed in the file
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(string(data), testAsset.Keys[0].Key) || strings.Contains(string(data), "movie") {
+        t.Error("clear keys in the key store file")
+    }
+
+    other, _ := Open(filename, strings.Repeat("11", 32))
+    if _, err := other.Load("movie"); err == nil || err == ErrAssetNotFound {
+        t.Errorf("load with another key: %v", err)
+    }
+
+    data[len(data)-1] ^= 0x01
+    if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := backend.Load("movie"); err == nil || err == ErrAssetNotFound {
+        t.Errorf("load of a corrupted file: %v", err)
+    }
+}
+
+func TestFileBackendSecret(t *testing.T) {
+    for _, secret := range []string{ "", "s3cret", testSecret[:32], testSecret + "20" } {
+        if _, err := Open(filepath.Join(t.TempDir(), "keys.db"), secret); err == nil {
+            t.Errorf("key store file opened with the key %q", secret)
+        }
+    }
+}
+
+func TestHttpBackend(t *testing.T) {
+    var lock sync.Mutex
+    assets := make(map[string][]byte)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Authorization") != "Bearer t0ken" {
+            w.WriteHeader(http.StatusUnauthorized)
+            return
+        }
+        lock.Lock()
+        defer lock.Unlock()
+        switch r.Method {
+            case "GET":
+                data, ok := assets[r.URL.EscapedPath()]
+                if ok == false {
+                    w.WriteHeader(http.StatusNotFound)
+                    return
+                }
+                w.Write(data)
+            case "PUT":
+                data, _ := ioutil.ReadAll(r.Body)
+                assets[r.URL.EscapedPath()] = data
+                w.WriteHeader(http.StatusCreated)
+        }
+    }))
+    defer server.Close()
+
+    backend, err := Open(server.URL + "/", "t0ken")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := backend.Store("movie/1", testAsset); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := assets["/assets/movie%2F1"]; ok == false {
+        t.Errorf("asset stored at %v, expected /assets/movie%%2F1", reflect.ValueOf(assets).MapKeys())
+    }
+    var stored Asset
+    if err := json.Unmarshal(assets["/assets/movie%2F1"], &stored); err != nil || !reflect.DeepEqual(stored, testAsset) {
+        t.Errorf("stored asset %s", assets["/assets/movie%2F1"])
+    }
+
+    asset, err := backend.Load("movie/1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(asset, testAsset) {
+        t.Errorf("asset %+v, expected %+v", asset, testAsset)
+    }
+    if _, err := backend.Load("other"); err != ErrAssetNotFound {
+        t.Errorf("load of an unknown asset: %v", err)
+    }
+
+    unauthorized, _ := Open(server.URL, "other")
+    if _, err := unauthorized.Load("movie/1"); err == nil || err == ErrAssetNotFound {
+        t.Errorf("load without authorization: %v", err)
+    }
+    if err := unauthorized.Store("movie/1", testAsset); err == nil {
+        t.Error("asset stored without authorization")
+    }
+}
@@ -0,0 +1,438 @@
+package mp4
+
+import (
+	"errors"
+)
+
+// Fields of an H.264 sequence parameter set needed to parse the slice headers (ISO/IEC 14496-10 7.3.2.1)
+type avcSps struct {
+	ChromaArrayType         uint32
+	SeparateColourPlane     bool
+	Log2MaxFrameNum         uint32
+	PicOrderCntType         uint32
+	Log2MaxPicOrderCntLsb   uint32
+	DeltaPicOrderAlwaysZero bool
+	FrameMbsOnly            bool
+	PicSizeInMapUnits       uint32
+}
+
+// Fields of an H.264 picture parameter set needed to parse the slice headers (ISO/IEC 14496-10 7.3.2.2)
+type avcPps struct {
+	SpsId                             uint32
+	EntropyCodingMode                 bool
+	BottomFieldPicOrderInFramePresent bool
+	NumSliceGroups                    uint32
+	SliceGroupMapType                 uint32
+	SliceGroupChangeRate              uint32
+	NumRefIdxL0DefaultActive          uint32
+	NumRefIdxL1DefaultActive          uint32
+	WeightedPred                      bool
+	WeightedBipredIdc                 uint32
+	DeblockingFilterControlPresent    bool
+	RedundantPicCntPresent            bool
+}
+
+// Parameter sets of an H.264 track, from its avcC box and from the SPS and PPS NAL units of its samples
+type avcParameterSets struct {
+	sps map[uint32]avcSps
+	pps map[uint32]avcPps
+}
+
+// Reader of the bits of a NAL unit, skipping its emulation prevention bytes
+type nalReader struct {
+	nal   []byte
+	pos   int  // Position of the next byte in the NAL unit
+	cur   byte // Byte being read
+	left  uint // Bits left in the byte being read
+	zeros int  // Zero bytes before the next byte
+	err   error
+}
+
+var errNalTruncated = errors.New("Truncated NAL unit")
+
+func newAvcParameterSets(video *StreamVideoEntry) *avcParameterSets {
+	params := &avcParameterSets{ sps: make(map[uint32]avcSps), pps: make(map[uint32]avcPps) }
+	if video == nil {
+		return params
+	}
+	for i := 0; i < int(video.SPSEntryCount) && (i + 1) * int(video.SPSSize) <= len(video.SPSData); i++ {
+		params.add(video.SPSData[i*int(video.SPSSize):(i+1)*int(video.SPSSize)])
+	}
+	for i := 0; i < int(video.PPSEntryCount) && (i + 1) * int(video.PPSSize) <= len(video.PPSData); i++ {
+		params.add(video.PPSData[i*int(video.PPSSize):(i+1)*int(video.PPSSize)])
+	}
+	return params
+}
+
+// Add an SPS or a PPS NAL unit, the other NAL units and the parameter sets that cannot be parsed are ignored
+func (params *avcParameterSets) add(nal []byte) {
+	if len(nal) < 2 {
+		return
+	}
+	r := &nalReader{ nal: nal, pos: 1 }
+	switch nal[0] & 0x1f {
+		case 7:
+			id, sps := r.sps()
+			if r.err == nil {
+				params.sps[id] = sps
+			}
+		case 8:
+			id, pps := r.pps()
+			if r.err == nil {
+				params.pps[id] = pps
+			}
+	}
+}
+
+// Size in bytes of the header of a slice NAL unit (nal_unit_type 1 or 5), up to the first byte holding
+// slice_data(): the header byte, the slice header and, with CABAC, the alignment bits. The size counts the
+// emulation prevention bytes of the NAL unit.
+func (params *avcParameterSets) sliceHeaderSize(nal []byte) (size int, err error) {
+	if len(nal) < 2 {
+		return 0, errNalTruncated
+	}
+	nalRefIdc := nal[0] >> 5 & 0x03
+	idr := nal[0] & 0x1f == 5
+	r := &nalReader{ nal: nal, pos: 1 }
+
+	r.ue() // first_mb_in_slice
+	sliceType := r.ue() % 5
+	ppsId := r.ue()
+	if r.err != nil {
+		return 0, r.err
+	}
+	pps, ok := params.pps[ppsId]
+	if !ok {
+		return 0, errors.New("Unknown picture parameter set")
+	}
+	sps, ok := params.sps[pps.SpsId]
+	if !ok {
+		return 0, errors.New("Unknown sequence parameter set")
+	}
+	p, b, sp, si := sliceType == 0, sliceType == 1, sliceType == 3, sliceType == 4
+
+	if sps.SeparateColourPlane {
+		r.u(2) // colour_plane_id
+	}
+	r.u(sps.Log2MaxFrameNum) // frame_num
+	fieldPic := false
+	if !sps.FrameMbsOnly {
+		fieldPic = r.flag()
+		if fieldPic {
+			r.u(1) // bottom_field_flag
+		}
+	}
+	if idr {
+		r.ue() // idr_pic_id
+	}
+	if sps.PicOrderCntType == 0 {
+		r.u(sps.Log2MaxPicOrderCntLsb) // pic_order_cnt_lsb
+		if pps.BottomFieldPicOrderInFramePresent && !fieldPic {
+			r.se() // delta_pic_order_cnt_bottom
+		}
+	}
+	if sps.PicOrderCntType == 1 && !sps.DeltaPicOrderAlwaysZero {
+		r.se() // delta_pic_order_cnt[0]
+		if pps.BottomFieldPicOrderInFramePresent && !fieldPic {
+			r.se() // delta_pic_order_cnt[1]
+		}
+	}
+	if pps.RedundantPicCntPresent {
+		r.ue() // redundant_pic_cnt
+	}
+	if b {
+		r.u(1) // direct_spatial_mv_pred_flag
+	}
+	numRefIdxL0, numRefIdxL1 := pps.NumRefIdxL0DefaultActive, pps.NumRefIdxL1DefaultActive
+	if p || sp || b {
+		if r.flag() { // num_ref_idx_active_override_flag
+			numRefIdxL0 = r.ue() + 1
+			if b {
+				numRefIdxL1 = r.ue() + 1
+			}
+		}
+	}
+
+	// ref_pic_list_modification()
+	if !(sliceType == 2 || si) {
+		r.refPicListModification()
+		if b {
+			r.refPicListModification()
+		}
+	}
+
+	// pred_weight_table()
+	if (pps.WeightedPred && (p || sp)) || (pps.WeightedBipredIdc == 1 && b) {
+		r.ue() // luma_log2_weight_denom
+		if sps.ChromaArrayType != 0 {
+			r.ue() // chroma_log2_weight_denom
+		}
+		r.weights(numRefIdxL0, sps.ChromaArrayType != 0)
+		if b {
+			r.weights(numRefIdxL1, sps.ChromaArrayType != 0)
+		}
+	}
+
+	// dec_ref_pic_marking()
+	if nalRefIdc != 0 {
+		if idr {
+			r.u(2) // no_output_of_prior_pics_flag, long_term_reference_flag
+		} else if r.flag() { // adaptive_ref_pic_marking_mode_flag
+			for r.err == nil {
+				operation := r.ue() // memory_management_control_operation
+				if operation == 0 {
+					break
+				}
+				if operation == 1 || operation == 3 {
+					r.ue() // difference_of_pic_nums_minus1
+				}
+				if operation == 2 {
+					r.ue() // long_term_pic_num
+				}
+				if operation == 3 || operation == 6 {
+					r.ue() // long_term_frame_idx
+				}
+				if operation == 4 {
+					r.ue() // max_long_term_frame_idx_plus1
+				}
+			}
+		}
+	}
+
+	if pps.EntropyCodingMode && sliceType != 2 && !si {
+		r.ue() // cabac_init_idc
+	}
+	r.se() // slice_qp_delta
+	if sp || si {
+		if sp {
+			r.u(1) // sp_for_switch_flag
+		}
+		r.se() // slice_qs_delta
+	}
+	if pps.DeblockingFilterControlPresent {
+		if r.ue() != 1 { // disable_deblocking_filter_idc
+			r.se() // slice_alpha_c0_offset_div2
+			r.se() // slice_beta_offset_div2
+		}
+	}
+	if pps.NumSliceGroups > 1 && pps.SliceGroupMapType >= 3 && pps.SliceGroupMapType <= 5 && pps.SliceGroupChangeRate != 0 {
+		r.u(ceilLog2(sps.PicSizeInMapUnits / pps.SliceGroupChangeRate + 1)) // slice_group_change_cycle
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	// The bits left in the last byte read are the start of the slice data with CAVLC, or alignment bits with
+	// CABAC: this byte stays clear too
+	return r.pos, nil
+}
+
+func (r *nalReader) sps() (id uint32, sps avcSps) {
+	profile := r.u(8)
+	r.u(16) // constraint_set flags, reserved_zero_2bits, level_idc
+	id = r.ue()
+	sps.ChromaArrayType = 1
+	switch profile {
+		case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+			chromaFormat := r.ue()
+			if chromaFormat == 3 {
+				sps.SeparateColourPlane = r.flag()
+			}
+			sps.ChromaArrayType = chromaFormat
+			if sps.SeparateColourPlane {
+				sps.ChromaArrayType = 0
+			}
+			r.ue() // bit_depth_luma_minus8
+			r.ue() // bit_depth_chroma_minus8
+			r.u(1) // qpprime_y_zero_transform_bypass_flag
+			if r.flag() { // seq_scaling_matrix_present_flag
+				lists := 8
+				if chromaFormat == 3 {
+					lists = 12
+				}
+				for i := 0; i < lists; i++ {
+					if r.flag() { // seq_scaling_list_present_flag
+						if i < 6 {
+							r.scalingList(16)
+						} else {
+							r.scalingList(64)
+						}
+					}
+				}
+			}
+	}
+	sps.Log2MaxFrameNum = r.ue() + 4
+	sps.PicOrderCntType = r.ue()
+	switch sps.PicOrderCntType {
+		case 0:
+			sps.Log2MaxPicOrderCntLsb = r.ue() + 4
+		case 1:
+			sps.DeltaPicOrderAlwaysZero = r.flag()
+			r.se() // offset_for_non_ref_pic
+			r.se() // offset_for_top_to_bottom_field
+			cycle := r.ue()
+			for i := uint32(0); i < cycle && r.err == nil; i++ {
+				r.se() // offset_for_ref_frame
+			}
+	}
+	r.ue() // max_num_ref_frames
+	r.u(1) // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	sps.FrameMbsOnly = r.flag()
+	sps.PicSizeInMapUnits = widthInMbs * heightInMapUnits
+	return
+}
+
+func (r *nalReader) pps() (id uint32, pps avcPps) {
+	id = r.ue()
+	pps.SpsId = r.ue()
+	pps.EntropyCodingMode = r.flag()
+	pps.BottomFieldPicOrderInFramePresent = r.flag()
+	pps.NumSliceGroups = r.ue() + 1
+	if pps.NumSliceGroups > 1 {
+		pps.SliceGroupMapType = r.ue()
+		switch pps.SliceGroupMapType {
+			case 0:
+				for i := uint32(0); i < pps.NumSliceGroups && r.err == nil; i++ {
+					r.ue() // run_length_minus1
+				}
+			case 2:
+				for i := uint32(1); i < pps.NumSliceGroups && r.err == nil; i++ {
+					r.ue() // top_left
+					r.ue() // bottom_right
+				}
+			case 3, 4, 5:
+				r.u(1) // slice_group_change_direction_flag
+				pps.SliceGroupChangeRate = r.ue() + 1
+			case 6:
+				units := r.ue() + 1
+				bits := ceilLog2(pps.NumSliceGroups)
+				for i := uint32(0); i < units && r.err == nil; i++ {
+					r.u(bits) // slice_group_id
+				}
+		}
+	}
+	pps.NumRefIdxL0DefaultActive = r.ue() + 1
+	pps.NumRefIdxL1DefaultActive = r.ue() + 1
+	pps.WeightedPred = r.flag()
+	pps.WeightedBipredIdc = r.u(2)
+	r.se() // pic_init_qp_minus26
+	r.se() // pic_init_qs_minus26
+	r.se() // chroma_qp_index_offset
+	pps.DeblockingFilterControlPresent = r.flag()
+	r.u(1) // constrained_intra_pred_flag
+	pps.RedundantPicCntPresent = r.flag()
+	return
+}
+
+func (r *nalReader) scalingList(size int) {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+func (r *nalReader) refPicListModification() {
+	if !r.flag() { // ref_pic_list_modification_flag
+		return
+	}
+	for r.err == nil {
+		idc := r.ue() // modification_of_pic_nums_idc
+		if idc == 3 {
+			return
+		}
+		r.ue() // abs_diff_pic_num_minus1 or long_term_pic_num
+	}
+}
+
+func (r *nalReader) weights(numRefIdx uint32, chroma bool) {
+	for i := uint32(0); i < numRefIdx && r.err == nil; i++ {
+		if r.flag() { // luma_weight_flag
+			r.se() // luma_weight
+			r.se() // luma_offset
+		}
+		if chroma && r.flag() { // chroma_weight_flag
+			for j := 0; j < 4; j++ {
+				r.se() // chroma_weight, chroma_offset of Cb and Cr
+			}
+		}
+	}
+}
+
+func (r *nalReader) bit() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if r.left == 0 {
+		if r.pos >= len(r.nal) {
+			r.err = errNalTruncated
+			return 0
+		}
+		b := r.nal[r.pos]
+		r.pos++
+		if r.zeros >= 2 && b == 0x03 {
+			// emulation_prevention_three_byte
+			r.zeros = 0
+			if r.pos >= len(r.nal) {
+				r.err = errNalTruncated
+				return 0
+			}
+			b = r.nal[r.pos]
+			r.pos++
+		}
+		if b == 0 {
+			r.zeros++
+		} else {
+			r.zeros = 0
+		}
+		r.cur, r.left = b, 8
+	}
+	r.left--
+	return uint32(r.cur >> r.left & 0x01)
+}
+
+func (r *nalReader) flag() bool {
+	return r.bit() == 1
+}
+
+func (r *nalReader) u(n uint32) (v uint32) {
+	for i := uint32(0); i < n; i++ {
+		v = v << 1 | r.bit()
+	}
+	return
+}
+
+// Unsigned Exp-Golomb code
+func (r *nalReader) ue() uint32 {
+	zeros := uint32(0)
+	for r.bit() == 0 && r.err == nil {
+		zeros++
+		if zeros > 31 {
+			r.err = errors.New("Invalid Exp-Golomb code")
+			return 0
+		}
+	}
+	return (1 << zeros) - 1 + r.u(zeros)
+}
+
+// Signed Exp-Golomb code
+func (r *nalReader) se() int32 {
+	v := r.ue()
+	if v & 0x01 == 1 {
+		return int32(v / 2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+func ceilLog2(v uint32) (n uint32) {
+	for (1 << n) < v {
+		n++
+	}
+	return
+}
@@ -0,0 +1,312 @@
+package mp4
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// Writer of the RBSP bits of the NAL units of the tests
+type bitWriter struct {
+	bits []byte
+}
+
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		w.bits = append(w.bits, byte(v>>uint(i))&0x01)
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	n := 0
+	for (v+1)>>uint(n) > 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v+1)
+}
+
+func (w *bitWriter) se(v int32) {
+	if v > 0 {
+		w.ue(uint32(2*v - 1))
+	} else {
+		w.ue(uint32(-2 * v))
+	}
+}
+
+// NAL unit of a header byte and of the bits written, with the emulation prevention bytes
+func (w *bitWriter) nal(header byte) []byte {
+	rbsp := make([]byte, (len(w.bits)+7)/8)
+	for i, b := range w.bits {
+		rbsp[i/8] |= b << uint(7-i%8)
+	}
+	nal := []byte{header}
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			nal = append(nal, 0x03)
+			zeros = 0
+		}
+		nal = append(nal, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return nal
+}
+
+func testSps(log2MaxFrameNum int, log2MaxPicOrderCntLsb int) []byte {
+	var w bitWriter
+	w.u(8, 66) // Baseline
+	w.u(16, 0x001e)
+	w.ue(0) // seq_parameter_set_id
+	w.ue(uint32(log2MaxFrameNum - 4))
+	w.ue(0) // pic_order_cnt_type
+	w.ue(uint32(log2MaxPicOrderCntLsb - 4))
+	w.ue(4) // max_num_ref_frames
+	w.u(1, 0)
+	w.ue(39)    // pic_width_in_mbs_minus1
+	w.ue(29)    // pic_height_in_map_units_minus1
+	w.u(1, 1)   // frame_mbs_only_flag
+	w.u(3, 0x4) // direct_8x8_inference_flag, frame_cropping_flag, vui_parameters_present_flag, rbsp_stop_one_bit
+	return w.nal(0x67)
+}
+
+func testPps(cabac bool, weightedPred bool) []byte {
+	var w bitWriter
+	w.ue(0) // pic_parameter_set_id
+	w.ue(0) // seq_parameter_set_id
+	if cabac {
+		w.u(1, 1)
+	} else {
+		w.u(1, 0)
+	}
+	w.u(1, 0)
+	w.ue(0) // num_slice_groups_minus1
+	w.ue(2) // num_ref_idx_l0_default_active_minus1
+	w.ue(0)
+	if weightedPred {
+		w.u(1, 1)
+	} else {
+		w.u(1, 0)
+	}
+	w.u(2, 0)
+	w.se(0)
+	w.se(0)
+	w.se(0)
+	w.u(1, 1) // deblocking_filter_control_present_flag
+	w.u(1, 0)
+	w.u(1, 0)
+	w.u(1, 1)
+	return w.nal(0x68)
+}
+
+func testParameterSets(sps []byte, pps []byte) *avcParameterSets {
+	params := newAvcParameterSets(nil)
+	params.add(sps)
+	params.add(pps)
+	return params
+}
+
+func TestSliceHeaderSizeCavlc(t *testing.T) {
+	params := testParameterSets(testSps(4, 6), testPps(false, true))
+
+	// P slice with a reference list modification, a weight table and memory management operations
+	var w bitWriter
+	w.ue(0) // first_mb_in_slice
+	w.ue(5) // slice_type P
+	w.ue(0)
+	w.u(4, 3) // frame_num
+	w.u(6, 6) // pic_order_cnt_lsb
+	w.u(1, 1) // num_ref_idx_active_override_flag
+	w.ue(3)
+	w.u(1, 1) // ref_pic_list_modification_flag_l0
+	w.ue(0)
+	w.ue(5)
+	w.ue(1)
+	w.ue(2)
+	w.ue(3)
+	w.ue(6) // luma_log2_weight_denom
+	w.ue(6) // chroma_log2_weight_denom
+	for i := 0; i < 4; i++ {
+		w.u(1, 1)
+		w.se(100)
+		w.se(-30)
+		w.u(1, 1)
+		w.se(64)
+		w.se(-12)
+		w.se(70)
+		w.se(9)
+	}
+	w.u(1, 1) // adaptive_ref_pic_marking_mode_flag
+	w.ue(1)
+	w.ue(7)
+	w.ue(3)
+	w.ue(2)
+	w.ue(1)
+	w.ue(0)
+	w.se(-2) // slice_qp_delta
+	w.ue(0)  // disable_deblocking_filter_idc
+	w.se(1)
+	w.se(-1)
+	headerBits := len(w.bits)
+	w.u(16, 0xbeef) // slice_data()
+	nal := w.nal(0x41)
+
+	size, err := params.sliceHeaderSize(nal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 1 + (headerBits+7)/8; size != expected {
+		t.Errorf("slice header size %d, expected %d", size, expected)
+	}
+	if size <= 32 {
+		t.Errorf("slice header size %d, the test header should be longer than 32 bytes", size)
+	}
+}
+
+func TestSliceHeaderSizeCabac(t *testing.T) {
+	params := testParameterSets(testSps(4, 6), testPps(true, false))
+
+	var w bitWriter
+	w.ue(0)
+	w.ue(7) // slice_type I
+	w.ue(0)
+	w.u(4, 0)
+	w.ue(0) // idr_pic_id
+	w.u(6, 0)
+	w.u(2, 0) // no_output_of_prior_pics_flag, long_term_reference_flag
+	w.se(3)
+	w.ue(1) // disable_deblocking_filter_idc
+	headerBits := len(w.bits)
+	for len(w.bits)%8 != 0 {
+		w.u(1, 1) // cabac_alignment_one_bit
+	}
+	w.u(8, 0xa5)
+	nal := w.nal(0x65)
+
+	size, err := params.sliceHeaderSize(nal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 1 + (headerBits+7)/8; size != expected {
+		t.Errorf("slice header size %d, expected %d", size, expected)
+	}
+	if nal[size] != 0xa5 {
+		t.Errorf("slice data starts with %#x, expected 0xa5", nal[size])
+	}
+}
+
+func TestSliceHeaderSizeEmulationPrevention(t *testing.T) {
+	params := testParameterSets(testSps(16, 16), testPps(false, false))
+
+	// The zero frame_num and pic_order_cnt_lsb need emulation prevention bytes in the slice header
+	var w bitWriter
+	w.ue(0)
+	w.ue(5)
+	w.ue(0)
+	w.u(16, 0)
+	w.u(16, 0)
+	w.u(1, 0) // num_ref_idx_active_override_flag
+	w.u(1, 0) // ref_pic_list_modification_flag_l0
+	w.u(1, 0) // adaptive_ref_pic_marking_mode_flag
+	w.se(0)
+	w.ue(1)
+	headerBits := len(w.bits)
+	w.u(8, 0xff)
+	nal := w.nal(0x21)
+
+	size, err := params.sliceHeaderSize(nal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := nal[:size]
+	emulation := 0
+	for i := 2; i < len(header); i++ {
+		if header[i] == 0x03 && header[i-1] == 0 && header[i-2] == 0 {
+			emulation++
+		}
+	}
+	if emulation == 0 {
+		t.Fatal("the test header should hold emulation prevention bytes")
+	}
+	if expected := 1 + (headerBits+7)/8 + emulation; size != expected {
+		t.Errorf("slice header size %d, expected %d", size, expected)
+	}
+}
+
+func TestSliceHeaderSizeUnknownParameterSet(t *testing.T) {
+	params := testParameterSets(testSps(4, 6), testPps(false, false))
+
+	var w bitWriter
+	w.ue(0)
+	w.ue(5)
+	w.ue(3) // pic_parameter_set_id
+	w.u(32, 0xffffffff)
+	if _, err := params.sliceHeaderSize(w.nal(0x41)); err == nil {
+		t.Error("slice of an unknown PPS parsed")
+	}
+}
+
+func TestAvcParameterSetsFromTrack(t *testing.T) {
+	// SPS and PPS of a High profile 640x360 x264 stream
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAHqzZQKAv+XARAAADAAEAAAMAMg8WLZY=")
+	pps, _ := base64.StdEncoding.DecodeString("aOvjyyLA")
+	video := &StreamVideoEntry{SPSEntryCount: 1, SPSSize: uint16(len(sps)), SPSData: sps, PPSEntryCount: 1, PPSSize: uint16(len(pps)), PPSData: pps}
+	params := newAvcParameterSets(video)
+
+	s, ok := params.sps[0]
+	if !ok {
+		t.Fatal("SPS not parsed")
+	}
+	if s.ChromaArrayType != 1 || s.Log2MaxFrameNum != 4 || s.PicOrderCntType != 0 || s.Log2MaxPicOrderCntLsb != 6 || !s.FrameMbsOnly || s.PicSizeInMapUnits != 40*23 {
+		t.Errorf("SPS parsed as %+v", s)
+	}
+	p, ok := params.pps[0]
+	if !ok {
+		t.Fatal("PPS not parsed")
+	}
+	if !p.EntropyCodingMode || p.NumSliceGroups != 1 || p.NumRefIdxL0DefaultActive != 3 || !p.DeblockingFilterControlPresent {
+		t.Errorf("PPS parsed as %+v", p)
+	}
+}
+
+func TestNalSubsamples(t *testing.T) {
+	params := testParameterSets(testSps(4, 6), testPps(false, false))
+
+	var w bitWriter
+	w.ue(0)
+	w.ue(5)
+	w.ue(0)
+	w.u(4, 1)
+	w.u(6, 2)
+	w.u(1, 0)
+	w.u(1, 0)
+	w.u(1, 0)
+	w.se(0)
+	w.ue(1)
+	for i := 0; i < 100; i++ {
+		w.u(8, 0x5a)
+	}
+	slice := w.nal(0x41)
+	headerSize, _ := params.sliceHeaderSize(slice)
+	sei := []byte{0x06, 0x05, 0x01, 0x00, 0x80}
+
+	var sample []byte
+	for _, nal := range [][]byte{sei, slice} {
+		sample = append(sample, 0, 0, 0, byte(len(nal)))
+		sample = append(sample, nal...)
+	}
+	subsamples := nalSubsamples(sample, 4, params)
+	if len(subsamples) != 1 {
+		t.Fatalf("%d subsamples, expected 1", len(subsamples))
+	}
+	protected := (len(slice) - headerSize) / 16 * 16
+	if subsamples[0].ProtectedBytes != uint32(protected) || int(subsamples[0].ClearBytes) != len(sample)-protected {
+		t.Errorf("subsample %+v, expected %d protected bytes", subsamples[0], protected)
+	}
+	if int(subsamples[0].ClearBytes) < 4+len(sei)+4+headerSize {
+		t.Error("slice header protected")
+	}
+}
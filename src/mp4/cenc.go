@@ -0,0 +1,1098 @@
+package mp4
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Common encryption of the samples of a track (ISO/IEC 23001-7)
+type Protection struct {
+	Scheme     string // Protection scheme: "cenc" (AES-CTR) or "cbcs" (AES-CBC with a 1:9 pattern)
+	KeyId      []byte // 16 bytes key ID
+	Key        []byte // 16 bytes content key
+	ConstantIV []byte // 16 bytes IV of all the samples with cbcs, cenc samples have their own IV
+	Pssh       []PsshBox // Headers of the DRM systems, written in the init
+	KeyRotation bool     // The key changes with the key periods: the fragments give their key in a seig sample group, with their pssh boxes
+}
+
+// Common encryption applied upstream to the samples of a source file. The samples are passed through without
+// their keys: the init declares the protection of the source, and the fragments carry the auxiliary information
+// (IV and subsamples) of their samples. When the key of the source is known, the samples are decrypted as they
+// are read instead, and the track is served like a clear one.
+type StreamEncryption struct {
+	Scheme        string    // Protection scheme of the source (eg: "cenc", "cbcs")
+	SchemeVersion uint32
+	Tenc          TencBox   // Default key ID, IV size, constant IV and pattern of the samples
+	Pssh          []PsshBox `json:",omitempty"` // Headers of the DRM systems of the source
+	SaizBoxOffset int64     // Sizes of the auxiliary information of the samples, 0 if the samples have none
+	SaizBoxSize   uint32
+	AuxInfoOffset int64     // Auxiliary information of the first sample in the source file, the samples follow
+	Key           []byte    `json:",omitempty"` // 16 bytes content key of the source, nil to pass the samples through
+}
+
+// Decryption of samples of a source file protected upstream, in the order they are stored in the mdat
+type SampleDecryption struct {
+	block   cipher.Block
+	cbc     bool
+	crypt   byte
+	skip    byte
+	offsets []int64      // Offset in the source file of each sample, followed by the end of the last one
+	samples []SencSample // IV and subsamples of each sample
+	last    int          // Last sample decrypted, kept for the reads of its NAL units
+	data    []byte
+}
+
+// Size of the per-sample initialization vectors of cenc, cbcs uses a constant IV
+const perSampleIVSize = 8
+
+// Pattern of cbcs: one encrypted block every ten blocks of the video slices. Audio samples are fully encrypted.
+const (
+	cbcsCryptByteBlock = 1
+	cbcsSkipByteBlock  = 9
+)
+
+// Encrypted and skipped blocks of a track, 0:0 disables the pattern
+func (protection Protection) pattern(trackType string) (crypt byte, skip byte) {
+	if protection.Scheme == "cbcs" && trackType == "video" {
+		return cbcsCryptByteBlock, cbcsSkipByteBlock
+	}
+	return 0, 0
+}
+
+// Track Encryption Box, default encryption parameters of the samples of the track
+type TencBox struct {
+	Size                   uint32
+	Version                byte // 1 to give the pattern of cbcs
+	Flags                  [3]byte
+	DefaultCryptByteBlock  byte // Version 1 only
+	DefaultSkipByteBlock   byte // Version 1 only
+	DefaultIsProtected     byte
+	DefaultPerSampleIVSize byte
+	DefaultKID             [16]byte
+	DefaultConstantIV      []byte // Only if DefaultPerSampleIVSize is 0
+}
+
+// Sample Encryption Box, initialization vector and subsamples of each sample of the fragment
+type SencBox struct {
+	Offset  int64 // Offset of the box content in a source file
+	Size    uint32
+	Version byte
+	Flags   [3]byte // 0x000002: the samples have subsamples
+	Samples []SencSample
+}
+
+type SencSample struct {
+	IV         []byte
+	Subsamples []Subsample
+}
+
+// Clear bytes followed by protected bytes of a sample
+type Subsample struct {
+	ClearBytes     uint16
+	ProtectedBytes uint32
+}
+
+// Sample Auxiliary Information Sizes Box, size of the senc entry of each sample
+type SaizBox struct {
+	Offset                int64 // Offset of the box content in a source file
+	Size                  uint32
+	Version               byte
+	Flags                 [3]byte
+	DefaultSampleInfoSize byte // 0 if the sizes differ
+	SampleCount           uint32
+	SampleInfoSizes       []byte
+}
+
+// Sample Auxiliary Information Offsets Box, offset of the senc entries from the start of the moof, or from the
+// start of the file in a source file. Version 1 has 64-bit offsets.
+type SaioBox struct {
+	Size    uint32
+	Version byte
+	Flags   [3]byte
+	Offsets []uint64
+}
+
+// Sample to Group Box, the runs of samples of a fragment and the description of their group
+type SbgpBox struct {
+	Size         uint32
+	Version      byte
+	Flags        [3]byte
+	GroupingType [4]byte
+	Entries      []SbgpEntry
+}
+
+type SbgpEntry struct {
+	SampleCount           uint32
+	GroupDescriptionIndex uint32 // 0x10001 and above for the descriptions of the fragment
+}
+
+// Sample Group Description Box of the seig grouping type, the key ID and the encryption parameters of groups of
+// samples overriding the defaults of the tenc box (ISO/IEC 23001-7 6)
+type SgpdBox struct {
+	Size         uint32
+	Version      byte // Always 1, the default length of the entries is the length of the first one
+	Flags        [3]byte
+	GroupingType [4]byte
+	Entries      []SeigEntry
+}
+
+type SeigEntry struct {
+	CryptByteBlock  byte
+	SkipByteBlock   byte
+	IsProtected     byte
+	PerSampleIVSize byte
+	KID             [16]byte
+	ConstantIV      []byte // Only if PerSampleIVSize is 0
+}
+
+// Protection System Specific Header Box, data of a DRM system to get the key. Version 1 lists the key IDs.
+type PsshBox struct {
+	Size     uint32
+	Version  byte
+	Flags    [3]byte
+	SystemId [16]byte
+	KIDs     [][16]byte // Version 1 only
+	Data     []byte
+}
+
+// Pssh box of a DRM system, with its size
+func NewPsshBox(version byte, systemId []byte, keyIds [][]byte, data []byte) (pssh PsshBox) {
+	pssh.Version = version
+	copy(pssh.SystemId[:], systemId)
+	if version == 1 {
+		pssh.KIDs = make([][16]byte, len(keyIds))
+		for i, keyId := range keyIds {
+			copy(pssh.KIDs[i][:], keyId)
+		}
+	}
+	pssh.Data = data
+	pssh.Size = 4 + 16 + 4 + uint32(len(pssh.Data))
+	if version == 1 {
+		pssh.Size += 4 + 16 * uint32(len(pssh.KIDs))
+	}
+	return
+}
+
+// Parse a serialised pssh box (eg: given by a DRM vendor)
+func ParsePsshBox(data []byte) (pssh PsshBox, err error) {
+	if len(data) < 32 || string(data[4:8]) != "pssh" || binary.BigEndian.Uint32(data[0:4]) != uint32(len(data)) {
+		return pssh, errors.New("Invalid pssh box")
+	}
+	pssh.Size = uint32(len(data)) - 8
+	pssh.Version = data[8]
+	copy(pssh.Flags[:], data[9:12])
+	copy(pssh.SystemId[:], data[12:28])
+	offset := 28
+	if pssh.Version == 1 {
+		kidCount := int(binary.BigEndian.Uint32(data[28:32]))
+		offset = 32
+		if kidCount > (len(data) - offset - 4) / 16 {
+			return pssh, errors.New("Invalid pssh box")
+		}
+		pssh.KIDs = make([][16]byte, kidCount)
+		for i := range pssh.KIDs {
+			copy(pssh.KIDs[i][:], data[offset:offset+16])
+			offset += 16
+		}
+	}
+	if offset + 4 > len(data) || int(binary.BigEndian.Uint32(data[offset:offset+4])) != len(data) - offset - 4 {
+		return pssh, errors.New("Invalid pssh box")
+	}
+	pssh.Data = data[offset+4:]
+	return
+}
+
+func (pssh PsshBox) Bytes() (data []byte) {
+	boxSize := pssh.Size + 8
+	data = make([]byte, 28, boxSize)
+
+	binary.BigEndian.PutUint32(data[0:4], boxSize)
+	copy(data[4:8], []byte{'p', 's', 's', 'h'})
+	data[8] = pssh.Version
+	copy(data[9:12], pssh.Flags[:])
+	copy(data[12:28], pssh.SystemId[:])
+	if pssh.Version == 1 {
+		kidCount := make([]byte, 4)
+		binary.BigEndian.PutUint32(kidCount, uint32(len(pssh.KIDs)))
+		data = append(data, kidCount...)
+		for _, kid := range pssh.KIDs {
+			data = append(data, kid[:]...)
+		}
+	}
+	dataSize := make([]byte, 4)
+	binary.BigEndian.PutUint32(dataSize, uint32(len(pssh.Data)))
+	data = append(data, dataSize...)
+	data = append(data, pssh.Data...)
+
+	return
+}
+
+func (tenc TencBox) Bytes() (data []byte) {
+	boxSize := tenc.Size + 8
+	data = make([]byte, boxSize)
+
+	binary.BigEndian.PutUint32(data[0:4], boxSize)
+	copy(data[4:8], []byte{'t', 'e', 'n', 'c'})
+	data[8] = tenc.Version
+	copy(data[9:12], tenc.Flags[:])
+	// data[12] reserved
+	if tenc.Version == 1 {
+		data[13] = tenc.DefaultCryptByteBlock << 4 | tenc.DefaultSkipByteBlock
+	}
+	data[14] = tenc.DefaultIsProtected
+	data[15] = tenc.DefaultPerSampleIVSize
+	copy(data[16:32], tenc.DefaultKID[:])
+	if tenc.DefaultPerSampleIVSize == 0 {
+		data[32] = byte(len(tenc.DefaultConstantIV))
+		copy(data[33:], tenc.DefaultConstantIV)
+	}
+
+	return
+}
+
+func (senc SencBox) Bytes() (data []byte) {
+	boxSize := senc.Size + 8
+	data = make([]byte, 16, boxSize)
+
+	binary.BigEndian.PutUint32(data[0:4], boxSize)
+	copy(data[4:8], []byte{'s', 'e', 'n', 'c'})
+	data[8] = senc.Version
+	copy(data[9:12], senc.Flags[:])
+	binary.BigEndian.PutUint32(data[12:16], uint32(len(senc.Samples)))
+	for _, sample := range senc.Samples {
+		data = append(data, sample.Bytes(senc.Flags[2] & 0x02 != 0)...)
+	}
+
+	return
+}
+
+// Entry of a sample in the senc box, it is also the auxiliary information of the sample
+func (sample SencSample) Bytes(subsamples bool) (data []byte) {
+	data = append(data, sample.IV...)
+	if subsamples == false {
+		return
+	}
+
+	entry := make([]byte, 2 + 6 * len(sample.Subsamples))
+	binary.BigEndian.PutUint16(entry[0:2], uint16(len(sample.Subsamples)))
+	for i, subsample := range sample.Subsamples {
+		binary.BigEndian.PutUint16(entry[2+i*6:4+i*6], subsample.ClearBytes)
+		binary.BigEndian.PutUint32(entry[4+i*6:8+i*6], subsample.ProtectedBytes)
+	}
+	return append(data, entry...)
+}
+
+func (saiz SaizBox) Bytes() (data []byte) {
+	boxSize := saiz.Size + 8
+	data = make([]byte, 17, boxSize)
+
+	binary.BigEndian.PutUint32(data[0:4], boxSize)
+	copy(data[4:8], []byte{'s', 'a', 'i', 'z'})
+	data[8] = saiz.Version
+	copy(data[9:12], saiz.Flags[:])
+	data[12] = saiz.DefaultSampleInfoSize
+	binary.BigEndian.PutUint32(data[13:17], saiz.SampleCount)
+	data = append(data, saiz.SampleInfoSizes...)
+
+	return
+}
+
+func (saio SaioBox) Bytes() (data []byte) {
+	boxSize := saio.Size + 8
+	data = make([]byte, boxSize)
+
+	binary.BigEndian.PutUint32(data[0:4], boxSize)
+	copy(data[4:8], []byte{'s', 'a', 'i', 'o'})
+	data[8] = saio.Version
+	copy(data[9:12], saio.Flags[:])
+	binary.BigEndian.PutUint32(data[12:16], uint32(len(saio.Offsets)))
+	for i, offset := range saio.Offsets {
+		if saio.Version == 1 {
+			binary.BigEndian.PutUint64(data[16+i*8:24+i*8], offset)
+		} else {
+			binary.BigEndian.PutUint32(data[16+i*4:20+i*4], uint32(offset))
+		}
+	}
+
+	return
+}
+
+func (sbgp SbgpBox) Bytes() (data []byte) {
+	boxSize := sbgp.Size + 8
+	data = make([]byte, boxSize)
+
+	binary.BigEndian.PutUint32(data[0:4], boxSize)
+	copy(data[4:8], []byte{'s', 'b', 'g', 'p'})
+	data[8] = sbgp.Version
+	copy(data[9:12], sbgp.Flags[:])
+	copy(data[12:16], sbgp.GroupingType[:])
+	binary.BigEndian.PutUint32(data[16:20], uint32(len(sbgp.Entries)))
+	for i, entry := range sbgp.Entries {
+		binary.BigEndian.PutUint32(data[20+i*8:24+i*8], entry.SampleCount)
+		binary.BigEndian.PutUint32(data[24+i*8:28+i*8], entry.GroupDescriptionIndex)
+	}
+
+	return
+}
+
+func (entry SeigEntry) Bytes() (data []byte) {
+	data = make([]byte, 20)
+	// data[0] reserved
+	data[1] = entry.CryptByteBlock << 4 | entry.SkipByteBlock
+	data[2] = entry.IsProtected
+	data[3] = entry.PerSampleIVSize
+	copy(data[4:20], entry.KID[:])
+	if entry.IsProtected == 1 && entry.PerSampleIVSize == 0 {
+		data = append(data, byte(len(entry.ConstantIV)))
+		data = append(data, entry.ConstantIV...)
+	}
+	return
+}
+
+func (sgpd SgpdBox) Bytes() (data []byte) {
+	boxSize := sgpd.Size + 8
+	data = make([]byte, 24, boxSize)
+
+	binary.BigEndian.PutUint32(data[0:4], boxSize)
+	copy(data[4:8], []byte{'s', 'g', 'p', 'd'})
+	data[8] = sgpd.Version
+	copy(data[9:12], sgpd.Flags[:])
+	copy(data[12:16], sgpd.GroupingType[:])
+	if len(sgpd.Entries) != 0 {
+		binary.BigEndian.PutUint32(data[16:20], uint32(len(sgpd.Entries[0].Bytes())))
+	}
+	binary.BigEndian.PutUint32(data[20:24], uint32(len(sgpd.Entries)))
+	for _, entry := range sgpd.Entries {
+		data = append(data, entry.Bytes()...)
+	}
+
+	return
+}
+
+func readTencBox(f *os.File, size uint32, level int, boxPath string, mp4 map[string][]interface{}) {
+	data := make([]byte, size)
+	_, err := f.Read(data)
+	if err != nil {
+		panic(err)
+	}
+	var tenc TencBox
+	tenc.Size = size
+	tenc.Version = data[0]
+	copy(tenc.Flags[:], data[1:4])
+	if tenc.Version == 1 {
+		tenc.DefaultCryptByteBlock = data[5] >> 4
+		tenc.DefaultSkipByteBlock = data[5] & 0x0f
+	}
+	tenc.DefaultIsProtected = data[6]
+	tenc.DefaultPerSampleIVSize = data[7]
+	copy(tenc.DefaultKID[:], data[8:24])
+	if tenc.DefaultPerSampleIVSize == 0 && size > 24 {
+		tenc.DefaultConstantIV = data[25:25+int(data[24])]
+	}
+	addBox(mp4, boxPath, tenc)
+	dumpBox(boxPath, tenc)
+}
+
+// Only the position of the entries of a senc box is read, they are read with the samples
+func readSencBox(f *os.File, size uint32, level int, boxPath string, mp4 map[string][]interface{}) {
+	var senc SencBox
+	senc.Offset, _ = f.Seek(0, os.SEEK_CUR)
+	data := make([]byte, 8)
+	_, err := f.Read(data)
+	if err != nil {
+		panic(err)
+	}
+	senc.Size = size
+	senc.Version = data[0]
+	copy(senc.Flags[:], data[1:4])
+	f.Seek(int64(size - 8), 1)
+	addBox(mp4, boxPath, senc)
+	dumpBox(boxPath, senc)
+}
+
+func readSaizBox(f *os.File, size uint32, level int, boxPath string, mp4 map[string][]interface{}) {
+	var saiz SaizBox
+	saiz.Offset, _ = f.Seek(0, os.SEEK_CUR)
+	data := make([]byte, size)
+	_, err := f.Read(data)
+	if err != nil {
+		panic(err)
+	}
+	saiz.Size = size
+	saiz.Version = data[0]
+	copy(saiz.Flags[:], data[1:4])
+	offset := 4
+	if saiz.Flags[2] & 0x01 != 0 {
+		offset += 8 // aux_info_type and aux_info_type_parameter
+	}
+	saiz.DefaultSampleInfoSize = data[offset]
+	saiz.SampleCount = binary.BigEndian.Uint32(data[offset+1:offset+5])
+	if saiz.DefaultSampleInfoSize == 0 {
+		saiz.SampleInfoSizes = data[offset+5:]
+		if uint32(len(saiz.SampleInfoSizes)) > saiz.SampleCount {
+			saiz.SampleInfoSizes = saiz.SampleInfoSizes[:saiz.SampleCount]
+		}
+	}
+	addBox(mp4, boxPath, saiz)
+	dumpBox(boxPath, saiz)
+}
+
+func readSaioBox(f *os.File, size uint32, level int, boxPath string, mp4 map[string][]interface{}) {
+	data := make([]byte, size)
+	_, err := f.Read(data)
+	if err != nil {
+		panic(err)
+	}
+	var saio SaioBox
+	saio.Size = size
+	saio.Version = data[0]
+	copy(saio.Flags[:], data[1:4])
+	offset := 4
+	if saio.Flags[2] & 0x01 != 0 {
+		offset += 8
+	}
+	entryCount := int(binary.BigEndian.Uint32(data[offset:offset+4]))
+	offset += 4
+	for i := 0; i < entryCount && offset < len(data); i++ {
+		if saio.Version == 1 {
+			saio.Offsets = append(saio.Offsets, binary.BigEndian.Uint64(data[offset:offset+8]))
+			offset += 8
+		} else {
+			saio.Offsets = append(saio.Offsets, uint64(binary.BigEndian.Uint32(data[offset:offset+4])))
+			offset += 4
+		}
+	}
+	addBox(mp4, boxPath, saio)
+	dumpBox(boxPath, saio)
+}
+
+func readPsshBox(f *os.File, size uint32, level int, boxPath string, mp4 map[string][]interface{}) {
+	data := make([]byte, size + 8)
+	binary.BigEndian.PutUint32(data[0:4], size + 8)
+	copy(data[4:8], []byte{'p', 's', 's', 'h'})
+	_, err := f.Read(data[8:])
+	if err != nil {
+		panic(err)
+	}
+	pssh, err := ParsePsshBox(data)
+	if err != nil {
+		return
+	}
+	addBox(mp4, boxPath, pssh)
+	dumpBox(boxPath, pssh)
+}
+
+// Common encryption of the samples of a source file, nil if they are clear
+func (mp4 Mp4) StreamEncryption() (encryption *StreamEncryption, err error) {
+	entryPath := mp4.SampleEntryPath()
+	if strings.HasSuffix(entryPath, ".encv") == false && strings.HasSuffix(entryPath, ".enca") == false {
+		return nil, nil
+	}
+	if mp4.Boxes[entryPath + ".sinf.schm"] == nil || mp4.Boxes[entryPath + ".sinf.schi.tenc"] == nil {
+		return nil, errors.New("Protected sample entry without protection scheme or track encryption box")
+	}
+	schm := mp4.Boxes[entryPath + ".sinf.schm"][0].(SchmBox)
+	encryption = new(StreamEncryption)
+	encryption.Scheme = string(schm.SchemeType[:])
+	encryption.SchemeVersion = schm.SchemeVersion
+	encryption.Tenc = mp4.Boxes[entryPath + ".sinf.schi.tenc"][0].(TencBox)
+	switch encryption.Scheme {
+		case "cenc", "cbcs", "cens", "cbc1":
+		default:
+			return nil, errors.New("Unsupported protection scheme " + encryption.Scheme)
+	}
+	for _, box := range mp4.Boxes["moov.pssh"] {
+		encryption.Pssh = append(encryption.Pssh, box.(PsshBox))
+	}
+
+	stblPath := "moov.trak.mdia.minf.stbl"
+	if mp4.Boxes[stblPath + ".saiz"] == nil {
+		if encryption.Tenc.DefaultPerSampleIVSize != 0 {
+			return nil, errors.New("Protected samples without auxiliary information sizes (saiz)")
+		}
+		// Constant IV without subsamples, the samples only use the defaults of the tenc box
+		return
+	}
+	saiz := mp4.Boxes[stblPath + ".saiz"][0].(SaizBox)
+	encryption.SaizBoxOffset = saiz.Offset
+	encryption.SaizBoxSize = saiz.Size
+
+	// Like the samples in the mdat, the auxiliary information of the samples must be contiguous
+	switch {
+		case mp4.Boxes[stblPath + ".saio"] != nil:
+			saio := mp4.Boxes[stblPath + ".saio"][0].(SaioBox)
+			if len(saio.Offsets) != 1 {
+				return nil, errors.New("Auxiliary information of the samples is not contiguous")
+			}
+			encryption.AuxInfoOffset = int64(saio.Offsets[0])
+		case mp4.Boxes[stblPath + ".senc"] != nil:
+			encryption.AuxInfoOffset = mp4.Boxes[stblPath + ".senc"][0].(SencBox).Offset + 8
+		case mp4.Boxes["moov.trak.senc"] != nil:
+			encryption.AuxInfoOffset = mp4.Boxes["moov.trak.senc"][0].(SencBox).Offset + 8
+		default:
+			return nil, errors.New("Protected samples without auxiliary information offsets (saio or senc)")
+	}
+	return
+}
+
+// Samples protected upstream and passed through with their encryption, false for clear samples and for samples
+// decrypted with the key of the source
+func (sConf StreamConfig) PassthroughEncryption() bool {
+	return sConf.Encryption != nil && sConf.Encryption.Key == nil
+}
+
+// Declare the protection in a DASH init: the sample entry becomes an encv or enca entry, with a sinf box giving
+// its original format, the protection scheme and the key ID. The pssh boxes of the DRM systems end the moov.
+func ProtectDashInit(mp4Init map[string][]interface{}, protection Protection) {
+	var tenc TencBox
+	tenc.DefaultIsProtected = 1
+	copy(tenc.DefaultKID[:], protection.KeyId)
+	tenc.Size = 24
+	if protection.Scheme == "cbcs" {
+		tenc.Version = 1
+		if mp4Init["moov.trak.mdia.minf.stbl.stsd.avc1"] != nil {
+			tenc.DefaultCryptByteBlock, tenc.DefaultSkipByteBlock = protection.pattern("video")
+		}
+		tenc.DefaultConstantIV = protection.ConstantIV
+		tenc.Size += 1 + uint32(len(tenc.DefaultConstantIV))
+	} else {
+		tenc.DefaultPerSampleIVSize = perSampleIVSize
+	}
+
+	declareProtection(mp4Init, protection.Scheme, 0x00010000, tenc, protection.Pssh)
+}
+
+// Declare the protection applied upstream to the samples of a source file, passed through to the DASH init
+func passthroughDashInit(mp4Init map[string][]interface{}, encryption StreamEncryption) {
+	declareProtection(mp4Init, encryption.Scheme, encryption.SchemeVersion, encryption.Tenc, encryption.Pssh)
+}
+
+func declareProtection(mp4Init map[string][]interface{}, scheme string, schemeVersion uint32, tenc TencBox, psshBoxes []PsshBox) {
+	stsdPath := "moov.trak.mdia.minf.stbl.stsd"
+	var entry, protectedEntry string
+	var children []string
+	if mp4Init[stsdPath + ".avc1"] != nil {
+		entry, protectedEntry, children = "avc1", "encv", []string{ "avcC", "btrt" }
+	} else if mp4Init[stsdPath + ".mp4a"] != nil {
+		entry, protectedEntry, children = "mp4a", "enca", []string{ "esds" }
+	} else {
+		return
+	}
+
+	var frma FrmaBox
+	copy(frma.DataFormat[:], []byte(entry))
+	frma.Size = 4
+
+	var schm SchmBox
+	copy(schm.SchemeType[:], []byte(scheme))
+	schm.SchemeVersion = schemeVersion
+	schm.Size = 12
+
+	var schi ParentBox
+	schi.Name = [4]byte{'s', 'c', 'h', 'i'}
+	schi.Size = tenc.Size + 8
+
+	var sinf ParentBox
+	sinf.Name = [4]byte{'s', 'i', 'n', 'f'}
+	sinf.Size = frma.Size + 8 + schm.Size + 8 + schi.Size + 8
+
+	// Move the sample entry and its children
+	entryPath := stsdPath + "." + entry
+	protectedPath := stsdPath + "." + protectedEntry
+	for _, child := range children {
+		if mp4Init[entryPath + "." + child] != nil {
+			mp4Init[protectedPath + "." + child] = mp4Init[entryPath + "." + child]
+			delete(mp4Init, entryPath + "." + child)
+		}
+	}
+	switch box := mp4Init[entryPath][0].(type) {
+		case Avc1Box:
+			box.Size += sinf.Size + 8
+			replaceBox(mp4Init, protectedPath, box)
+		case Mp4aBox:
+			box.Size += sinf.Size + 8
+			replaceBox(mp4Init, protectedPath, box)
+	}
+	delete(mp4Init, entryPath)
+
+	replaceBox(mp4Init, protectedPath + ".sinf", sinf)
+	replaceBox(mp4Init, protectedPath + ".sinf.frma", frma)
+	replaceBox(mp4Init, protectedPath + ".sinf.schm", schm)
+	replaceBox(mp4Init, protectedPath + ".sinf.schi", schi)
+	replaceBox(mp4Init, protectedPath + ".sinf.schi.tenc", tenc)
+
+	// The parents grow by the size of the sinf box
+	stsd := mp4Init[stsdPath][0].(StsdBox)
+	stsd.Size += sinf.Size + 8
+	replaceBox(mp4Init, stsdPath, stsd)
+	for _, parentPath := range []string{ "moov.trak.mdia.minf.stbl", "moov.trak.mdia.minf", "moov.trak.mdia", "moov.trak", "moov" } {
+		parent := mp4Init[parentPath][0].(ParentBox)
+		parent.Size += sinf.Size + 8
+		replaceBox(mp4Init, parentPath, parent)
+	}
+
+	if len(psshBoxes) == 0 {
+		return
+	}
+	moov := mp4Init["moov"][0].(ParentBox)
+	mp4Init["moov.pssh"] = make([]interface{}, len(psshBoxes))
+	for i, pssh := range psshBoxes {
+		mp4Init["moov.pssh"][i] = pssh
+		moov.Size += pssh.Size + 8
+	}
+	replaceBox(mp4Init, "moov", moov)
+}
+
+// Encrypt the samples of a fragment, or of a chunk, and describe them in senc, saiz and saio boxes. With cenc the
+// IV of a sample is derived from the track file, the number of the sample in the file (sourceSamples) and its
+// decode time in the output, so a fragment is encrypted identically each time it is built. A key may protect the
+// same file in several outputs (eg: a package and the loops of a live channel) at other decode times: the sample
+// number tells the samples apart at the same decode time and the decode time tells the outputs apart, an IV is
+// only reused for the same sample of the same file, whose plaintext is the same. With cbcs the samples have the
+// constant IV of the init, and the boxes are only written for the subsamples of the video.
+func protectFragment(fmp4 map[string][]interface{}, sConf StreamConfig, protection Protection, sourceSamples []uint32) (err error) {
+	block, err := aes.NewCipher(protection.Key)
+	if err != nil {
+		return
+	}
+
+	tfhd := fmp4["moof.traf.tfhd"][0].(TfhdBox)
+	tfdt := fmp4["moof.traf.tfdt"][0].(TfdtBox)
+	trun := fmp4["moof.traf.trun"][0].(TrunBox)
+	mdat := fmp4["mdat"][0].(MdatBox)
+
+	if mdat.Data == nil {
+		f, err := os.Open(mdat.Filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		mdat.Data = make([]byte, mdat.Size)
+		mdat.readData(f, mdat.Data)
+	}
+
+	lengthSize := 0
+	if sConf.Type == "video" {
+		lengthSize = int(sConf.Video.NalUnitSize & 0x03) + 1
+	}
+
+	var senc SencBox
+	if lengthSize != 0 {
+		senc.Flags[2] = 0x02
+	}
+	senc.Samples = make([]SencSample, len(trun.Samples))
+	params := newAvcParameterSets(sConf.Video)
+	decodeTime := tfdt.BaseMediaDecodeTime
+	offset := uint32(0)
+	for i, s := range trun.Samples {
+		sample := mdat.Data[offset:offset+s.Size]
+		offset += s.Size
+
+		if protection.Scheme == "cbcs" {
+			senc.Samples[i].IV = protection.ConstantIV
+		} else {
+			senc.Samples[i].IV = sampleIV(block, mdat.Filename, sourceSamples[i], decodeTime)
+		}
+		if trun.Flags[1] & 0x01 != 0 {
+			decodeTime += uint64(s.Duration)
+		} else {
+			decodeTime += uint64(tfhd.DefaultSampleDuration)
+		}
+
+		if lengthSize != 0 {
+			senc.Samples[i].Subsamples = nalSubsamples(sample, lengthSize, params)
+		}
+		if protection.Scheme == "cbcs" {
+			crypt, skip := protection.pattern(sConf.Type)
+			encryptPatternSample(block, senc.Samples[i], sample, crypt, skip)
+			senc.Samples[i].IV = nil
+		} else {
+			encryptSample(block, senc.Samples[i], sample)
+		}
+	}
+	replaceBox(fmp4, "mdat", mdat)
+	addSampleEncryption(fmp4, senc)
+	if protection.KeyRotation {
+		addKeyRotation(fmp4, sConf.Type, protection)
+	}
+	return
+}
+
+// Give the key of the samples of a fragment, which changes with the key periods, in a seig sample group
+// overriding the tenc box of the init, and the pssh boxes of the key in the moof
+func addKeyRotation(fmp4 map[string][]interface{}, trackType string, protection Protection) {
+	mfhd := fmp4["moof.mfhd"][0].(MfhdBox)
+	trun := fmp4["moof.traf.trun"][0].(TrunBox)
+
+	var seig SeigEntry
+	seig.IsProtected = 1
+	copy(seig.KID[:], protection.KeyId)
+	if protection.Scheme == "cbcs" {
+		seig.CryptByteBlock, seig.SkipByteBlock = protection.pattern(trackType)
+		seig.ConstantIV = protection.ConstantIV
+	} else {
+		seig.PerSampleIVSize = perSampleIVSize
+	}
+
+	var sgpd SgpdBox
+	sgpd.Version = 1
+	sgpd.GroupingType = [4]byte{'s', 'e', 'i', 'g'}
+	sgpd.Entries = []SeigEntry{seig}
+	sgpd.Size = 16 + uint32(len(seig.Bytes()))
+
+	// All the samples are in the first group described by the fragment
+	var sbgp SbgpBox
+	sbgp.GroupingType = [4]byte{'s', 'e', 'i', 'g'}
+	sbgp.Entries = []SbgpEntry{{SampleCount: trun.SampleCount, GroupDescriptionIndex: 0x10001}}
+	sbgp.Size = 12 + 8
+
+	traf := fmp4["moof.traf"][0].(ParentBox)
+	traf.Size += sbgp.Size + 8 + sgpd.Size + 8
+	moof := fmp4["moof"][0].(ParentBox)
+	moof.Size = mfhd.Size + 8 + traf.Size + 8
+	for _, pssh := range protection.Pssh {
+		addBox(fmp4, "moof.pssh", pssh)
+		moof.Size += pssh.Size + 8
+	}
+	trun.DataOffset = int32(moof.Size + 8 + 8)
+
+	replaceBox(fmp4, "moof", moof)
+	replaceBox(fmp4, "moof.traf", traf)
+	replaceBox(fmp4, "moof.traf.trun", trun)
+	replaceBox(fmp4, "moof.traf.sbgp", sbgp)
+	replaceBox(fmp4, "moof.traf.sgpd", sgpd)
+}
+
+// Pass the encryption of the samples of a source file through to a fragment: the auxiliary information of the
+// samples, given by their numbers in the source, is read and written in the senc box of the fragment
+func passthroughFragment(fmp4 map[string][]interface{}, f *os.File, encryption StreamEncryption, samples []uint32) (err error) {
+	if encryption.SaizBoxSize == 0 || len(samples) == 0 {
+		return
+	}
+	senc, err := readAuxiliaryInformation(f, encryption, samples)
+	if err != nil {
+		return
+	}
+	addSampleEncryption(fmp4, senc)
+	return
+}
+
+// Read the auxiliary information of samples of a source file, given by their numbers in the source
+func readAuxiliaryInformation(f *os.File, encryption StreamEncryption, samples []uint32) (senc SencBox, err error) {
+	boxes := make(map[string][]interface{})
+	f.Seek(encryption.SaizBoxOffset, 0)
+	readSaizBox(f, encryption.SaizBoxSize, 0, "saiz", boxes)
+	saiz := boxes["saiz"][0].(SaizBox)
+	infoSize := func(sample uint32) int64 {
+		if saiz.DefaultSampleInfoSize != 0 {
+			return int64(saiz.DefaultSampleInfoSize)
+		}
+		if sample < uint32(len(saiz.SampleInfoSizes)) {
+			return int64(saiz.SampleInfoSizes[sample])
+		}
+		return 0
+	}
+
+	offset := encryption.AuxInfoOffset
+	next := uint32(0)
+	ivSize := int(encryption.Tenc.DefaultPerSampleIVSize)
+	senc.Samples = make([]SencSample, len(samples))
+	for i, sample := range samples {
+		for ; next < sample; next++ {
+			offset += infoSize(next)
+		}
+		info := make([]byte, infoSize(sample))
+		_, err = f.ReadAt(info, offset)
+		if err != nil || len(info) < ivSize {
+			return senc, errors.New("Cannot read the auxiliary information of the protected samples")
+		}
+		senc.Samples[i].IV = info[:ivSize]
+		if len(info) >= ivSize + 2 {
+			senc.Flags[2] = 0x02
+			count := int(binary.BigEndian.Uint16(info[ivSize:ivSize+2]))
+			if len(info) < ivSize + 2 + 6 * count {
+				return senc, errors.New("Invalid auxiliary information of the protected samples")
+			}
+			senc.Samples[i].Subsamples = make([]Subsample, count)
+			for j := range senc.Samples[i].Subsamples {
+				entry := info[ivSize+2+j*6:]
+				senc.Samples[i].Subsamples[j].ClearBytes = binary.BigEndian.Uint16(entry[0:2])
+				senc.Samples[i].Subsamples[j].ProtectedBytes = binary.BigEndian.Uint32(entry[2:6])
+			}
+		}
+	}
+	return
+}
+
+// Describe the encryption of the samples of a fragment in its senc, saiz and saio boxes, the entries of the senc
+// box being the auxiliary information of the samples
+func addSampleEncryption(fmp4 map[string][]interface{}, senc SencBox) {
+	mfhd := fmp4["moof.mfhd"][0].(MfhdBox)
+	tfhd := fmp4["moof.traf.tfhd"][0].(TfhdBox)
+	tfdt := fmp4["moof.traf.tfdt"][0].(TfdtBox)
+	trun := fmp4["moof.traf.trun"][0].(TrunBox)
+
+	var saiz SaizBox
+	saiz.SampleInfoSizes = make([]byte, len(senc.Samples))
+	senc.Size = 8
+	for i, sample := range senc.Samples {
+		entrySize := len(sample.Bytes(senc.Flags[2] & 0x02 != 0))
+		saiz.SampleInfoSizes[i] = byte(entrySize)
+		senc.Size += uint32(entrySize)
+	}
+	if senc.Size == 8 {
+		// Nothing to describe, the samples use the defaults of the tenc box
+		return
+	}
+
+	saiz.SampleCount = uint32(len(senc.Samples))
+	saiz.DefaultSampleInfoSize = saiz.SampleInfoSizes[0]
+	for _, size := range saiz.SampleInfoSizes {
+		if size != saiz.DefaultSampleInfoSize {
+			saiz.DefaultSampleInfoSize = 0
+			break
+		}
+	}
+	if saiz.DefaultSampleInfoSize != 0 {
+		saiz.SampleInfoSizes = nil
+	}
+	saiz.Size = 9 + uint32(len(saiz.SampleInfoSizes))
+
+	// The entries follow the senc header: its size, type, version, flags and sample count
+	var saio SaioBox
+	saio.Offsets = []uint64{ uint64(8 + mfhd.Size + 8 + 8 + tfhd.Size + 8 + tfdt.Size + 8 + trun.Size + 8 + 16) }
+	saio.Size = 8 + 4*uint32(len(saio.Offsets))
+
+	traf := fmp4["moof.traf"][0].(ParentBox)
+	traf.Size += senc.Size + 8 + saiz.Size + 8 + saio.Size + 8
+	moof := fmp4["moof"][0].(ParentBox)
+	moof.Size = mfhd.Size + 8 + traf.Size + 8
+	trun.DataOffset = int32(moof.Size + 8 + 8)
+
+	replaceBox(fmp4, "moof", moof)
+	replaceBox(fmp4, "moof.traf", traf)
+	replaceBox(fmp4, "moof.traf.trun", trun)
+	replaceBox(fmp4, "moof.traf.senc", senc)
+	replaceBox(fmp4, "moof.traf.saiz", saiz)
+	replaceBox(fmp4, "moof.traf.saio", saio)
+}
+
+// IV of a cenc sample from its file, its number in the file and its decode time in the output
+func sampleIV(block cipher.Block, filename string, sampleNumber uint32, decodeTime uint64) []byte {
+	data := make([]byte, 12, 12 + len(filename))
+	binary.BigEndian.PutUint32(data[0:4], sampleNumber)
+	binary.BigEndian.PutUint64(data[4:12], decodeTime)
+	seed := sha1.Sum(append(data, filename...))
+	iv := make([]byte, aes.BlockSize)
+	block.Encrypt(iv, seed[0:aes.BlockSize])
+	return iv[0:perSampleIVSize]
+}
+
+// Subsamples of an H.264 sample: the slices (nal_unit_type 1 and 5) are protected by whole blocks from their
+// slice data, the length and the header of their NAL unit and their slice header parsed with the parameter sets
+// staying clear, like the partial block left before the protected bytes. The other NAL units are clear, the SPS
+// and PPS ones replacing the parameter sets of the track for the next slices. Data partitions (nal_unit_type 2
+// to 4) and the slices whose header cannot be parsed (unknown parameter set, truncated or invalid header) stay
+// fully clear, and a fragment only knows the parameter sets of the avcC box and of its own samples.
+func nalSubsamples(sample []byte, lengthSize int, params *avcParameterSets) (subsamples []Subsample) {
+	clear := 0
+	offset := 0
+	for offset + lengthSize <= len(sample) {
+		nalSize := 0
+		for _, b := range sample[offset:offset+lengthSize] {
+			nalSize = nalSize << 8 | int(b)
+		}
+		if offset + lengthSize + nalSize > len(sample) {
+			nalSize = len(sample) - offset - lengthSize
+		}
+
+		protected := 0
+		nal := sample[offset+lengthSize:offset+lengthSize+nalSize]
+		if nalSize > 0 {
+			switch nal[0] & 0x1f {
+				case 1, 5:
+					if headerSize, err := params.sliceHeaderSize(nal); err == nil && headerSize < nalSize {
+						protected = (nalSize - headerSize) / aes.BlockSize * aes.BlockSize
+					}
+				case 7, 8:
+					params.add(nal)
+			}
+		}
+		clear += lengthSize + nalSize - protected
+		offset += lengthSize + nalSize
+		if protected == 0 {
+			continue
+		}
+
+		for clear > 0xffff {
+			subsamples = append(subsamples, Subsample{ ClearBytes: 0xffff })
+			clear -= 0xffff
+		}
+		subsamples = append(subsamples, Subsample{ ClearBytes: uint16(clear), ProtectedBytes: uint32(protected) })
+		clear = 0
+	}
+	clear += len(sample) - offset
+	for clear > 0xffff {
+		subsamples = append(subsamples, Subsample{ ClearBytes: 0xffff })
+		clear -= 0xffff
+	}
+	if clear > 0 {
+		subsamples = append(subsamples, Subsample{ ClearBytes: uint16(clear) })
+	}
+	return
+}
+
+// Encrypt the protected bytes of a sample in AES-CTR, the counter runs across the subsamples of the sample. A
+// sample without subsamples is fully protected.
+func encryptSample(block cipher.Block, sencSample SencSample, sample []byte) {
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, sencSample.IV)
+	stream := cipher.NewCTR(block, counter)
+
+	if sencSample.Subsamples == nil {
+		stream.XORKeyStream(sample, sample)
+		return
+	}
+
+	offset := 0
+	for _, subsample := range sencSample.Subsamples {
+		offset += int(subsample.ClearBytes)
+		protected := sample[offset:offset+int(subsample.ProtectedBytes)]
+		stream.XORKeyStream(protected, protected)
+		offset += int(subsample.ProtectedBytes)
+	}
+}
+
+// Encrypt the protected bytes of a sample in AES-CBC with a pattern of crypt encrypted blocks followed by skip
+// clear blocks, the IV is reset at each subsample. A partial block at the end of a subsample stays clear.
+func encryptPatternSample(block cipher.Block, sencSample SencSample, sample []byte, crypt byte, skip byte) {
+	cryptPatternSample(cipher.NewCBCEncrypter, block, sencSample, sample, crypt, skip)
+}
+
+func cryptPatternSample(newMode func(cipher.Block, []byte) cipher.BlockMode, block cipher.Block, sencSample SencSample, sample []byte, crypt byte, skip byte) {
+	subsamples := sencSample.Subsamples
+	if subsamples == nil {
+		subsamples = []Subsample{ { ProtectedBytes: uint32(len(sample)) } }
+	}
+	if crypt == 0 && skip == 0 {
+		crypt = 1
+	}
+
+	offset := 0
+	for _, subsample := range subsamples {
+		offset += int(subsample.ClearBytes)
+		protected := sample[offset:offset+int(subsample.ProtectedBytes)]
+		offset += int(subsample.ProtectedBytes)
+
+		mode := newMode(block, sencSample.IV)
+		for start := 0; start + aes.BlockSize <= len(protected); start += (int(crypt) + int(skip)) * aes.BlockSize {
+			end := start + int(crypt) * aes.BlockSize
+			if end > len(protected) {
+				end = start + (len(protected) - start) / aes.BlockSize * aes.BlockSize
+			}
+			mode.CryptBlocks(protected[start:end], protected[start:end])
+		}
+	}
+}
+
+// Decrypt the protected bytes of a sample in AES-CBC with a pattern, the reverse of encryptPatternSample
+func decryptPatternSample(block cipher.Block, sencSample SencSample, sample []byte, crypt byte, skip byte) {
+	cryptPatternSample(cipher.NewCBCDecrypter, block, sencSample, sample, crypt, skip)
+}
+
+// Decryption of the samples of a source file with the key of the source: the samples, given by the number in the
+// source of the first one, its offset in the file and their sizes, are decrypted when they are read from the mdat
+func NewSampleDecryption(filename string, encryption StreamEncryption, firstSample uint32, offset int64, sizes []uint32) (decryption *SampleDecryption, err error) {
+	decryption = new(SampleDecryption)
+	decryption.block, err = aes.NewCipher(encryption.Key)
+	if err != nil {
+		return nil, err
+	}
+	switch encryption.Scheme {
+		case "cenc":
+		case "cbcs":
+			decryption.cbc = true
+			decryption.crypt = encryption.Tenc.DefaultCryptByteBlock
+			decryption.skip = encryption.Tenc.DefaultSkipByteBlock
+		default:
+			return nil, errors.New("Cannot decrypt the protection scheme " + encryption.Scheme)
+	}
+
+	decryption.offsets = make([]int64, len(sizes) + 1)
+	decryption.offsets[0] = offset
+	samples := make([]uint32, len(sizes))
+	for i, size := range sizes {
+		decryption.offsets[i+1] = decryption.offsets[i] + int64(size)
+		samples[i] = firstSample + uint32(i)
+	}
+	decryption.last = -1
+
+	if encryption.SaizBoxSize == 0 {
+		// The samples are fully protected with the constant IV of the tenc box
+		decryption.samples = make([]SencSample, len(sizes))
+	} else {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		senc, err := readAuxiliaryInformation(f, encryption, samples)
+		if err != nil {
+			return nil, err
+		}
+		decryption.samples = senc.Samples
+	}
+
+	// CBC needs 16 bytes IVs, the 8 bytes IVs are padded with zeros
+	for i := range decryption.samples {
+		if len(decryption.samples[i].IV) == 0 {
+			decryption.samples[i].IV = encryption.Tenc.DefaultConstantIV
+		}
+		if decryption.cbc && len(decryption.samples[i].IV) != aes.BlockSize {
+			iv := make([]byte, aes.BlockSize)
+			copy(iv, decryption.samples[i].IV)
+			decryption.samples[i].IV = iv
+		}
+	}
+	return
+}
+
+// Decrypt data read at offset in the source file. The samples partly read are read and decrypted whole, as the
+// protected bytes of a sample are chained.
+func (decryption *SampleDecryption) decrypt(f *os.File, data []byte, offset int64) (err error) {
+	end := offset + int64(len(data))
+	i := sort.Search(len(decryption.samples), func(i int) bool { return decryption.offsets[i+1] > offset })
+	for ; i < len(decryption.samples) && decryption.offsets[i] < end; i++ {
+		if i != decryption.last {
+			decryption.data = make([]byte, decryption.offsets[i+1] - decryption.offsets[i])
+			_, err = f.ReadAt(decryption.data, decryption.offsets[i])
+			if err != nil {
+				decryption.last = -1
+				return
+			}
+			if decryption.cbc {
+				decryptPatternSample(decryption.block, decryption.samples[i], decryption.data, decryption.crypt, decryption.skip)
+			} else {
+				encryptSample(decryption.block, decryption.samples[i], decryption.data)
+			}
+			decryption.last = i
+		}
+
+		start := decryption.offsets[i]
+		if start < offset {
+			start = offset
+		}
+		stop := decryption.offsets[i+1]
+		if stop > end {
+			stop = end
+		}
+		copy(data[start-offset:stop-offset], decryption.data[start-decryption.offsets[i]:stop-decryption.offsets[i]])
+	}
+	return
+}
@@ -0,0 +1,436 @@
+package mp4
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+var testKey = []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+
+func testSample(size int) []byte {
+	sample := make([]byte, size)
+	for i := range sample {
+		sample[i] = byte(i * 7)
+	}
+	return sample
+}
+
+func TestEncryptSample(t *testing.T) {
+	block, _ := aes.NewCipher(testKey)
+	iv := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	subsamples := []Subsample{{ClearBytes: 5, ProtectedBytes: 20}, {ClearBytes: 3, ProtectedBytes: 33}, {ClearBytes: 10}}
+	sample := testSample(5 + 20 + 3 + 33 + 10)
+
+	encrypted := append([]byte(nil), sample...)
+	encryptSample(block, SencSample{IV: iv, Subsamples: subsamples}, encrypted)
+
+	// The counter runs across the protected bytes of the subsamples
+	var protected []byte
+	protected = append(protected, sample[5:25]...)
+	protected = append(protected, sample[28:61]...)
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, iv)
+	cipher.NewCTR(block, counter).XORKeyStream(protected, protected)
+
+	var expected []byte
+	expected = append(expected, sample[0:5]...)
+	expected = append(expected, protected[0:20]...)
+	expected = append(expected, sample[25:28]...)
+	expected = append(expected, protected[20:]...)
+	expected = append(expected, sample[61:]...)
+	if !bytes.Equal(encrypted, expected) {
+		t.Errorf("sample encrypted as %x, expected %x", encrypted, expected)
+	}
+
+	encryptSample(block, SencSample{IV: iv, Subsamples: subsamples}, encrypted)
+	if !bytes.Equal(encrypted, sample) {
+		t.Errorf("sample decrypted as %x, expected %x", encrypted, sample)
+	}
+
+	// A sample without subsamples is fully protected
+	encrypted = append([]byte(nil), sample...)
+	encryptSample(block, SencSample{IV: iv}, encrypted)
+	expected = append([]byte(nil), sample...)
+	cipher.NewCTR(block, counter).XORKeyStream(expected, expected)
+	if !bytes.Equal(encrypted, expected) {
+		t.Errorf("sample encrypted as %x, expected %x", encrypted, expected)
+	}
+}
+
+// Length prefixed NAL units of a sample
+func testNalSample(lengthSize int, nals ...[]byte) (sample []byte) {
+	for _, nal := range nals {
+		for i := lengthSize - 1; i >= 0; i-- {
+			sample = append(sample, byte(len(nal)>>uint(8*i)))
+		}
+		sample = append(sample, nal...)
+	}
+	return
+}
+
+func TestNalSubsamplesClear(t *testing.T) {
+	params := testParameterSets(testSps(4, 6), testPps(false, false))
+	partition := append([]byte{0x02}, bytes.Repeat([]byte{0x5a}, 100)...)
+	sei := append([]byte{0x06}, bytes.Repeat([]byte{0x5a}, 100)...)
+
+	// Slice of an unknown PPS
+	var w bitWriter
+	w.ue(0)
+	w.ue(5)
+	w.ue(3)
+	w.u(32, 0xffffffff)
+	unknown := append(w.nal(0x41), bytes.Repeat([]byte{0x5a}, 100)...)
+
+	sample := testNalSample(4, sei, partition, unknown)
+	subsamples := nalSubsamples(sample, 4, params)
+	if len(subsamples) != 1 || int(subsamples[0].ClearBytes) != len(sample) || subsamples[0].ProtectedBytes != 0 {
+		t.Errorf("subsamples %+v, expected %d clear bytes", subsamples, len(sample))
+	}
+}
+
+func TestNalSubsamplesLargeClear(t *testing.T) {
+	params := testParameterSets(testSps(4, 6), testPps(false, false))
+	sei := append([]byte{0x06}, make([]byte, 0x1ffff)...)
+
+	var w bitWriter
+	w.ue(0)
+	w.ue(7) // slice_type I
+	w.ue(0)
+	w.u(4, 0)
+	w.u(6, 0)
+	w.u(1, 0) // adaptive_ref_pic_marking_mode_flag
+	w.se(0)
+	w.ue(1)
+	for i := 0; i < 64; i++ {
+		w.u(8, 0x5a)
+	}
+	slice := w.nal(0x21)
+	headerSize, err := params.sliceHeaderSize(slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clear bytes of the SEI and of the slice header are split in subsamples of at most 0xffff bytes
+	sample := testNalSample(4, sei, slice)
+	subsamples := nalSubsamples(sample, 4, params)
+	protected := (len(slice) - headerSize) / aes.BlockSize * aes.BlockSize
+	clear := len(sample) - protected
+	if len(subsamples) != 3 || subsamples[0].ClearBytes != 0xffff || subsamples[1].ClearBytes != 0xffff || subsamples[0].ProtectedBytes != 0 || subsamples[1].ProtectedBytes != 0 {
+		t.Fatalf("subsamples %+v", subsamples)
+	}
+	if int(subsamples[2].ClearBytes) != clear-2*0xffff || int(subsamples[2].ProtectedBytes) != protected {
+		t.Errorf("last subsample %+v, expected %d clear and %d protected bytes", subsamples[2], clear-2*0xffff, protected)
+	}
+}
+
+func TestNalSubsamplesParameterSetsOfSample(t *testing.T) {
+	// The track knows no parameter sets, the sample gives them before its slice
+	params := newAvcParameterSets(nil)
+
+	var w bitWriter
+	w.ue(0)
+	w.ue(7)
+	w.ue(0)
+	w.u(4, 0)
+	w.ue(0) // idr_pic_id
+	w.u(6, 0)
+	w.u(2, 0)
+	w.se(0)
+	w.ue(1)
+	for i := 0; i < 64; i++ {
+		w.u(8, 0x5a)
+	}
+	slice := w.nal(0x65)
+
+	sample := testNalSample(2, testSps(4, 6), testPps(false, false), slice)
+	subsamples := nalSubsamples(sample, 2, params)
+	if len(subsamples) != 1 || subsamples[0].ProtectedBytes == 0 {
+		t.Errorf("subsamples %+v, expected the slice data to be protected", subsamples)
+	}
+}
+
+func TestNalSubsamplesTruncated(t *testing.T) {
+	params := newAvcParameterSets(nil)
+
+	// The size of the last NAL unit overflows the sample
+	sample := append(testNalSample(4, []byte{0x09, 0xf0}), 0x00, 0x00, 0x10, 0x00, 0x06, 0x5a)
+	subsamples := nalSubsamples(sample, 4, params)
+	if len(subsamples) != 1 || int(subsamples[0].ClearBytes) != len(sample) {
+		t.Errorf("subsamples %+v, expected %d clear bytes", subsamples, len(sample))
+	}
+
+	// Trailing bytes shorter than a NAL unit length
+	sample = append(testNalSample(4, []byte{0x09, 0xf0}), 0x00, 0x00)
+	subsamples = nalSubsamples(sample, 4, params)
+	if len(subsamples) != 1 || int(subsamples[0].ClearBytes) != len(sample) {
+		t.Errorf("subsamples %+v, expected %d clear bytes", subsamples, len(sample))
+	}
+}
+
+func TestProtectionPattern(t *testing.T) {
+	tests := []struct {
+		scheme    string
+		trackType string
+		crypt     byte
+		skip      byte
+	}{
+		{"cbcs", "video", 1, 9},
+		{"cbcs", "audio", 0, 0},
+		{"cenc", "video", 0, 0},
+	}
+	for _, test := range tests {
+		if crypt, skip := (Protection{Scheme: test.scheme}).pattern(test.trackType); crypt != test.crypt || skip != test.skip {
+			t.Errorf("%s %s pattern %d:%d, expected %d:%d", test.scheme, test.trackType, crypt, skip, test.crypt, test.skip)
+		}
+	}
+}
+
+func TestEncryptPatternSample(t *testing.T) {
+	block, _ := aes.NewCipher(testKey)
+	iv := bytes.Repeat([]byte{0xa5}, aes.BlockSize)
+	subsamples := []Subsample{{ClearBytes: 7, ProtectedBytes: 500}, {ClearBytes: 3, ProtectedBytes: 40}}
+	sample := testSample(7 + 500 + 3 + 40)
+
+	encrypted := append([]byte(nil), sample...)
+	encryptPatternSample(block, SencSample{IV: iv, Subsamples: subsamples}, encrypted, 1, 9)
+
+	// The first block of every ten is encrypted, chained within each subsample from the constant IV. The partial
+	// block ending the subsamples stays clear.
+	expected := append([]byte(nil), sample...)
+	offset := 0
+	for _, subsample := range subsamples {
+		offset += int(subsample.ClearBytes)
+		var blocks []byte
+		for start := 0; start+aes.BlockSize <= int(subsample.ProtectedBytes); start += 160 {
+			blocks = append(blocks, sample[offset+start:offset+start+aes.BlockSize]...)
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(blocks, blocks)
+		for start := 0; len(blocks) != 0; start += 160 {
+			copy(expected[offset+start:], blocks[:aes.BlockSize])
+			blocks = blocks[aes.BlockSize:]
+		}
+		offset += int(subsample.ProtectedBytes)
+	}
+	if !bytes.Equal(encrypted, expected) {
+		t.Errorf("sample encrypted as %x, expected %x", encrypted, expected)
+	}
+
+	decryptPatternSample(block, SencSample{IV: iv, Subsamples: subsamples}, encrypted, 1, 9)
+	if !bytes.Equal(encrypted, sample) {
+		t.Errorf("sample decrypted as %x, expected %x", encrypted, sample)
+	}
+}
+
+func TestEncryptPatternSampleWithoutPattern(t *testing.T) {
+	block, _ := aes.NewCipher(testKey)
+	iv := bytes.Repeat([]byte{0xa5}, aes.BlockSize)
+	sample := testSample(100)
+
+	// The whole blocks of an audio sample are encrypted, the partial block ending it stays clear
+	encrypted := append([]byte(nil), sample...)
+	encryptPatternSample(block, SencSample{IV: iv}, encrypted, 0, 0)
+	expected := append([]byte(nil), sample...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(expected[:96], expected[:96])
+	if !bytes.Equal(encrypted, expected) {
+		t.Errorf("sample encrypted as %x, expected %x", encrypted, expected)
+	}
+
+	decryptPatternSample(block, SencSample{IV: iv}, encrypted, 0, 0)
+	if !bytes.Equal(encrypted, sample) {
+		t.Errorf("sample decrypted as %x, expected %x", encrypted, sample)
+	}
+}
+
+func TestSampleDecryption(t *testing.T) {
+	block, _ := aes.NewCipher(testKey)
+	iv := bytes.Repeat([]byte{0x5a}, aes.BlockSize)
+	sizes := []uint32{100, 37, 300}
+
+	for _, scheme := range []string{"cenc", "cbcs"} {
+		// Samples fully protected with the constant IV of the tenc box, after 10 bytes of the file
+		var clear, encrypted []byte
+		encrypted = make([]byte, 10)
+		for i, size := range sizes {
+			sample := testSample(int(size))
+			sample[0] = byte(i)
+			clear = append(clear, sample...)
+			if scheme == "cbcs" {
+				encryptPatternSample(block, SencSample{IV: iv}, sample, 1, 9)
+			} else {
+				encryptSample(block, SencSample{IV: iv}, sample)
+			}
+			encrypted = append(encrypted, sample...)
+		}
+		filename := t.TempDir() + "/source.mp4"
+		if err := ioutil.WriteFile(filename, encrypted, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		encryption := StreamEncryption{Scheme: scheme, Key: testKey, Tenc: TencBox{DefaultCryptByteBlock: 1, DefaultSkipByteBlock: 9, DefaultConstantIV: iv}}
+		decryption, err := NewSampleDecryption(filename, encryption, 1, 10, sizes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Reads spanning several samples, within a sample, and going back to a previous sample
+		for _, r := range [][2]int{{0, len(clear)}, {5, 150}, {120, 121}, {137, 437}, {0, 1}} {
+			data := make([]byte, r[1]-r[0])
+			copy(data, encrypted[10+r[0]:10+r[1]])
+			if err := decryption.decrypt(f, data, int64(10+r[0])); err != nil {
+				t.Fatalf("%s: bytes %d to %d: %v", scheme, r[0], r[1], err)
+			}
+			if !bytes.Equal(data, clear[r[0]:r[1]]) {
+				t.Errorf("%s: bytes %d to %d decrypted as %x, expected %x", scheme, r[0], r[1], data, clear[r[0]:r[1]])
+			}
+		}
+	}
+
+	if _, err := NewSampleDecryption("", StreamEncryption{Scheme: "cens", Key: testKey}, 1, 0, sizes); err == nil {
+		t.Error("decryption of the cens scheme")
+	}
+}
+
+func TestSampleDecryptionReadError(t *testing.T) {
+	// The last sample is cut short in the source file
+	sizes := []uint32{100, 37}
+	filename := t.TempDir() + "/source.mp4"
+	if err := ioutil.WriteFile(filename, make([]byte, 120), 0644); err != nil {
+		t.Fatal(err)
+	}
+	encryption := StreamEncryption{Scheme: "cenc", Key: testKey, Tenc: TencBox{DefaultConstantIV: make([]byte, 8)}}
+	decryption, err := NewSampleDecryption(filename, encryption, 1, 0, sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mdat := MdatBox{Size: 100, Filename: filename, Decryption: decryption}
+	if _, err := MapToBytes(map[string][]interface{}{"mdat": {mdat}}); err != nil {
+		t.Errorf("first sample: %v", err)
+	}
+	mdat.Offset = 100
+	mdat.Size = 20
+	if _, err := MapToBytes(map[string][]interface{}{"mdat": {mdat}}); err == nil {
+		t.Error("second sample read from the end of the file")
+	}
+}
+
+func TestProtectedFragmentIVs(t *testing.T) {
+	sConf, filename := testTrack(t, "audio", 1000, []SttsBoxEntry{{SampleCount: 8, SampleDelta: 1000}}, nil, []uint32{20, 21, 22, 23, 24, 25, 26, 27})
+	protection := &Protection{Scheme: "cenc", KeyId: testKey, Key: testKey}
+	ivs := func(fragmentNumber uint32, decodeTimeOffset int64) (ivs []string) {
+		fmp4 := CreateDashFragmentWithConf(sConf, filename, fragmentNumber, 2, FragmentOptions{Protection: protection, DecodeTimeOffset: decodeTimeOffset})
+		for _, sample := range fmp4["moof.traf.senc"][0].(SencBox).Samples {
+			ivs = append(ivs, string(sample.IV))
+		}
+		return
+	}
+
+	// The fragment is encrypted identically each time it is built
+	vod := ivs(2, 0)
+	if len(vod) != 2 || vod[0] == vod[1] || !reflect.DeepEqual(ivs(2, 0), vod) {
+		t.Fatalf("IVs %x", vod)
+	}
+	// Other samples of the file at the same decode times, like a live channel looping the package, and the same
+	// samples at other decode times have other IVs
+	for _, other := range [][]string{ivs(1, 2000), ivs(3, -2000), ivs(2, 8000)} {
+		for _, iv := range other {
+			if iv == vod[0] || iv == vod[1] {
+				t.Errorf("IV %x of the package reused", iv)
+			}
+		}
+	}
+}
+
+func TestPassthroughEncryption(t *testing.T) {
+	sConf, filename := testTrack(t, "video", 1000, []SttsBoxEntry{{SampleCount: 4, SampleDelta: 1000}}, []uint32{1, 3}, []uint32{30, 31, 32, 33})
+	sConf.Video.CodecInfo = [3]byte{0x42, 0xc0, 0x1e}
+	sConf.Video.NalUnitSize = 0xff
+
+	// Auxiliary information of the samples protected upstream, after a saiz box giving their sizes: an IV and
+	// subsamples, the third sample having two of them
+	var info [][]byte
+	for i := 0; i < 4; i++ {
+		entry := bytes.Repeat([]byte{byte(0x10 + i)}, 8)
+		entry = append(entry, 0, 1, 0, 5, 0, 0, 0, byte(25+i))
+		if i == 2 {
+			entry[9] = 2
+			entry = append(entry, 0, 1, 0, 0, 0, 1)
+		}
+		info = append(info, entry)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption := StreamEncryption{Scheme: "cenc", SchemeVersion: 0x00010000, SaizBoxOffset: int64(len(data))}
+	encryption.Tenc = TencBox{Size: 24, DefaultIsProtected: 1, DefaultPerSampleIVSize: 8}
+	copy(encryption.Tenc.DefaultKID[:], testKey)
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 0, 4)
+	for _, entry := range info {
+		data = append(data, byte(len(entry)))
+	}
+	encryption.SaizBoxSize = uint32(int64(len(data)) - encryption.SaizBoxOffset)
+	encryption.AuxInfoOffset = int64(len(data))
+	for _, entry := range info {
+		data = append(data, entry...)
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sConf.Encryption = &encryption
+
+	// The init declares the protection of the source
+	mp4Init := CreateDashInitWithConf(sConf)
+	stsdPath := "moov.trak.mdia.minf.stbl.stsd"
+	if mp4Init[stsdPath+".avc1"] != nil || mp4Init[stsdPath+".encv"] == nil || mp4Init[stsdPath+".encv.avcC"] == nil {
+		t.Fatal("avc1 sample entry not protected")
+	}
+	if frma := mp4Init[stsdPath+".encv.sinf.frma"][0].(FrmaBox); string(frma.DataFormat[:]) != "avc1" {
+		t.Errorf("original format %s", frma.DataFormat)
+	}
+	if schm := mp4Init[stsdPath+".encv.sinf.schm"][0].(SchmBox); string(schm.SchemeType[:]) != "cenc" {
+		t.Errorf("scheme %s", schm.SchemeType)
+	}
+	if tenc := mp4Init[stsdPath+".encv.sinf.schi.tenc"][0].(TencBox); !bytes.Equal(tenc.DefaultKID[:], testKey) || tenc.DefaultPerSampleIVSize != 8 {
+		t.Errorf("tenc box %+v", tenc)
+	}
+	if _, err := MapToBytes(mp4Init); err != nil {
+		t.Fatal(err)
+	}
+
+	// The samples of the second fragment keep their auxiliary information, which the saio box locates
+	fmp4 := CreateDashFragmentWithConf(sConf, filename, 2, 2, FragmentOptions{})
+	if fmp4 == nil || fmp4["moof.traf.senc"] == nil || fmp4["moof.traf.saiz"] == nil || fmp4["moof.traf.saio"] == nil {
+		t.Fatal("fragment without senc, saiz and saio boxes")
+	}
+	senc := fmp4["moof.traf.senc"][0].(SencBox)
+	if len(senc.Samples) != 2 || senc.Flags[2]&0x02 == 0 {
+		t.Fatalf("senc box %+v", senc)
+	}
+	saiz := fmp4["moof.traf.saiz"][0].(SaizBox)
+	if saiz.SampleCount != 2 || saiz.DefaultSampleInfoSize != 0 || !bytes.Equal(saiz.SampleInfoSizes, []byte{22, 16}) {
+		t.Errorf("saiz box %+v", saiz)
+	}
+	b, err := MapToBytes(fmp4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moof := bytes.Index(b, []byte("moof")) - 4
+	offset := moof + int(fmp4["moof.traf.saio"][0].(SaioBox).Offsets[0])
+	if got, expected := b[offset:offset+len(info[2])+len(info[3])], append(append([]byte{}, info[2]...), info[3]...); !bytes.Equal(got, expected) {
+		t.Errorf("auxiliary information %x at the saio offset, expected %x", got, expected)
+	}
+	if mdat := fmp4["mdat"][0].(MdatBox); !bytes.Equal(b[len(b)-int(mdat.Size):len(b)-33], bytes.Repeat([]byte{2}, 32)) {
+		t.Error("samples not passed through")
+	}
+}
@@ -33,10 +33,15 @@ package mp4
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 )
 
 var debugMode bool
@@ -45,13 +50,155 @@ var funcBoxes map[string]interface{}
 type JsonConfig struct {
 	SegmentDuration uint32
 	Tracks          map[string][]TrackEntry
+	Events          string                  `json:",omitempty"` // Timed events sidecar filename
+	EventStreams    []EventStream           `json:"-"`          // Timed events loaded from the sidecar
+	Playlist        []PlaylistItem          `json:",omitempty"` // Packages played in sequence if this is a playlist package
+	Live            *LiveConfig             `json:",omitempty"` // Plays the playlist as a live channel on the wall clock
+	HlsFormat       string                  `json:",omitempty"` // HLS segments: "fmp4" for the CMAF segments of DASH, TS otherwise
+	Encryption      *EncryptionConfig       `json:",omitempty"` // Encryption of the HLS segments
+	HlsByteRanges   bool                    `json:",omitempty"` // HLS segments are byte ranges of a single resource per rendition
+	ProgramDateTime *time.Time              `json:",omitempty"` // Wall clock time of the start of the program (eg: "2016-01-01T20:00:00Z")
+	DateRanges      []DateRange             `json:",omitempty"` // Tagged ranges of the program (eg: intro, recap, credits)
+	Cenc            *CencConfig             `json:",omitempty"` // Common encryption of the DASH fragments
+	Preview         *PreviewConfig          `json:",omitempty"` // Preview of the users without entitlement, removed for the requests of entitled users
+}
+
+// Preview of a package: the users whose token does not give one of the entitlements in its claim only play the
+// first milliseconds of the package
+type PreviewConfig struct {
+	Duration     uint64   // Duration of the preview in milliseconds
+	Claim        string   // Token claim of the entitlement of the user (eg: "ent")
+	Entitlements []string // Values of the claim playing the whole package (eg: "subscriber")
+}
+
+// Range of the program tagged by the editorial tools, dated from the program date time
+type DateRange struct {
+	Id         string
+	Class      string            `json:",omitempty"` // Semantics of the range (eg: "com.afrostream.intro")
+	Start      uint64            // Start in milliseconds from the start of the program
+	Duration   uint64            `json:",omitempty"` // Duration in milliseconds, 0 is unknown
+	Skip       bool              `json:",omitempty"` // Players may offer to skip the range (eg: skip intro)
+	Attributes map[string]string `json:",omitempty"` // Client attributes, their names start with "X-" (eg: "X-COM-AFROSTREAM-TITLE")
+}
+
+type EncryptionConfig struct {
+	Method         string // HLS encryption method: "AES-128" for whole segments, "SAMPLE-AES" for the samples
+	Key            string `json:",omitempty"` // Per-asset key in 32 hexadecimal digits
+	KeyFile        string `json:",omitempty"` // Key store filename holding the key in binary or hexadecimal
+	RotationPeriod uint32 `json:",omitempty"` // Number of segments encrypted with the same key, 0 for a single key
+	ContentKey     []byte `json:"-"`          // Key loaded from the package or the key store
+}
+
+type CencConfig struct {
+	Scheme  string // Protection scheme: "cenc" (AES-CTR) or "cbcs" (AES-CBC pattern encryption, also played by HLS)
+	KeyId   string `json:",omitempty"` // Key ID in 32 hexadecimal digits, dashes are allowed (eg: "10000000-1000-1000-1000-100000000001")
+	Key     string `json:",omitempty"` // Content key in 32 hexadecimal digits
+	KeyFile string `json:",omitempty"` // Key store filename holding the key in binary or hexadecimal
+	AssetId string `json:",omitempty"` // Asset of the key store holding the keys of the tracks, instead of a single key
+
+	RotationPeriod uint32 `json:",omitempty"` // Number of segments encrypted with the same key, 0 for a single key
+
+	// DRM systems giving the key to the players, signalled by pssh boxes in the init and ContentProtection
+	// descriptors in the MPD
+	PsshVersion byte             `json:",omitempty"` // Version of the Widevine and PlayReady pssh boxes, 1 also lists the key IDs
+	Widevine    *WidevineConfig  `json:",omitempty"`
+	PlayReady   *PlayReadyConfig `json:",omitempty"`
+	ClearKey    bool             `json:",omitempty"` // W3C ClearKey, its pssh box always lists the key IDs
+	ClearKeyUrl string           `json:",omitempty"` // ClearKey license URL, the license route of ams by default
+}
+
+type WidevineConfig struct {
+	Provider  string            `json:",omitempty"` // Content provider name registered with Widevine
+	ContentId string            `json:",omitempty"` // Content ID of the asset, given to the license service
+	Pssh      map[string]string `json:",omitempty"` // Pssh boxes in base 64 by key ID, given by the DRM vendor
+}
+
+type PlayReadyConfig struct {
+	LaUrl            string            `json:",omitempty"` // License acquisition URL
+	LuiUrl           string            `json:",omitempty"` // License acquisition user interface URL
+	CustomAttributes string            `json:",omitempty"` // XML content of the CUSTOMATTRIBUTES element of the header
+	Header           string            `json:",omitempty"` // Complete WRMHEADER XML replacing the generated header
+	Pssh             map[string]string `json:",omitempty"` // Pssh boxes in base 64 by key ID, given by the DRM vendor
+}
+
+type LiveConfig struct {
+	AvailabilityStartTime time.Time // Wall clock time of the first segment (eg: "2016-01-01T00:00:00Z")
+	TimeShiftBufferDepth  uint32    `json:",omitempty"` // Seconds of content available behind the live edge, 0 for the default
+	MinimumUpdatePeriod   uint32    `json:",omitempty"` // Seconds between MPD updates, 0 for the segment duration
+	Loop                  bool      `json:",omitempty"` // Restart the playlist at its end
+	PartDuration          uint32    `json:",omitempty"` // Milliseconds of the LL-HLS parts and of the chunks of the CMAF segments, 0 disables low latency
+}
+
+type PlaylistItem struct {
+	Package string      // Package filename relative to the document root (eg: "intro/intro.json")
+	In      uint64      `json:",omitempty"` // In point in milliseconds
+	Out     uint64      `json:",omitempty"` // Out point in milliseconds, 0 is the end of the package
+	Config  *JsonConfig `json:"-"`          // Package loaded by ams
+}
+
+// Timed events sidecar content
+type EventsConfig struct {
+	EventStreams []EventStream
+}
+
+type EventStream struct {
+	SchemeIdUri string // Scheme of the events (eg: "urn:afrostream:chapter")
+	Value       string `json:",omitempty"`
+	Timescale   uint32 // Timescale of the events presentation time and duration (eg: 1000)
+	Inband      bool   `json:",omitempty"` // Also carry the events in EMSG boxes of the fragments
+	EmsgVersion byte   `json:",omitempty"` // EMSG box version, 0 or 1
+	Events      []Event
+}
+
+type Event struct {
+	Id               uint32
+	PresentationTime uint64 // Relative to the start of the presentation
+	Duration         uint32 `json:",omitempty"` // 0 is unknown
+	MessageData      string `json:",omitempty"`
 }
 
 type TrackEntry struct {
-	Bandwidth uint64
-	Lang      string
-	File      string
-	Config    *StreamConfig `json:",omitempty"`
+	Bandwidth     uint64
+	PeakBandwidth uint64 `json:",omitempty"` // Highest bandwidth of a segment, 0 if unknown
+	Lang          string
+	File          string
+	Config        *StreamConfig `json:",omitempty"`
+	Default       bool          `json:",omitempty"` // Default audio track of the package, the first audio track if none is flagged
+	Watermark     *TrackEntry   `json:",omitempty"` // Variant B of the forensic watermark of a video track, the track itself being variant A
+}
+
+// Highest bandwidth of a segment of the track, the average bandwidth if it is unknown
+func (t TrackEntry) MaxBandwidth() uint64 {
+	if t.PeakBandwidth > t.Bandwidth {
+		return t.PeakBandwidth
+	}
+
+	return t.Bandwidth
+}
+
+// A package is watermarked when one of its video tracks, or of the video tracks of its playlist items, has a
+// variant B
+func (jConfig JsonConfig) Watermarked() bool {
+	for _, t := range jConfig.Tracks["video"] {
+		if t.Watermark != nil {
+			return true
+		}
+	}
+	for _, item := range jConfig.Playlist {
+		if item.Config != nil && item.Config.Watermarked() {
+			return true
+		}
+	}
+	return false
+}
+
+// Per request options of a DASH fragment
+type FragmentOptions struct {
+	Events           []EventStream // Inband events carried in EMSG boxes
+	DecodeTimeOffset int64         // Shift of the decode times in the track timescale (eg: live channels)
+	Live             bool          // The last segment of the file is not the last segment of the representation
+	IFramesOnly      bool          // Trick mode fragment, each I-Frame lasts until the next one
+	Protection       *Protection   // Common encryption of the samples, nil for clear fragments
 }
 
 type StreamAudioEntry struct {
@@ -60,6 +207,12 @@ type StreamAudioEntry struct {
 	SampleSize       uint16 // MP4A MP4 Box Info (eg: 16)
 	CompressionId    uint16 // MP4A MP4 Box Info (eg: 0)
 	SampleRate       uint32 // MP4A MP4 Box Info (eg: 3145728000)
+
+	// AudioSpecificConfig fields, taken from the ESDS DecoderSpecificInfo
+	ObjectType           uint8  // Signalled audio object type, 2 (AAC-LC), 5 (HE-AAC) or 29 (HE-AACv2)
+	SamplingFrequency    uint32 // Output sampling frequency, SBR extension frequency included (eg: 48000)
+	ChannelConfiguration uint8  // Output channel configuration, PS upmix included (eg: 2)
+	DecoderSpecificInfo  []byte // Raw AudioSpecificConfig (eg: [17 144])
 }
 
 type StreamVideoEntry struct {
@@ -84,6 +237,8 @@ type StreamVideoEntry struct {
 	StssBoxSize          uint32
 	CttsBoxOffset        int64
 	CttsBoxSize          uint32
+	IFrameCount          uint32  // STSS MP4 Box number of I-Frames, 0 if unknown (eg: 452)
+	IFrameBandwidth      uint64  // Bandwidth of the I-Frames only (eg: 98304)
 }
 
 type StreamConfig struct {
@@ -99,10 +254,13 @@ type StreamConfig struct {
 	Language      [3]byte // ISO-639-2/T 3 letters code (eg: []byte{ 'e', 'n', 'g' }
 	HandlerType   uint32  // HDLR MP4 Box info (eg: 1986618469)
 	SampleDelta   uint32  // STTS MP4 Box SampleDelta via Entries[0] (eg: 1024)
+	SttsBoxOffset int64   `json:",omitempty"` // STTS MP4 Box giving the decode times of the fragments, SampleDelta only if not set
+	SttsBoxSize   uint32  `json:",omitempty"`
 	MediaTime     int64   // ELST MP4 Box MediaTime
 
-	Audio *StreamAudioEntry `json:",omitempty"`
-	Video *StreamVideoEntry `json:",omitempty"`
+	Audio      *StreamAudioEntry `json:",omitempty"`
+	Video      *StreamVideoEntry `json:",omitempty"`
+	Encryption *StreamEncryption `json:",omitempty"` // Common encryption applied upstream, nil for clear samples
 }
 
 type Mp4 struct {
@@ -258,6 +416,7 @@ type DrefUrnBox struct {
 
 type SttsBox struct {
 	Size       uint32
+	Offset     int64
 	Version    byte
 	Reserved   [3]byte
 	EntryCount uint32
@@ -481,9 +640,32 @@ type SchmBox struct {
 }
 
 type MdatBox struct {
-	Size     uint32
-	Filename string
-	Offset   int64
+	Size       uint32
+	Filename   string
+	Offset     int64
+	Ranges     []MdatRange       // Data gathered from these ranges of the file instead of Offset when set
+	Data       []byte            // Samples transformed in memory (eg: encrypted), read from the file when nil
+	Decryption *SampleDecryption // Samples protected upstream, decrypted when they are read from the file
+}
+
+type MdatRange struct {
+	Offset int64
+	Size   uint32
+}
+
+// Event Message Box (ISO/IEC 23009-1 5.10.3.3)
+type EmsgBox struct {
+	Size                  uint32
+	Version               byte
+	Flags                 [3]byte
+	SchemeIdUri           string
+	Value                 string
+	Timescale             uint32
+	PresentationTimeDelta uint32 // Version 0 only
+	PresentationTime      uint64 // Version 1 only
+	EventDuration         uint32
+	Id                    uint32
+	MessageData           []byte
 }
 
 // ***
@@ -1302,6 +1484,299 @@ func (esds EsdsBox) Bytes() (data []byte) {
 	return
 }
 
+// Read the size field of an MPEG-4 descriptor (ISO/IEC 14496-1 expandable class)
+func readDescriptorSize(data []byte, offset int) (size int, newOffset int) {
+	for i := 0; i < 4 && offset < len(data); i++ {
+		b := data[offset]
+		offset++
+		size = (size << 7) | int(b&0x7f)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	newOffset = offset
+
+	return
+}
+
+// Return the DecoderSpecificInfo (tag 0x05) payload of the ES_Descriptor, nil if not found
+func (esds EsdsBox) DecoderSpecificInfo() []byte {
+	data := esds.Data
+	offset := 0
+	for offset < len(data) {
+		tag := data[offset]
+		var size int
+		size, offset = readDescriptorSize(data, offset+1)
+		switch tag {
+		case 0x03: // ES_Descriptor
+			if offset+3 > len(data) {
+				return nil
+			}
+			flags := data[offset+2]
+			offset += 3
+			if flags&0x80 != 0 { // streamDependenceFlag
+				offset += 2
+			}
+			if flags&0x40 != 0 && offset < len(data) { // URL_Flag
+				offset += 1 + int(data[offset])
+			}
+			if flags&0x20 != 0 { // OCRstreamFlag
+				offset += 2
+			}
+		case 0x04: // DecoderConfigDescriptor
+			offset += 13
+		case 0x05: // DecoderSpecificInfo
+			if offset+size > len(data) {
+				return nil
+			}
+			return data[offset : offset+size]
+		default:
+			offset += size
+		}
+	}
+
+	return nil
+}
+
+// MPEG-4 Audio sampling frequencies indexed by samplingFrequencyIndex
+var aacSamplingFrequencies = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// Return the samplingFrequencyIndex of a frequency, 0x0f if it must be explicitly coded
+func SamplingFrequencyIndex(frequency uint32) uint32 {
+	for i, f := range aacSamplingFrequencies {
+		if f == frequency {
+			return uint32(i)
+		}
+	}
+
+	return 0x0f
+}
+
+type bitReader struct {
+	data   []byte
+	offset uint
+}
+
+func (r *bitReader) bitsLeft() uint {
+	return uint(len(r.data))*8 - r.offset
+}
+
+func (r *bitReader) readBits(n uint) (v uint32) {
+	for ; n > 0; n-- {
+		v <<= 1
+		if r.offset < uint(len(r.data))*8 {
+			v |= uint32(r.data[r.offset/8]>>(7-r.offset%8)) & 0x01
+		}
+		r.offset++
+	}
+
+	return
+}
+
+func (r *bitReader) readAudioObjectType() uint8 {
+	objectType := r.readBits(5)
+	if objectType == 31 {
+		objectType = 32 + r.readBits(6)
+	}
+
+	return uint8(objectType)
+}
+
+func (r *bitReader) readSamplingFrequency() (frequency uint32, err error) {
+	index := r.readBits(4)
+	if index == 0x0f {
+		frequency = r.readBits(24)
+		return
+	}
+	if int(index) >= len(aacSamplingFrequencies) {
+		err = fmt.Errorf("invalid sampling frequency index %d", index)
+		return
+	}
+	frequency = aacSamplingFrequencies[index]
+
+	return
+}
+
+type AudioSpecificConfig struct {
+	ObjectType                 uint8  // Core audio object type (eg: 2 for AAC-LC)
+	SamplingFrequency          uint32 // Core sampling frequency (eg: 24000)
+	ChannelConfiguration       uint8  // Core channel configuration (eg: 1)
+	SBRPresent                 bool   // Spectral Band Replication (HE-AAC)
+	PSPresent                  bool   // Parametric Stereo (HE-AACv2)
+	ExtensionSamplingFrequency uint32 // SBR output sampling frequency (eg: 48000)
+}
+
+// Decode an AudioSpecificConfig (ISO/IEC 14496-3 1.6.2.1), explicit hierarchical and
+// backward compatible SBR/PS signalling are both supported
+func ParseAudioSpecificConfig(data []byte) (asc AudioSpecificConfig, err error) {
+	if len(data) < 2 {
+		err = errors.New("AudioSpecificConfig is too short")
+		return
+	}
+
+	r := bitReader{data: data}
+	asc.ObjectType = r.readAudioObjectType()
+	asc.SamplingFrequency, err = r.readSamplingFrequency()
+	if err != nil {
+		return
+	}
+	asc.ChannelConfiguration = uint8(r.readBits(4))
+
+	if asc.ObjectType == 5 || asc.ObjectType == 29 {
+		asc.SBRPresent = true
+		asc.PSPresent = asc.ObjectType == 29
+		asc.ExtensionSamplingFrequency, err = r.readSamplingFrequency()
+		if err != nil {
+			return
+		}
+		asc.ObjectType = r.readAudioObjectType()
+		if asc.ObjectType == 22 {
+			r.readBits(4) // extensionChannelConfiguration
+		}
+	}
+
+	switch asc.ObjectType {
+	case 1, 2, 3, 4, 6, 7, 17, 19, 20, 21, 22, 23:
+		// GASpecificConfig
+		r.readBits(1) // frameLengthFlag
+		if r.readBits(1) == 1 { // dependsOnCoreCoder
+			r.readBits(14) // coreCoderDelay
+		}
+		extensionFlag := r.readBits(1)
+		if asc.ChannelConfiguration == 0 {
+			err = errors.New("AudioSpecificConfig with program_config_element is not supported")
+			return
+		}
+		if asc.ObjectType == 6 || asc.ObjectType == 20 {
+			r.readBits(3) // layerNr
+		}
+		if extensionFlag == 1 {
+			if asc.ObjectType == 22 {
+				r.readBits(16) // numOfSubFrame + layer_length
+			}
+			if asc.ObjectType == 17 || asc.ObjectType == 19 || asc.ObjectType == 20 || asc.ObjectType == 23 {
+				r.readBits(3) // resilience flags
+			}
+			r.readBits(1) // extensionFlag3
+		}
+	default:
+		err = fmt.Errorf("unsupported audio object type %d", asc.ObjectType)
+		return
+	}
+
+	// Backward compatible SBR/PS signalling
+	if !asc.SBRPresent && r.bitsLeft() >= 16 && r.readBits(11) == 0x2b7 {
+		if r.readAudioObjectType() == 5 {
+			if r.readBits(1) == 1 {
+				asc.SBRPresent = true
+				asc.ExtensionSamplingFrequency, err = r.readSamplingFrequency()
+				if err != nil {
+					return
+				}
+				if r.bitsLeft() >= 12 && r.readBits(11) == 0x548 {
+					asc.PSPresent = r.readBits(1) == 1
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// Audio object type to signal in codecs strings (eg: 5 for mp4a.40.5)
+func (asc AudioSpecificConfig) SignalledObjectType() uint8 {
+	if asc.PSPresent {
+		return 29
+	}
+	if asc.SBRPresent {
+		return 5
+	}
+
+	return asc.ObjectType
+}
+
+// Sampling frequency of the decoded output
+func (asc AudioSpecificConfig) OutputSamplingFrequency() uint32 {
+	if asc.SBRPresent && asc.ExtensionSamplingFrequency != 0 {
+		return asc.ExtensionSamplingFrequency
+	}
+
+	return asc.SamplingFrequency
+}
+
+// Channel configuration of the decoded output, PS upmixes mono to stereo
+func (asc AudioSpecificConfig) OutputChannelConfiguration() uint8 {
+	if asc.PSPresent && asc.ChannelConfiguration == 1 {
+		return 2
+	}
+
+	return asc.ChannelConfiguration
+}
+
+// RFC 6381 codecs string, packages created before AudioSpecificConfig parsing are AAC-LC
+func (audio StreamAudioEntry) Codecs() string {
+	if audio.ObjectType == 0 {
+		return "mp4a.40.2"
+	}
+
+	return fmt.Sprintf("mp4a.40.%d", audio.ObjectType)
+}
+
+// Number of output channels, falls back on the MP4A box info
+func (audio StreamAudioEntry) Channels() uint16 {
+	if audio.ChannelConfiguration == 0 {
+		return audio.NumberOfChannels
+	}
+	if audio.ChannelConfiguration == 7 {
+		return 8
+	}
+
+	return uint16(audio.ChannelConfiguration)
+}
+
+// Output sampling frequency of an audio stream, falls back on the MDHD timescale
+func (sConf StreamConfig) AudioSamplingRate() uint32 {
+	if sConf.Audio == nil || sConf.Audio.SamplingFrequency == 0 {
+		return sConf.Timescale
+	}
+
+	return sConf.Audio.SamplingFrequency
+}
+
+// Create the ES_Descriptor carried by the ESDS box from a DecoderSpecificInfo
+func createEsdsData(decoderSpecificInfo []byte, avgBitrate uint32) (data []byte) {
+	dsiSize := len(decoderSpecificInfo)
+	decoderConfigSize := 13 + 2 + dsiSize
+	esSize := 3 + 2 + decoderConfigSize + 3
+
+	data = make([]byte, 2+esSize)
+	data[0] = 0x03 // ES_Descriptor
+	data[1] = byte(esSize)
+	binary.BigEndian.PutUint16(data[2:4], 1) // ES_ID
+	data[4] = 0x00
+	data[5] = 0x04 // DecoderConfigDescriptor
+	data[6] = byte(decoderConfigSize)
+	data[7] = 0x40  // objectTypeIndication: Audio ISO/IEC 14496-3
+	data[8] = 0x15  // streamType: AudioStream, upStream = 0, reserved = 1
+	binary.BigEndian.PutUint32(data[16:20], avgBitrate)
+	data[20] = 0x05 // DecoderSpecificInfo
+	data[21] = byte(dsiSize)
+	copy(data[22:22+dsiSize], decoderSpecificInfo)
+	data[22+dsiSize] = 0x06 // SLConfigDescriptor
+	data[23+dsiSize] = 0x01
+	data[24+dsiSize] = 0x02 // predefined: reserved for use in MP4 files
+
+	return
+}
+
+// Average bitrate in bits/second of size bytes over duration, 0 for an empty track
+func averageBitrate(size uint32, duration uint64, timescale uint32) uint32 {
+	if duration == 0 || timescale == 0 {
+		return 0
+	}
+	return uint32(float64(size) / (float64(duration) / float64(timescale)) * 8)
+}
+
 func readAvc1Box(f *os.File, size uint32, level int, boxPath string, mp4 map[string][]interface{}) {
 	data := make([]byte, 78)
 	_, err := f.Read(data)
@@ -1638,13 +2113,14 @@ func (stco StcoBox) Bytes() (data []byte) {
 }
 
 func readSttsBox(f *os.File, size uint32, level int, boxPath string, mp4 map[string][]interface{}) {
+	var stts SttsBox
+	stts.Offset, _ = f.Seek(0, os.SEEK_CUR)
 	data := make([]byte, size)
 	_, err := f.Read(data)
 	if err != nil {
 		panic(err)
 	}
 
-	var stts SttsBox
 	stts.Size = size
 	stts.Version = data[0]
 	copy(stts.Reserved[:], data[1:4])
@@ -1659,6 +2135,18 @@ func readSttsBox(f *os.File, size uint32, level int, boxPath string, mp4 map[str
 	dumpBox(boxPath, stts)
 }
 
+// Decode time of a sample in the track timescale, the sum of the durations of the samples before it
+func (stts SttsBox) DecodeTime(sampleNumber uint32) (decodeTime uint64) {
+	for _, entry := range stts.Entries {
+		if sampleNumber <= entry.SampleCount {
+			return decodeTime + uint64(sampleNumber)*uint64(entry.SampleDelta)
+		}
+		decodeTime += uint64(entry.SampleCount) * uint64(entry.SampleDelta)
+		sampleNumber -= entry.SampleCount
+	}
+	return
+}
+
 func (stts SttsBox) Bytes() (data []byte) {
 	var offset uint32
 	boxSize := stts.Size + 8
@@ -2172,23 +2660,69 @@ func readMdatBox(f *os.File, size uint32, level int, boxPath string, mp4 map[str
 }
 
 func (mdat MdatBox) Bytes() (data []byte) {
+	data, err := mdat.Read()
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// Serialised mdat box, its data is read from the source file and decrypted when the samples were protected upstream
+func (mdat MdatBox) Read() (data []byte, err error) {
 	boxSize := mdat.Size + 8
 	data = make([]byte, boxSize)
 	binary.BigEndian.PutUint32(data[0:4], boxSize)
 	copy(data[4:8], []byte{'m', 'd', 'a', 't'})
+	if mdat.Data != nil {
+		copy(data[8:], mdat.Data)
+		return
+	}
 	f, err := os.Open(mdat.Filename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	_, err = f.ReadAt(data[8:], mdat.Offset)
+	defer f.Close()
+	err = mdat.readData(f, data[8:])
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	return
 }
 
+func (mdat MdatBox) readData(f *os.File, data []byte) (err error) {
+	if mdat.Ranges == nil {
+		_, err = f.ReadAt(data, mdat.Offset)
+		if err != nil {
+			return
+		}
+		if mdat.Decryption != nil {
+			err = mdat.Decryption.decrypt(f, data, mdat.Offset)
+		}
+		return
+	}
+
+	var offset uint32
+	for _, r := range mdat.Ranges {
+		_, err = f.ReadAt(data[offset:offset+r.Size], r.Offset)
+		if err != nil {
+			return
+		}
+		if mdat.Decryption != nil {
+			err = mdat.Decryption.decrypt(f, data[offset:offset+r.Size], r.Offset)
+			if err != nil {
+				return
+			}
+		}
+		offset += r.Size
+	}
+	return
+}
+
 func (mdat MdatBox) ToBytes() (data []byte) {
+	if mdat.Data != nil {
+		return mdat.Data
+	}
 	if mdat.Filename == "" {
 		return make([]byte, 0)
 	}
@@ -2199,7 +2733,8 @@ func (mdat MdatBox) ToBytes() (data []byte) {
 	if err != nil {
 		panic(err)
 	}
-	_, err = f.ReadAt(data, mdat.Offset)
+	defer f.Close()
+	err = mdat.readData(f, data)
 	if err != nil {
 		panic(err)
 	}
@@ -2207,6 +2742,108 @@ func (mdat MdatBox) ToBytes() (data []byte) {
 	return
 }
 
+func readEmsgBox(f *os.File, size uint32, level int, boxPath string, mp4 map[string][]interface{}) {
+	data := make([]byte, size)
+	_, err := f.Read(data)
+	if err != nil {
+		panic(err)
+	}
+	var emsg EmsgBox
+	emsg.Size = size
+	emsg.Version = data[0]
+	copy(emsg.Flags[:], data[1:4])
+	offset := 4
+	readString := func() string {
+		end := offset
+		for end < len(data) && data[end] != 0 {
+			end++
+		}
+		s := string(data[offset:end])
+		offset = end + 1
+		return s
+	}
+	if emsg.Version == 0 {
+		emsg.SchemeIdUri = readString()
+		emsg.Value = readString()
+		emsg.Timescale = binary.BigEndian.Uint32(data[offset : offset+4])
+		emsg.PresentationTimeDelta = binary.BigEndian.Uint32(data[offset+4 : offset+8])
+		emsg.EventDuration = binary.BigEndian.Uint32(data[offset+8 : offset+12])
+		emsg.Id = binary.BigEndian.Uint32(data[offset+12 : offset+16])
+		offset += 16
+	} else {
+		emsg.Timescale = binary.BigEndian.Uint32(data[offset : offset+4])
+		emsg.PresentationTime = binary.BigEndian.Uint64(data[offset+4 : offset+12])
+		emsg.EventDuration = binary.BigEndian.Uint32(data[offset+12 : offset+16])
+		emsg.Id = binary.BigEndian.Uint32(data[offset+16 : offset+20])
+		offset += 20
+		emsg.SchemeIdUri = readString()
+		emsg.Value = readString()
+	}
+	emsg.MessageData = data[offset:]
+	addBox(mp4, boxPath, emsg)
+	dumpBox(boxPath, emsg)
+}
+
+func (emsg EmsgBox) Bytes() (data []byte) {
+	boxSize := emsg.Size + 8
+	data = make([]byte, boxSize)
+
+	binary.BigEndian.PutUint32(data[0:4], boxSize)
+	copy(data[4:8], []byte{'e', 'm', 's', 'g'})
+	data[8] = emsg.Version
+	copy(data[9:12], emsg.Flags[:])
+	offset := 12
+	if emsg.Version == 0 {
+		offset += copy(data[offset:], []byte(emsg.SchemeIdUri)) + 1
+		offset += copy(data[offset:], []byte(emsg.Value)) + 1
+		binary.BigEndian.PutUint32(data[offset:offset+4], emsg.Timescale)
+		binary.BigEndian.PutUint32(data[offset+4:offset+8], emsg.PresentationTimeDelta)
+		binary.BigEndian.PutUint32(data[offset+8:offset+12], emsg.EventDuration)
+		binary.BigEndian.PutUint32(data[offset+12:offset+16], emsg.Id)
+		offset += 16
+	} else {
+		binary.BigEndian.PutUint32(data[offset:offset+4], emsg.Timescale)
+		binary.BigEndian.PutUint64(data[offset+4:offset+12], emsg.PresentationTime)
+		binary.BigEndian.PutUint32(data[offset+12:offset+16], emsg.EventDuration)
+		binary.BigEndian.PutUint32(data[offset+16:offset+20], emsg.Id)
+		offset += 20
+		offset += copy(data[offset:], []byte(emsg.SchemeIdUri)) + 1
+		offset += copy(data[offset:], []byte(emsg.Value)) + 1
+	}
+	copy(data[offset:], emsg.MessageData)
+
+	return
+}
+
+// Create the EMSG Box of an event, segmentStart is the presentation time of the segment in the event stream timescale
+// and timeOffset the shift of the decode times of the output in the event stream timescale (eg: live channels)
+func createEmsgBox(stream EventStream, event Event, segmentStart uint64, timeOffset int64) (emsg EmsgBox) {
+	emsg.Version = stream.EmsgVersion
+	emsg.SchemeIdUri = stream.SchemeIdUri
+	emsg.Value = stream.Value
+	emsg.Timescale = stream.Timescale
+	emsg.EventDuration = event.Duration
+	if event.Duration == 0 {
+		emsg.EventDuration = 0xFFFFFFFF
+	}
+	emsg.Id = event.Id
+	emsg.MessageData = []byte(event.MessageData)
+	emsg.Size = 4 + 16 + uint32(len(emsg.MessageData)) + uint32(len(emsg.SchemeIdUri)) + 1 + uint32(len(emsg.Value)) + 1
+	if emsg.Version == 0 {
+		emsg.PresentationTimeDelta = uint32(event.PresentationTime - segmentStart)
+	} else {
+		emsg.PresentationTime = event.PresentationTime
+		if timeOffset < 0 && uint64(-timeOffset) > event.PresentationTime {
+			emsg.PresentationTime = 0
+		} else {
+			emsg.PresentationTime = uint64(int64(event.PresentationTime) + timeOffset)
+		}
+		emsg.Size += 4
+	}
+
+	return
+}
+
 // Read 8 bytes Box (4 bytes size and 4 bytes box name)
 func readBox(f *os.File, level int) (boxSize uint32, boxName string) {
 	data := make([]byte, 8)
@@ -2265,7 +2902,7 @@ func readBoxes(f *os.File, size uint32, level int, boxPath string, mp4 map[strin
 func writeBox(f *os.File, boxName [4]byte, box interface{}) {
 	var size uint32
 	size = uint32(binary.Size(box))
-	log.Printf("size of box is %u", size)
+	log.Printf("size of box is %d", size)
 	err := binary.Write(f, binary.BigEndian, size)
 	if err != nil {
 		log.Printf("cannot write box size: %v", err)
@@ -2309,21 +2946,39 @@ func ParseFile(filename string, language string) (mp4 Mp4) {
 
 	mp4.Filename = filename
 	mp4.Language = language
-	if mp4.Boxes["moov.trak.mdia.minf.stbl.stsd.mp4a"] != nil {
+	switch mp4.SampleEntryPath() {
+	case "moov.trak.mdia.minf.stbl.stsd.mp4a", "moov.trak.mdia.minf.stbl.stsd.enca":
 		mp4.IsAudio = true
-	} else {
-		mp4.IsAudio = false
-	}
-
-	if mp4.Boxes["moov.trak.mdia.minf.stbl.stsd.avc1"] != nil {
+	case "moov.trak.mdia.minf.stbl.stsd.avc1", "moov.trak.mdia.minf.stbl.stsd.encv":
 		mp4.IsVideo = true
-	} else {
-		mp4.IsVideo = false
 	}
 
 	return
 }
 
+// Path of the sample entry of the track: avc1 or mp4a, or encv or enca when the samples were protected upstream
+// from avc1 or mp4a samples. Empty for other formats.
+func (mp4 Mp4) SampleEntryPath() string {
+	stsdPath := "moov.trak.mdia.minf.stbl.stsd"
+	for _, entry := range []string{ "avc1", "mp4a" } {
+		if mp4.Boxes[stsdPath + "." + entry] != nil {
+			return stsdPath + "." + entry
+		}
+	}
+	for _, entry := range []string{ "encv", "enca" } {
+		entryPath := stsdPath + "." + entry
+		if mp4.Boxes[entryPath] == nil || mp4.Boxes[entryPath + ".sinf.frma"] == nil {
+			continue
+		}
+		frma := mp4.Boxes[entryPath + ".sinf.frma"][0].(FrmaBox)
+		format := string(frma.DataFormat[:])
+		if (entry == "encv" && format == "avc1") || (entry == "enca" && format == "mp4a") {
+			return entryPath
+		}
+	}
+	return ""
+}
+
 func boxToBytes(box interface{}, boxFullPath string) []byte {
 	boxNames := strings.Split(boxFullPath, ".")
 	boxName := boxNames[len(boxNames)-1]
@@ -2385,6 +3040,26 @@ func boxToBytes(box interface{}, boxFullPath string) []byte {
 	case "avc1":
 		avc1 := box.(Avc1Box)
 		return avc1.Bytes()
+	case "encv":
+		encv := box.(Avc1Box).Bytes()
+		copy(encv[4:8], []byte{'e', 'n', 'c', 'v'})
+		return encv
+	case "enca":
+		enca := box.(Mp4aBox).Bytes()
+		copy(enca[4:8], []byte{'e', 'n', 'c', 'a'})
+		return enca
+	case "sinf":
+		sinf := box.(ParentBox)
+		return sinf.Bytes()
+	case "schm":
+		schm := box.(SchmBox)
+		return schm.Bytes()
+	case "schi":
+		schi := box.(ParentBox)
+		return schi.Bytes()
+	case "tenc":
+		tenc := box.(TencBox)
+		return tenc.Bytes()
 	case "avcC":
 		avcC := box.(AvcCBox)
 		return avcC.Bytes()
@@ -2442,68 +3117,140 @@ func boxToBytes(box interface{}, boxFullPath string) []byte {
 	case "trun":
 		trun := box.(TrunBox)
 		return trun.Bytes()
+	case "senc":
+		senc := box.(SencBox)
+		return senc.Bytes()
+	case "saiz":
+		saiz := box.(SaizBox)
+		return saiz.Bytes()
+	case "saio":
+		saio := box.(SaioBox)
+		return saio.Bytes()
+	case "sbgp":
+		sbgp := box.(SbgpBox)
+		return sbgp.Bytes()
+	case "sgpd":
+		sgpd := box.(SgpdBox)
+		return sgpd.Bytes()
+	case "pssh":
+		pssh := box.(PsshBox)
+		return pssh.Bytes()
 	case "frma":
 		frma := box.(FrmaBox)
 		return frma.Bytes()
 	case "mdat":
 		mdat := box.(MdatBox)
 		return mdat.Bytes()
+	case "emsg":
+		emsg := box.(EmsgBox)
+		return emsg.Bytes()
 	}
 
 	return nil
 }
 
-func MapToBytes(mp4 map[string][]interface{}) (data []byte) {
-	boxPathOrder := []string{
-		"ftyp",
-		"styp",
-		"free",
-		"moof",
-		"moof.mfhd",
-		"moof.traf",
-		"moof.traf.tfhd",
-		"moof.traf.tfdt",
-		"moof.traf.trun",
-		"moov",
-		"moov.mvhd",
-		"moov.trak",
-		"moov.trak.tkhd",
-		"moov.trak.mdia",
-		"moov.trak.mdia.mdhd",
-		"moov.trak.mdia.hdlr",
-		"moov.trak.mdia.minf",
-		"moov.trak.mdia.minf.smhd",
-		"moov.trak.mdia.minf.vmhd",
-		"moov.trak.mdia.minf.dinf",
-		"moov.trak.mdia.minf.dinf.dref",
-		"moov.trak.mdia.minf.stbl",
-		"moov.trak.mdia.minf.stbl.stsd",
-		"moov.trak.mdia.minf.stbl.stsd.mp4a",
-		"moov.trak.mdia.minf.stbl.stsd.mp4a.esds",
-		"moov.trak.mdia.minf.stbl.stsd.avc1",
-		"moov.trak.mdia.minf.stbl.stsd.avc1.avcC",
-		"moov.trak.mdia.minf.stbl.stsd.avc1.btrt",
-		"moov.trak.mdia.minf.stbl.stts",
-		"moov.trak.mdia.minf.stbl.ctts",
-		"moov.trak.mdia.minf.stbl.stsc",
-		"moov.trak.mdia.minf.stbl.stsz",
-		"moov.trak.mdia.minf.stbl.sdtp",
-		"moov.trak.mdia.minf.stbl.stco",
-		"moov.mvex",
-		"moov.mvex.mehd",
-		"moov.mvex.trex",
-		"mdat",
-	}
-
+// Order of the boxes in a serialised mp4
+var boxPathOrder = []string{
+	"ftyp",
+	"styp",
+	"free",
+	"emsg",
+	"moof",
+	"moof.mfhd",
+	"moof.traf",
+	"moof.traf.tfhd",
+	"moof.traf.tfdt",
+	"moof.traf.trun",
+	"moof.traf.senc",
+	"moof.traf.saiz",
+	"moof.traf.saio",
+	"moof.traf.sbgp",
+	"moof.traf.sgpd",
+	"moof.pssh",
+	"moov",
+	"moov.mvhd",
+	"moov.trak",
+	"moov.trak.tkhd",
+	"moov.trak.mdia",
+	"moov.trak.mdia.mdhd",
+	"moov.trak.mdia.hdlr",
+	"moov.trak.mdia.minf",
+	"moov.trak.mdia.minf.smhd",
+	"moov.trak.mdia.minf.vmhd",
+	"moov.trak.mdia.minf.dinf",
+	"moov.trak.mdia.minf.dinf.dref",
+	"moov.trak.mdia.minf.stbl",
+	"moov.trak.mdia.minf.stbl.stsd",
+	"moov.trak.mdia.minf.stbl.stsd.mp4a",
+	"moov.trak.mdia.minf.stbl.stsd.mp4a.esds",
+	"moov.trak.mdia.minf.stbl.stsd.avc1",
+	"moov.trak.mdia.minf.stbl.stsd.avc1.avcC",
+	"moov.trak.mdia.minf.stbl.stsd.avc1.btrt",
+	"moov.trak.mdia.minf.stbl.stsd.enca",
+	"moov.trak.mdia.minf.stbl.stsd.enca.esds",
+	"moov.trak.mdia.minf.stbl.stsd.enca.sinf",
+	"moov.trak.mdia.minf.stbl.stsd.enca.sinf.frma",
+	"moov.trak.mdia.minf.stbl.stsd.enca.sinf.schm",
+	"moov.trak.mdia.minf.stbl.stsd.enca.sinf.schi",
+	"moov.trak.mdia.minf.stbl.stsd.enca.sinf.schi.tenc",
+	"moov.trak.mdia.minf.stbl.stsd.encv",
+	"moov.trak.mdia.minf.stbl.stsd.encv.avcC",
+	"moov.trak.mdia.minf.stbl.stsd.encv.btrt",
+	"moov.trak.mdia.minf.stbl.stsd.encv.sinf",
+	"moov.trak.mdia.minf.stbl.stsd.encv.sinf.frma",
+	"moov.trak.mdia.minf.stbl.stsd.encv.sinf.schm",
+	"moov.trak.mdia.minf.stbl.stsd.encv.sinf.schi",
+	"moov.trak.mdia.minf.stbl.stsd.encv.sinf.schi.tenc",
+	"moov.trak.mdia.minf.stbl.stts",
+	"moov.trak.mdia.minf.stbl.ctts",
+	"moov.trak.mdia.minf.stbl.stsc",
+	"moov.trak.mdia.minf.stbl.stsz",
+	"moov.trak.mdia.minf.stbl.sdtp",
+	"moov.trak.mdia.minf.stbl.stco",
+	"moov.mvex",
+	"moov.mvex.mehd",
+	"moov.mvex.trex",
+	"moov.pssh",
+	"mdat",
+}
+
+// Serialised mp4, an error is returned when the samples of the mdat can't be read or decrypted
+func MapToBytes(mp4 map[string][]interface{}) (data []byte, err error) {
 	for _, v := range boxPathOrder {
 		if mp4[v] == nil {
 			continue
 		}
-		b := boxToBytes(mp4[v][0], v)
-		if b == nil {
-			break
+		for _, box := range mp4[v] {
+			if mdat, ok := box.(MdatBox); ok {
+				var b []byte
+				b, err = mdat.Read()
+				if err != nil {
+					return nil, err
+				}
+				data = append(data, b...)
+				continue
+			}
+			b := boxToBytes(box, v)
+			if b == nil {
+				return
+			}
+			data = append(data, b...)
+		}
+	}
+
+	return
+}
+
+// Size of a serialised mp4, the mdat is not read
+func MapSize(mp4 map[string][]interface{}) (size int64) {
+	for _, v := range boxPathOrder {
+		for _, box := range mp4[v] {
+			if mdat, ok := box.(MdatBox); ok {
+				size += int64(mdat.Size) + 8
+				continue
+			}
+			size += int64(len(boxToBytes(box, v)))
 		}
-		data = append(data, b...)
 	}
 
 	return
@@ -2624,7 +3371,7 @@ func CreateDashInit(mp4 map[string][]interface{}) (mp4Init map[string][]interfac
 		btrt.MaxBitrate = 0
 		mdat := mp4["mdat"][0].(MdatBox)
 		mdhd := mp4["moov.trak.mdia.mdhd"][0].(MdhdBox)
-		btrt.AvgBitrate = uint32(float64(mdat.Size) / (float64(mdhd.Duration) / float64(mdhd.Timescale)) * 8)
+		btrt.AvgBitrate = averageBitrate(mdat.Size, mdhd.Duration, mdhd.Timescale)
 		avc1.Size = 78 + avcC.Size + 8 + btrt.Size + 8
 		stsd.Size = 8 + avc1.Size + 8
 		hdlr.Name = []byte("AMS Video Handler\x00")
@@ -3010,8 +3757,12 @@ func CreateDashInitWithConf(sConf StreamConfig) (mp4Init map[string][]interface{
 		replaceBox(mp4Init, "moov.trak.mdia.minf.smhd", smhd)
 
 		var esds EsdsBox
-		esds.Data = []byte{0x03, 0x19, 0x00, 0x01, 0x00, 0x04, 0x11, 0x40, 0x15, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xF3, 0xC2, 0x05, 0x02, 0x11, 0x90, 0x06, 0x01, 0x02}
-		esds.Size = 31
+		if len(sConf.Audio.DecoderSpecificInfo) != 0 {
+			esds.Data = createEsdsData(sConf.Audio.DecoderSpecificInfo, averageBitrate(sConf.MdatBoxSize, sConf.Duration, sConf.Timescale))
+		} else {
+			esds.Data = []byte{0x03, 0x19, 0x00, 0x01, 0x00, 0x04, 0x11, 0x40, 0x15, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xF3, 0xC2, 0x05, 0x02, 0x11, 0x90, 0x06, 0x01, 0x02}
+		}
+		esds.Size = 4 + uint32(len(esds.Data))
 		replaceBox(mp4Init, "moov.trak.mdia.minf.stbl.stsd.mp4a.esds", esds)
 
 		var mp4a Mp4aBox
@@ -3061,13 +3812,13 @@ func CreateDashInitWithConf(sConf StreamConfig) (mp4Init map[string][]interface{
 		avcC.PPSEntryCount = sConf.Video.PPSEntryCount
 		avcC.PPSSize = sConf.Video.PPSSize
 		avcC.PPSData = sConf.Video.PPSData
-		avcC.Size = 40
+		avcC.Size = 11 + uint32(avcC.SPSSize)*uint32(avcC.SPSEntryCount) + uint32(avcC.PPSSize)*uint32(avcC.PPSEntryCount)
 		replaceBox(mp4Init, "moov.trak.mdia.minf.stbl.stsd.avc1.avcC", avcC)
 
 		var btrt BtrtBox
 		btrt.DecodingBufferSize = 0
 		btrt.MaxBitrate = 0
-		btrt.AvgBitrate = uint32(float64(sConf.MdatBoxSize) / (float64(sConf.Duration) / float64(sConf.Timescale)) * 8)
+		btrt.AvgBitrate = averageBitrate(sConf.MdatBoxSize, sConf.Duration, sConf.Timescale)
 		btrt.Size = 12
 		replaceBox(mp4Init, "moov.trak.mdia.minf.stbl.stsd.avc1.btrt", btrt)
 
@@ -3136,10 +3887,21 @@ func CreateDashInitWithConf(sConf StreamConfig) (mp4Init map[string][]interface{
 	moov.Size = mvhd.Size + 8 + trak.Size + 8 + mvex.Size + 8
 	replaceBox(mp4Init, "moov", moov)
 
+	if sConf.PassthroughEncryption() {
+		passthroughDashInit(mp4Init, *sConf.Encryption)
+	}
+
 	return
 }
 
-func CreateDashFragmentWithConf(sConf StreamConfig, filename string, fragmentNumber uint32, fragmentDuration uint32) (fmp4 map[string][]interface{}) {
+func CreateDashFragmentWithConf(sConf StreamConfig, filename string, fragmentNumber uint32, fragmentDuration uint32, options FragmentOptions) (fmp4 map[string][]interface{}) {
+	fmp4, _, _ = createDashFragment(sConf, filename, fragmentNumber, fragmentDuration, options)
+	return
+}
+
+// Create a DASH fragment, with the numbers in the source of its samples and the STTS box of the source, nil if
+// the package only gives the sample delta
+func createDashFragment(sConf StreamConfig, filename string, fragmentNumber uint32, fragmentDuration uint32, options FragmentOptions) (fmp4 map[string][]interface{}, sourceSamples []uint32, stts *SttsBox) {
 	lastSegment := false
 	compositionTimeOffset := false
 
@@ -3197,6 +3959,12 @@ func CreateDashFragmentWithConf(sConf StreamConfig, filename string, fragmentNum
 	replaceBox(fmp4, "moof.traf.tfhd", tfhd)
 
 	mp4 := make(map[string][]interface{})
+	if sConf.SttsBoxOffset != 0 {
+		f.Seek(sConf.SttsBoxOffset, 0)
+		readSttsBox(f, sConf.SttsBoxSize, 0, "moov.trak.mdia.minf.stbl.stts", mp4)
+		box := mp4["moov.trak.mdia.minf.stbl.stts"][0].(SttsBox)
+		stts = &box
+	}
 	var ctts CttsBox
 	if sConf.Type == "video" && sConf.Video.CttsBoxOffset != 0 {
 		f.Seek(sConf.Video.CttsBoxOffset, 0)
@@ -3397,6 +4165,89 @@ func CreateDashFragmentWithConf(sConf StreamConfig, filename string, fragmentNum
 	tfdt.Reserved = [3]byte{0, 0, 0}
 	tfdt.BaseMediaDecodeTime = uint64(sampleStart) * uint64(tfhd.DefaultSampleDuration)
 	tfdt.Size = 12
+
+	// EMSG for each inband event starting in this fragment, which lasts until the decode time of the first
+	// sample of the next fragment
+	fragmentEnd := uint64(sampleEnd+1) * uint64(tfhd.DefaultSampleDuration)
+	if stts != nil {
+		tfdt.BaseMediaDecodeTime = stts.DecodeTime(sampleStart)
+		fragmentEnd = stts.DecodeTime(sampleEnd + 1)
+	}
+	fragmentStart := tfdt.BaseMediaDecodeTime
+	for _, stream := range options.Events {
+		if stream.Inband == false || stream.Timescale == 0 {
+			continue
+		}
+		for _, event := range stream.Events {
+			eventStart := event.PresentationTime * uint64(sConf.Timescale) / uint64(stream.Timescale)
+			if eventStart >= fragmentStart && (eventStart < fragmentEnd || lastSegment == true) {
+				addBox(fmp4, "emsg", createEmsgBox(stream, event, fragmentStart*uint64(stream.Timescale)/uint64(sConf.Timescale), options.DecodeTimeOffset*int64(stream.Timescale)/int64(sConf.Timescale)))
+			}
+		}
+	}
+
+	// Numbers in the source of the samples of the fragment, for the auxiliary information of protected samples
+	// and the IVs of the samples protected by the fragment
+	for i = sampleStart; i <= sampleEnd; i++ {
+		sourceSamples = append(sourceSamples, i)
+	}
+
+	// Samples decrypted with the key of the source
+	if sConf.Encryption != nil && sConf.Encryption.Key != nil {
+		sizes := make([]uint32, len(trun.Samples))
+		for k, sample := range trun.Samples {
+			sizes[k] = sample.Size
+		}
+		mdat.Decryption, err = NewSampleDecryption(filename, *sConf.Encryption, sampleStart, mdat.Offset, sizes)
+		if err != nil {
+			fmp4 = nil
+			return
+		}
+	}
+
+	if options.IFramesOnly == true && sConf.Type == "video" {
+		var samples []TrunBoxSample
+		var ranges []MdatRange
+		sourceSamples = nil
+		offset := mdat.Offset
+		j := 0
+		for k, sample := range trun.Samples {
+			if j < len(iFramesToSet) && uint32(k) == iFramesToSet[j] {
+				next := trun.SampleCount
+				if j+1 < len(iFramesToSet) {
+					next = iFramesToSet[j+1]
+				}
+				sample.Duration = (next - uint32(k)) * tfhd.DefaultSampleDuration
+				if stts != nil {
+					sample.Duration = uint32(stts.DecodeTime(sampleStart+next) - stts.DecodeTime(sampleStart+uint32(k)))
+				}
+				samples = append(samples, sample)
+				ranges = append(ranges, MdatRange{Offset: offset, Size: sample.Size})
+				sourceSamples = append(sourceSamples, sampleStart+uint32(k))
+				j++
+			}
+			offset += int64(sample.Size)
+		}
+
+		trun.Flags[1] |= 0x01 // sample-duration-present
+		trun.SampleCount = uint32(len(samples))
+		trun.Samples = samples
+		trun.Size = 12 + trun.SampleCount*12
+		if compositionTimeOffset == true {
+			trun.Size += trun.SampleCount * 4
+		}
+		mdat.Size = 0
+		for _, r := range ranges {
+			mdat.Size += r.Size
+		}
+		mdat.Ranges = ranges
+	}
+
+	if options.DecodeTimeOffset < 0 && uint64(-options.DecodeTimeOffset) > tfdt.BaseMediaDecodeTime {
+		tfdt.BaseMediaDecodeTime = 0
+	} else {
+		tfdt.BaseMediaDecodeTime = uint64(int64(tfdt.BaseMediaDecodeTime) + options.DecodeTimeOffset)
+	}
 	replaceBox(fmp4, "moof.traf.tfdt", tfdt)
 
 	// for loop to set each trun.Samples[X] from moov.trak.mdia.minf.stbl.stsz
@@ -3409,11 +4260,20 @@ func CreateDashFragmentWithConf(sConf StreamConfig, filename string, fragmentNum
 	replaceBox(fmp4, "moof", moof)
 	replaceBox(fmp4, "mdat", mdat)
 
+	if sConf.PassthroughEncryption() && passthroughFragment(fmp4, f, *sConf.Encryption, sourceSamples) != nil {
+		fmp4 = nil
+		return
+	}
+	if options.Protection != nil && protectFragment(fmp4, sConf, *options.Protection, sourceSamples) != nil {
+		fmp4 = nil
+		return
+	}
+
 	// STYP
 	var styp StypBox
 	styp.MajorBrand = [4]byte{'i', 's', 'o', '6'}
 	styp.MinorVersion = 0
-	if lastSegment == true {
+	if lastSegment == true && options.Live == false {
 		styp.CompatibleBrands = make([][4]byte, 3)
 		styp.CompatibleBrands[2] = [4]byte{'l', 'm', 's', 'g'}
 		styp.Size = 20
@@ -3428,6 +4288,148 @@ func CreateDashFragmentWithConf(sConf StreamConfig, filename string, fragmentNum
 	return
 }
 
+// Create a fragment made of CMAF chunks of chunkDuration milliseconds, each one with its moof and mdat. The first
+// chunk also carries the styp, free and emsg boxes of the fragment. Chunks are numbered on the decode time of
+// their first sample, so the sequence numbers keep increasing across the fragments.
+func CreateDashChunksWithConf(sConf StreamConfig, filename string, fragmentNumber uint32, fragmentDuration uint32, chunkDuration uint32, options FragmentOptions) (chunks []map[string][]interface{}) {
+	// Protected chunks are encrypted once they are split
+	clearOptions := options
+	clearOptions.Protection = nil
+	fmp4, sourceSamples, stts := createDashFragment(sConf, filename, fragmentNumber, fragmentDuration, clearOptions)
+	if fmp4 == nil || fmp4["moof.traf.trun"] == nil {
+		return
+	}
+	tfhd := fmp4["moof.traf.tfhd"][0].(TfhdBox)
+	tfdt := fmp4["moof.traf.tfdt"][0].(TfdtBox)
+	trun := fmp4["moof.traf.trun"][0].(TrunBox)
+	mfhd := fmp4["moof.mfhd"][0].(MfhdBox)
+	mdat := fmp4["mdat"][0].(MdatBox)
+	if trun.SampleCount == 0 || mdat.Ranges != nil {
+		if options.Protection != nil && protectFragment(fmp4, sConf, *options.Protection, sourceSamples) != nil {
+			return nil
+		}
+		return []map[string][]interface{}{ fmp4 }
+	}
+
+	samplesPerChunk := uint32(uint64(chunkDuration) * uint64(sConf.Timescale) / 1000 / uint64(tfhd.DefaultSampleDuration))
+	if samplesPerChunk == 0 {
+		samplesPerChunk = 1
+	}
+	sampleSize := (trun.Size - 12) / trun.SampleCount
+
+	offset := mdat.Offset
+	for start := uint32(0); start < trun.SampleCount; start += samplesPerChunk {
+		end := start + samplesPerChunk
+		if end > trun.SampleCount {
+			end = trun.SampleCount
+		}
+
+		chunk := make(map[string][]interface{})
+		if start == 0 {
+			for _, boxPath := range []string{ "styp", "free", "emsg" } {
+				if fmp4[boxPath] != nil {
+					chunk[boxPath] = fmp4[boxPath]
+				}
+			}
+		}
+
+		chunkTfdt := tfdt
+		chunkTfdt.BaseMediaDecodeTime += uint64(start) * uint64(tfhd.DefaultSampleDuration)
+		if stts != nil {
+			chunkTfdt.BaseMediaDecodeTime = tfdt.BaseMediaDecodeTime + stts.DecodeTime(sourceSamples[start]) - stts.DecodeTime(sourceSamples[0])
+		}
+		chunkMfhd := mfhd
+		chunkMfhd.SequenceNumber = uint32(tfdt.BaseMediaDecodeTime / uint64(tfhd.DefaultSampleDuration)) + start + 1
+
+		chunkTrun := trun
+		chunkTrun.Samples = trun.Samples[start:end]
+		chunkTrun.SampleCount = end - start
+		chunkTrun.Size = 12 + chunkTrun.SampleCount * sampleSize
+
+		chunkMdat := mdat
+		chunkMdat.Offset = offset
+		chunkMdat.Size = 0
+		for _, sample := range chunkTrun.Samples {
+			chunkMdat.Size += sample.Size
+		}
+		offset += int64(chunkMdat.Size)
+
+		traf := fmp4["moof.traf"][0].(ParentBox)
+		traf.Size = tfhd.Size + 8 + chunkTfdt.Size + 8 + chunkTrun.Size + 8
+		moof := fmp4["moof"][0].(ParentBox)
+		moof.Size = chunkMfhd.Size + 8 + traf.Size + 8
+		chunkTrun.DataOffset = int32(moof.Size + 8 + 8)
+
+		replaceBox(chunk, "moof", moof)
+		replaceBox(chunk, "moof.mfhd", chunkMfhd)
+		replaceBox(chunk, "moof.traf", traf)
+		replaceBox(chunk, "moof.traf.tfhd", tfhd)
+		replaceBox(chunk, "moof.traf.tfdt", chunkTfdt)
+		replaceBox(chunk, "moof.traf.trun", chunkTrun)
+		replaceBox(chunk, "mdat", chunkMdat)
+		if fmp4["moof.traf.senc"] != nil {
+			// Samples protected upstream keep their auxiliary information
+			senc := fmp4["moof.traf.senc"][0].(SencBox)
+			senc.Samples = senc.Samples[start:end]
+			addSampleEncryption(chunk, senc)
+		}
+		if options.Protection != nil && protectFragment(chunk, sConf, *options.Protection, sourceSamples[start:end]) != nil {
+			return nil
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return
+}
+
+// Duration of a chunk in the track timescale
+func ChunkDuration(chunk map[string][]interface{}) uint64 {
+	tfhd := chunk["moof.traf.tfhd"][0].(TfhdBox)
+	trun := chunk["moof.traf.trun"][0].(TrunBox)
+	return uint64(trun.SampleCount) * uint64(tfhd.DefaultSampleDuration)
+}
+
+// A chunk is independent if its first sample is a sync sample
+func IndependentChunk(chunk map[string][]interface{}) bool {
+	trun := chunk["moof.traf.trun"][0].(TrunBox)
+	if trun.Flags[1] & 0x04 == 0 || len(trun.Samples) == 0 {
+		return true
+	}
+	return trun.Samples[0].Flags & 0x00010000 == 0 // sample_is_non_sync_sample
+}
+
+// Read a timed events sidecar file
+func ReadEventStreams(filename string) (streams []EventStream, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	var eConf EventsConfig
+	err = json.Unmarshal(data, &eConf)
+	if err != nil {
+		return
+	}
+
+	for _, stream := range eConf.EventStreams {
+		if stream.SchemeIdUri == "" {
+			err = errors.New("event stream without SchemeIdUri")
+			return
+		}
+		if stream.Timescale == 0 {
+			err = fmt.Errorf("event stream '%s' has no timescale", stream.SchemeIdUri)
+			return
+		}
+		if stream.EmsgVersion > 1 {
+			err = fmt.Errorf("event stream '%s' has an unknown EMSG version %d", stream.SchemeIdUri, stream.EmsgVersion)
+			return
+		}
+	}
+	streams = eConf.EventStreams
+
+	return
+}
+
 // ***
 // *** Package initialization
 // ***
@@ -3486,11 +4488,24 @@ func init() {
 		"moov.trak.mdia.minf.stbl.stsd.encv.sinf.frma": readFrmaBox,
 		"moov.trak.mdia.minf.stbl.stsd.encv.sinf.schm": readSchmBox,
 		"moov.trak.mdia.minf.stbl.stsd.encv.sinf.schi": readBoxes,
+		"moov.trak.mdia.minf.stbl.stsd.encv.sinf.schi.tenc": readTencBox,
+		"moov.trak.mdia.minf.stbl.stsd.enca":           readMp4aBox,
+		"moov.trak.mdia.minf.stbl.stsd.enca.esds":      readEsdsBox,
+		"moov.trak.mdia.minf.stbl.stsd.enca.sinf":      readBoxes,
+		"moov.trak.mdia.minf.stbl.stsd.enca.sinf.frma": readFrmaBox,
+		"moov.trak.mdia.minf.stbl.stsd.enca.sinf.schm": readSchmBox,
+		"moov.trak.mdia.minf.stbl.stsd.enca.sinf.schi": readBoxes,
+		"moov.trak.mdia.minf.stbl.stsd.enca.sinf.schi.tenc": readTencBox,
 		"moov.trak.mdia.minf.stbl.stsc":                readStscBox,
 		"moov.trak.mdia.minf.stbl.stsz":                readStszBox,
 		"moov.trak.mdia.minf.stbl.sdtp":                readSdtpBox,
 		"moov.trak.mdia.minf.stbl.stco":                readStcoBox,
 		"moov.trak.mdia.minf.stbl.stss":                readStssBox,
+		"moov.trak.mdia.minf.stbl.saiz":                readSaizBox,
+		"moov.trak.mdia.minf.stbl.saio":                readSaioBox,
+		"moov.trak.mdia.minf.stbl.senc":                readSencBox,
+		"moov.trak.senc":                               readSencBox,
+		"moov.pssh":                                    readPsshBox,
 		"moov.mvex":                                    readBoxes,
 		"moov.mvex.mehd":                               readMehdBox,
 		"moov.mvex.trex":                               readTrexBox,
@@ -3514,5 +4529,6 @@ func init() {
 		"meta.flin.paen":                               readBoxes,
 		"meco":                                         readBoxes,
 		"mdat":                                         readMdatBox,
+		"emsg":                                         readEmsgBox,
 	}
 }
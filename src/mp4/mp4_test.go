@@ -0,0 +1,239 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	tests := []struct {
+		config    string
+		signalled uint8
+		frequency uint32
+		channels  uint8
+		sbr       bool
+		ps        bool
+	}{
+		{"1210", 2, 44100, 2, false, false},          // AAC-LC
+		{"2b118800", 5, 48000, 2, true, false},       // Explicit hierarchical SBR
+		{"eb098800", 29, 48000, 2, true, true},       // Explicit hierarchical PS
+		{"130856e59d4880", 29, 48000, 2, true, true}, // Backward compatible SBR and PS
+	}
+
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.config)
+		asc, err := ParseAudioSpecificConfig(data)
+		if err != nil {
+			t.Errorf("%s: %v", test.config, err)
+			continue
+		}
+		if asc.ObjectType != 2 || asc.SBRPresent != test.sbr || asc.PSPresent != test.ps {
+			t.Errorf("%s: parsed as %+v", test.config, asc)
+		}
+		if asc.SignalledObjectType() != test.signalled || asc.OutputSamplingFrequency() != test.frequency || asc.OutputChannelConfiguration() != test.channels {
+			t.Errorf("%s: mp4a.40.%d %d Hz %d channels, expected mp4a.40.%d %d Hz %d channels", test.config, asc.SignalledObjectType(), asc.OutputSamplingFrequency(), asc.OutputChannelConfiguration(), test.signalled, test.frequency, test.channels)
+		}
+	}
+}
+
+func TestParseAudioSpecificConfigErrors(t *testing.T) {
+	// Too short, invalid samplingFrequencyIndex, program_config_element and CELP
+	for _, config := range []string{"12", "1690", "1200", "4210"} {
+		data, _ := hex.DecodeString(config)
+		if asc, err := ParseAudioSpecificConfig(data); err == nil {
+			t.Errorf("%s: parsed as %+v", config, asc)
+		}
+	}
+}
+
+func TestEsdsDecoderSpecificInfo(t *testing.T) {
+	dsi := []byte{0x12, 0x10}
+	esds := EsdsBox{Data: createEsdsData(dsi, 128000)}
+
+	if int(esds.Data[1]) != len(esds.Data)-2 {
+		t.Errorf("ES_Descriptor size %d, expected %d", esds.Data[1], len(esds.Data)-2)
+	}
+	if int(esds.Data[6]) != len(esds.Data)-10 {
+		t.Errorf("DecoderConfigDescriptor size %d, expected %d", esds.Data[6], len(esds.Data)-10)
+	}
+	if !bytes.Equal(esds.DecoderSpecificInfo(), dsi) {
+		t.Errorf("DecoderSpecificInfo %x, expected %x", esds.DecoderSpecificInfo(), dsi)
+	}
+}
+
+func TestAverageBitrate(t *testing.T) {
+	if bitrate := averageBitrate(250000, 20000, 1000); bitrate != 100000 {
+		t.Errorf("average bitrate %d, expected 100000", bitrate)
+	}
+	if bitrate := averageBitrate(250000, 0, 1000); bitrate != 0 {
+		t.Errorf("average bitrate %d of an empty track, expected 0", bitrate)
+	}
+}
+
+func TestSttsDecodeTime(t *testing.T) {
+	stts := SttsBox{Entries: []SttsBoxEntry{{SampleCount: 3, SampleDelta: 1000}, {SampleCount: 2, SampleDelta: 1001}, {SampleCount: 1, SampleDelta: 500}}}
+	for sample, expected := range map[uint32]uint64{0: 0, 1: 1000, 3: 3000, 4: 4001, 5: 5002, 6: 5502, 10: 5502} {
+		if decodeTime := stts.DecodeTime(sample); decodeTime != expected {
+			t.Errorf("decode time %d of sample %d, expected %d", decodeTime, sample, expected)
+		}
+	}
+}
+
+func TestEmsgBox(t *testing.T) {
+	stream := EventStream{SchemeIdUri: "urn:afrostream:chapter", Value: "1", Timescale: 1000}
+	event := Event{Id: 7, PresentationTime: 12500, MessageData: "Chapter 2"}
+
+	for _, version := range []byte{0, 1} {
+		stream.EmsgVersion = version
+		emsg := createEmsgBox(stream, event, 12000, 0)
+		if version == 0 && emsg.PresentationTimeDelta != 500 || version == 1 && emsg.PresentationTime != 12500 || emsg.EventDuration != 0xffffffff {
+			t.Errorf("EMSG box %+v", emsg)
+		}
+
+		data := emsg.Bytes()
+		if int(binary.BigEndian.Uint32(data[0:4])) != len(data) || string(data[4:8]) != "emsg" {
+			t.Fatalf("EMSG box %x", data)
+		}
+		filename := filepath.Join(t.TempDir(), "emsg")
+		if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Seek(8, 0)
+		boxes := make(map[string][]interface{})
+		readEmsgBox(f, uint32(len(data)-8), 0, "emsg", boxes)
+		f.Close()
+		if read := boxes["emsg"][0].(EmsgBox); !reflect.DeepEqual(read, emsg) {
+			t.Errorf("EMSG box version %d read as %+v, expected %+v", version, read, emsg)
+		}
+	}
+}
+
+// Write the sample tables of a track and its samples, filled with their number, to a file
+func testTrack(t *testing.T, trackType string, timescale uint32, entries []SttsBoxEntry, syncSamples []uint32, sizes []uint32) (sConf StreamConfig, filename string) {
+	sConf = StreamConfig{Type: trackType, Timescale: timescale, SampleDelta: entries[0].SampleDelta}
+	data := make([]byte, 8)
+
+	sConf.SttsBoxOffset = int64(len(data))
+	data = append(data, 0, 0, 0, 0)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(entries)))
+	for _, entry := range entries {
+		data = binary.BigEndian.AppendUint32(data, entry.SampleCount)
+		data = binary.BigEndian.AppendUint32(data, entry.SampleDelta)
+		sConf.Duration += uint64(entry.SampleCount) * uint64(entry.SampleDelta)
+	}
+	sConf.SttsBoxSize = uint32(int64(len(data)) - sConf.SttsBoxOffset)
+
+	if trackType == "video" {
+		sConf.Video = &StreamVideoEntry{StssBoxOffset: int64(len(data))}
+		data = append(data, 0, 0, 0, 0)
+		data = binary.BigEndian.AppendUint32(data, uint32(len(syncSamples)))
+		for _, sample := range syncSamples {
+			data = binary.BigEndian.AppendUint32(data, sample)
+		}
+		sConf.Video.StssBoxSize = uint32(int64(len(data)) - sConf.Video.StssBoxOffset)
+	} else {
+		sConf.Audio = &StreamAudioEntry{}
+	}
+
+	sConf.StszBoxOffset = int64(len(data))
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 0)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(sizes)))
+	for _, size := range sizes {
+		data = binary.BigEndian.AppendUint32(data, size)
+	}
+	sConf.StszBoxSize = uint32(int64(len(data)) - sConf.StszBoxOffset)
+
+	sConf.MdatBoxOffset = int64(len(data))
+	for i, size := range sizes {
+		data = append(data, bytes.Repeat([]byte{byte(i)}, int(size))...)
+		sConf.MdatBoxSize += size
+	}
+
+	filename = filepath.Join(t.TempDir(), "track.mp4")
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestFragmentEmsgBoxes(t *testing.T) {
+	sConf, filename := testTrack(t, "audio", 1000, []SttsBoxEntry{{SampleCount: 6, SampleDelta: 1000}}, nil, []uint32{10, 11, 12, 13, 14, 15})
+	options := FragmentOptions{DecodeTimeOffset: 10000}
+	for _, version := range []byte{0, 1} {
+		options.Events = append(options.Events, EventStream{SchemeIdUri: "urn:afrostream:chapter", Value: fmt.Sprint(version), Timescale: 90000, Inband: true, EmsgVersion: version, Events: []Event{{Id: 1, PresentationTime: 225000}}})
+	}
+
+	fmp4 := CreateDashFragmentWithConf(sConf, filename, 2, 2, options)
+	if tfdt := fmp4["moof.traf.tfdt"][0].(TfdtBox); tfdt.BaseMediaDecodeTime != 12000 {
+		t.Errorf("fragment decode time %d, expected 12000", tfdt.BaseMediaDecodeTime)
+	}
+	if len(fmp4["emsg"]) != 2 {
+		t.Fatalf("%d EMSG boxes, expected 2", len(fmp4["emsg"]))
+	}
+	// 2.5 s in the source, 12.5 s once shifted like the decode times of the fragment
+	if emsg := fmp4["emsg"][0].(EmsgBox); emsg.PresentationTimeDelta != 45000 {
+		t.Errorf("EMSG box version 0 presentation time delta %d, expected 45000", emsg.PresentationTimeDelta)
+	}
+	if emsg := fmp4["emsg"][1].(EmsgBox); emsg.PresentationTime != 1125000 {
+		t.Errorf("EMSG box version 1 presentation time %d, expected 1125000", emsg.PresentationTime)
+	}
+
+	options.DecodeTimeOffset = -3000
+	fmp4 = CreateDashFragmentWithConf(sConf, filename, 2, 2, options)
+	if emsg := fmp4["emsg"][1].(EmsgBox); emsg.PresentationTime != 0 {
+		t.Errorf("EMSG box version 1 presentation time %d before the start of the output, expected 0", emsg.PresentationTime)
+	}
+}
+
+func TestIFramesOnlyFragment(t *testing.T) {
+	entries := []SttsBoxEntry{{SampleCount: 2, SampleDelta: 1000}, {SampleCount: 2, SampleDelta: 1500}, {SampleCount: 2, SampleDelta: 1000}, {SampleCount: 2, SampleDelta: 500}}
+	sConf, filename := testTrack(t, "video", 1000, entries, []uint32{1, 4, 7}, []uint32{100, 10, 11, 90, 12, 13, 80, 14})
+
+	fmp4 := CreateDashFragmentWithConf(sConf, filename, 1, 8, FragmentOptions{IFramesOnly: true})
+	trun := fmp4["moof.traf.trun"][0].(TrunBox)
+	if trun.SampleCount != 3 || len(trun.Samples) != 3 {
+		t.Fatalf("%d samples, expected the 3 I-Frames", trun.SampleCount)
+	}
+	// Each I-Frame lasts until the decode time of the next one, or the end of the fragment
+	for i, expected := range []uint32{3500, 3500, 1000} {
+		if trun.Samples[i].Duration != expected {
+			t.Errorf("I-Frame %d lasts %d, expected %d", i, trun.Samples[i].Duration, expected)
+		}
+	}
+	mdat := fmp4["mdat"][0].(MdatBox)
+	if mdat.Size != 270 || len(mdat.Ranges) != 3 || mdat.Ranges[1].Offset != sConf.MdatBoxOffset+121 || mdat.Ranges[1].Size != 90 {
+		t.Errorf("I-Frames data %d bytes in %+v", mdat.Size, mdat.Ranges)
+	}
+}
+
+func TestDashChunksDecodeTimes(t *testing.T) {
+	entries := []SttsBoxEntry{{SampleCount: 2, SampleDelta: 1000}, {SampleCount: 2, SampleDelta: 1500}, {SampleCount: 2, SampleDelta: 500}}
+	sConf, filename := testTrack(t, "audio", 1000, entries, nil, []uint32{10, 11, 12, 13, 14, 15})
+
+	chunks := CreateDashChunksWithConf(sConf, filename, 1, 10, 2000, FragmentOptions{DecodeTimeOffset: 10000})
+	if len(chunks) != 3 {
+		t.Fatalf("%d chunks, expected 3", len(chunks))
+	}
+	// The chunks start at the decode times of their first sample, not at multiples of the sample delta
+	for i, expected := range []uint64{10000, 12000, 15000} {
+		if tfdt := chunks[i]["moof.traf.tfdt"][0].(TfdtBox); tfdt.BaseMediaDecodeTime != expected {
+			t.Errorf("chunk %d decode time %d, expected %d", i, tfdt.BaseMediaDecodeTime, expected)
+		}
+	}
+	for i, expected := range []int64{0, 21, 46} {
+		if mdat := chunks[i]["mdat"][0].(MdatBox); mdat.Offset != sConf.MdatBoxOffset+expected {
+			t.Errorf("chunk %d data at %d, expected %d", i, mdat.Offset-sConf.MdatBoxOffset, expected)
+		}
+	}
+}
@@ -5,18 +5,45 @@ func CreateStreamPackets(streamInfo StreamInfo, samplesInfo []SampleInfo, fragme
 
 	// For each sample
 	for _, sample := range samplesInfo {
-		// Create the elementary stream
-		elementaryStream := CreateElementaryStreamSrc(streamInfo, sample)
-
-		// Create packets stream
-		pes := createPackets(streamInfo, sample, uint32(len(elementaryStream)))
+		createSamplePackets(streamInfo, sample, fragment)
+	}
+}
 
-		// Fill packets payload
-		fillPackets(&pes, elementaryStream)
+// Create Elementary stream packets of a video and an audio stream, interleaved by decoding time.
+// The fragment starts with the first video sample, its I-Frame and PCR.
+func CreateMuxedStreamPackets(video StreamInfo, videoSamplesInfo []SampleInfo, audio StreamInfo, audioSamplesInfo []SampleInfo, fragment *FragmentData) {
+	v := 0
+	a := 0
+	for v < len(videoSamplesInfo) || a < len(audioSamplesInfo) {
+		if a == len(audioSamplesInfo) || (v < len(videoSamplesInfo) && (v == 0 || videoSamplesInfo[v].DTS <= audioSamplesInfo[a].DTS)) {
+			createSamplePackets(video, videoSamplesInfo[v], fragment)
+			v++
+		} else {
+			createSamplePackets(audio, audioSamplesInfo[a], fragment)
+			a++
+		}
+	}
+}
 
-		// Append fragment to PES
-		fragment.pes = append(fragment.pes, pes...)
+func createSamplePackets(streamInfo StreamInfo, sample SampleInfo, fragment *FragmentData) {
+	// Create the elementary stream, a blank one of the same size to lay the packets out.
+	// The size of SAMPLE-AES encrypted samples is only known once they are encrypted.
+	var elementaryStream []byte
+	if fragment.layoutOnly && streamInfo.isEncrypted() == false {
+		streamSize, _ := getStreamSizeAndHeaderLength(streamInfo, sample, sample.DTS == sample.CTS)
+		elementaryStream = make([]byte, streamSize)
+	} else {
+		elementaryStream = CreateElementaryStreamSrc(streamInfo, sample)
 	}
+
+	// Create packets stream
+	pes := createPackets(streamInfo, sample, uint32(len(elementaryStream)))
+
+	// Fill packets payload
+	fillPackets(&pes, elementaryStream)
+
+	// Append fragment to PES
+	fragment.pes = append(fragment.pes, pes...)
 }
 
 func CreateElementaryStreamSrc(stream StreamInfo, sample SampleInfo) ([]byte) {
@@ -24,6 +51,19 @@ func CreateElementaryStreamSrc(stream StreamInfo, sample SampleInfo) ([]byte) {
 	var data *Data
 	sameTimeStamps := sample.DTS == sample.CTS
 
+	// Encrypted NAL units are read first, the emulation prevention bytes change their size
+	var nalUnits [][]byte
+	if stream.isVideo() && stream.isEncrypted() {
+		sample.size = 0
+		for _, unit := range sample.NALUnits {
+			stream.mdat.Offset = unit.mdatOffset
+			stream.mdat.Size = unit.mdatSize
+			nalUnit := encryptNALUnit(stream, stream.mdat.ToBytes())
+			nalUnits = append(nalUnits, nalUnit)
+			sample.size += stream.nalLengthSize + uint32(len(nalUnit))
+		}
+	}
+
 	// Create data holding the elementary stream
 	streamSize, headerLength := getStreamSizeAndHeaderLength(stream, sample, sameTimeStamps)
 
@@ -38,12 +78,16 @@ func CreateElementaryStreamSrc(stream StreamInfo, sample SampleInfo) ([]byte) {
 		pushSPSAndPPS(stream, data)
 
 		// For each NAL Units
-		for _, unit := range sample.NALUnits {
+		for i, unit := range sample.NALUnits {
 
 			// Packet start id code
 			data.PushUInt(1, 24)
 
 			// Add the corresponding data
+			if nalUnits != nil {
+				data.PushAll(nalUnits[i])
+				continue
+			}
 			stream.mdat.Offset = unit.mdatOffset
 			stream.mdat.Size = unit.mdatSize
 			data.PushAll(stream.mdat.ToBytes())
@@ -54,7 +98,11 @@ func CreateElementaryStreamSrc(stream StreamInfo, sample SampleInfo) ([]byte) {
 
 		stream.mdat.Offset = sample.mdatOffset
 		stream.mdat.Size = sample.mdatSize
-		data.PushAll(stream.mdat.ToBytes())
+		frame := stream.mdat.ToBytes()
+		if stream.isEncrypted() {
+			encryptAACFrame(stream, frame)
+		}
+		data.PushAll(frame)
 	}
 
 	return data.Data
@@ -93,10 +141,10 @@ func pushADTSHeader(stream StreamInfo, frameLength uint32, data *Data) {
 	data.PushUInt(0, 1)			// ID: 0 for MPEG-4, 1 for MPEG-2
 	data.PushUInt(0, 2)			// Layer
 	data.PushUInt(1, 1) 		// CRC Absent checksum
-	data.PushUInt(1, 2) 		// Profile: Using only Low complexity
-	data.PushUInt(3, 4)			// Sampling frequency: 48 000 khz
+	data.PushUInt(stream.adtsProfile, 2) 		// Profile: Audio object type minus one
+	data.PushUInt(stream.adtsFrequencyIndex, 4)	// Sampling frequency index
 	data.PushUInt(0, 1) 		// Private bit
-	data.PushUInt(uint32(stream.Audio.NumberOfChannels), 3) // Channel configuration: Number of channels
+	data.PushUInt(stream.adtsChannels, 3) // Channel configuration
 	data.PushUInt(0, 1) 		// Original
 	data.PushUInt(0, 1)			// Home
 	data.PushUInt(0, 1	)		// Copyright identification bit
@@ -87,6 +87,27 @@ func registerInformation(streamInfo *StreamInfo) {
 	} else {
 		streamInfo.PID = 256
 		streamInfo.streamType = 15 //127
+
+		registerADTSInformation(streamInfo)
 	}
 
 }
+
+func registerADTSInformation(streamInfo *StreamInfo) {
+	// Default: Low complexity, 48 000 Hz
+	streamInfo.adtsProfile = 1
+	streamInfo.adtsFrequencyIndex = 3
+	streamInfo.adtsChannels = uint32(streamInfo.Audio.NumberOfChannels)
+
+	asc, err := mp4.ParseAudioSpecificConfig(streamInfo.Audio.DecoderSpecificInfo)
+	if err != nil {
+		return
+	}
+
+	// ADTS describes the AAC core, SBR and PS are implicitly signalled
+	streamInfo.adtsProfile = uint32(asc.ObjectType) - 1
+	streamInfo.adtsChannels = uint32(asc.ChannelConfiguration)
+	if index := mp4.SamplingFrequencyIndex(asc.SamplingFrequency); index != 0x0f {
+		streamInfo.adtsFrequencyIndex = index
+	}
+}
@@ -13,8 +13,37 @@ func CreateProgramPackets(info StreamInfo, fragment *FragmentData) {
 	fragment.pmt.Section.Sections[0].StreamType = byte(info.streamType)
 	fragment.pmt.Section.Sections[0].ElementaryPID = info.PID
 	fragment.pmt.Section.Sections[0].ESInfoLength = 0
+	registerEncryptionDescriptors(info, &fragment.pmt.Section.Sections[0])
 	/*if info.isAudio() {
 		fragment.pmt.Section.Sections[0].ESInfoLength = 6
 		fragment.pmt.Section.Sections[0].Descriptor = DataB(StrToBytes("0a 04 65 6e 67 00"))
 	}*/
 }
+
+// Create main packets program of a muxed fragment: PAT and PMT listing the video and audio streams.
+// The video stream carries the PCR.
+func CreateMuxedProgramPackets(video StreamInfo, audio StreamInfo, fragment *FragmentData) {
+	// Create PAT
+	fragment.pat = *NewPAT()
+
+	// Create program stream
+	fragment.pmt = *NewPMT(video.PID)
+	fragment.pmt.Section.Sections = make([]ProgramMapSubSection, 2)
+
+	// Register streams
+	for i, info := range []StreamInfo{video, audio} {
+		fragment.pmt.Section.Sections[i].StreamType = byte(info.streamType)
+		fragment.pmt.Section.Sections[i].ElementaryPID = info.PID
+		fragment.pmt.Section.Sections[i].ESInfoLength = 0
+		registerEncryptionDescriptors(info, &fragment.pmt.Section.Sections[i])
+	}
+}
+
+// Describe the encryption of a SAMPLE-AES stream
+func registerEncryptionDescriptors(info StreamInfo, section *ProgramMapSubSection) {
+	descriptors := encryptionDescriptors(info)
+	if len(descriptors) != 0 {
+		section.ESInfoLength = uint16(descriptors.Size())
+		section.Descriptor = descriptors
+	}
+}
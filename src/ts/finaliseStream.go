@@ -1,9 +1,19 @@
 package ts
 
+import "sort"
+
 func FinaliseFragment(data *FragmentData) (bytes []byte) {
 
 	bytes = make([]byte, 0)
 
+	// One PAT and one PMT per fragment, their continuity counters follow the fragment number
+	if data.number > 0 {
+		data.pat.ContinuityCounter = byte((data.number - 1) % 16)
+		data.pmt.ContinuityCounter = byte((data.number - 1) % 16)
+	}
+	padContinuityCounters(data)
+	counters := make(map[uint16]byte)
+
 	pmt := data.pmt.ToBytes().Data
 	pat := data.pat.ToBytes().Data
 	patEmitter := data.PAT_Emitter
@@ -15,7 +25,7 @@ func FinaliseFragment(data *FragmentData) (bytes []byte) {
 	bytes = append(bytes, pat...)
 	bytes = append(bytes, pmt...)
 
-	for i, packet := range data.pes {
+	for _, packet := range data.pes {
 
 		if patEmitter.Emit() {
 			//fmt.Println("patEmit")
@@ -31,10 +41,68 @@ func FinaliseFragment(data *FragmentData) (bytes []byte) {
 
 		//fmt.Println("PES")
 		//fmt.Println(i)
-		packet.ContinuityCounter = byte(i % 16)
+		packet.ContinuityCounter = counters[packet.PID]
+		counters[packet.PID] = (counters[packet.PID] + 1) % 16
 		bytes = append(bytes, packet.ToBytes().Data...)
 	}
 
 	return
 }
 
+// Split payload packets so each PID has a multiple of 16 packets: the continuity counters of every
+// fragment start at 0 and continue those of the previous fragment
+func padContinuityCounters(data *FragmentData) {
+	counts := make(map[uint16]int)
+	largest := make(map[uint16]int) // Packet continuing a PES with the largest payload
+	for i, packet := range data.pes {
+		counts[packet.PID]++
+		if packet.PayloadUnitStartIndicator == 0 {
+			if j, ok := largest[packet.PID]; !ok || len(packet.Data) > len(data.pes[j].Data) {
+				largest[packet.PID] = i
+			}
+		}
+	}
+
+	var indices []int
+	for pid, i := range largest {
+		extra := (16 - counts[pid] % 16) % 16
+		if extra != 0 && len(data.pes[i].Data) > extra {
+			indices = append(indices, i)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(indices)))
+
+	for _, i := range indices {
+		packet := data.pes[i]
+		packets := splitPacket(packet, (16 - counts[packet.PID] % 16) % 16 + 1)
+		data.pes = append(data.pes[:i], append(packets, data.pes[i+1:]...)...)
+	}
+}
+
+// Split the payload of a packet in n packets stuffed with their adaptation field
+func splitPacket(packet PES, n int) (packets []PES) {
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = 1
+	}
+	sizes[n-1] = len(packet.Data) - (n - 1)
+	// An adaptation field of one byte has no flags, keep at least two bytes of adaptation field
+	if sizes[n-1] == 183 {
+		sizes[0]++
+		sizes[n-1]--
+	}
+
+	offset := 0
+	for _, size := range sizes {
+		p := *NewStream(packet.PID)
+		p.setAdaptationControl(true, true)
+		p.setTotalAdaptationSize(byte(184 - size))
+		p.Payload.EmptySize = uint32(size)
+		p.Data = packet.Data[offset:offset+size]
+		offset += size
+		packets = append(packets, p)
+	}
+
+	return
+}
+
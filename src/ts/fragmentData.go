@@ -2,8 +2,12 @@ package ts
 
 // Variables data used to create our fragment
 type FragmentData struct {
+	number uint32
 	pes []PES
 
+	// Only lay the packets out, clear samples are not read
+	layoutOnly bool
+
 	PCR_Emitter IEmitter
 	DTS_Emitter IEmitter
 	CTS_Emitter IEmitter
@@ -1,5 +1,9 @@
 package ts
 
+import (
+	"mp4"
+)
+
 // Get information on the fragment. Start and end of the samples list
 func GetFragmentInfo(streamInfo *StreamInfo, fragmentNumber uint32, fragmentDuration uint32) (fragmentInfo *FragmentInfo) {
 
@@ -16,6 +20,9 @@ func GetFragmentInfo(streamInfo *StreamInfo, fragmentNumber uint32, fragmentDura
 	// Retrieve MDAT offset and size
 	registerMdatOffset(streamInfo, fragmentInfo)
 
+	// Decrypt the samples protected upstream with the key of the source
+	registerSampleDecryption(streamInfo, fragmentInfo)
+
 	// Retrieve CTTS start Offset for CTS
 	registerCTSStart(*streamInfo, fragmentInfo)
 
@@ -81,6 +88,27 @@ func registerMdatOffset(stream *StreamInfo, frag *FragmentInfo) {
 	}
 }
 
+func registerSampleDecryption(stream *StreamInfo, frag *FragmentInfo) {
+	if stream.Encryption == nil || stream.Encryption.Key == nil {
+		return
+	}
+
+	sizes := make([]uint32, frag.getSampleCount())
+	for i := range sizes {
+		if stream.stsz.SampleSize == 0 {
+			sizes[i] = stream.stsz.EntrySize[frag.sampleStart + uint32(i)]
+		} else {
+			sizes[i] = stream.stsz.SampleSize
+		}
+	}
+
+	decryption, err := mp4.NewSampleDecryption(stream.filename, *stream.Encryption, frag.sampleStart, stream.mdat.Offset, sizes)
+	if err != nil {
+		panic(err)
+	}
+	stream.mdat.Decryption = decryption
+}
+
 func registerCTSStart(stream StreamInfo, frag *FragmentInfo) {
 
 	var i uint32
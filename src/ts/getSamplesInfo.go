@@ -91,10 +91,11 @@ func registerSamplesSizes(stream StreamInfo, info FragmentInfo, sampleInfo *[]Sa
 
 func registerISamples(info FragmentInfo, sampleInfo *[]SampleInfo) {
 
+	// I-Frames indices are relative to the start of the fragment
 	for i := 0; i < len(info.iFramesIndices); i++ {
 		iFrameId := info.iFramesIndices[i]
-		if info.isFrameInFragment(iFrameId) {
-			(*sampleInfo)[iFrameId-info.sampleStart].isIFrameType = true
+		if info.isFrameInFragment(iFrameId + info.sampleStart) {
+			(*sampleInfo)[iFrameId].isIFrameType = true
 		}
 	}
 }
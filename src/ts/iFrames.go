@@ -0,0 +1,69 @@
+package ts
+
+import (
+	"mp4"
+)
+
+// Location of an I-Frame in a fragment
+type IFrameRange struct {
+	Offset   int64   // Offset of the first packet of the I-Frame
+	Size     int64   // Size of all the packets of the I-Frame
+	Duration float64 // Duration in seconds until the next I-Frame or the end of the fragment
+}
+
+// Locate the I-Frames of the fragment created by CreateHLSFragmentWithConf. The packets are laid out
+// the same way without reading the samples data
+func GetIFrameRanges(sConf mp4.StreamConfig, filename string, fragmentNumber uint32, fragmentDuration uint32) (ranges []IFrameRange) {
+
+	if fragmentNumber == 0 {
+		panic("Fragment number incorrect")
+	}
+
+	modifiedFragment := FragmentData{}
+	modifiedFragment.number = fragmentNumber
+
+	streamInfo := AnalyseStream(sConf, filename)
+	if !streamInfo.isVideo() {
+		return
+	}
+	CreateProgramPackets(*streamInfo, &modifiedFragment)
+	fragmentInfo := GetFragmentInfo(streamInfo, fragmentNumber, fragmentDuration)
+	samplesInfo := GetSamplesInfo(*streamInfo, *fragmentInfo)
+
+	modifiedFragment.layoutOnly = true
+	CreateStreamPackets(*streamInfo, samplesInfo, &modifiedFragment)
+	padContinuityCounters(&modifiedFragment)
+
+	// The PAT and the PMT come first
+	offset := int64(len(modifiedFragment.pat.ToBytes().Data) + len(modifiedFragment.pmt.ToBytes().Data))
+
+	// An I-Frame spans from its random access packet to the start of the next sample
+	sample := -1
+	iFrameSample := 0
+	for _, packet := range modifiedFragment.pes {
+		if packet.PayloadUnitStartIndicator == 1 {
+			sample++
+			if packet.RandomAccessIndicator == 1 {
+				if len(ranges) > 0 {
+					ranges[len(ranges) - 1].Duration = sampleDuration(*streamInfo, sample - iFrameSample)
+				}
+				ranges = append(ranges, IFrameRange{Offset: offset})
+				iFrameSample = sample
+			}
+		}
+		if sample == iFrameSample && len(ranges) > 0 {
+			ranges[len(ranges) - 1].Size += 188
+		}
+		offset += 188
+	}
+	if len(ranges) > 0 {
+		ranges[len(ranges) - 1].Duration = sampleDuration(*streamInfo, len(samplesInfo) - iFrameSample)
+	}
+
+	return
+}
+
+// Duration in seconds of a number of samples
+func sampleDuration(stream StreamInfo, samples int) (float64) {
+	return float64(samples) * float64(stream.SampleDelta) / float64(stream.Timescale)
+}
@@ -0,0 +1,110 @@
+package ts
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hls"
+	"io/ioutil"
+	"mp4"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testBox(name string, payload ...[]byte) []byte {
+	data := make([]byte, 8)
+	copy(data[4:8], name)
+	for _, p := range payload {
+		data = append(data, p...)
+	}
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(data)))
+	return data
+}
+
+func testUint32(values ...uint32) (data []byte) {
+	for _, v := range values {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return
+}
+
+// Write a 25 fps H.264 video track of 8 samples, with I-Frames at the samples 1 and 5
+func testVideoFile(t *testing.T) (sConf mp4.StreamConfig, filename string) {
+	var samples, sizes []byte
+	var count uint32
+	for i := 0; i < 8; i++ {
+		nal := append([]byte{0x41}, make([]byte, 150+i)...)
+		if i%4 == 0 {
+			nal = append([]byte{0x65}, make([]byte, 600+i)...)
+		}
+		sample := append(testUint32(uint32(len(nal))), nal...)
+		samples = append(samples, sample...)
+		sizes = append(sizes, testUint32(uint32(len(sample)))...)
+		count++
+	}
+
+	sps := []byte{0x67, 0x64, 0x00, 0x1e, 0xac, 0xd9, 0x40, 0xa0, 0x2f, 0xf9, 0x70, 0x11}
+	pps := []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+	avcC := testBox("avcC", []byte{1, 0x64, 0x00, 0x1e, 0xff, 0xe1, 0, byte(len(sps))}, sps, []byte{1, 0, byte(len(pps))}, pps)
+	avc1 := testBox("avc1", make([]byte, 24), []byte{0x02, 0x80, 0x01, 0x68}, make([]byte, 50), avcC)
+	stbl := testBox("stbl",
+		testBox("stsd", testUint32(0, 1), avc1),
+		testBox("stts", testUint32(0, 1, count, 512)),
+		testBox("stss", testUint32(0, 2, 1, 5)),
+		testBox("stsz", testUint32(0, 0, count), sizes))
+	mdhd := testBox("mdhd", testUint32(0, 0, 0, 12800, count*512, 0x15c70000))
+	moov := testBox("moov", testBox("trak", testBox("mdia", mdhd, testBox("minf", stbl))))
+
+	filename = filepath.Join(t.TempDir(), "video.mp4")
+	if err := ioutil.WriteFile(filename, append(moov, testBox("mdat", samples)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sConf = mp4.StreamConfig{Type: "video", Timescale: 12800, SampleDelta: 512, Duration: uint64(count) * 512}
+	return
+}
+
+func TestIFramesMediaPlaylist(t *testing.T) {
+	sConf, filename := testVideoFile(t)
+	segment := CreateHLSFragmentWithConf(sConf, filename, 1, 4, nil)
+	ranges := GetIFrameRanges(sConf, filename, 1, 4)
+	if len(ranges) != 2 {
+		t.Fatalf("%d I-Frames, expected 2", len(ranges))
+	}
+
+	// The PAT and the PMT are the initialization of the I-Frames
+	if ranges[0].Offset != 376 || segment[1]&0x1f != 0 || segment[2] != 0 {
+		t.Errorf("first I-Frame at %d, expected after the PAT and the PMT", ranges[0].Offset)
+	}
+	var iFrames []hls.IFrameSegment
+	for i, r := range ranges {
+		if r.Offset%188 != 0 || r.Size == 0 || r.Size%188 != 0 || r.Offset+r.Size > int64(len(segment)) {
+			t.Fatalf("I-Frame %d at %d, %d bytes, out of the %d bytes of the segment", i, r.Offset, r.Size, len(segment))
+		}
+		// The I-Frame starts with a random access packet and ends at the start of the next sample
+		packet := segment[r.Offset:]
+		if packet[0] != 0x47 || packet[1]&0x40 == 0 || packet[3]&0x20 == 0 || packet[5]&0x40 == 0 {
+			t.Errorf("I-Frame %d does not start with a random access packet: %x", i, packet[:8])
+		}
+		if end := r.Offset + r.Size; end < int64(len(segment)) && segment[end+1]&0x40 == 0 {
+			t.Errorf("I-Frame %d does not end at the start of a sample", i)
+		}
+		if r.Duration != 0.16 {
+			t.Errorf("I-Frame %d lasts %f s, expected 0.16 s", i, r.Duration)
+		}
+		iFrames = append(iFrames, hls.IFrameSegment{Segment: 1, Offset: r.Offset, Size: r.Size, Duration: r.Duration})
+	}
+
+	s := hls.CreateIFramesMediaDescriptor(4, iFrames, "v", "und", 1000000)
+	expected := "#EXT-X-I-FRAMES-ONLY\n" +
+		"#EXT-X-MAP:URI=\"v_video_und_1000000-1.ts\",BYTERANGE=\"376@0\"\n" +
+		"#EXTINF:0.160,\n" +
+		fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n", ranges[0].Size, ranges[0].Offset) +
+		"v_video_und_1000000-1.ts\n" +
+		"#EXTINF:0.160,\n" +
+		fmt.Sprintf("#EXT-X-BYTERANGE:%d@%d\n", ranges[1].Size, ranges[1].Offset) +
+		"v_video_und_1000000-1.ts\n" +
+		"#EXT-X-ENDLIST"
+	if !strings.HasSuffix(s, expected) {
+		t.Errorf("I-Frame playlist\n%s\nexpected to end with\n%s", s, expected)
+	}
+}
@@ -39,6 +39,16 @@ type DescriptorData struct {
 	DescriptorData []byte
 }
 
+// Descriptors of an elementary stream
+type Descriptors []DescriptorData
+
+func newDescriptor(tag byte, data []byte) (descriptor DescriptorData) {
+	descriptor.DescriptorTag = tag
+	descriptor.DescriptorLength = byte(len(data))
+	descriptor.DescriptorData = data
+	return
+}
+
 // To bytes
 func (pmt PMT) ToBytes() (data Data) {
 	data = pmt.Packet.ToBytes()
@@ -154,6 +164,21 @@ func (descriptor Descriptor) Size() (int) {
 	return 2
 }
 
+func (descriptors Descriptors) ToBytes() (data Data) {
+	data = *NewData(descriptors.Size())
+	for _, descriptor := range descriptors {
+		data.PushBytes(descriptor)
+	}
+	return
+}
+
+func (descriptors Descriptors) Size() (size int) {
+	for _, descriptor := range descriptors {
+		size += descriptor.Size()
+	}
+	return
+}
+
 // Constructor
 func NewPMT(PCR_PID uint16) (pmt *PMT) {
 	pmt = new(PMT)
@@ -0,0 +1,139 @@
+package ts
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+)
+
+// Key and IV of SAMPLE-AES encrypted fragments (MPEG-2 Stream Encryption Format for HTTP Live Streaming)
+type SampleEncryption struct {
+	Key []byte
+	IV  []byte
+}
+
+// Stream types of the encrypted elementary streams
+const (
+	streamTypeEncryptedH264 = 0xdb
+	streamTypeEncryptedADTS = 0xcf
+)
+
+// Encrypt the samples of the stream, the stream is declared with its encrypted stream type
+func (info *StreamInfo) setSampleEncryption(encryption *SampleEncryption) (err error) {
+	if encryption == nil {
+		return
+	}
+
+	info.block, err = aes.NewCipher(encryption.Key)
+	if err != nil {
+		return
+	}
+	info.iv = encryption.IV
+
+	if info.isVideo() {
+		info.streamType = streamTypeEncryptedH264
+	} else {
+		info.streamType = streamTypeEncryptedADTS
+	}
+	return
+}
+
+func (info StreamInfo) isEncrypted() (bool) {
+	return info.block != nil
+}
+
+// Descriptors of an encrypted stream in the PMT: the private data indicator, and the audio setup information
+// giving the AudioSpecificConfig of the clear audio
+func encryptionDescriptors(info StreamInfo) (descriptors Descriptors) {
+	if info.isEncrypted() == false {
+		return
+	}
+
+	if info.isVideo() {
+		descriptors = append(descriptors, newDescriptor(0x0f, []byte("zavc")))
+		return
+	}
+
+	descriptors = append(descriptors, newDescriptor(0x0f, []byte("aacd")))
+
+	// Registration descriptor of the audio setup information
+	setup := []byte("apad")
+	setup = append(setup, []byte("zaac")...)
+	setup = append(setup, 0x00, 0x00) // Priming
+	setup = append(setup, 0x01) // Version
+	setup = append(setup, byte(len(info.Audio.DecoderSpecificInfo)))
+	setup = append(setup, info.Audio.DecoderSpecificInfo...)
+	descriptors = append(descriptors, newDescriptor(0x05, setup))
+
+	return
+}
+
+// Encrypt a H.264 NAL unit: slices longer than 48 bytes have their first 32 bytes clear, then one block of
+// 16 bytes encrypted every 160 bytes. The pattern applies on the NAL unit without its emulation prevention
+// bytes, which are inserted back after the encryption.
+func encryptNALUnit(info StreamInfo, nal []byte) ([]byte) {
+	nalType := nal[0] & 0x1f
+	if (nalType != 1 && nalType != 5) || len(nal) <= 48 {
+		return nal
+	}
+
+	rbsp := removeEmulationPrevention(nal)
+	mode := cipher.NewCBCEncrypter(info.block, info.iv)
+	for offset := 32; len(rbsp) - offset > 16; offset += 160 {
+		mode.CryptBlocks(rbsp[offset:offset+16], rbsp[offset:offset+16])
+	}
+
+	return insertEmulationPrevention(rbsp)
+}
+
+// Encrypt an AAC frame following its ADTS header: the first 16 bytes are clear, then all the complete
+// blocks of 16 bytes are encrypted
+func encryptAACFrame(info StreamInfo, frame []byte) {
+	if len(frame) < 32 {
+		return
+	}
+
+	end := 16 + (len(frame) - 16) / 16 * 16
+	cipher.NewCBCEncrypter(info.block, info.iv).CryptBlocks(frame[16:end], frame[16:end])
+}
+
+// Remove the 0x03 bytes following two zero bytes
+func removeEmulationPrevention(nal []byte) (rbsp []byte) {
+	rbsp = make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return
+}
+
+// Insert a 0x03 byte after two zero bytes followed by a byte lower than 4, or ending the NAL unit
+func insertEmulationPrevention(rbsp []byte) (nal []byte) {
+	nal = make([]byte, 0, len(rbsp) + len(rbsp) / 64)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 0x03 {
+			nal = append(nal, 0x03)
+			zeros = 0
+		}
+		if b == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		nal = append(nal, b)
+	}
+	// A NAL unit ending with a cabac_zero_word ends with 0x000003
+	if zeros >= 2 {
+		nal = append(nal, 0x03)
+	}
+	return
+}
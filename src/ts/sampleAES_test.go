@@ -0,0 +1,140 @@
+package ts
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"math/rand"
+	"testing"
+)
+
+var testEncryption = &SampleEncryption{
+	Key: []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f},
+	IV:  []byte{0x0f, 0x0e, 0x0d, 0x0c, 0x0b, 0x0a, 0x09, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01, 0x00},
+}
+
+func TestEmulationPreventionRoundTrip(t *testing.T) {
+	tests := []struct {
+		rbsp string
+		nal  string
+	}{
+		{"\x65\x00\x00\x00\x01", "\x65\x00\x00\x03\x00\x01"},
+		{"\x65\x00\x00\x03\x00\x00\x02", "\x65\x00\x00\x03\x03\x00\x00\x03\x02"},
+		{"\x65\x00\x00\x04\x00\x00", "\x65\x00\x00\x04\x00\x00\x03"},
+		{"\x65\x00\x01\x00\x00\x05", "\x65\x00\x01\x00\x00\x05"},
+	}
+	for _, test := range tests {
+		if nal := insertEmulationPrevention([]byte(test.rbsp)); string(nal) != test.nal {
+			t.Errorf("RBSP %x inserted as %x, expected %x", test.rbsp, nal, test.nal)
+		}
+		if rbsp := removeEmulationPrevention([]byte(test.nal)); string(rbsp) != test.rbsp {
+			t.Errorf("NAL unit %x removed as %x, expected %x", test.nal, rbsp, test.rbsp)
+		}
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		rbsp := make([]byte, 1+random.Intn(64))
+		for j := range rbsp {
+			rbsp[j] = byte(random.Intn(5)) // Mostly start code emulations
+		}
+		if removed := removeEmulationPrevention(insertEmulationPrevention(rbsp)); !bytes.Equal(removed, rbsp) {
+			t.Fatalf("RBSP %x round trip as %x", rbsp, removed)
+		}
+	}
+}
+
+// Check that a NAL unit holds no start code emulation
+func checkStartCodeEmulation(t *testing.T, nal []byte) {
+	for i := 2; i < len(nal); i++ {
+		if nal[i-2] == 0 && nal[i-1] == 0 && nal[i] <= 0x02 {
+			t.Fatalf("start code emulation at %d in %x", i-2, nal)
+		}
+	}
+}
+
+func TestEncryptNALUnit(t *testing.T) {
+	var info StreamInfo
+	info.Type = "video"
+	if err := info.setSampleEncryption(testEncryption); err != nil {
+		t.Fatal(err)
+	}
+	if info.streamType != streamTypeEncryptedH264 {
+		t.Errorf("stream type %#x, expected %#x", info.streamType, streamTypeEncryptedH264)
+	}
+
+	random := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		rbsp := make([]byte, 49+random.Intn(1000))
+		random.Read(rbsp)
+		rbsp[0] = 0x65
+		for j := 1; j < len(rbsp); j++ {
+			if random.Intn(4) == 0 {
+				rbsp[j] = 0
+			}
+		}
+		nal := insertEmulationPrevention(rbsp)
+
+		encrypted := encryptNALUnit(info, append([]byte(nil), nal...))
+		checkStartCodeEmulation(t, encrypted)
+
+		// Decrypt the blocks of the pattern of the RBSP
+		decrypted := removeEmulationPrevention(encrypted)
+		if len(decrypted) != len(rbsp) {
+			t.Fatalf("encrypted RBSP of %d bytes, expected %d", len(decrypted), len(rbsp))
+		}
+		block, _ := aes.NewCipher(testEncryption.Key)
+		mode := cipher.NewCBCDecrypter(block, testEncryption.IV)
+		for offset := 32; len(decrypted)-offset > 16; offset += 160 {
+			if bytes.Equal(decrypted[offset:offset+16], rbsp[offset:offset+16]) {
+				t.Fatalf("clear block at %d", offset)
+			}
+			mode.CryptBlocks(decrypted[offset:offset+16], decrypted[offset:offset+16])
+		}
+		if !bytes.Equal(decrypted, rbsp) {
+			t.Fatalf("RBSP %x decrypted as %x", rbsp, decrypted)
+		}
+	}
+}
+
+func TestEncryptNALUnitClear(t *testing.T) {
+	var info StreamInfo
+	info.Type = "video"
+	info.setSampleEncryption(testEncryption)
+
+	sps := append([]byte{0x67}, make([]byte, 100)...)
+	shortSlice := append([]byte{0x41}, bytes.Repeat([]byte{0x5a}, 47)...)
+	for _, nal := range [][]byte{sps, shortSlice} {
+		if encrypted := encryptNALUnit(info, append([]byte(nil), nal...)); !bytes.Equal(encrypted, nal) {
+			t.Errorf("NAL unit %x encrypted as %x", nal, encrypted)
+		}
+	}
+}
+
+func TestEncryptAACFrame(t *testing.T) {
+	var info StreamInfo
+	info.Type = "audio"
+	info.setSampleEncryption(testEncryption)
+	if info.streamType != streamTypeEncryptedADTS {
+		t.Errorf("stream type %#x, expected %#x", info.streamType, streamTypeEncryptedADTS)
+	}
+
+	frame := bytes.Repeat([]byte{0xa5}, 16+2*16+7)
+	encrypted := append([]byte(nil), frame...)
+	encryptAACFrame(info, encrypted)
+	if !bytes.Equal(encrypted[:16], frame[:16]) || !bytes.Equal(encrypted[48:], frame[48:]) {
+		t.Errorf("frame %x encrypted as %x, the leading and trailing bytes should stay clear", frame, encrypted)
+	}
+	block, _ := aes.NewCipher(testEncryption.Key)
+	cipher.NewCBCDecrypter(block, testEncryption.IV).CryptBlocks(encrypted[16:48], encrypted[16:48])
+	if !bytes.Equal(encrypted, frame) {
+		t.Errorf("frame %x decrypted as %x", frame, encrypted)
+	}
+
+	short := bytes.Repeat([]byte{0xa5}, 31)
+	encrypted = append([]byte(nil), short...)
+	encryptAACFrame(info, encrypted)
+	if !bytes.Equal(encrypted, short) {
+		t.Errorf("frame of 31 bytes encrypted as %x", encrypted)
+	}
+}
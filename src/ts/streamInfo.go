@@ -1,6 +1,9 @@
 package ts
 
-import "mp4"
+import (
+	"crypto/cipher"
+	"mp4"
+)
 
 type StreamInfo struct {
 	mp4.StreamConfig
@@ -23,6 +26,15 @@ type StreamInfo struct {
 
 	// Number of bytes describing the nal length (e.g. 4)
 	nalLengthSize		  uint32
+
+	// ADTS header information of the AAC core (e.g. 1 for Low complexity, 3 for 48 000 Hz, 2 channels)
+	adtsProfile			  uint32
+	adtsFrequencyIndex	  uint32
+	adtsChannels		  uint32
+
+	// SAMPLE-AES encryption of the samples, nil block for clear samples
+	block				  cipher.Block
+	iv					  []byte
 }
 
 func (info StreamInfo) isVideo() (bool) {
@@ -5,17 +5,36 @@ import (
 )
 
 
-func CreateHLSFragmentWithConf(sConf mp4.StreamConfig, filename string, fragmentNumber uint32, fragmentDuration uint32) ([]byte) {
+// Create a TS fragment of a stream, its samples are SAMPLE-AES encrypted if encryption is set
+func CreateHLSFragmentWithConf(sConf mp4.StreamConfig, filename string, fragmentNumber uint32, fragmentDuration uint32, encryption *SampleEncryption) ([]byte) {
+	modifiedFragment := createFragment(sConf, filename, fragmentNumber, fragmentDuration, encryption, false)
+
+	// 6) Create our fragment assembling all created packets
+	fragment := FinaliseFragment(&modifiedFragment)
+	return fragment
+}
+
+// Size of the fragment created by CreateHLSFragmentWithConf, clear samples are not read
+func GetHLSFragmentSize(sConf mp4.StreamConfig, filename string, fragmentNumber uint32, fragmentDuration uint32, encryption *SampleEncryption) (int64) {
+	modifiedFragment := createFragment(sConf, filename, fragmentNumber, fragmentDuration, encryption, true)
+	return fragmentSize(&modifiedFragment)
+}
+
+func createFragment(sConf mp4.StreamConfig, filename string, fragmentNumber uint32, fragmentDuration uint32, encryption *SampleEncryption, layoutOnly bool) (modifiedFragment FragmentData) {
 
 	if fragmentNumber == 0 {
 		panic("Fragment number incorrect")
 	}
 
 	// Variables data used to create our modifiedFragment
-	modifiedFragment := FragmentData{}
+	modifiedFragment.number = fragmentNumber
+	modifiedFragment.layoutOnly = layoutOnly
 
 	// 1) analyse the stream and found get main information
 	streamInfo := AnalyseStream(sConf, filename)
+	if err := streamInfo.setSampleEncryption(encryption); err != nil {
+		panic(err)
+	}
 
 	// 2) Create program packets
 	CreateProgramPackets(*streamInfo, &modifiedFragment)
@@ -29,7 +48,66 @@ func CreateHLSFragmentWithConf(sConf mp4.StreamConfig, filename string, fragment
 	// 5) Create PES packets
 	CreateStreamPackets(*streamInfo, samplesInfo, &modifiedFragment)
 
+	return
+}
+
+// Create a fragment muxing a video and an audio stream, used by clients which can't play separate audio renditions.
+// The samples of both streams are SAMPLE-AES encrypted if encryption is set.
+func CreateMuxedHLSFragmentWithConf(videoConf mp4.StreamConfig, videoFilename string, audioConf mp4.StreamConfig, audioFilename string, fragmentNumber uint32, fragmentDuration uint32, encryption *SampleEncryption) ([]byte) {
+	modifiedFragment := createMuxedFragment(videoConf, videoFilename, audioConf, audioFilename, fragmentNumber, fragmentDuration, encryption, false)
+
 	// 6) Create our fragment assembling all created packets
 	fragment := FinaliseFragment(&modifiedFragment)
 	return fragment
 }
+
+// Size of the fragment created by CreateMuxedHLSFragmentWithConf, clear samples are not read
+func GetMuxedHLSFragmentSize(videoConf mp4.StreamConfig, videoFilename string, audioConf mp4.StreamConfig, audioFilename string, fragmentNumber uint32, fragmentDuration uint32, encryption *SampleEncryption) (int64) {
+	modifiedFragment := createMuxedFragment(videoConf, videoFilename, audioConf, audioFilename, fragmentNumber, fragmentDuration, encryption, true)
+	return fragmentSize(&modifiedFragment)
+}
+
+func createMuxedFragment(videoConf mp4.StreamConfig, videoFilename string, audioConf mp4.StreamConfig, audioFilename string, fragmentNumber uint32, fragmentDuration uint32, encryption *SampleEncryption, layoutOnly bool) (modifiedFragment FragmentData) {
+
+	if fragmentNumber == 0 {
+		panic("Fragment number incorrect")
+	}
+
+	// Variables data used to create our modifiedFragment
+	modifiedFragment.number = fragmentNumber
+	modifiedFragment.layoutOnly = layoutOnly
+
+	// 1) analyse both streams and found get main information
+	videoInfo := AnalyseStream(videoConf, videoFilename)
+	audioInfo := AnalyseStream(audioConf, audioFilename)
+	for _, info := range []*StreamInfo{videoInfo, audioInfo} {
+		if err := info.setSampleEncryption(encryption); err != nil {
+			panic(err)
+		}
+	}
+
+	// 2) Create program packets listing both streams
+	CreateMuxedProgramPackets(*videoInfo, *audioInfo, &modifiedFragment)
+
+	// 3) Retrieve information on the created modifiedFragment for each stream
+	videoFragmentInfo := GetFragmentInfo(videoInfo, fragmentNumber, fragmentDuration)
+	audioFragmentInfo := GetFragmentInfo(audioInfo, fragmentNumber, fragmentDuration)
+
+	// 4) Retrieve information on all contained samples, the PCR is carried by the video stream only
+	videoSamplesInfo := GetSamplesInfo(*videoInfo, *videoFragmentInfo)
+	audioSamplesInfo := GetSamplesInfo(*audioInfo, *audioFragmentInfo)
+	for i := range audioSamplesInfo {
+		audioSamplesInfo[i].hasPCR = false
+	}
+
+	// 5) Create PES packets interleaved by decoding time
+	CreateMuxedStreamPackets(*videoInfo, videoSamplesInfo, *audioInfo, audioSamplesInfo, &modifiedFragment)
+
+	return
+}
+
+// Size of a fragment once finalised: its PAT, PMT and packets
+func fragmentSize(data *FragmentData) (int64) {
+	padContinuityCounters(data)
+	return int64(len(data.pat.ToBytes().Data) + len(data.pmt.ToBytes().Data) + 188 * len(data.pes))
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2015
+//      Sebastien Petit & Afrostream - www.afrostream.tv - spebsd@gmail.com.
+//      All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+// OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+// HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+// LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+// OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+// SUCH DAMAGE.
+
+package util
+
+type language struct {
+    Tag  string // RFC 5646 language tag
+    Name string // Name of the language in the language itself
+}
+
+// ISO-639-2 language codes given to amspackager, bibliographic and terminologic codes
+var languages = map[string]language{
+    "afr": { "af", "Afrikaans" },
+    "amh": { "am", "አማርኛ" },
+    "ara": { "ar", "العربية" },
+    "bam": { "bm", "Bamanankan" },
+    "chi": { "zh", "中文" },
+    "zho": { "zh", "中文" },
+    "dut": { "nl", "Nederlands" },
+    "nld": { "nl", "Nederlands" },
+    "eng": { "en", "English" },
+    "ewe": { "ee", "Eʋegbe" },
+    "fre": { "fr", "Français" },
+    "fra": { "fr", "Français" },
+    "ful": { "ff", "Fulfulde" },
+    "ger": { "de", "Deutsch" },
+    "deu": { "de", "Deutsch" },
+    "hau": { "ha", "Hausa" },
+    "hin": { "hi", "हिन्दी" },
+    "ibo": { "ig", "Igbo" },
+    "ita": { "it", "Italiano" },
+    "jpn": { "ja", "日本語" },
+    "kin": { "rw", "Kinyarwanda" },
+    "kor": { "ko", "한국어" },
+    "lin": { "ln", "Lingála" },
+    "lug": { "lg", "Luganda" },
+    "mlg": { "mg", "Malagasy" },
+    "por": { "pt", "Português" },
+    "rus": { "ru", "Русский" },
+    "sna": { "sn", "ChiShona" },
+    "som": { "so", "Soomaali" },
+    "spa": { "es", "Español" },
+    "swa": { "sw", "Kiswahili" },
+    "tur": { "tr", "Türkçe" },
+    "twi": { "tw", "Twi" },
+    "wol": { "wo", "Wolof" },
+    "xho": { "xh", "isiXhosa" },
+    "yor": { "yo", "Yorùbá" },
+    "zul": { "zu", "isiZulu" },
+}
+
+// RFC 5646 tag of an ISO-639-2 language code, the code itself if it is unknown
+func LanguageTag(code string) string {
+    if l, ok := languages[code]; ok {
+        return l.Tag
+    }
+
+    return code
+}
+
+// Name of the language of an ISO-639-2 language code, the code itself if it is unknown
+func LanguageName(code string) string {
+    if l, ok := languages[code]; ok {
+        return l.Name
+    }
+
+    return code
+}
@@ -32,9 +32,13 @@
 package util
 
 import (
+    "bytes"
     "errors"
     "path"
+    "sort"
+    "strconv"
     "strings"
+    "time"
 
     "mp4"
 )
@@ -63,3 +67,359 @@ func NumberOfSegments(track mp4.TrackEntry, jConfig mp4.JsonConfig) (uint32) {
 	return numberOfSegments
 }
 
+// Number of segments of the preview of a package, the last one ends after the preview. 0 without preview.
+func PreviewSegments(jConfig mp4.JsonConfig) uint32 {
+    if jConfig.Preview == nil || jConfig.SegmentDuration == 0 {
+        return 0
+    }
+    segmentDuration := uint64(jConfig.SegmentDuration) * 1000
+    return uint32((jConfig.Preview.Duration + segmentDuration - 1) / segmentDuration)
+}
+
+// Duration of a package in milliseconds, based on the first video track or on the first audio track
+func PackageDuration(jConfig mp4.JsonConfig) uint64 {
+    t, ok := referenceTrack(jConfig)
+    if ok == false {
+        return 0
+    }
+
+    return t.Config.Duration * 1000 / uint64(t.Config.Timescale)
+}
+
+// MPEG-TS timestamp (90kHz) of the start of the presentation, the TS segments keep the composition offset
+// of the edit list of the reference track
+func TimestampOrigin(jConfig mp4.JsonConfig) uint64 {
+    t, ok := referenceTrack(jConfig)
+    if ok == false || t.Config.MediaTime <= 0 {
+        return 0
+    }
+
+    return uint64(t.Config.MediaTime) * 90000 / uint64(t.Config.Timescale)
+}
+
+// Track giving the timeline of a package: the first video track, or the first audio track for audio only content
+func referenceTrack(jConfig mp4.JsonConfig) (t mp4.TrackEntry, ok bool) {
+    if jConfig.Tracks["video"] != nil {
+        return jConfig.Tracks["video"][0], true
+    } else if jConfig.Tracks["audio"] != nil {
+        return jConfig.Tracks["audio"][0], true
+    }
+
+    return
+}
+
+// In and out points of a playlist item in milliseconds, out is clipped to the package duration
+func PlaylistItemRange(item mp4.PlaylistItem) (in uint64, out uint64) {
+    duration := PackageDuration(*item.Config)
+    in = item.In
+    out = item.Out
+    if out == 0 || out > duration {
+        out = duration
+    }
+    if in > out {
+        in = out
+    }
+
+    return
+}
+
+// First and last segment numbers of a track covering a playlist item
+func PlaylistItemSegments(item mp4.PlaylistItem, track mp4.TrackEntry) (first uint32, last uint32) {
+    in, out := PlaylistItemRange(item)
+    segmentDuration := uint64(item.Config.SegmentDuration) * 1000
+
+    first = uint32(in / segmentDuration) + 1
+    last = uint32(out / segmentDuration)
+    if out % segmentDuration != 0 {
+        last++
+    }
+    // An in point at the end of the package plays its last segment
+    n := NumberOfSegments(track, *item.Config)
+    if last > n {
+        last = n
+    }
+    if first > n {
+        first = n
+    }
+    if last < first {
+        last = first
+    }
+
+    return
+}
+
+// Find the track of a package matching a track of the reference package (the first playlist item).
+// Tracks are matched by type, language and bandwidth rank.
+func MatchTrack(reference mp4.JsonConfig, jConfig mp4.JsonConfig, trackType string, trackLang string, trackBandwidth uint64) (track mp4.TrackEntry, err error) {
+    rank := 0
+    for _, t := range reference.Tracks[trackType] {
+        if t.Lang == trackLang && t.Bandwidth < trackBandwidth {
+            rank++
+        }
+    }
+
+    var candidates []mp4.TrackEntry
+    for _, t := range jConfig.Tracks[trackType] {
+        if t.Lang == trackLang {
+            candidates = append(candidates, t)
+        }
+    }
+    if candidates == nil {
+        candidates = append(candidates, jConfig.Tracks[trackType]...)
+    }
+    if candidates == nil {
+        err = errors.New("No " + trackType + " track to match")
+        return
+    }
+
+    sort.Slice(candidates, func(i, j int) bool { return candidates[i].Bandwidth < candidates[j].Bandwidth })
+    if rank >= len(candidates) {
+        rank = len(candidates) - 1
+    }
+    track = candidates[rank]
+
+    return
+}
+
+// A track of a playlist item can follow the matching track of the first item in the single Period of a live
+// channel, described by the init segment of the first item, if it has its timescale and codec configuration
+func CompatibleTracks(reference mp4.TrackEntry, t mp4.TrackEntry) bool {
+    r, c := reference.Config, t.Config
+    if r == nil || c == nil || r.Type != c.Type || r.Timescale != c.Timescale {
+        return false
+    }
+    if r.Video != nil || c.Video != nil {
+        if r.Video == nil || c.Video == nil {
+            return false
+        }
+        rv, cv := r.Video, c.Video
+        return rv.CodecInfo == cv.CodecInfo && rv.NalUnitSize == cv.NalUnitSize && rv.Width == cv.Width && rv.Height == cv.Height && bytes.Equal(rv.SPSData, cv.SPSData) && bytes.Equal(rv.PPSData, cv.PPSData)
+    }
+    if r.Audio != nil || c.Audio != nil {
+        if r.Audio == nil || c.Audio == nil {
+            return false
+        }
+        ra, ca := r.Audio, c.Audio
+        return ra.NumberOfChannels == ca.NumberOfChannels && ra.SampleRate == ca.SampleRate && ra.ObjectType == ca.ObjectType && bytes.Equal(ra.DecoderSpecificInfo, ca.DecoderSpecificInfo)
+    }
+
+    return true
+}
+
+// Audio track muxed with the video tracks: the highest bandwidth track of the language, or of any language
+// if there is no track of this language
+func MuxedAudioTrack(audios []mp4.TrackEntry, trackLang string) (track mp4.TrackEntry, ok bool) {
+    for _, t := range audios {
+        if t.Lang == trackLang && (ok == false || t.Bandwidth > track.Bandwidth) {
+            track = t
+            ok = true
+        }
+    }
+    if ok == false && len(audios) != 0 {
+        return MuxedAudioTrack(audios, audios[0].Lang)
+    }
+
+    return
+}
+
+// Number of the last segment of a live channel available at the given time, 0 if none is available yet
+func LiveEdge(jConfig mp4.JsonConfig, now time.Time) uint32 {
+    elapsed := now.Sub(jConfig.Live.AvailabilityStartTime)
+    if elapsed < 0 {
+        return 0
+    }
+
+    return uint32(elapsed / (time.Duration(jConfig.SegmentDuration) * time.Second))
+}
+
+// Number of segments of a live channel before it ends, 0 if the channel loops
+func LiveSegments(jConfig mp4.JsonConfig) (n uint32) {
+    if jConfig.Live.Loop == true {
+        return 0
+    }
+    for _, item := range jConfig.Playlist {
+        first, last := liveItemSegments(item)
+        n += last - first + 1
+    }
+
+    return
+}
+
+// First and last segment numbers of a playlist item played by a live channel
+func liveItemSegments(item mp4.PlaylistItem) (first uint32, last uint32) {
+    t, _ := referenceTrack(*item.Config)
+    return PlaylistItemSegments(item, t)
+}
+
+// Position of a segment of a live channel in its playlist: the item playing it and the number of the segment
+// in the package of the item. ok is false after the end of a channel which does not loop.
+func LiveSegment(jConfig mp4.JsonConfig, number uint32) (item int, segmentNumber uint32, ok bool) {
+    var cycle uint32
+    for _, it := range jConfig.Playlist {
+        first, last := liveItemSegments(it)
+        cycle += last - first + 1
+    }
+    if number == 0 || cycle == 0 {
+        return
+    }
+
+    index := number - 1
+    if index >= cycle {
+        if jConfig.Live.Loop == false {
+            return
+        }
+        index %= cycle
+    }
+
+    for i, it := range jConfig.Playlist {
+        first, last := liveItemSegments(it)
+        if index <= last - first {
+            return i, first + index, true
+        }
+        index -= last - first + 1
+    }
+
+    return
+}
+
+// Duration of a playlist item played by a live channel in the timescale of its reference track, from the start
+// of its first segment to the end of its last one, which is short at the end of the package
+func liveItemDuration(item mp4.PlaylistItem) (duration uint64, timescale uint32) {
+    t, ok := referenceTrack(*item.Config)
+    if ok == false {
+        return
+    }
+    first, last := PlaylistItemSegments(item, t)
+    segmentDuration := uint64(item.Config.SegmentDuration) * uint64(t.Config.Timescale)
+    end := uint64(last) * segmentDuration
+    if end > t.Config.Duration {
+        end = t.Config.Duration
+    }
+    if start := uint64(first - 1) * segmentDuration; end > start {
+        duration = end - start
+    }
+
+    return duration, t.Config.Timescale
+}
+
+// Shift of the decode times of the package of the playlist item playing a segment of a live channel to the
+// timeline of the channel, in the given track timescale. Each item starts at the end of the last segment of the
+// previous one, so the decode times stay continuous when an item ends with a short segment.
+func LiveDecodeTimeOffset(jConfig mp4.JsonConfig, number uint32, timescale uint32) int64 {
+    itemIndex, _, ok := LiveSegment(jConfig, number)
+    if ok == false {
+        return 0
+    }
+
+    var cycle uint32
+    var cycleDuration, start uint64
+    for i, it := range jConfig.Playlist {
+        first, last := liveItemSegments(it)
+        cycle += last - first + 1
+        duration, itemTimescale := liveItemDuration(it)
+        if itemTimescale == 0 {
+            continue
+        }
+        duration = duration * uint64(timescale) / uint64(itemTimescale)
+        cycleDuration += duration
+        if i < itemIndex {
+            start += duration
+        }
+    }
+    start += uint64((number - 1) / cycle) * cycleDuration
+
+    first, _ := liveItemSegments(jConfig.Playlist[itemIndex])
+    return int64(start) - int64(first - 1) * int64(jConfig.Playlist[itemIndex].Config.SegmentDuration) * int64(timescale)
+}
+
+// First and last segments of a live channel in its time shift buffer at the live edge, the last one is the
+// last complete segment. The window of an ended channel stays on its last segments.
+func LiveWindow(jConfig mp4.JsonConfig, edge uint32) (first uint32, last uint32) {
+    last = edge
+    if n := LiveSegments(jConfig); n != 0 && last > n {
+        last = n
+    }
+    first = 1
+    if depth := jConfig.Live.TimeShiftBufferDepth / jConfig.SegmentDuration + 1; last > depth {
+        first = last - depth
+    }
+
+    return
+}
+
+// Wall clock time when a part of a segment of a live channel becomes available, parts are numbered from 1 and
+// part 0 is the whole segment. Parts ending after the segment are available with the whole segment.
+func LiveAvailabilityTime(jConfig mp4.JsonConfig, number uint32, part uint32) time.Time {
+    segmentDuration := time.Duration(jConfig.SegmentDuration) * time.Second
+    start := jConfig.Live.AvailabilityStartTime.Add(time.Duration(number - 1) * segmentDuration)
+    offset := time.Duration(part) * time.Duration(jConfig.Live.PartDuration) * time.Millisecond
+    if part == 0 || offset > segmentDuration {
+        offset = segmentDuration
+    }
+
+    return start.Add(offset)
+}
+
+// Number of parts of the segment in progress at the live edge available at the given time
+func LiveParts(jConfig mp4.JsonConfig, now time.Time) uint32 {
+    if jConfig.Live.PartDuration == 0 {
+        return 0
+    }
+    edge := LiveEdge(jConfig, now)
+    elapsed := now.Sub(jConfig.Live.AvailabilityStartTime.Add(time.Duration(edge) * time.Duration(jConfig.SegmentDuration) * time.Second))
+    if elapsed < 0 {
+        return 0
+    }
+
+    return uint32(elapsed / (time.Duration(jConfig.Live.PartDuration) * time.Millisecond))
+}
+
+// Parse a single byte range (eg: "bytes=0-499", "bytes=500-" or "bytes=-500") of a resource. Several ranges
+// are not supported, the whole resource is served instead.
+func ParseByteRange(header string, total int64) (start int64, end int64, ok bool, err error) {
+    if strings.HasPrefix(header, "bytes=") == false || strings.Contains(header, ",") {
+        return
+    }
+    bounds := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(header, "bytes=")), "-", 2)
+    if len(bounds) != 2 {
+        err = errors.New("Invalid range " + header)
+        return
+    }
+
+    if bounds[0] == "" {
+        var suffix int64
+        suffix, err = parseRangeBound(bounds[1])
+        if err != nil || suffix == 0 || total == 0 {
+            err = errors.New("Invalid range " + header)
+            return
+        }
+        if suffix > total {
+            suffix = total
+        }
+        return total - suffix, total - 1, true, nil
+    }
+
+    start, err = parseRangeBound(bounds[0])
+    if err != nil || start >= total {
+        err = errors.New("Invalid range " + header)
+        return
+    }
+    end = total - 1
+    if bounds[1] != "" {
+        end, err = parseRangeBound(bounds[1])
+        if err != nil || end < start {
+            err = errors.New("Invalid range " + header)
+            return
+        }
+        if end >= total {
+            end = total - 1
+        }
+    }
+    return start, end, true, nil
+}
+
+// Position of a byte range, the signs accepted by strconv.ParseInt are refused
+func parseRangeBound(s string) (int64, error) {
+    v, err := strconv.ParseUint(s, 10, 63)
+    return int64(v), err
+}
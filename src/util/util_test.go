@@ -0,0 +1,291 @@
+package util
+
+import (
+    "testing"
+    "time"
+
+    "mp4"
+)
+
+func TestParseByteRange(t *testing.T) {
+    tests := []struct {
+        header string
+        start  int64
+        end    int64
+        ok     bool
+    }{
+        {"", 0, 0, false},
+        {"items=0-9", 0, 0, false},
+        {"bytes=0-9,20-29", 0, 0, false},
+        {"bytes=0-499", 0, 499, true},
+        {"bytes=500-", 500, 999, true},
+        {"bytes=500-2000", 500, 999, true},
+        {"bytes=999-999", 999, 999, true},
+        {"bytes=-300", 700, 999, true},
+        {"bytes=-2000", 0, 999, true},
+        {"bytes= 10-19 ", 10, 19, true},
+    }
+    for _, test := range tests {
+        start, end, ok, err := ParseByteRange(test.header, 1000)
+        if err != nil {
+            t.Errorf("%q: %v", test.header, err)
+        } else if start != test.start || end != test.end || ok != test.ok {
+            t.Errorf("%q: range %d-%d %t, expected %d-%d %t", test.header, start, end, ok, test.start, test.end, test.ok)
+        }
+    }
+}
+
+func TestParseByteRangeUnsatisfiable(t *testing.T) {
+    for _, header := range []string{"bytes=", "bytes=-", "bytes=5", "bytes=1000-", "bytes=10-9", "bytes=-0", "bytes=--5", "bytes=+5-9", "bytes=5--9", "bytes=a-9", "bytes=9223372036854775808-"} {
+        if start, end, _, err := ParseByteRange(header, 1000); err == nil {
+            t.Errorf("%q: range %d-%d", header, start, end)
+        }
+    }
+    if start, end, _, err := ParseByteRange("bytes=-5", 0); err == nil {
+        t.Errorf("range %d-%d of an empty resource", start, end)
+    }
+}
+
+// Package of a video track of a duration in milliseconds, with 4 seconds segments
+func testPackage(duration uint64, lang string, bandwidths ...uint64) *mp4.JsonConfig {
+    jConfig := &mp4.JsonConfig{ SegmentDuration: 4, Tracks: make(map[string][]mp4.TrackEntry) }
+    config := &mp4.StreamConfig{ Type: "video", Duration: duration, Timescale: 1000 }
+    if len(bandwidths) == 0 {
+        bandwidths = []uint64{ 1000000 }
+    }
+    for _, bandwidth := range bandwidths {
+        jConfig.Tracks["video"] = append(jConfig.Tracks["video"], mp4.TrackEntry{ Bandwidth: bandwidth, Lang: lang, Config: config })
+    }
+    return jConfig
+}
+
+func TestPlaylistItemSegments(t *testing.T) {
+    tests := []struct {
+        in, out     uint64
+        first, last uint32
+    }{
+        { 0, 0, 1, 5 },
+        { 5000, 13000, 2, 4 },
+        { 4000, 8000, 2, 2 },
+        { 5000, 30000, 2, 5 },
+        { 20000, 0, 5, 5 },
+        { 25000, 0, 5, 5 },
+    }
+    jConfig := testPackage(20000, "und")
+    for _, test := range tests {
+        item := mp4.PlaylistItem{ In: test.in, Out: test.out, Config: jConfig }
+        first, last := PlaylistItemSegments(item, jConfig.Tracks["video"][0])
+        if first != test.first || last != test.last {
+            t.Errorf("item %d-%d plays the segments %d to %d, expected %d to %d", test.in, test.out, first, last, test.first, test.last)
+        }
+    }
+
+    in, out := PlaylistItemRange(mp4.PlaylistItem{ In: 25000, Out: 30000, Config: jConfig })
+    if in != 20000 || out != 20000 {
+        t.Errorf("item range %d-%d, expected 20000-20000", in, out)
+    }
+}
+
+func TestMatchTrack(t *testing.T) {
+    reference := testPackage(20000, "eng", 500000, 1000000, 2000000)
+
+    // Tracks are matched by the rank of their bandwidth, clipped to the tracks of the package
+    jConfig := testPackage(20000, "eng", 3000000, 800000)
+    for bandwidth, expected := range map[uint64]uint64{ 500000: 800000, 1000000: 3000000, 2000000: 3000000 } {
+        track, err := MatchTrack(*reference, *jConfig, "video", "eng", bandwidth)
+        if err != nil || track.Bandwidth != expected {
+            t.Errorf("track of %d matched with %d, expected %d (%v)", bandwidth, track.Bandwidth, expected, err)
+        }
+    }
+
+    // Tracks of other languages match when the package has none of the language
+    track, err := MatchTrack(*reference, *testPackage(20000, "fra", 900000), "video", "eng", 1000000)
+    if err != nil || track.Lang != "fra" {
+        t.Errorf("track %+v matched, %v", track, err)
+    }
+    if _, err := MatchTrack(*reference, *jConfig, "audio", "eng", 128000); err == nil {
+        t.Error("audio track matched in a package without audio")
+    }
+}
+
+// Live channel of a package of 5 segments followed by a package of 3 segments
+func testChannel(loop bool) mp4.JsonConfig {
+    start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+    return mp4.JsonConfig{
+        SegmentDuration: 4,
+        Playlist: []mp4.PlaylistItem{ { Config: testPackage(20000, "und") }, { Config: testPackage(10000, "und") } },
+        Live: &mp4.LiveConfig{ AvailabilityStartTime: start, TimeShiftBufferDepth: 8, Loop: loop },
+    }
+}
+
+func TestLiveSegment(t *testing.T) {
+    tests := []struct {
+        number        uint32
+        item          int
+        segmentNumber uint32
+        ok            bool
+    }{
+        { 0, 0, 0, false },
+        { 1, 0, 1, true },
+        { 5, 0, 5, true },
+        { 6, 1, 1, true },
+        { 8, 1, 3, true },
+        { 9, 0, 0, false },
+    }
+    jConfig := testChannel(false)
+    if n := LiveSegments(jConfig); n != 8 {
+        t.Errorf("%d segments, expected 8", n)
+    }
+    for _, test := range tests {
+        item, segmentNumber, ok := LiveSegment(jConfig, test.number)
+        if item != test.item || segmentNumber != test.segmentNumber || ok != test.ok {
+            t.Errorf("segment %d is segment %d of item %d (%t), expected segment %d of item %d (%t)", test.number, segmentNumber, item, ok, test.segmentNumber, test.item, test.ok)
+        }
+    }
+
+    // A looping channel plays its playlist again
+    jConfig = testChannel(true)
+    if n := LiveSegments(jConfig); n != 0 {
+        t.Errorf("%d segments of a looping channel", n)
+    }
+    if item, segmentNumber, ok := LiveSegment(jConfig, 14); item != 1 || segmentNumber != 1 || ok == false {
+        t.Errorf("segment 14 is segment %d of item %d (%t), expected segment 1 of item 1", segmentNumber, item, ok)
+    }
+}
+
+func TestLiveDecodeTimeOffset(t *testing.T) {
+    // The second item ends with a 2 s segment, the first item of the next cycle starts right after it
+    jConfig := testChannel(true)
+    tests := []struct {
+        number    uint32
+        timescale uint32
+        offset    int64
+    }{
+        { 1, 1000, 0 },
+        { 5, 1000, 0 },
+        { 6, 1000, 20000 },
+        { 8, 1000, 20000 },
+        { 9, 1000, 30000 },
+        { 9, 90000, 2700000 },
+        { 14, 1000, 50000 },
+    }
+    for _, test := range tests {
+        if offset := LiveDecodeTimeOffset(jConfig, test.number, test.timescale); offset != test.offset {
+            t.Errorf("segment %d shifted by %d in the timescale %d, expected %d", test.number, offset, test.timescale, test.offset)
+        }
+    }
+
+    // The item starting at 5 s plays from the start of its second segment
+    jConfig.Playlist[0].In = 5000
+    for number, expected := range map[uint32]int64{ 1: -4000, 4: -4000, 5: 16000, 7: 16000, 8: 22000 } {
+        if offset := LiveDecodeTimeOffset(jConfig, number, 1000); offset != expected {
+            t.Errorf("segment %d shifted by %d, expected %d", number, offset, expected)
+        }
+    }
+}
+
+func TestCompatibleTracks(t *testing.T) {
+    video := func(timescale uint32, sps byte) mp4.TrackEntry {
+        return mp4.TrackEntry{ Config: &mp4.StreamConfig{ Type: "video", Timescale: timescale, Video: &mp4.StreamVideoEntry{ CodecInfo: [3]byte{ 0x64, 0x00, 0x1F }, SPSData: []byte{ 0x67, sps }, PPSData: []byte{ 0x68 } } } }
+    }
+    audio := func(timescale uint32, dsi byte) mp4.TrackEntry {
+        return mp4.TrackEntry{ Config: &mp4.StreamConfig{ Type: "audio", Timescale: timescale, Audio: &mp4.StreamAudioEntry{ NumberOfChannels: 2, DecoderSpecificInfo: []byte{ 0x11, dsi } } } }
+    }
+
+    if CompatibleTracks(video(25000, 1), video(25000, 1)) == false || CompatibleTracks(audio(48000, 0x90), audio(48000, 0x90)) == false {
+        t.Error("same tracks are not compatible")
+    }
+    for name, pair := range map[string][2]mp4.TrackEntry{
+        "timescale":           { video(25000, 1), video(30000, 1) },
+        "SPS":                 { video(25000, 1), video(25000, 2) },
+        "AudioSpecificConfig": { audio(48000, 0x90), audio(48000, 0x88) },
+        "type":                { video(48000, 1), audio(48000, 1) },
+    } {
+        if CompatibleTracks(pair[0], pair[1]) {
+            t.Errorf("tracks of another %s are compatible", name)
+        }
+    }
+}
+
+func TestLiveEdgeAndWindow(t *testing.T) {
+    jConfig := testChannel(false)
+    start := jConfig.Live.AvailabilityStartTime
+    for elapsed, expected := range map[time.Duration]uint32{ -time.Second: 0, 3900 * time.Millisecond: 0, 4 * time.Second: 1, 33 * time.Second: 8 } {
+        if edge := LiveEdge(jConfig, start.Add(elapsed)); edge != expected {
+            t.Errorf("live edge %d after %s, expected %d", edge, elapsed, expected)
+        }
+    }
+
+    // The window holds the segments of the time shift buffer depth and the segment before it
+    tests := []struct {
+        edge        uint32
+        first, last uint32
+    }{
+        { 0, 1, 0 },
+        { 2, 1, 2 },
+        { 6, 3, 6 },
+        { 8, 5, 8 },
+        { 20, 5, 8 },
+    }
+    for _, test := range tests {
+        if first, last := LiveWindow(jConfig, test.edge); first != test.first || last != test.last {
+            t.Errorf("window %d-%d at the live edge %d, expected %d-%d", first, last, test.edge, test.first, test.last)
+        }
+    }
+    if first, last := LiveWindow(testChannel(true), 20); first != 17 || last != 20 {
+        t.Errorf("window %d-%d of a looping channel, expected 17-20", first, last)
+    }
+}
+
+func TestMuxedAudioTrack(t *testing.T) {
+    audios := []mp4.TrackEntry{ { Lang: "fra", Bandwidth: 96000 }, { Lang: "eng", Bandwidth: 64000 }, { Lang: "eng", Bandwidth: 128000 }, { Lang: "fra", Bandwidth: 192000 } }
+    tests := map[string]mp4.TrackEntry{
+        "eng": audios[2],
+        "fra": audios[3],
+        "deu": audios[3], // The language of the first track
+    }
+    for lang, expected := range tests {
+        if track, ok := MuxedAudioTrack(audios, lang); ok == false || track != expected {
+            t.Errorf("%s video muxed with the %s audio track of %d, expected the %s track of %d", lang, track.Lang, track.Bandwidth, expected.Lang, expected.Bandwidth)
+        }
+    }
+    if _, ok := MuxedAudioTrack(nil, "eng"); ok {
+        t.Error("muxed audio track without audio tracks")
+    }
+}
+
+func TestLiveParts(t *testing.T) {
+    jConfig := testChannel(false)
+    jConfig.Live.PartDuration = 1000
+    start := jConfig.Live.AvailabilityStartTime
+
+    // Parts of 1 second of the segment 2, played from 4 seconds
+    for part, expected := range map[uint32]time.Duration{ 0: 8 * time.Second, 1: 5 * time.Second, 3: 7 * time.Second, 4: 8 * time.Second, 5: 8 * time.Second } {
+        if availability := LiveAvailabilityTime(jConfig, 2, part); availability != start.Add(expected) {
+            t.Errorf("part %d available at %s, expected %s", part, availability, start.Add(expected))
+        }
+    }
+
+    for elapsed, expected := range map[time.Duration]uint32{ -time.Second: 0, 0: 0, 3 * time.Second: 3, 9500 * time.Millisecond: 1 } {
+        if parts := LiveParts(jConfig, start.Add(elapsed)); parts != expected {
+            t.Errorf("%d parts after %s, expected %d", parts, elapsed, expected)
+        }
+    }
+    jConfig.Live.PartDuration = 0
+    if parts := LiveParts(jConfig, start.Add(3 * time.Second)); parts != 0 {
+        t.Errorf("%d parts without low latency", parts)
+    }
+}
+
+func TestPreviewSegments(t *testing.T) {
+    jConfig := *testPackage(20000, "und")
+    if n := PreviewSegments(jConfig); n != 0 {
+        t.Errorf("%d preview segments without preview", n)
+    }
+    for duration, expected := range map[uint64]uint32{ 1: 1, 4000: 1, 4001: 2, 12000: 3 } {
+        jConfig.Preview = &mp4.PreviewConfig{ Duration: duration }
+        if n := PreviewSegments(jConfig); n != expected {
+            t.Errorf("%d segments of a preview of %d ms, expected %d", n, duration, expected)
+        }
+    }
+}
@@ -0,0 +1,191 @@
+package vtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// WebVTT cue, times are in milliseconds
+type Cue struct {
+	Id       string
+	Start    uint64
+	End      uint64
+	Settings string // Cue settings following the timings (eg: "align:start line:0")
+	Payload  string
+}
+
+// WebVTT file
+type File struct {
+	Header string // Text following WEBVTT on the first line
+	Blocks []string // STYLE and REGION blocks preceding the cues
+	Cues   []Cue
+}
+
+// Parse a WebVTT file, comments are dropped
+func ParseFile(filename string) (f File, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	if len(lines) == 0 || !strings.HasPrefix(strings.TrimPrefix(lines[0], "\ufeff"), "WEBVTT") {
+		err = errors.New("Invalid WebVTT file " + filename)
+		return
+	}
+	f.Header = strings.TrimPrefix(strings.TrimPrefix(lines[0], "\ufeff"), "WEBVTT")
+
+	// Skip the header lines, blocks are separated by blank lines
+	i := 1
+	for i < len(lines) && lines[i] != "" {
+		i++
+	}
+
+	for i < len(lines) {
+		if lines[i] == "" {
+			i++
+			continue
+		}
+		start := i
+		for i < len(lines) && lines[i] != "" {
+			i++
+		}
+		block := lines[start:i]
+
+		if strings.HasPrefix(block[0], "NOTE") {
+			continue
+		}
+		if strings.HasPrefix(block[0], "STYLE") || strings.HasPrefix(block[0], "REGION") {
+			if len(f.Cues) == 0 {
+				f.Blocks = append(f.Blocks, strings.Join(block, "\n"))
+			}
+			continue
+		}
+
+		cue := Cue{}
+		if !strings.Contains(block[0], "-->") {
+			cue.Id = block[0]
+			block = block[1:]
+		}
+		if len(block) == 0 {
+			err = fmt.Errorf("Missing cue timings line %d in %s", start + 1, filename)
+			return
+		}
+		cue.Start, cue.End, cue.Settings, err = parseTimings(block[0])
+		if err != nil {
+			err = fmt.Errorf("%s line %d in %s", err.Error(), start + 1, filename)
+			return
+		}
+		cue.Payload = strings.Join(block[1:], "\n")
+		f.Cues = append(f.Cues, cue)
+	}
+
+	return
+}
+
+// Parse a cue timings line (eg: "00:01.000 --> 00:04.000 align:start")
+func parseTimings(line string) (start uint64, end uint64, settings string, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[1] != "-->" {
+		err = errors.New("Invalid cue timings")
+		return
+	}
+	if start, err = parseTimestamp(fields[0]); err != nil {
+		return
+	}
+	if end, err = parseTimestamp(fields[2]); err != nil {
+		return
+	}
+	settings = strings.Join(fields[3:], " ")
+	return
+}
+
+// Parse a timestamp (eg: "01:02:03.456" or "02:03.456") in milliseconds, the minutes and seconds
+// have two digits and are lower than 60, the hours have at least two digits
+func parseTimestamp(s string) (ms uint64, err error) {
+	parts := strings.Split(s, ":")
+	seconds := strings.Split(parts[len(parts) - 1], ".")
+	if len(parts) < 2 || len(parts) > 3 || len(seconds) != 2 || len(seconds[1]) != 3 {
+		err = errors.New("Invalid timestamp " + s)
+		return
+	}
+	if len(parts) == 3 && len(parts[0]) < 2 || len(parts[len(parts) - 2]) != 2 || len(seconds[0]) != 2 || parts[len(parts) - 2] > "59" || seconds[0] > "59" {
+		err = errors.New("Invalid timestamp " + s)
+		return
+	}
+
+	values := append(parts[:len(parts) - 1], seconds...)
+	units := []uint64{ 60000, 1000, 1 }
+	if len(parts) == 3 {
+		units = []uint64{ 3600000, 60000, 1000, 1 }
+	}
+	for i, value := range values {
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			err = errors.New("Invalid timestamp " + s)
+			return
+		}
+		ms += v * units[i]
+	}
+
+	return
+}
+
+func formatTimestamp(ms uint64) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms / 3600000, (ms / 60000) % 60, (ms / 1000) % 60, ms % 1000)
+}
+
+// Create the segment of the cues displayed between start and end (in milliseconds). Cues spanning several
+// segments are repeated in each of them, with their original timings. The cue times are mapped on the
+// MPEG-TS timestamp (90kHz) of the start of the presentation.
+func (f File) Segment(start uint64, end uint64, mpegts uint64) (s string) {
+	s = "WEBVTT" + f.Header + "\n"
+	s += fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:%s\n", mpegts, formatTimestamp(0))
+	for _, block := range f.Blocks {
+		s += "\n" + block + "\n"
+	}
+
+	for _, cue := range f.Cues {
+		if cue.Start >= end || cue.End <= start {
+			continue
+		}
+		s += "\n"
+		if cue.Id != "" {
+			s += cue.Id + "\n"
+		}
+		s += formatTimestamp(cue.Start) + " --> " + formatTimestamp(cue.End)
+		if cue.Settings != "" {
+			s += " " + cue.Settings
+		}
+		s += "\n"
+		if cue.Payload != "" {
+			s += cue.Payload + "\n"
+		}
+	}
+
+	return
+}
+
+// End of the last cue in milliseconds
+func (f File) Duration() (duration uint64) {
+	for _, cue := range f.Cues {
+		if cue.End > duration {
+			duration = cue.End
+		}
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package vtt
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := map[string]uint64{
+		"00:00.000":     0,
+		"02:03.456":     123456,
+		"01:02:03.456":  3723456,
+		"100:00:00.001": 360000001,
+	}
+	for s, expected := range tests {
+		ms, err := parseTimestamp(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if ms != expected {
+			t.Errorf("%s: %d ms, expected %d", s, ms, expected)
+		}
+	}
+
+	for _, s := range []string{"", "03.456", "02:03", "02:03.45", "02:03.4567", "2:03.456", "02:3.456", "1:02:03.456", "00:60.000", "60:00.000", "00:00:60.000", "02:0a.456", "+1:02.456", "00:00:00:00.000"} {
+		if ms, err := parseTimestamp(s); err == nil {
+			t.Errorf("%s: parsed as %d ms", s, ms)
+		}
+	}
+}
+
+func TestParseTimings(t *testing.T) {
+	start, end, settings, err := parseTimings("00:01.000 --> 00:04.500 align:start  line:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 1000 || end != 4500 || settings != "align:start line:0" {
+		t.Errorf("timings %d --> %d %q", start, end, settings)
+	}
+
+	for _, line := range []string{"00:01.000 00:04.500", "00:01.000 -> 00:04.500", "00:01.000 -->"} {
+		if _, _, _, err := parseTimings(line); err == nil {
+			t.Errorf("%q parsed", line)
+		}
+	}
+}
+
+func TestParseFileAndSegment(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "subtitles.vtt")
+	data := "\ufeffWEBVTT - Test\r\n" +
+		"Kind: captions\r\n" +
+		"\r\n" +
+		"STYLE\r\n" +
+		"::cue { color: yellow }\r\n" +
+		"\r\n" +
+		"NOTE dropped\r\n" +
+		"\r\n" +
+		"intro\r\n" +
+		"00:01.000 --> 00:04.000 align:start\r\n" +
+		"Hello\r\n" +
+		"world\r\n" +
+		"\r\n" +
+		"00:03.500 --> 00:12.000\r\n" +
+		"Spanning\r\n"
+	if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ParseFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Header != " - Test" || len(f.Blocks) != 1 || len(f.Cues) != 2 {
+		t.Fatalf("parsed as %+v", f)
+	}
+	if cue := f.Cues[0]; cue.Id != "intro" || cue.Start != 1000 || cue.End != 4000 || cue.Settings != "align:start" || cue.Payload != "Hello\nworld" {
+		t.Errorf("first cue %+v", cue)
+	}
+	if f.Duration() != 12000 {
+		t.Errorf("duration %d, expected 12000", f.Duration())
+	}
+
+	segment := f.Segment(10000, 20000, 900000)
+	expected := "WEBVTT - Test\n" +
+		"X-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n" +
+		"\n" +
+		"STYLE\n" +
+		"::cue { color: yellow }\n" +
+		"\n" +
+		"00:00:03.500 --> 00:00:12.000\n" +
+		"Spanning\n"
+	if segment != expected {
+		t.Errorf("segment\n%s\nexpected\n%s", segment, expected)
+	}
+	if segment := f.Segment(0, 4000, 0); strings.Count(segment, "-->") != 2 {
+		t.Errorf("segment\n%s\nexpected both cues", segment)
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	for i, data := range []string{"", "WEBVT\n", "WEBVTT\n\nintro\n", "WEBVTT\n\n00:01.000 --> 00:4.000\nHello\n"} {
+		filename := filepath.Join(dir, string(rune('a'+i))+".vtt")
+		if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if f, err := ParseFile(filename); err == nil {
+			t.Errorf("%q parsed as %+v", data, f)
+		}
+	}
+}